@@ -5,95 +5,290 @@ package config
 
 import (
 	"fmt"
+	"log"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/grafeas/grafeas/go/config"
 )
 
-const emptyFieldErrTemplate = `invalid field: "%s" must not be empty`
+// The DB engines which Config can connect to.
+const (
+	EnginePostgres = "postgres"
+	EngineMySQL    = "mysql"
+)
 
 // default values for Config
 const (
-	defaultPort    = 5432
-	defaultDBName  = "grafeas"
-	defaultSSLMode = "verify-full"
+	defaultEngine       = EnginePostgres
+	defaultPort         = 5432
+	defaultMySQLPort    = 3306
+	defaultDBName       = "grafeas"
+	defaultSSLMode      = "verify-full"
+	defaultMySQLSSLMode = "VERIFY_IDENTITY"
+
+	defaultCertExpiryWarningThreshold = Duration(30 * 24 * time.Hour)
 )
 
-// Config is the configuration for PostgreSQL store.
+// Config is the configuration for PostgreSQL or MySQL store.
 // json tags are required because
 // config.ConvertGenericConfigToSpecificType internally uses json package.
+//
+// Any string field can refer to an environment variable (e.g. "${DB_PASSWORD}")
+// or the content of a file (e.g. "file:///var/run/secrets/db-password"),
+// and the references are resolved by New.
+//
+// Fields containing secrets are tagged with `secret:"true"`,
+// so that they are redacted in errors and when c is formatted or marshaled.
 type Config struct {
+	// URL is an alternative to the discrete connection fields, e.g.
+	// postgres://grafeas_rw@some-host.rds.amazonaws.com:5432/grafeas?sslmode=verify-full.
+	// The schemes postgres, postgresql and mysql are supported, and they set Engine,
+	// so a mysql:// URL connects via go-sql-driver/mysql rather than being formatted as a libpq DSN.
+	// The query parameters sslmode, sslrootcert, sslcert, sslkey, application_name and connect_timeout are supported as well.
+	// The values in it are copied to the discrete fields, which must be empty or have the same values.
+	// The password can be omitted to use the IAM auth or AWS Secrets Manager.
+	URL string `json:"url" secret:"true"`
+
+	// Engine is the DB engine, i.e. postgres or mysql, which determines the format of the DSN.
+	// It defaults to the one given by WithDefaultEngine, e.g. the engine of the driver, or to postgres.
+	// A mysql:// URL sets it to mysql.
+	Engine string `json:"engine"`
+
 	Host   string `json:"host"`
 	Reader string `json:"reader"`
 	Port   int    `json:"port"`
 	// For rds_prostgres, DBName has to alrady exist and can be accessed by User.
 	DBName   string `json:"db_name"`
 	User     string `json:"user"`
-	Password string `json:"password"`
+	Password string `json:"password" secret:"true"`
 	// Valid sslmodes: disable, allow, prefer, require, verify-ca, verify-full.
-	// See https://www.postgresql.org/docs/current/static/libpq-connect.html for details
-	SSLMode     string `json:"ssl_mode"`
+	// See https://www.postgresql.org/docs/current/static/libpq-connect.html for details.
+	// For MySQL, its ssl-mode is used instead: DISABLED, PREFERRED, REQUIRED, VERIFY_CA, VERIFY_IDENTITY.
+	SSLMode string `json:"ssl_mode"`
+	// SSLRootCert is the path of the PEM file containing the certificates which the server is verified against.
+	// If it's empty and SSLMode verifies the server, the AWS global RDS CA bundle embedded in this module is used.
 	SSLRootCert string `json:"ssl_root_cert"`
+	// SSLCert and SSLKey are the paths of the PEM files containing the client certificate and its private key,
+	// which are presented to a server requiring client certificates.
+	// They are reloaded when the files are rotated.
+	SSLCert string `json:"ssl_cert"`
+	SSLKey  string `json:"ssl_key"`
+	// SSLKeyPassword decrypts SSLKey if it's encrypted.
+	// Only encrypted PEM blocks with the legacy "Proc-Type: 4,ENCRYPTED" header are supported.
+	SSLKeyPassword string `json:"ssl_key_password" secret:"true"`
+	// CertExpiryWarningThreshold is how long before the expiration of SSLRootCert or SSLCert
+	// warnings start to be logged.
+	CertExpiryWarningThreshold Duration `json:"cert_expiry_warning_threshold"`
+	// AllowInsecureTransport has to be true to use an SSLMode which may send data in plaintext,
+	// i.e. disable, allow and prefer, so that it cannot be used in production by accident.
+	// It does not allow the IAM auth without verifying the server, because the token would be exposed.
+	AllowInsecureTransport bool `json:"allow_insecure_transport"`
 	// PaginationKey is a 32-bit URL-safe base64 key used to encrypt pagination tokens.
 	// Check the underlying DB implementation to see it's supported.
 	// Regarding PostgreSQL, if one is not provided, it will be generated [1].
 	// Multiple grafeas instances in the same cluster must share the same value.
 	//
 	// [1] https://github.com/grafeas/grafeas-pgsql
-	PaginationKey string `json:"pagination_key"`
+	PaginationKey string `json:"pagination_key" secret:"true"`
+
+	// ApplicationName is reported to the DB, e.g. in pg_stat_activity.
+	// It's ignored by MySQL, because go-sql-driver/mysql can't send it.
+	ApplicationName string `json:"application_name"`
+	// ConnectTimeout is the maximum time to wait for a new connection to be established.
+	// Zero means no timeout.
+	ConnectTimeout Duration `json:"connect_timeout"`
+	// StatementTimeout aborts any statement that takes more than the specified time.
+	// Zero means no timeout.
+	// MySQL only applies it to SELECT statements (see max_execution_time).
+	StatementTimeout Duration `json:"statement_timeout"`
+	// InitStatements are run in order on every new connection before it's used,
+	// e.g. "SET lock_timeout = '5s'" or "SET search_path TO grafeas".
+	// If any of them fails, the connection is closed and the error is returned.
+	// They are redacted as secrets because they may contain one, e.g. SET my.api_key = '...'.
+	InitStatements []string `json:"init_statements" secret:"true"`
 
 	ConnPool ConnPoolConfig `json:"conn_pool"`
 
 	// IAMAuth is only used when Password is empty.
 	IAMAuth IAMAuthConfig `json:"iam_auth"`
+
+	// SecretsManager is only used when Password is empty,
+	// and takes precedence over IAMAuth if SecretsManager.SecretID is not empty.
+	SecretsManager SecretsManagerConfig `json:"secrets_manager"`
+
+	// Discovery replaces Host and Reader, which must be empty if Discovery.ClusterIdentifier is not empty.
+	Discovery DiscoveryConfig `json:"discovery"`
+
+	// Proxy is used when the connections go through RDS Proxy.
+	Proxy ProxyConfig `json:"proxy"`
+
+	// ReadOnly configures the read-only mode of the storage.
+	ReadOnly ReadOnlyConfig `json:"read_only"`
+}
+
+// Option configures how New populates a Config.
+type Option func(*options)
+
+type options struct {
+	defaultEngine string
+	logger        *log.Logger
 }
 
-func New(ci *config.StorageConfiguration) (*Config, error) {
+// WithDefaultEngine makes New use engine if the config does not specify one.
+// GrafeasStorageProvider passes the engine of its driver.
+func WithDefaultEngine(engine string) Option {
+	return func(o *options) {
+		o.defaultEngine = engine
+	}
+}
+
+// WithLogger makes New log the warnings about the config to logger instead of log.Default(),
+// e.g. the ignored deprecated fields. GrafeasStorageProvider passes its logger.
+func WithLogger(logger *log.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// New converts ci to a Config, resolves its references, populates the default values and validates it.
+func New(ci *config.StorageConfiguration, opts ...Option) (*Config, error) {
+	o := options{defaultEngine: defaultEngine, logger: log.Default()}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	var c Config
 
-	err := config.ConvertGenericConfigToSpecificType(ci, &c)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert the generic storage config to a rds config, err: %v", err)
+	var source config.StorageConfiguration
+	if ci != nil {
+		source = *ci
 	}
-	c.populateDefaultValues()
+	// A Config is copied as is, because its MarshalJSON redacts the secrets.
+	switch conf := source.(type) {
+	case Config:
+		c = conf
+	case *Config:
+		c = *conf
+	default:
+		err := config.ConvertGenericConfigToSpecificType(ci, &c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert the generic storage config to a rds config, err: %v", err)
+		}
+	}
+	if err := c.resolveReferences(); err != nil {
+		return nil, err
+	}
+	var errs ValidationErrors
+	// The URL is applied before the default values, so that they do not conflict with it.
+	c.applyURL(&errs)
+	if c.Engine == "" {
+		c.Engine = o.defaultEngine
+	}
+	c.populateDefaultValues(o.logger)
 
-	if err := c.validate(); err != nil {
+	c.validate(&errs)
+	if err := errs.err(); err != nil {
 		return nil, err
 	}
+	c.warnPinning(o.logger)
 	return &c, nil
 }
 
-func (c *Config) populateDefaultValues() {
+// populateDefaultValues populates the unset fields, and logs the warnings to logger.
+func (c *Config) populateDefaultValues(logger *log.Logger) {
+	if c.Engine == "" {
+		c.Engine = defaultEngine
+	}
 	if c.Port == 0 {
 		c.Port = defaultPort
+		if c.Engine == EngineMySQL {
+			c.Port = defaultMySQLPort
+		}
 	}
 	if c.DBName == "" {
 		c.DBName = defaultDBName
 	}
 	if c.SSLMode == "" {
 		c.SSLMode = defaultSSLMode
+		if c.Engine == EngineMySQL {
+			c.SSLMode = defaultMySQLSSLMode
+		}
+	}
+	if c.CertExpiryWarningThreshold == 0 {
+		c.CertExpiryWarningThreshold = defaultCertExpiryWarningThreshold
 	}
-	c.IAMAuth.populateDefaultValues()
+	c.ConnPool.populateDefaultValues(fieldPath(rootPath, "conn_pool"), logger)
+	c.IAMAuth.populateDefaultValues(fieldPath(rootPath, "iam_auth"), logger)
+	c.SecretsManager.populateDefaultValues()
+	c.Discovery.populateDefaultValues()
+	c.populateProxyDefaultValues()
+	c.ReadOnly.populateDefaultValues()
 }
 
-func (c *Config) validate() error {
-	if c.Host == "" {
-		return fmt.Errorf(emptyFieldErrTemplate, "Config.Host")
+// validate adds every violation in c to errs.
+func (c *Config) validate(errs *ValidationErrors) {
+	if !contains(supportedEngines, c.Engine) {
+		errs.add(fieldPath(rootPath, "engine"), c.Engine, fmt.Sprintf(ruleOneOf, strings.Join(supportedEngines, ", ")))
+	}
+	// The host can also be omitted if it's stored in the secret.
+	// On the other hand, it must be omitted if it's discovered.
+	switch {
+	case c.UsesDiscovery():
+		discoveryPath := fieldPath(fieldPath(rootPath, "discovery"), "cluster_identifier")
+		if c.Host != "" {
+			errs.add(fieldPath(rootPath, "host"), c.Host, fmt.Sprintf(ruleExcludedWith, discoveryPath))
+		}
+		if c.Reader != "" {
+			errs.add(fieldPath(rootPath, "reader"), c.Reader, fmt.Sprintf(ruleExcludedWith, discoveryPath))
+		}
+		c.Discovery.validate(fieldPath(rootPath, "discovery"), errs)
+	case c.Host == "" && !c.UsesSecretsManager():
+		errs.add(fieldPath(rootPath, "host"), c.Host, ruleNotEmpty)
 	}
 	if c.Port <= 0 {
-		return fmt.Errorf(`invalid field: "Config.Port" must be larger than zero, got %v`, c.Port)
+		errs.add(fieldPath(rootPath, "port"), c.Port, rulePositive)
+	}
+	// The user can be omitted if it's stored in the secret.
+	if c.User == "" && !c.UsesSecretsManager() {
+		errs.add(fieldPath(rootPath, "user"), c.User, ruleNotEmpty)
+	}
+	c.validateTLS(errs)
+	c.validateProxy(errs)
+	c.ReadOnly.validate(fieldPath(rootPath, "read_only"), errs)
+	if c.ConnectTimeout < 0 {
+		errs.add(fieldPath(rootPath, "connect_timeout"), c.ConnectTimeout, ruleNotNegative)
 	}
-	if c.User == "" {
-		return fmt.Errorf(emptyFieldErrTemplate, "Config.User")
+	if c.StatementTimeout < 0 {
+		errs.add(fieldPath(rootPath, "statement_timeout"), c.StatementTimeout, ruleNotNegative)
 	}
-	if c.SSLRootCert == "" && (c.SSLMode == "verify-ca" || c.SSLMode == "verify-full") {
-		return fmt.Errorf(`invalid field: Config.SSLRootCert must not be empty because SSLMode is %s`, c.SSLMode)
+	if c.CertExpiryWarningThreshold < 0 {
+		errs.add(fieldPath(rootPath, "cert_expiry_warning_threshold"), c.CertExpiryWarningThreshold, ruleNotNegative)
 	}
-	if c.Password != "" {
-		return nil
+	switch {
+	case c.UsesSecretsManager():
+		c.SecretsManager.validate(fieldPath(rootPath, "secrets_manager"), errs)
+	case c.UsesIAMAuth():
+		c.IAMAuth.validate(fieldPath(rootPath, "iam_auth"), errs)
 	}
-	// The password is empty, so IAMAuth must be valid.
-	return c.IAMAuth.validate()
+}
+
+// supportedEngines lists the values which Engine can have.
+var supportedEngines = []string{EnginePostgres, EngineMySQL}
+
+// UsesSecretsManager returns true if the credentials should be fetched from AWS Secrets Manager.
+func (c *Config) UsesSecretsManager() bool {
+	return c.Password == "" && c.SecretsManager.SecretID != ""
+}
+
+// UsesDiscovery returns true if the endpoints should be discovered via the RDS API.
+func (c *Config) UsesDiscovery() bool {
+	return c.Discovery.ClusterIdentifier != ""
+}
+
+// UsesIAMAuth returns true if an IAM auth token should be used as the password.
+func (c *Config) UsesIAMAuth() bool {
+	return c.Password == "" && !c.UsesSecretsManager()
 }
 
 // ConnPoolConfig contains the configuration related to connection pool management.
@@ -106,13 +301,26 @@ func (c *Config) validate() error {
 //
 // Default values are not provided for these fields because
 // 0 is the zero value of `int`, but it's also a valid value for these fields.
+// The only exception is ConnMaxIdleTime when connecting through RDS Proxy (see ProxyConfig).
 type ConnPoolConfig struct {
-	MaxOpenConns             int `json:"max_open_conns"`
-	MaxIdleConns             int `json:"max_idle_conns"`
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime Duration `json:"conn_max_lifetime"`
+	ConnMaxIdleTime Duration `json:"conn_max_idle_time"`
+
+	// Deprecated: Use ConnMaxLifetime instead.
 	ConnMaxLifetimeInSeconds int `json:"conn_max_lifetime_in_seconds"`
+	// Deprecated: Use ConnMaxIdleTime instead.
 	ConnMaxIdleTimeInSeconds int `json:"conn_max_idle_time_in_seconds"`
 }
 
+func (c *ConnPoolConfig) populateDefaultValues(path string, logger *log.Logger) {
+	warnDeprecatedSeconds(&c.ConnMaxLifetime, c.ConnMaxLifetimeInSeconds,
+		fieldPath(path, "conn_max_lifetime"), fieldPath(path, "conn_max_lifetime_in_seconds"), logger)
+	warnDeprecatedSeconds(&c.ConnMaxIdleTime, c.ConnMaxIdleTimeInSeconds,
+		fieldPath(path, "conn_max_idle_time"), fieldPath(path, "conn_max_idle_time_in_seconds"), logger)
+}
+
 // IAMAuthConfig contains configuration required to
 // get a temporary DB password (i.e. token) from AWS API.
 type IAMAuthConfig struct {
@@ -122,20 +330,21 @@ type IAMAuthConfig struct {
 	CredentialsProvider ZTSCredentialProviderConfig `json:"credentials_provider"`
 }
 
-func (c *IAMAuthConfig) populateDefaultValues() {
-	c.CredentialsProvider.populateDefaultValues()
+func (c *IAMAuthConfig) populateDefaultValues(path string, logger *log.Logger) {
+	c.CredentialsProvider.populateDefaultValues(fieldPath(path, "credentials_provider"), logger)
 }
 
-func (c *IAMAuthConfig) validate() error {
+// validate adds the violations in c to errs, and path is the path of c in the config file.
+func (c *IAMAuthConfig) validate(path string, errs *ValidationErrors) {
 	if c.Region == "" {
-		return fmt.Errorf(emptyFieldErrTemplate, "IAMAuthConfig.Region")
+		errs.add(fieldPath(path, "region"), c.Region, ruleNotEmpty)
 	}
-	return c.CredentialsProvider.validate()
+	c.CredentialsProvider.validate(fieldPath(path, "credentials_provider"), errs)
 }
 
 // default values for ZTSCredentialProviderConfig
 const (
-	defaultRenewThresholdInSeconds = 600
+	defaultRenewThreshold = Duration(10 * time.Minute)
 )
 
 // ZTSCredentialProviderConfig stores the configurations for configuring ZTSCredentialsProvider.
@@ -149,29 +358,152 @@ type ZTSCredentialProviderConfig struct {
 	// ExternalID refers to the one defined in AWS documentation.
 	// More info: https://docs.aws.amazon.com/IAM/latest/UserGuide/id_roles_create_for-user_externalid.html
 	ExternalID string `json:"external_id"`
-	// RenewThresholdInSeconds defines the time period to refresh the credentials before it is expired.
+	// RenewThreshold defines the time period to refresh the credentials before it is expired.
+	RenewThreshold Duration `json:"renew_threshold"`
+
+	// Deprecated: Use RenewThreshold instead.
 	RenewThresholdInSeconds int `json:"renew_threshold_in_seconds"`
 }
 
-func (c *ZTSCredentialProviderConfig) populateDefaultValues() {
-	if c.RenewThresholdInSeconds == 0 {
-		c.RenewThresholdInSeconds = defaultRenewThresholdInSeconds
+func (c *ZTSCredentialProviderConfig) populateDefaultValues(path string, logger *log.Logger) {
+	warnDeprecatedSeconds(&c.RenewThreshold, c.RenewThresholdInSeconds,
+		fieldPath(path, "renew_threshold"), fieldPath(path, "renew_threshold_in_seconds"), logger)
+	if c.RenewThreshold == 0 {
+		c.RenewThreshold = defaultRenewThreshold
 	}
 }
 
-func (c *ZTSCredentialProviderConfig) validate() error {
+// validate adds the violations in c to errs, and path is the path of c in the config file.
+func (c *ZTSCredentialProviderConfig) validate(path string, errs *ValidationErrors) {
 	if _, err := url.Parse(c.APIEndpoint); err != nil {
-		return fmt.Errorf(`invalid field: "ZTSCredentialProviderConfig.APIEndpoint" should be a valid url, err: %v`, err)
+		errs.add(fieldPath(path, "api_endpoint"), c.APIEndpoint, ruleValidURL)
 	}
 	if c.AthenzDomain == "" {
-		return fmt.Errorf(emptyFieldErrTemplate, "ZTSCredentialProviderConfig.AthenzDomain")
+		errs.add(fieldPath(path, "athenz_domain"), c.AthenzDomain, ruleNotEmpty)
 	}
 	if c.IAMRole == "" {
-		return fmt.Errorf(emptyFieldErrTemplate, "ZTSCredentialProviderConfig.IAMRole")
+		errs.add(fieldPath(path, "iam_role"), c.IAMRole, ruleNotEmpty)
+	}
+	if c.RenewThreshold <= 0 {
+		errs.add(fieldPath(path, "renew_threshold"), c.RenewThreshold, rulePositive)
+	}
+}
+
+// default values for SecretsManagerConfig
+const (
+	defaultSecretRefreshInterval = Duration(5 * time.Minute)
+)
+
+// SecretsManagerConfig contains configuration required to
+// fetch the DB credentials from AWS Secrets Manager, which may rotate them automatically.
+// The secret must be a JSON object in the format used by the secrets managed by RDS, e.g.
+//
+//	{"username": "grafeas_rw", "password": "...", "host": "some-host.rds.amazonaws.com", "port": 5432}
+//
+// host and port are optional, and they are only used if Config.Host is empty.
+type SecretsManagerConfig struct {
+	// SecretID is the ARN or the name of the secret.
+	SecretID string `json:"secret_id"`
+	// Region refers to the AWS region in which the secret resides.
+	Region string `json:"region"`
+	// Endpoint overrides the default endpoint of AWS Secrets Manager, e.g. a VPC endpoint.
+	Endpoint string `json:"endpoint"`
+	// RefreshInterval defines how often the secret is fetched again to pick up a rotated password.
+	// The secret is also fetched again whenever the DB rejects the current password.
+	RefreshInterval Duration `json:"refresh_interval"`
+}
+
+func (c *SecretsManagerConfig) populateDefaultValues() {
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = defaultSecretRefreshInterval
+	}
+}
+
+// validate adds the violations in c to errs, and path is the path of c in the config file.
+func (c *SecretsManagerConfig) validate(path string, errs *ValidationErrors) {
+	if c.Region == "" {
+		errs.add(fieldPath(path, "region"), c.Region, ruleNotEmpty)
+	}
+	if _, err := url.Parse(c.Endpoint); err != nil {
+		errs.add(fieldPath(path, "endpoint"), c.Endpoint, ruleValidURL)
+	}
+	if c.RefreshInterval <= 0 {
+		errs.add(fieldPath(path, "refresh_interval"), c.RefreshInterval, rulePositive)
+	}
+}
+
+// default values for DiscoveryConfig
+const (
+	defaultDiscoveryRefreshInterval = Duration(time.Minute)
+)
+
+// DiscoveryConfig contains configuration required to
+// discover the endpoints of an Aurora cluster via the RDS API, i.e. DescribeDBClusters and DescribeDBInstances.
+// The writer connects to the endpoint of the writer instance,
+// and the reader connects to the reader endpoint of the cluster, or to the writer if there is no reader.
+// The AWS credentials are created in the same way as the ones for AWS Secrets Manager.
+type DiscoveryConfig struct {
+	// ClusterIdentifier is the identifier of the Aurora cluster.
+	ClusterIdentifier string `json:"cluster_identifier"`
+	// Region refers to the AWS region in which the cluster resides.
+	Region string `json:"region"`
+	// Endpoint overrides the default endpoint of the RDS API, e.g. a VPC endpoint.
+	Endpoint string `json:"endpoint"`
+	// RefreshInterval defines how often the endpoints are discovered again to follow the changes of the topology,
+	// e.g. a failover.
+	RefreshInterval Duration `json:"refresh_interval"`
+}
+
+func (c *DiscoveryConfig) populateDefaultValues() {
+	if c.ClusterIdentifier != "" && c.RefreshInterval == 0 {
+		c.RefreshInterval = defaultDiscoveryRefreshInterval
+	}
+}
+
+// validate adds the violations in c to errs, and path is the path of c in the config file.
+func (c *DiscoveryConfig) validate(path string, errs *ValidationErrors) {
+	if c.Region == "" {
+		errs.add(fieldPath(path, "region"), c.Region, ruleNotEmpty)
+	}
+	if _, err := url.Parse(c.Endpoint); err != nil {
+		errs.add(fieldPath(path, "endpoint"), c.Endpoint, ruleValidURL)
+	}
+	if c.RefreshInterval <= 0 {
+		errs.add(fieldPath(path, "refresh_interval"), c.RefreshInterval, rulePositive)
+	}
+}
+
+// default values for ReadOnlyConfig
+const (
+	defaultReadOnlyRetryAfter = Duration(30 * time.Second)
+)
+
+// ReadOnlyConfig configures the read-only mode, in which the storage keeps serving the reads
+// and rejects the writes with codes.Unavailable, e.g. during a major version upgrade or a blue/green switchover.
+// A change of Enabled or RetryAfter is applied without reconnecting.
+type ReadOnlyConfig struct {
+	// Enabled switches the storage to the read-only mode.
+	Enabled bool `json:"enabled"`
+	// RetryAfter is returned to the clients as how long to wait before retrying the rejected writes.
+	RetryAfter Duration `json:"retry_after"`
+	// DetectInterval defines how often the writer is checked for transaction_read_only,
+	// so that the storage is read-only while the writer is, e.g. after it has been demoted by a failover.
+	// Zero disables the check.
+	DetectInterval Duration `json:"detect_interval"`
+}
+
+func (c *ReadOnlyConfig) populateDefaultValues() {
+	if c.RetryAfter == 0 {
+		c.RetryAfter = defaultReadOnlyRetryAfter
+	}
+}
+
+// validate adds the violations in c to errs, and path is the path of c in the config file.
+func (c *ReadOnlyConfig) validate(path string, errs *ValidationErrors) {
+	if c.RetryAfter <= 0 {
+		errs.add(fieldPath(path, "retry_after"), c.RetryAfter, rulePositive)
 	}
-	if c.RenewThresholdInSeconds <= 0 {
-		return fmt.Errorf(`invalid field: "ZTSCredentialProviderConfig.RenewThreshold" must be greater than 0, got %v`,
-			c.RenewThresholdInSeconds)
+	if c.DetectInterval < 0 {
+		errs.add(fieldPath(path, "detect_interval"), c.DetectInterval, ruleNotNegative)
 	}
-	return nil
 }
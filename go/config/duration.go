@@ -0,0 +1,59 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Duration is a time.Duration which is written as a Go duration string in the config file, e.g. "30m" or "500ms".
+// See time.ParseDuration for the format.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+// A number is rejected because its unit would be ambiguous.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf(`a duration must be a string like "30s" or "500ms", got %s`, b)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// resolveDeprecatedSeconds sets d to the value of a deprecated *_in_seconds field if d is not set,
+// and returns false if both are set, in which case the deprecated one is ignored.
+func resolveDeprecatedSeconds(d *Duration, seconds int) bool {
+	if seconds == 0 {
+		return true
+	}
+	if *d != 0 {
+		return false
+	}
+	*d = Duration(time.Duration(seconds) * time.Second)
+	return true
+}
+
+// warnDeprecatedSeconds resolves a deprecated *_in_seconds field and logs a warning to logger if it conflicts with d.
+func warnDeprecatedSeconds(d *Duration, seconds int, path, deprecatedPath string, logger *log.Logger) {
+	if !resolveDeprecatedSeconds(d, seconds) {
+		logger.Printf("both %q and the deprecated %q are set, so the latter is ignored", path, deprecatedPath)
+	}
+}
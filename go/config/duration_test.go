@@ -0,0 +1,118 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDurationUnmarshalJSON(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		input   string
+		want    Duration
+		wantErr bool
+	}{
+		{
+			name:  "minutes",
+			input: `"30m"`,
+			want:  Duration(30 * time.Minute),
+		},
+		{
+			name:  "milliseconds",
+			input: `"500ms"`,
+			want:  Duration(500 * time.Millisecond),
+		},
+		{
+			name:    "number",
+			input:   `30`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid string",
+			input:   `"thirty minutes"`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var got Duration
+			err := json.Unmarshal([]byte(tt.input), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationMarshalJSON(t *testing.T) {
+	t.Parallel()
+
+	b, err := json.Marshal(Duration(90 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), `"1m30s"`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestResolveDeprecatedSeconds(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		d       Duration
+		seconds int
+		want    Duration
+		wantOK  bool
+	}{
+		{
+			name:   "neither is set",
+			wantOK: true,
+		},
+		{
+			name:   "only the duration is set",
+			d:      Duration(time.Minute),
+			want:   Duration(time.Minute),
+			wantOK: true,
+		},
+		{
+			name:    "only the deprecated field is set",
+			seconds: 90,
+			want:    Duration(90 * time.Second),
+			wantOK:  true,
+		},
+		{
+			name:    "both are set",
+			d:       Duration(time.Minute),
+			seconds: 90,
+			want:    Duration(time.Minute),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := tt.d
+			if ok := resolveDeprecatedSeconds(&d, tt.seconds); ok != tt.wantOK {
+				t.Errorf("got %v, want %v", ok, tt.wantOK)
+			}
+			if d != tt.want {
+				t.Errorf("got %v, want %v", d, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// rootPath is the path of Config in a Grafeas config file, i.e. grafeas.rds.
+// The "grafeas" prefix is omitted because every field of a Grafeas config is under it.
+const rootPath = "rds"
+
+// redactedValue replaces the value of a secret field in the errors.
+const redactedValue = "REDACTED"
+
+// rules which can be violated by the fields of Config
+const (
+	ruleNotEmpty    = "must not be empty"
+	rulePositive    = "must be greater than 0"
+	ruleNotNegative = "must not be negative"
+	ruleValidURL    = "must be a valid URL"
+	ruleOneOf       = "must be one of %s"
+	ruleLessThan    = "must be less than %s"
+
+	ruleRequiredWith    = "must not be empty because %s is set"
+	ruleExcludedWith    = "must be empty because %s is set"
+	ruleMatchURL        = "must be empty or match the value in url"
+	ruleURLScheme       = "must have one of the schemes %s"
+	ruleURLQuery        = "must not contain the unsupported query parameter %q"
+	ruleInsecureSSLMode = "must encrypt the connection unless allow_insecure_transport is true"
+	ruleIAMAuthSSLMode  = "must verify the server certificate because the IAM auth token is sent over the connection"
+)
+
+// ValidationError describes a field of Config which violates a rule.
+type ValidationError struct {
+	// Path is the path of the field in the config file, e.g. rds.iam_auth.credentials_provider.iam_role.
+	Path string
+	// Value is the offending value, and it's redacted if the field contains a secret.
+	Value string
+	// Rule describes the violated rule, e.g. "must not be empty".
+	Rule string
+}
+
+func (e ValidationError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("invalid field %q: %s", e.Path, e.Rule)
+	}
+	return fmt.Sprintf("invalid field %q: %s, got %q", e.Path, e.Rule, e.Value)
+}
+
+// ValidationErrors contains every violation found in Config,
+// so that all of them can be fixed at once.
+// It's returned by New, and it can be inspected via errors.As.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("found %d invalid field(s) in the config: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// add records a violation, and value is redacted if the field at path contains a secret.
+func (e *ValidationErrors) add(path string, value interface{}, rule string) {
+	v := fmt.Sprint(value)
+	if v != "" && isSecretPath(path) {
+		v = redactedValue
+	}
+	*e = append(*e, ValidationError{Path: path, Value: v, Rule: rule})
+}
+
+// err returns nil if there is no violation,
+// which avoids returning a non-nil error interface holding a nil slice.
+func (e ValidationErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// isSecretPath returns true if the field at path is tagged with `secret:"true"`.
+func isSecretPath(path string) bool {
+	names := strings.Split(path, ".")
+	if len(names) == 0 || names[0] != rootPath {
+		return false
+	}
+	t := reflect.TypeOf(Config{})
+	for i, name := range names[1:] {
+		field, ok := fieldByJSONName(t, name)
+		if !ok {
+			return false
+		}
+		if i == len(names)-2 {
+			return field.Tag.Get("secret") == "true"
+		}
+		t = field.Type
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+	}
+	return false
+}
+
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); joinFieldPath("", field) == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// fieldPath returns the path of the field with the given JSON name under parent.
+func fieldPath(parent, name string) string {
+	return parent + "." + name
+}
@@ -0,0 +1,99 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/grafeas/grafeas/go/config"
+)
+
+func TestNewAggregatesValidationErrors(t *testing.T) {
+	t.Parallel()
+
+	gc, err := config.LoadConfig(path.Join("testdata", "invalid_multiple_fields.yaml"))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	_, err = New(gc.StorageConfig)
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, but want it to be ValidationErrors", err)
+	}
+	want := ValidationErrors{
+		{Path: "rds.host", Rule: ruleNotEmpty},
+		{Path: "rds.port", Value: "-1", Rule: rulePositive},
+		{Path: "rds.iam_auth.region", Rule: ruleNotEmpty},
+		{Path: "rds.iam_auth.credentials_provider.iam_role", Rule: ruleNotEmpty},
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("got %+v, want %+v", errs, want)
+	}
+}
+
+func TestValidationErrorsAdd(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		path  string
+		value interface{}
+		want  ValidationError
+	}{
+		{
+			name:  "plain value",
+			path:  "rds.iam_auth.region",
+			value: "us-west-2",
+			want:  ValidationError{Path: "rds.iam_auth.region", Value: "us-west-2", Rule: ruleNotEmpty},
+		},
+		{
+			name:  "secret value",
+			path:  "rds.password",
+			value: "dummy-password-for-unit-tests-only",
+			want:  ValidationError{Path: "rds.password", Value: redactedValue, Rule: ruleNotEmpty},
+		},
+		{
+			name:  "empty secret value",
+			path:  "rds.pagination_key",
+			value: "",
+			want:  ValidationError{Path: "rds.pagination_key", Rule: ruleNotEmpty},
+		},
+		{
+			name:  "unknown path",
+			path:  "rds.unknown.field",
+			value: "some value",
+			want:  ValidationError{Path: "rds.unknown.field", Value: "some value", Rule: ruleNotEmpty},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var errs ValidationErrors
+			errs.add(tt.path, tt.value, ruleNotEmpty)
+			if len(errs) != 1 || errs[0] != tt.want {
+				t.Errorf("got %+v, want %+v", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationErrorsErr(t *testing.T) {
+	t.Parallel()
+
+	var errs ValidationErrors
+	if err := errs.err(); err != nil {
+		t.Errorf("got %v, but want nil when there is no violation", err)
+	}
+	errs.add("rds.host", "", ruleNotEmpty)
+	errs.add("rds.port", 0, rulePositive)
+	want := `found 2 invalid field(s) in the config: invalid field "rds.host": must not be empty; ` +
+		`invalid field "rds.port": must be greater than 0, got "0"`
+	if err := errs.err(); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
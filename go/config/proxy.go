@@ -0,0 +1,93 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// default values for ProxyConfig
+const (
+	// defaultIdleClientTimeout is the default IdleClientTimeout of RDS Proxy.
+	defaultIdleClientTimeout = Duration(30 * time.Minute)
+)
+
+// ProxyConfig contains the configuration required to connect through RDS Proxy,
+// in which case Host and Reader are the endpoints of the proxy.
+// Ref: https://docs.aws.amazon.com/AmazonRDS/latest/UserGuide/rds-proxy.html
+type ProxyConfig struct {
+	// Enabled is true if the connections go through RDS Proxy.
+	Enabled bool `json:"enabled"`
+	// Endpoint is the endpoint of the proxy which the IAM auth tokens are generated for,
+	// and it's only needed if Host is an alias of it, e.g. a CNAME.
+	Endpoint string `json:"endpoint"`
+	// ReaderEndpoint is the same as Endpoint for Reader, i.e. a read-only endpoint of the proxy.
+	ReaderEndpoint string `json:"reader_endpoint"`
+	// IdleClientTimeout must be the same as the one configured for the proxy,
+	// which closes the connections idle for longer than it.
+	// ConnPool.ConnMaxIdleTime defaults to its half and must be less than it,
+	// so that the pool does not reuse a connection closed by the proxy.
+	IdleClientTimeout Duration `json:"idle_client_timeout"`
+}
+
+func (c *Config) populateProxyDefaultValues() {
+	if !c.Proxy.Enabled {
+		return
+	}
+	if c.Proxy.IdleClientTimeout == 0 {
+		c.Proxy.IdleClientTimeout = defaultIdleClientTimeout
+	}
+	if c.ConnPool.ConnMaxIdleTime == 0 {
+		c.ConnPool.ConnMaxIdleTime = c.Proxy.IdleClientTimeout / 2
+	}
+}
+
+// validateProxy adds the violations related to RDS Proxy to errs.
+func (c *Config) validateProxy(errs *ValidationErrors) {
+	if !c.Proxy.Enabled {
+		return
+	}
+	path := fieldPath(rootPath, "proxy")
+	if c.UsesDiscovery() {
+		// The discovered endpoints are the ones of the instances rather than the proxy.
+		errs.add(fieldPath(fieldPath(rootPath, "discovery"), "cluster_identifier"), c.Discovery.ClusterIdentifier,
+			fmt.Sprintf(ruleExcludedWith, fieldPath(path, "enabled")))
+	}
+	if c.Proxy.IdleClientTimeout <= 0 {
+		errs.add(fieldPath(path, "idle_client_timeout"), c.Proxy.IdleClientTimeout, rulePositive)
+	} else if c.ConnPool.ConnMaxIdleTime >= c.Proxy.IdleClientTimeout {
+		errs.add(fieldPath(fieldPath(rootPath, "conn_pool"), "conn_max_idle_time"), c.ConnPool.ConnMaxIdleTime,
+			fmt.Sprintf(ruleLessThan, fieldPath(path, "idle_client_timeout")))
+	}
+}
+
+// pinningFields returns the paths of the fields which make RDS Proxy pin every connection to a DB connection,
+// i.e. the ones which change the state of the session.
+// Ref: https://docs.aws.amazon.com/AmazonRDS/latest/UserGuide/rds-proxy-pinning.html
+func (c *Config) pinningFields() []string {
+	var paths []string
+	// It's sent to the DB as a run-time parameter in the startup message.
+	if c.StatementTimeout > 0 {
+		paths = append(paths, fieldPath(rootPath, "statement_timeout"))
+	}
+	// SET statements change the session state by definition.
+	if len(c.InitStatements) > 0 {
+		paths = append(paths, fieldPath(rootPath, "init_statements"))
+	}
+	return paths
+}
+
+// warnPinning logs the fields which defeat the multiplexing of RDS Proxy to logger.
+// They are not rejected because the pinning only affects the efficiency.
+func (c *Config) warnPinning(logger *log.Logger) {
+	if !c.Proxy.Enabled {
+		return
+	}
+	for _, path := range c.pinningFields() {
+		logger.Printf("%q changes the session state, which pins the connections in RDS Proxy; "+
+			"consider setting it on the DB user or in the DB parameter group instead", path)
+	}
+}
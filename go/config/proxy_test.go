@@ -0,0 +1,78 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestValidateProxy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		conf     Config
+		wantErrs ValidationErrors
+	}{
+		{
+			name: "proxy disabled",
+			conf: Config{ConnPool: ConnPoolConfig{ConnMaxIdleTime: Duration(time.Hour)}},
+		},
+		{
+			name: "proxy enabled",
+			conf: Config{
+				ConnPool: ConnPoolConfig{ConnMaxIdleTime: Duration(10 * time.Minute)},
+				Proxy:    ProxyConfig{Enabled: true, IdleClientTimeout: defaultIdleClientTimeout},
+			},
+		},
+		{
+			name: "idle client timeout not positive",
+			conf: Config{Proxy: ProxyConfig{Enabled: true, IdleClientTimeout: Duration(-time.Second)}},
+			wantErrs: ValidationErrors{
+				{Path: "rds.proxy.idle_client_timeout", Value: "-1s", Rule: rulePositive},
+			},
+		},
+		{
+			name: "discovery",
+			conf: Config{
+				Discovery: DiscoveryConfig{ClusterIdentifier: "grafeas"},
+				Proxy:     ProxyConfig{Enabled: true, IdleClientTimeout: defaultIdleClientTimeout},
+			},
+			wantErrs: ValidationErrors{
+				{Path: "rds.discovery.cluster_identifier", Value: "grafeas", Rule: "must be empty because rds.proxy.enabled is set"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var errs ValidationErrors
+			tt.conf.validateProxy(&errs)
+			if !reflect.DeepEqual(tt.wantErrs, errs) {
+				t.Errorf("errors mismatch, want %v, got %v", tt.wantErrs, errs)
+			}
+		})
+	}
+}
+
+func TestPinningFields(t *testing.T) {
+	t.Parallel()
+
+	conf := Config{}
+	if got := conf.pinningFields(); len(got) != 0 {
+		t.Errorf("got %v, want no field", got)
+	}
+	conf.StatementTimeout = Duration(30 * time.Second)
+	if got, want := conf.pinningFields(), []string{"rds.statement_timeout"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	conf.InitStatements = []string{"SET lock_timeout = '5s'"}
+	if got, want := conf.pinningFields(), []string{"rds.statement_timeout", "rds.init_statements"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// plainConfig has the same fields as Config but none of its methods,
+// so that it can be formatted and marshaled without recursing into them.
+type plainConfig Config
+
+// String implements fmt.Stringer, which is used by %v and %+v, with the secrets redacted.
+func (c Config) String() string {
+	return fmt.Sprintf("%+v", plainConfig(c.redacted()))
+}
+
+// GoString implements fmt.GoStringer, which is used by %#v, with the secrets redacted.
+func (c Config) GoString() string {
+	s := fmt.Sprintf("%#v", plainConfig(c.redacted()))
+	return "config.Config" + strings.TrimPrefix(s, "config.plainConfig")
+}
+
+// MarshalJSON implements json.Marshaler with the secrets redacted.
+// Note that New does not marshal a Config passed to it, so the secrets are kept in that case.
+func (c Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(plainConfig(c.redacted()))
+}
+
+// redacted returns a copy of c whose non-empty fields tagged with `secret:"true"` are replaced with redactedValue.
+// The strings in a tagged slice or map are redacted one by one.
+func (c Config) redacted() Config {
+	redact(reflect.ValueOf(&c).Elem())
+	return c
+}
+
+// redact redacts the exported fields of the struct v in place.
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		v.Field(i).Set(redactedCopy(v.Field(i), field.Tag.Get("secret") == "true"))
+	}
+}
+
+// redactedCopy returns a copy of v whose strings are redacted if secret is true,
+// and whose structs have their tagged fields redacted.
+// The slices, the maps and the pointers are copied rather than modified,
+// because they share their contents with the Config being formatted.
+func redactedCopy(v reflect.Value, secret bool) reflect.Value {
+	switch v.Kind() {
+	case reflect.String:
+		if secret && v.String() != "" {
+			return reflect.ValueOf(redactedValue).Convert(v.Type())
+		}
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		redact(c)
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(redactedCopy(v.Index(i), secret))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(redactedCopy(v.Index(i), secret))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), redactedCopy(iter.Value(), secret))
+		}
+		return c
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(redactedCopy(v.Elem(), secret))
+		return c
+	}
+	return v
+}
@@ -0,0 +1,200 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/grafeas/grafeas/go/config"
+)
+
+// secretFieldRegexp matches the JSON names of fields which are likely to contain secrets.
+var secretFieldRegexp = regexp.MustCompile(`(?i)(password|secret|token|key|credential)`)
+
+// notSecretFields are the fields matching secretFieldRegexp which do not contain secrets.
+var notSecretFields = map[string]bool{
+	// The path of the key file, not the key itself.
+	"rds.ssl_key": true,
+	// The ARN or the name of the secret, not the secret itself.
+	"rds.secrets_manager.secret_id": true,
+}
+
+// TestSecretFieldsAreTagged fails if a field which looks like a secret is not tagged with `secret:"true"`,
+// in which case it would not be redacted.
+// If the field does not contain a secret, add it to notSecretFields.
+func TestSecretFieldsAreTagged(t *testing.T) {
+	t.Parallel()
+
+	walkStringFields(reflect.TypeOf(Config{}), rootPath, func(path string, field reflect.StructField) {
+		name := path[strings.LastIndex(path, ".")+1:]
+		if !secretFieldRegexp.MatchString(name) || notSecretFields[path] {
+			return
+		}
+		if field.Tag.Get("secret") != "true" {
+			t.Errorf(`%q looks like a secret, so tag it with secret:"true" or add it to notSecretFields`, path)
+		}
+	})
+}
+
+func TestConfigRedaction(t *testing.T) {
+	t.Parallel()
+
+	// Every string field is populated with its path, so that it's easy to tell which ones are printed.
+	var c Config
+	populateStringFields(reflect.ValueOf(&c).Elem(), rootPath)
+	var secrets, others []string
+	walkStringFields(reflect.TypeOf(c), rootPath, func(path string, field reflect.StructField) {
+		if field.Tag.Get("secret") == "true" {
+			secrets = append(secrets, path)
+		} else {
+			others = append(others, path)
+		}
+	})
+	if len(secrets) == 0 {
+		t.Fatal("no secret field is found")
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]string{
+		"String":      c.String(),
+		"%v":          fmt.Sprintf("%v", c),
+		"%+v":         fmt.Sprintf("%+v", &c),
+		"%#v":         fmt.Sprintf("%#v", c),
+		"MarshalJSON": string(b),
+	} {
+		for _, path := range secrets {
+			if strings.Contains(s, path) {
+				t.Errorf("%s: %q is not redacted in %s", name, path, s)
+			}
+		}
+		for _, path := range others {
+			if !strings.Contains(s, path) {
+				t.Errorf("%s: %q is missing in %s", name, path, s)
+			}
+		}
+		if !strings.Contains(s, redactedValue) {
+			t.Errorf("%s: %q is missing in %s", name, redactedValue, s)
+		}
+	}
+	if !strings.HasPrefix(c.GoString(), "config.Config{") {
+		t.Errorf("got %s, want it to start with config.Config{", c.GoString())
+	}
+}
+
+func TestConfigRedactionKeepsOriginal(t *testing.T) {
+	t.Parallel()
+
+	c := Config{Password: "dummy-password-for-unit-tests-only", InitStatements: []string{"SET my.key = 'dummy'", ""}}
+	got := c.redacted()
+	if want := []string{redactedValue, ""}; !reflect.DeepEqual(got.InitStatements, want) {
+		t.Errorf("got %q, want %q", got.InitStatements, want)
+	}
+	// The slice is copied, so the original statements are kept.
+	if c.InitStatements[0] != "SET my.key = 'dummy'" {
+		t.Errorf("got %q, but the original statement is modified", c.InitStatements[0])
+	}
+}
+
+func TestRedactedCopy(t *testing.T) {
+	t.Parallel()
+
+	type nested struct {
+		Token string `secret:"true"`
+		Name  string
+	}
+	type fields struct {
+		Tokens  map[string]string `secret:"true"`
+		Names   map[string]string
+		Pointer *string `secret:"true"`
+		Nested  []nested
+		Array   [1]string `secret:"true"`
+		Empty   []string  `secret:"true"`
+	}
+	pointer := "secret-pointer"
+	v := fields{
+		Tokens:  map[string]string{"a": "secret-a"},
+		Names:   map[string]string{"b": "name-b"},
+		Pointer: &pointer,
+		Nested:  []nested{{Token: "secret-nested", Name: "name-nested"}},
+		Array:   [1]string{"secret-array"},
+	}
+	got := redactedCopy(reflect.ValueOf(v), false).Interface().(fields)
+	want := fields{
+		Tokens: map[string]string{"a": redactedValue},
+		Names:  map[string]string{"b": "name-b"},
+		Nested: []nested{{Token: redactedValue, Name: "name-nested"}},
+		Array:  [1]string{redactedValue},
+	}
+	if got.Pointer == nil || *got.Pointer != redactedValue {
+		t.Errorf("got pointer %v, want it to point to %q", got.Pointer, redactedValue)
+	}
+	got.Pointer = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if v.Tokens["a"] != "secret-a" || pointer != "secret-pointer" || v.Nested[0].Token != "secret-nested" {
+		t.Errorf("got %+v, but the original is modified", v)
+	}
+}
+
+func TestNewKeepsSecretsOfConfig(t *testing.T) {
+	t.Parallel()
+
+	want := "dummy-password-for-unit-tests-only"
+	for _, ci := range []config.StorageConfiguration{
+		Config{Host: "localhost", User: "grafeas_rw", Password: want, SSLRootCert: "ca.pem"},
+		&Config{Host: "localhost", User: "grafeas_rw", Password: want, SSLRootCert: "ca.pem"},
+	} {
+		ci := ci
+		c, err := New(&ci)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Password != want {
+			t.Errorf("got %q, want %q", c.Password, want)
+		}
+	}
+}
+
+// walkStringFields invokes f with every string or string slice field of t and its path.
+func walkStringFields(t reflect.Type, path string, f func(string, reflect.StructField)) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldPath := joinFieldPath(path, field)
+		switch field.Type.Kind() {
+		case reflect.String:
+			f(fieldPath, field)
+		case reflect.Slice:
+			if field.Type.Elem().Kind() == reflect.String {
+				f(fieldPath, field)
+			}
+		case reflect.Struct:
+			walkStringFields(field.Type, fieldPath, f)
+		}
+	}
+}
+
+func populateStringFields(v reflect.Value, path string) {
+	for i := 0; i < v.NumField(); i++ {
+		fieldPath := joinFieldPath(path, v.Type().Field(i))
+		switch v.Field(i).Kind() {
+		case reflect.String:
+			v.Field(i).SetString(fieldPath)
+		case reflect.Slice:
+			if v.Field(i).Type().Elem().Kind() == reflect.String {
+				v.Field(i).Set(reflect.ValueOf([]string{fieldPath}))
+			}
+		case reflect.Struct:
+			populateStringFields(v.Field(i), fieldPath)
+		}
+	}
+}
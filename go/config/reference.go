@@ -0,0 +1,116 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// fileReferencePrefix is the prefix of a value which refers to the content of a local file,
+// e.g. file:///var/run/secrets/db-password.
+const fileReferencePrefix = "file://"
+
+// envReferenceRegexp matches a reference to an environment variable, e.g. ${DB_PASSWORD}.
+var envReferenceRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveReferences replaces the references in every string field of c with the values they refer to,
+// so that secrets (e.g. Password and PaginationKey) do not need to be stored in the config file.
+//
+// A value is resolved as follows:
+//
+//   - If it starts with "file://", it's replaced with the content of the file, without the trailing newline.
+//     Only absolute paths are supported, e.g. file:///var/run/secrets/db-password.
+//   - Otherwise, every ${ENV_VAR} in it is replaced with the value of the environment variable.
+//
+// An error is returned if a referenced environment variable is not set or a referenced file is not readable.
+func (c *Config) resolveReferences() error {
+	return resolveReferences(reflect.ValueOf(c).Elem(), "")
+}
+
+func resolveReferences(v reflect.Value, path string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldPath := joinFieldPath(path, field)
+		fieldValue := v.Field(i)
+		switch fieldValue.Kind() {
+		case reflect.String:
+			resolved, err := resolveReference(fieldValue.String())
+			if err != nil {
+				return fmt.Errorf("failed to resolve the reference in %q, err: %v", fieldPath, err)
+			}
+			fieldValue.SetString(resolved)
+		case reflect.Slice:
+			if fieldValue.Type().Elem().Kind() != reflect.String {
+				continue
+			}
+			for j := 0; j < fieldValue.Len(); j++ {
+				resolved, err := resolveReference(fieldValue.Index(j).String())
+				if err != nil {
+					return fmt.Errorf("failed to resolve the reference in \"%s[%d]\", err: %v", fieldPath, j, err)
+				}
+				fieldValue.Index(j).SetString(resolved)
+			}
+		case reflect.Struct:
+			if err := resolveReferences(fieldValue, fieldPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func resolveReference(value string) (string, error) {
+	if strings.HasPrefix(value, fileReferencePrefix) {
+		return resolveFileReference(value)
+	}
+	var err error
+	resolved := envReferenceRegexp.ReplaceAllStringFunc(value, func(ref string) string {
+		name := envReferenceRegexp.FindStringSubmatch(ref)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %q is not set", name)
+		}
+		return env
+	})
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+func resolveFileReference(ref string) (string, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("invalid file reference %q, err: %v", ref, err)
+	}
+	if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return "", fmt.Errorf(`invalid file reference %q, it must be in the form of "file:///absolute/path"`, ref)
+	}
+	content, err := os.ReadFile(u.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the file referenced by %q, err: %v", ref, err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// joinFieldPath appends the JSON name of field to path,
+// which is how the field is referred to in the config file, e.g. iam_auth.region.
+func joinFieldPath(path string, field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
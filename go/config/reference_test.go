@@ -0,0 +1,122 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafeas/grafeas/go/config"
+)
+
+// The tests in this file are not run in parallel because t.Setenv does not support it.
+
+func TestResolveReferences(t *testing.T) {
+	t.Setenv("GRAFEAS_RDS_TEST_PASSWORD", "dummy-password-for-unit-tests-only")
+	t.Setenv("GRAFEAS_RDS_TEST_ENV", "prod")
+	t.Setenv("GRAFEAS_RDS_TEST_EMPTY", "")
+	secretFile := filepath.Join(t.TempDir(), "pagination-key")
+	if err := os.WriteFile(secretFile, []byte("some_random_key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		conf       Config
+		wantConf   Config
+		wantErrMsg string
+	}{
+		{
+			name: "no reference",
+			conf: Config{Host: "some-host.rds.amazonaws.com"},
+			wantConf: Config{
+				Host: "some-host.rds.amazonaws.com",
+			},
+		},
+		{
+			name: "environment variables and file",
+			conf: Config{
+				Host:          "grafeas-${GRAFEAS_RDS_TEST_ENV}.rds.amazonaws.com",
+				User:          "grafeas_rw${GRAFEAS_RDS_TEST_EMPTY}",
+				Password:      "${GRAFEAS_RDS_TEST_PASSWORD}",
+				PaginationKey: "file://" + secretFile,
+				IAMAuth:       IAMAuthConfig{Region: "${GRAFEAS_RDS_TEST_ENV}"},
+			},
+			wantConf: Config{
+				Host:          "grafeas-prod.rds.amazonaws.com",
+				User:          "grafeas_rw",
+				Password:      "dummy-password-for-unit-tests-only",
+				PaginationKey: "some_random_key",
+				IAMAuth:       IAMAuthConfig{Region: "prod"},
+			},
+		},
+		{
+			name:       "missing environment variable",
+			conf:       Config{Password: "${GRAFEAS_RDS_TEST_MISSING}"},
+			wantErrMsg: `failed to resolve the reference in "password", err: environment variable "GRAFEAS_RDS_TEST_MISSING" is not set`,
+		},
+		{
+			name: "missing environment variable in a nested field",
+			conf: Config{IAMAuth: IAMAuthConfig{
+				CredentialsProvider: ZTSCredentialProviderConfig{IAMRole: "${GRAFEAS_RDS_TEST_MISSING}"},
+			}},
+			wantErrMsg: `"iam_auth.credentials_provider.iam_role"`,
+		},
+		{
+			name:       "unreadable file",
+			conf:       Config{PaginationKey: "file://" + filepath.Join(t.TempDir(), "missing")},
+			wantErrMsg: `failed to resolve the reference in "pagination_key", err: failed to read the file referenced by`,
+		},
+		{
+			name:       "relative file path",
+			conf:       Config{PaginationKey: "file://pagination-key"},
+			wantErrMsg: `it must be in the form of "file:///absolute/path"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.conf
+			err := c.resolveReferences()
+			if (err != nil) != (tt.wantErrMsg != "") {
+				if err != nil {
+					t.Errorf("don't want error, but got %q", err)
+				} else {
+					t.Errorf("got nil error, but want error to include %q", tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("want %q to include %q", err.Error(), tt.wantErrMsg)
+				}
+				return
+			}
+			if !reflect.DeepEqual(c, tt.wantConf) {
+				t.Errorf("config mismatch, want %+v, got %+v", tt.wantConf, c)
+			}
+		})
+	}
+}
+
+func TestNewResolvesReferencesBeforeValidation(t *testing.T) {
+	t.Setenv("GRAFEAS_RDS_TEST_USER", "grafeas_rw")
+	t.Setenv("GRAFEAS_RDS_TEST_PASSWORD", "dummy-password-for-unit-tests-only")
+
+	conf := config.StorageConfiguration(Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "${GRAFEAS_RDS_TEST_USER}",
+		Password:    "${GRAFEAS_RDS_TEST_PASSWORD}",
+		SSLRootCert: "/opt/rds-ca-2019-root.pem",
+	})
+	c, err := New(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.User != "grafeas_rw" || c.Password != "dummy-password-for-unit-tests-only" {
+		t.Errorf("the references are not resolved, got user %q and password %q", c.User, c.Password)
+	}
+}
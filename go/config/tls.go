@@ -0,0 +1,106 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sslModeSecurity describes how much protection an SSL mode gives.
+type sslModeSecurity int
+
+const (
+	// sslModeInsecure may send the traffic, including credentials, in plaintext.
+	sslModeInsecure sslModeSecurity = iota
+	// sslModeEncrypted always encrypts the traffic, but does not verify the server.
+	sslModeEncrypted
+	// sslModeVerified always encrypts the traffic and verifies the server certificate.
+	sslModeVerified
+)
+
+// sslModes contains the supported SSL modes of each engine,
+// which are libpq's sslmode [1] for PostgreSQL and MySQL's ssl-mode [2] for MySQL,
+// since each of them is passed to the driver of the engine as is.
+//
+// [1] https://www.postgresql.org/docs/current/libpq-ssl.html#LIBPQ-SSL-PROTECTION
+// [2] https://dev.mysql.com/doc/refman/8.0/en/connection-options.html#option_general_ssl-mode
+var sslModes = map[string]map[string]sslModeSecurity{
+	EnginePostgres: {
+		"disable":     sslModeInsecure,
+		"allow":       sslModeInsecure,
+		"prefer":      sslModeInsecure,
+		"require":     sslModeEncrypted,
+		"verify-ca":   sslModeVerified,
+		"verify-full": sslModeVerified,
+	},
+	EngineMySQL: {
+		"DISABLED":        sslModeInsecure,
+		"PREFERRED":       sslModeInsecure,
+		"REQUIRED":        sslModeEncrypted,
+		"VERIFY_CA":       sslModeVerified,
+		"VERIFY_IDENTITY": sslModeVerified,
+	},
+}
+
+// supportedSSLModes lists the keys of sslModes of each engine in a stable order for error messages.
+var supportedSSLModes = map[string][]string{
+	EnginePostgres: {"disable", "allow", "prefer", "require", "verify-ca", "verify-full"},
+	EngineMySQL:    {"DISABLED", "PREFERRED", "REQUIRED", "VERIFY_CA", "VERIFY_IDENTITY"},
+}
+
+// sslModeEngine returns the engine whose SSL modes c uses, which is PostgreSQL if Engine is empty.
+func (c *Config) sslModeEngine() string {
+	if c.Engine == "" {
+		return defaultEngine
+	}
+	return c.Engine
+}
+
+// validateTLS adds the violations of the TLS policy in c to errs:
+//
+//   - SSLMode must be supported by Engine, e.g. verify-full for PostgreSQL and VERIFY_IDENTITY for MySQL.
+//   - An insecure SSLMode must be explicitly allowed by AllowInsecureTransport.
+//   - SSLMode must verify the server when the IAM auth token is sent,
+//     because AWS requires SSL for the IAM auth.
+//   - SSLCert and SSLKey must be set together, and SSLKeyPassword requires SSLKey.
+//
+// The files are read and validated when the storage is created.
+func (c *Config) validateTLS(errs *ValidationErrors) {
+	if c.SSLCert != "" && c.SSLKey == "" {
+		errs.add(fieldPath(rootPath, "ssl_key"), c.SSLKey, fmt.Sprintf(ruleRequiredWith, "ssl_cert"))
+	}
+	if c.SSLKey != "" && c.SSLCert == "" {
+		errs.add(fieldPath(rootPath, "ssl_cert"), c.SSLCert, fmt.Sprintf(ruleRequiredWith, "ssl_key"))
+	}
+	if c.SSLKeyPassword != "" && c.SSLKey == "" {
+		errs.add(fieldPath(rootPath, "ssl_key"), c.SSLKey, fmt.Sprintf(ruleRequiredWith, "ssl_key_password"))
+	}
+
+	path := fieldPath(rootPath, "ssl_mode")
+	engine := c.sslModeEngine()
+	modes, ok := sslModes[engine]
+	if !ok {
+		// The engine itself is reported by validate.
+		return
+	}
+	security, ok := modes[c.SSLMode]
+	if !ok {
+		errs.add(path, c.SSLMode, fmt.Sprintf(ruleOneOf, strings.Join(supportedSSLModes[engine], ", ")))
+		return
+	}
+	if security == sslModeInsecure && !c.AllowInsecureTransport {
+		errs.add(path, c.SSLMode, ruleInsecureSSLMode)
+	}
+	if security != sslModeVerified && c.UsesIAMAuth() {
+		errs.add(path, c.SSLMode, ruleIAMAuthSSLMode)
+	}
+}
+
+// VerifiesServer returns true if SSLMode verifies the server certificate,
+// in which case the embedded RDS CA bundle is used unless SSLRootCert is set.
+func (c *Config) VerifiesServer() bool {
+	security, ok := sslModes[c.sslModeEngine()][c.SSLMode]
+	return ok && security == sslModeVerified
+}
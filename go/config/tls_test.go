@@ -0,0 +1,125 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import "testing"
+
+func TestSupportedSSLModes(t *testing.T) {
+	t.Parallel()
+
+	for _, engine := range supportedEngines {
+		if len(supportedSSLModes[engine]) != len(sslModes[engine]) {
+			t.Errorf("supportedSSLModes has %d modes of %s, but sslModes has %d", len(supportedSSLModes[engine]), engine, len(sslModes[engine]))
+		}
+		for _, mode := range supportedSSLModes[engine] {
+			if _, ok := sslModes[engine][mode]; !ok {
+				t.Errorf("%q is listed in supportedSSLModes of %s, but not in sslModes", mode, engine)
+			}
+		}
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		conf     Config
+		wantErrs int
+	}{
+		{
+			name: "verified mode with IAM auth",
+			conf: Config{Engine: EngineMySQL, SSLMode: "VERIFY_IDENTITY", SSLRootCert: "ca.pem"},
+		},
+		{
+			name: "verified mode without root cert",
+			conf: Config{Engine: EngineMySQL, SSLMode: "VERIFY_CA"},
+		},
+		{
+			name: "encrypted mode with password",
+			conf: Config{SSLMode: "require", Password: "dummy-password-for-unit-tests-only"},
+		},
+		{
+			name:     "encrypted mode with IAM auth",
+			conf:     Config{Engine: EngineMySQL, SSLMode: "REQUIRED"},
+			wantErrs: 1,
+		},
+		{
+			name: "encrypted mode with Secrets Manager",
+			conf: Config{SSLMode: "require", SecretsManager: SecretsManagerConfig{SecretID: "grafeas-db"}},
+		},
+		{
+			name:     "insecure mode with IAM auth",
+			conf:     Config{Engine: EngineMySQL, SSLMode: "PREFERRED"},
+			wantErrs: 2,
+		},
+		{
+			name: "client certificate",
+			conf: Config{SSLMode: "verify-full", SSLCert: "client.crt", SSLKey: "client.key", SSLKeyPassword: "dummy-password-for-unit-tests-only"},
+		},
+		{
+			name:     "client certificate without key",
+			conf:     Config{SSLMode: "verify-full", SSLCert: "client.crt"},
+			wantErrs: 1,
+		},
+		{
+			name:     "client key without certificate",
+			conf:     Config{SSLMode: "verify-full", SSLKey: "client.key"},
+			wantErrs: 1,
+		},
+		{
+			name:     "key password without key",
+			conf:     Config{SSLMode: "verify-full", SSLKeyPassword: "dummy-password-for-unit-tests-only"},
+			wantErrs: 1,
+		},
+		{
+			name:     "unsupported mode",
+			conf:     Config{SSLMode: "VERIFY-FULL"},
+			wantErrs: 1,
+		},
+		{
+			name:     "mode of mysql for postgres",
+			conf:     Config{Engine: EnginePostgres, SSLMode: "VERIFY_IDENTITY"},
+			wantErrs: 1,
+		},
+		{
+			name:     "mode of postgres for mysql",
+			conf:     Config{Engine: EngineMySQL, SSLMode: "verify-full"},
+			wantErrs: 1,
+		},
+		{
+			name: "unsupported engine",
+			conf: Config{Engine: "oracle", SSLMode: "anything"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var errs ValidationErrors
+			tt.conf.validateTLS(&errs)
+			if len(errs) != tt.wantErrs {
+				t.Errorf("got %v, want %d error(s)", errs, tt.wantErrs)
+			}
+		})
+	}
+}
+
+func TestVerifiesServer(t *testing.T) {
+	t.Parallel()
+
+	for engine, modes := range sslModes {
+		for mode, security := range modes {
+			c := Config{Engine: engine, SSLMode: mode}
+			if got, want := c.VerifiesServer(), security == sslModeVerified; got != want {
+				t.Errorf("%s %s: got %v, want %v", engine, mode, got, want)
+			}
+		}
+	}
+	// A mode is only valid for its own engine.
+	if c := (Config{Engine: EnginePostgres, SSLMode: "VERIFY_IDENTITY"}); c.VerifiesServer() {
+		t.Error("got true, but want a mode of mysql not to verify a postgres server")
+	}
+}
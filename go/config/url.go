@@ -0,0 +1,142 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// urlSchemeEngines maps the schemes which URL can have to the engines which they connect to.
+var urlSchemeEngines = map[string]string{
+	"postgres":   EnginePostgres,
+	"postgresql": EnginePostgres,
+	"mysql":      EngineMySQL,
+}
+
+// supportedURLSchemes lists the keys of urlSchemeEngines in a stable order for error messages.
+var supportedURLSchemes = []string{"postgres", "postgresql", "mysql"}
+
+// urlQueryFields maps the query parameters which URL can have to the JSON names of the corresponding fields.
+// Both the libpq names and the MySQL ones are supported.
+var urlQueryFields = map[string]string{
+	"sslmode":          "ssl_mode",
+	"ssl-mode":         "ssl_mode",
+	"sslrootcert":      "ssl_root_cert",
+	"ssl-ca":           "ssl_root_cert",
+	"sslcert":          "ssl_cert",
+	"ssl-cert":         "ssl_cert",
+	"sslkey":           "ssl_key",
+	"ssl-key":          "ssl_key",
+	"application_name": "application_name",
+	"connect_timeout":  "connect_timeout",
+}
+
+// applyURL copies the values in URL to the discrete fields, e.g. Host and User,
+// and adds the violations to errs, including the fields whose values conflict with the ones in URL.
+// A field is not considered to conflict with URL if either of them is empty or they are equal.
+func (c *Config) applyURL(errs *ValidationErrors) {
+	if c.URL == "" {
+		return
+	}
+	path := fieldPath(rootPath, "url")
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		errs.add(path, c.URL, ruleValidURL)
+		return
+	}
+	engine, ok := urlSchemeEngines[u.Scheme]
+	if !ok {
+		errs.add(path, c.URL, fmt.Sprintf(ruleURLScheme, strings.Join(supportedURLSchemes, ", ")))
+		return
+	}
+
+	// The default port of the engine is populated later.
+	c.applyURLString(errs, "engine", &c.Engine, engine)
+	c.applyURLString(errs, "host", &c.Host, u.Hostname())
+	if p := u.Port(); p != "" {
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			errs.add(path, c.URL, ruleValidURL)
+			return
+		}
+		c.applyURLInt(errs, "port", &c.Port, port)
+	}
+	c.applyURLString(errs, "db_name", &c.DBName, strings.TrimPrefix(u.Path, "/"))
+	if u.User != nil {
+		c.applyURLString(errs, "user", &c.User, u.User.Username())
+		// The password may be omitted, e.g. to use the IAM auth.
+		if password, ok := u.User.Password(); ok {
+			c.applyURLString(errs, "password", &c.Password, password)
+		}
+	}
+
+	for key, values := range u.Query() {
+		name, ok := urlQueryFields[key]
+		if !ok {
+			errs.add(path, c.URL, fmt.Sprintf(ruleURLQuery, key))
+			continue
+		}
+		value := values[len(values)-1]
+		switch name {
+		case "ssl_mode":
+			c.applyURLString(errs, name, &c.SSLMode, value)
+		case "ssl_root_cert":
+			c.applyURLString(errs, name, &c.SSLRootCert, value)
+		case "ssl_cert":
+			c.applyURLString(errs, name, &c.SSLCert, value)
+		case "ssl_key":
+			c.applyURLString(errs, name, &c.SSLKey, value)
+		case "application_name":
+			c.applyURLString(errs, name, &c.ApplicationName, value)
+		case "connect_timeout":
+			// It's in seconds as libpq's connect_timeout.
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				errs.add(path, c.URL, fmt.Sprintf(ruleURLQuery, key))
+				continue
+			}
+			timeout := Duration(time.Duration(seconds) * time.Second)
+			if c.ConnectTimeout != 0 && c.ConnectTimeout != timeout {
+				errs.add(fieldPath(rootPath, name), c.ConnectTimeout, ruleMatchURL)
+				continue
+			}
+			c.ConnectTimeout = timeout
+		}
+	}
+}
+
+// applyURLString sets the field with the given JSON name to value in the URL unless they conflict.
+func (c *Config) applyURLString(errs *ValidationErrors, name string, field *string, value string) {
+	switch {
+	case value == "" || *field == value:
+	case *field == "":
+		*field = value
+	default:
+		errs.add(fieldPath(rootPath, name), *field, ruleMatchURL)
+	}
+}
+
+// applyURLInt is the same as applyURLString except for the type of the field.
+func (c *Config) applyURLInt(errs *ValidationErrors, name string, field *int, value int) {
+	switch {
+	case *field == value:
+	case *field == 0:
+		*field = value
+	default:
+		errs.add(fieldPath(rootPath, name), *field, ruleMatchURL)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
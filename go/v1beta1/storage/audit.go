@@ -0,0 +1,507 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/grafeas/grafeas/go/name"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/fieldmask"
+)
+
+const (
+	errMsgWriteAudit    = "failed to write the audit record"
+	errMsgOpenAuditFile = "failed to open the audit file"
+	errMsgAuditQueue    = "the audit record is dropped because the queue is full"
+)
+
+const (
+	// auditWriteTimeout bounds the write of a batch of the records, which outlive the contexts of the calls.
+	auditWriteTimeout     = 5 * time.Second
+	defaultAuditQueueSize = 10000
+	// auditBatchSize is the maximum number of the records written at once.
+	auditBatchSize = 100
+)
+
+// AuditRecord describes a call of a method of Grafeas which creates, updates or deletes resources.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+	// Method is the name of the method, e.g. UpdateNote.
+	Method string `json:"method"`
+	// Resource is the name of the resource, e.g. projects/p/notes/n,
+	// or the name of the project if the resource is not known, e.g. an occurrence which failed to be created.
+	Resource string `json:"resource"`
+	// Caller is the identity claimed by the gRPC metadata (see WithAuditCallerKeys), if any.
+	// It's only as trustworthy as the proxy which sets it, because any client can send the metadata.
+	Caller string `json:"caller,omitempty"`
+	// Peer is the address of the gRPC client, if any.
+	Peer string `json:"peer,omitempty"`
+	// PeerIdentity is the subject of the TLS client certificate verified by the server, if any.
+	PeerIdentity string `json:"peer_identity,omitempty"`
+	// UserID is the user ID passed to the methods creating resources.
+	UserID string `json:"user_id,omitempty"`
+	// Diff is the change of an update.
+	Diff *AuditDiff `json:"diff,omitempty"`
+	// Code is the gRPC code of the error, or OK.
+	Code  string `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditDiff is the change of the fields of an update.
+// Old and New are the resource before and after the update in JSON (see protojson), which only contain the fields in Paths.
+type AuditDiff struct {
+	// Paths are the paths of the field mask, or the changed top-level fields if the mask is empty.
+	Paths []string        `json:"paths"`
+	Old   json.RawMessage `json:"old,omitempty"`
+	New   json.RawMessage `json:"new,omitempty"`
+}
+
+// AuditSink is where the audit records are written to, e.g. NewLogAuditSink, OpenFileAuditSink,
+// or pgsql.NewAuditSink and mysql.NewAuditSink which insert them into the audit_log table.
+// AuditedStorage closes it if it implements io.Closer.
+type AuditSink interface {
+	Write(ctx context.Context, r *AuditRecord) error
+}
+
+// AuditBatchSink can be implemented by an AuditSink which writes several records more efficiently at once,
+// e.g. in a transaction as pgsql.NewAuditSink and mysql.NewAuditSink do.
+type AuditBatchSink interface {
+	AuditSink
+	WriteBatch(ctx context.Context, rs []*AuditRecord) error
+}
+
+// LogAuditSink writes the audit records to a logger in JSON.
+type LogAuditSink struct {
+	logger *log.Logger
+}
+
+// NewLogAuditSink returns a LogAuditSink writing to logger.
+func NewLogAuditSink(logger *log.Logger) *LogAuditSink {
+	return &LogAuditSink{logger: logger}
+}
+
+// Write logs r.
+func (s *LogAuditSink) Write(_ context.Context, r *AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.logger.Printf("audit: %s", data)
+	return nil
+}
+
+// JSONAuditSink writes the audit records to an io.Writer in JSON, one per line.
+type JSONAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditSink returns a JSONAuditSink writing to w.
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+// OpenFileAuditSink returns a JSONAuditSink appending to the file at path, which is created if it doesn't exist.
+func OpenFileAuditSink(path string) (*JSONAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("%s, err: %v", errMsgOpenAuditFile, err)
+	}
+	return NewJSONAuditSink(f), nil
+}
+
+// Write writes r as a line.
+func (s *JSONAuditSink) Write(_ context.Context, r *AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the io.Writer if it implements io.Closer.
+func (s *JSONAuditSink) Close() error {
+	if closer, ok := s.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// AuditOption configures optional behaviors of AuditedStorage.
+type AuditOption func(*AuditedStorage)
+
+// WithAuditCallerKeys sets the keys of the gRPC metadata identifying the caller, and the first one present is recorded.
+// No key is trusted by default, because any client can send the metadata.
+// Only set a key which an authenticating proxy in front of the server always overwrites,
+// e.g. "x-forwarded-user" by oauth2-proxy.
+func WithAuditCallerKeys(keys ...string) AuditOption {
+	return func(s *AuditedStorage) {
+		s.callerKeys = keys
+	}
+}
+
+// WithAuditLogger makes AuditedStorage log the failures of the sink to logger instead of log.Default().
+func WithAuditLogger(logger *log.Logger) AuditOption {
+	return func(s *AuditedStorage) {
+		s.logger = logger
+	}
+}
+
+// WithAuditQueueSize sets how many records can wait to be written. It's 10000 by default.
+// The records are dropped and logged while the queue is full, e.g. while the sink is unreachable,
+// so that the calls are never blocked by the sink.
+func WithAuditQueueSize(size int) AuditOption {
+	return func(a *AuditedStorage) {
+		a.queueSize = size
+	}
+}
+
+// WithAuditReader makes AuditedStorage read the resources before the updates from s instead of the wrapped Storage,
+// e.g. the Storage under a CachedStorage, so that the diffs are not computed from the cached resources.
+func WithAuditReader(s Storage) AuditOption {
+	return func(a *AuditedStorage) {
+		a.reader = s
+	}
+}
+
+// AuditedStorage is a Storage which writes an AuditRecord to a sink for every call creating, updating or deleting resources,
+// whether it succeeds or not. The records are queued after the calls and written in batches in the background,
+// and a failure of the sink is logged without failing them. Close writes the queued records.
+//
+// The diff of an update is computed from the resource read just before it,
+// which may be stale if the storage reads from a replica or a cache (see WithAuditReader).
+type AuditedStorage struct {
+	Storage
+
+	// reader is where the resources are read from before the updates.
+	reader     Storage
+	sink       AuditSink
+	callerKeys []string
+	logger     *log.Logger
+	now        func() time.Time
+	queueSize  int
+
+	// mu guards closed and the sends to queue, which is closed by Close.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *AuditRecord
+	done   chan struct{}
+}
+
+// NewAuditedStorage returns an AuditedStorage wrapping s, which writes to sink and is configured with opts.
+// The records are written in the background until Close is invoked.
+func NewAuditedStorage(s Storage, sink AuditSink, opts ...AuditOption) *AuditedStorage {
+	a := &AuditedStorage{
+		Storage:   s,
+		reader:    s,
+		sink:      sink,
+		logger:    log.Default(),
+		now:       time.Now,
+		queueSize: defaultAuditQueueSize,
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.queue = make(chan *AuditRecord, a.queueSize)
+	go a.run()
+	return a
+}
+
+// Close writes the queued records, and closes the sink and the wrapped Storage if they implement io.Closer.
+func (a *AuditedStorage) Close() error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.mu.Unlock()
+	<-a.done
+	if closer, ok := a.sink.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			a.logger.Printf("failed to close the audit sink, err: %v", err)
+		}
+	}
+	if closer, ok := a.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// newRecord returns the record of a call of method on resource by the caller in ctx, which failed with err if it's not nil.
+func (a *AuditedStorage) newRecord(ctx context.Context, method, resource, uID string, err error) *AuditRecord {
+	r := &AuditRecord{
+		Time:     a.now(),
+		Method:   method,
+		Resource: resource,
+		UserID:   uID,
+		Code:     status.Code(err).String(),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, key := range a.callerKeys {
+			if values := md.Get(key); len(values) > 0 {
+				r.Caller = values[0]
+				break
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			r.Peer = p.Addr.String()
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 && len(info.State.VerifiedChains[0]) > 0 {
+			r.PeerIdentity = info.State.VerifiedChains[0][0].Subject.String()
+		}
+	}
+	return r
+}
+
+// write queues r to be written by run. If the queue is full or closed, r is logged instead.
+func (a *AuditedStorage) write(r *AuditRecord) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.closed {
+		select {
+		case a.queue <- r:
+			return
+		default:
+		}
+	}
+	// The record is logged as a last resort, so that it's not lost.
+	data, err := json.Marshal(r)
+	if err != nil {
+		a.logger.Printf("%s, err: %v", errMsgAuditQueue, err)
+		return
+	}
+	a.logger.Printf("%s: %s", errMsgAuditQueue, data)
+}
+
+// run writes the queued records in batches until the queue is closed.
+func (a *AuditedStorage) run() {
+	defer close(a.done)
+	for r := range a.queue {
+		batch := []*AuditRecord{r}
+	collect:
+		for len(batch) < auditBatchSize {
+			select {
+			case r, ok := <-a.queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, r)
+			default:
+				break collect
+			}
+		}
+		a.writeBatch(batch)
+	}
+}
+
+// writeBatch writes rs to the sink, logging the failures if any.
+func (a *AuditedStorage) writeBatch(rs []*AuditRecord) {
+	// The timeout bounds the whole batch, so that an unreachable sink doesn't hold the queue for every record.
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+	if sink, ok := a.sink.(AuditBatchSink); ok {
+		if err := sink.WriteBatch(ctx, rs); err != nil {
+			for _, r := range rs {
+				a.logger.Printf("%s of %s on %s, err: %v", errMsgWriteAudit, r.Method, r.Resource, err)
+			}
+		}
+		return
+	}
+	for _, r := range rs {
+		if err := a.sink.Write(ctx, r); err != nil {
+			a.logger.Printf("%s of %s on %s, err: %v", errMsgWriteAudit, r.Method, r.Resource, err)
+		}
+	}
+}
+
+// audit writes the record of a call.
+func (a *AuditedStorage) audit(ctx context.Context, method, resource, uID string, err error) {
+	a.write(a.newRecord(ctx, method, resource, uID, err))
+}
+
+// auditBatch writes a record for every created resource and every error of a call of a batch method on the project pID.
+func (a *AuditedStorage) auditBatch(ctx context.Context, method, pID, uID string, createdNames []string, errs []error) {
+	for _, n := range createdNames {
+		a.audit(ctx, method, n, uID, nil)
+	}
+	for _, err := range errs {
+		a.audit(ctx, method, name.FormatProject(pID), uID, err)
+	}
+}
+
+// auditUpdate writes the record of an update of resource from before to after.
+// before is nil if it couldn't be read, and after is nil if the update failed.
+func (a *AuditedStorage) auditUpdate(ctx context.Context, method, resource string, before, after proto.Message, mask *fieldmaskpb.FieldMask, err error) {
+	r := a.newRecord(ctx, method, resource, "", err)
+	if err != nil {
+		r.Diff = &AuditDiff{Paths: mask.GetPaths()}
+	} else {
+		r.Diff = newAuditDiff(before, after, mask)
+	}
+	a.write(r)
+}
+
+// newAuditDiff returns the diff of the fields in mask, or of the changed top-level fields if mask is empty.
+func newAuditDiff(before, after proto.Message, mask *fieldmaskpb.FieldMask) *AuditDiff {
+	paths := mask.GetPaths()
+	if len(paths) == 0 {
+		paths = changedFields(before, after)
+	}
+	m := &fieldmaskpb.FieldMask{Paths: paths}
+	return &AuditDiff{
+		Paths: paths,
+		Old:   partialJSON(before, m),
+		New:   partialJSON(after, m),
+	}
+}
+
+// changedFields returns the names of the top-level fields which differ between before and after.
+func changedFields(before, after proto.Message) []string {
+	var changed []string
+	fields := after.ProtoReflect().Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		m := &fieldmaskpb.FieldMask{Paths: []string{string(fields.Get(i).Name())}}
+		if !proto.Equal(partial(before, m), partial(after, m)) {
+			changed = append(changed, m.Paths[0])
+		}
+	}
+	return changed
+}
+
+// partial returns a message which only contains the fields of m in mask, or nil if m is nil.
+func partial(m proto.Message, mask *fieldmaskpb.FieldMask) proto.Message {
+	if m == nil || !m.ProtoReflect().IsValid() {
+		return nil
+	}
+	p := m.ProtoReflect().New().Interface()
+	if err := fieldmask.Apply(p, m, mask); err != nil {
+		return nil
+	}
+	return p
+}
+
+// partialJSON returns the JSON of partial(m, mask), or nil if it's nil.
+func partialJSON(m proto.Message, mask *fieldmaskpb.FieldMask) json.RawMessage {
+	p := partial(m, mask)
+	if p == nil {
+		return nil
+	}
+	data, err := protojson.Marshal(p)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// CreateProject creates the project via the wrapped Storage, and audits the call.
+func (a *AuditedStorage) CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error) {
+	created, err := a.Storage.CreateProject(ctx, pID, p)
+	a.audit(ctx, "CreateProject", name.FormatProject(pID), "", err)
+	return created, err
+}
+
+// DeleteProject deletes the project via the wrapped Storage, and audits the call.
+func (a *AuditedStorage) DeleteProject(ctx context.Context, pID string) error {
+	err := a.Storage.DeleteProject(ctx, pID)
+	a.audit(ctx, "DeleteProject", name.FormatProject(pID), "", err)
+	return err
+}
+
+// CreateOccurrence creates the occurrence via the wrapped Storage, and audits the call.
+func (a *AuditedStorage) CreateOccurrence(ctx context.Context, pID, uID string, o *gpb.Occurrence) (*gpb.Occurrence, error) {
+	created, err := a.Storage.CreateOccurrence(ctx, pID, uID, o)
+	resource := name.FormatProject(pID)
+	if err == nil {
+		resource = created.GetName()
+	}
+	a.audit(ctx, "CreateOccurrence", resource, uID, err)
+	return created, err
+}
+
+// BatchCreateOccurrences creates the occurrences via the wrapped Storage, and audits every created one and every error.
+func (a *AuditedStorage) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*gpb.Occurrence) ([]*gpb.Occurrence, []error) {
+	created, errs := a.Storage.BatchCreateOccurrences(ctx, pID, uID, occs)
+	names := make([]string, 0, len(created))
+	for _, o := range created {
+		names = append(names, o.GetName())
+	}
+	a.auditBatch(ctx, "BatchCreateOccurrences", pID, uID, names, errs)
+	return created, errs
+}
+
+// UpdateOccurrence updates the occurrence via the wrapped Storage, and audits the call with the diff.
+func (a *AuditedStorage) UpdateOccurrence(ctx context.Context, pID, oID string, o *gpb.Occurrence, mask *fieldmaskpb.FieldMask) (*gpb.Occurrence, error) {
+	before, _ := a.reader.GetOccurrence(ctx, pID, oID)
+	updated, err := a.Storage.UpdateOccurrence(ctx, pID, oID, o, mask)
+	a.auditUpdate(ctx, "UpdateOccurrence", name.FormatOccurrence(pID, oID), before, updated, mask, err)
+	return updated, err
+}
+
+// DeleteOccurrence deletes the occurrence via the wrapped Storage, and audits the call.
+func (a *AuditedStorage) DeleteOccurrence(ctx context.Context, pID, oID string) error {
+	err := a.Storage.DeleteOccurrence(ctx, pID, oID)
+	a.audit(ctx, "DeleteOccurrence", name.FormatOccurrence(pID, oID), "", err)
+	return err
+}
+
+// CreateNote creates the note via the wrapped Storage, and audits the call.
+func (a *AuditedStorage) CreateNote(ctx context.Context, pID, nID, uID string, n *gpb.Note) (*gpb.Note, error) {
+	created, err := a.Storage.CreateNote(ctx, pID, nID, uID, n)
+	a.audit(ctx, "CreateNote", name.FormatNote(pID, nID), uID, err)
+	return created, err
+}
+
+// BatchCreateNotes creates the notes via the wrapped Storage, and audits every created one and every error.
+func (a *AuditedStorage) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*gpb.Note) ([]*gpb.Note, []error) {
+	created, errs := a.Storage.BatchCreateNotes(ctx, pID, uID, notes)
+	names := make([]string, 0, len(created))
+	for _, n := range created {
+		names = append(names, n.GetName())
+	}
+	a.auditBatch(ctx, "BatchCreateNotes", pID, uID, names, errs)
+	return created, errs
+}
+
+// UpdateNote updates the note via the wrapped Storage, and audits the call with the diff.
+func (a *AuditedStorage) UpdateNote(ctx context.Context, pID, nID string, n *gpb.Note, mask *fieldmaskpb.FieldMask) (*gpb.Note, error) {
+	before, _ := a.reader.GetNote(ctx, pID, nID)
+	updated, err := a.Storage.UpdateNote(ctx, pID, nID, n, mask)
+	a.auditUpdate(ctx, "UpdateNote", name.FormatNote(pID, nID), before, updated, mask, err)
+	return updated, err
+}
+
+// DeleteNote deletes the note via the wrapped Storage, and audits the call.
+func (a *AuditedStorage) DeleteNote(ctx context.Context, pID, nID string) error {
+	err := a.Storage.DeleteNote(ctx, pID, nID)
+	a.audit(ctx, "DeleteNote", name.FormatNote(pID, nID), "", err)
+	return err
+}
+
+var _ Storage = (*AuditedStorage)(nil)
@@ -0,0 +1,533 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafeas/grafeas/go/config"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+// fakeAuditSink keeps the written records, and fails the writes if err is set.
+type fakeAuditSink struct {
+	mu      sync.Mutex
+	records []*AuditRecord
+	err     error
+	closed  bool
+}
+
+func (s *fakeAuditSink) Write(_ context.Context, r *AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	return s.err
+}
+
+func (s *fakeAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestAuditedStorage(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	ctx := peer.NewContext(
+		metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-forwarded-user", "alice")),
+		&peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}},
+	)
+	tests := []struct {
+		name  string
+		call  func(s *AuditedStorage, store *mocks.MockStorage)
+		wants []*AuditRecord
+	}{
+		{
+			name: "create",
+			call: func(s *AuditedStorage, store *mocks.MockStorage) {
+				store.EXPECT().CreateNote(ctx, "p", "n", "u", gomock.Any()).Return(&gpb.Note{Name: "projects/p/notes/n"}, nil)
+				s.CreateNote(ctx, "p", "n", "u", &gpb.Note{})
+			},
+			wants: []*AuditRecord{
+				{Time: now, Method: "CreateNote", Resource: "projects/p/notes/n", Caller: "alice", Peer: "10.0.0.1:443", UserID: "u", Code: "OK"},
+			},
+		},
+		{
+			name: "created occurrence",
+			call: func(s *AuditedStorage, store *mocks.MockStorage) {
+				store.EXPECT().CreateOccurrence(ctx, "p", "u", gomock.Any()).Return(&gpb.Occurrence{Name: "projects/p/occurrences/o"}, nil)
+				s.CreateOccurrence(ctx, "p", "u", &gpb.Occurrence{})
+			},
+			wants: []*AuditRecord{
+				{Time: now, Method: "CreateOccurrence", Resource: "projects/p/occurrences/o", Caller: "alice", Peer: "10.0.0.1:443", UserID: "u", Code: "OK"},
+			},
+		},
+		{
+			name: "failure",
+			call: func(s *AuditedStorage, store *mocks.MockStorage) {
+				store.EXPECT().DeleteProject(ctx, "p").Return(status.Error(codes.NotFound, "not found"))
+				s.DeleteProject(ctx, "p")
+			},
+			wants: []*AuditRecord{
+				{Time: now, Method: "DeleteProject", Resource: "projects/p", Caller: "alice", Peer: "10.0.0.1:443", Code: "NotFound", Error: "rpc error: code = NotFound desc = not found"},
+			},
+		},
+		{
+			name: "batch",
+			call: func(s *AuditedStorage, store *mocks.MockStorage) {
+				created := []*gpb.Note{{Name: "projects/p/notes/n1"}}
+				errs := []error{status.Error(codes.AlreadyExists, "exists")}
+				store.EXPECT().BatchCreateNotes(ctx, "p", "u", gomock.Any()).Return(created, errs)
+				s.BatchCreateNotes(ctx, "p", "u", map[string]*gpb.Note{"n1": {}, "n2": {}})
+			},
+			wants: []*AuditRecord{
+				{Time: now, Method: "BatchCreateNotes", Resource: "projects/p/notes/n1", Caller: "alice", Peer: "10.0.0.1:443", UserID: "u", Code: "OK"},
+				{Time: now, Method: "BatchCreateNotes", Resource: "projects/p", Caller: "alice", Peer: "10.0.0.1:443", UserID: "u", Code: "AlreadyExists", Error: "rpc error: code = AlreadyExists desc = exists"},
+			},
+		},
+		{
+			name: "update with mask",
+			call: func(s *AuditedStorage, store *mocks.MockStorage) {
+				before := &gpb.Note{Name: "projects/p/notes/n", ShortDescription: "old", LongDescription: "long"}
+				after := &gpb.Note{Name: "projects/p/notes/n", ShortDescription: "new", LongDescription: "long"}
+				mask := &fieldmaskpb.FieldMask{Paths: []string{"short_description"}}
+				store.EXPECT().GetNote(ctx, "p", "n").Return(before, nil)
+				store.EXPECT().UpdateNote(ctx, "p", "n", gomock.Any(), mask).Return(after, nil)
+				s.UpdateNote(ctx, "p", "n", &gpb.Note{ShortDescription: "new"}, mask)
+			},
+			wants: []*AuditRecord{
+				{
+					Time: now, Method: "UpdateNote", Resource: "projects/p/notes/n", Caller: "alice", Peer: "10.0.0.1:443", Code: "OK",
+					Diff: &AuditDiff{
+						Paths: []string{"short_description"},
+						Old:   json.RawMessage(`{"shortDescription":"old"}`),
+						New:   json.RawMessage(`{"shortDescription":"new"}`),
+					},
+				},
+			},
+		},
+		{
+			name: "update without mask",
+			call: func(s *AuditedStorage, store *mocks.MockStorage) {
+				before := &gpb.Occurrence{Name: "projects/p/occurrences/o", Remediation: "old"}
+				after := &gpb.Occurrence{Name: "projects/p/occurrences/o", Remediation: "new", NoteName: "projects/p/notes/n"}
+				store.EXPECT().GetOccurrence(ctx, "p", "o").Return(before, nil)
+				store.EXPECT().UpdateOccurrence(ctx, "p", "o", gomock.Any(), nil).Return(after, nil)
+				s.UpdateOccurrence(ctx, "p", "o", after, nil)
+			},
+			wants: []*AuditRecord{
+				{
+					Time: now, Method: "UpdateOccurrence", Resource: "projects/p/occurrences/o", Caller: "alice", Peer: "10.0.0.1:443", Code: "OK",
+					Diff: &AuditDiff{
+						Paths: []string{"note_name", "remediation"},
+						Old:   json.RawMessage(`{"remediation":"old"}`),
+						New:   json.RawMessage(`{"noteName":"projects/p/notes/n","remediation":"new"}`),
+					},
+				},
+			},
+		},
+		{
+			name: "failed update",
+			call: func(s *AuditedStorage, store *mocks.MockStorage) {
+				mask := &fieldmaskpb.FieldMask{Paths: []string{"short_description"}}
+				store.EXPECT().GetNote(ctx, "p", "n").Return(nil, status.Error(codes.NotFound, "not found"))
+				store.EXPECT().UpdateNote(ctx, "p", "n", gomock.Any(), mask).Return(nil, status.Error(codes.NotFound, "not found"))
+				s.UpdateNote(ctx, "p", "n", &gpb.Note{}, mask)
+			},
+			wants: []*AuditRecord{
+				{
+					Time: now, Method: "UpdateNote", Resource: "projects/p/notes/n", Caller: "alice", Peer: "10.0.0.1:443",
+					Code: "NotFound", Error: "rpc error: code = NotFound desc = not found",
+					Diff: &AuditDiff{Paths: []string{"short_description"}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			store := mocks.NewMockStorage(mockCtrl)
+			sink := &fakeAuditSink{}
+			s := NewAuditedStorage(store, sink, WithAuditCallerKeys("x-forwarded-user"))
+			s.now = func() time.Time { return now }
+			tt.call(s, store)
+			s.Close()
+
+			// The JSON is compared instead of the bytes, which protojson randomizes.
+			if got, want := normalizeAuditRecords(t, sink.records), normalizeAuditRecords(t, tt.wants); !reflect.DeepEqual(got, want) {
+				t.Errorf("got records %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// normalizeAuditRecords decodes the JSON of records to be compared regardless of the formatting.
+func normalizeAuditRecords(t *testing.T, records []*AuditRecord) []interface{} {
+	t.Helper()
+	var normalized []interface{}
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatal(err)
+		}
+		normalized = append(normalized, v)
+	}
+	return normalized
+}
+
+func TestAuditedStorageCallerKeys(t *testing.T) {
+	t.Parallel()
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-forwarded-user", "alice", "x-service", "scanner"))
+	tests := []struct {
+		name string
+		opts []AuditOption
+		want string
+	}{
+		{
+			name: "no key is trusted by default",
+		},
+		{
+			name: "the first present key",
+			opts: []AuditOption{WithAuditCallerKeys("x-user", "x-service")},
+			want: "scanner",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			store := mocks.NewMockStorage(mockCtrl)
+			sink := &fakeAuditSink{}
+			s := NewAuditedStorage(store, sink, tt.opts...)
+			store.EXPECT().DeleteNote(ctx, "p", "n").Return(nil)
+			s.DeleteNote(ctx, "p", "n")
+			s.Close()
+			if got := sink.records[0].Caller; got != tt.want {
+				t.Errorf("got caller %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuditedStoragePeerIdentity(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	sink := &fakeAuditSink{}
+	s := NewAuditedStorage(store, sink)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "scanner", Organization: []string{"example"}}}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr:     &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+
+	store.EXPECT().DeleteNote(ctx, "p", "n").Return(nil)
+	s.DeleteNote(ctx, "p", "n")
+	s.Close()
+	if got, want := sink.records[0].PeerIdentity, "CN=scanner,O=example"; got != want {
+		t.Errorf("got peer identity %q, want %q", got, want)
+	}
+}
+
+func TestAuditedStorageSinkFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	sink := &fakeAuditSink{err: errors.New("sink is down")}
+	var logs bytes.Buffer
+	s := NewAuditedStorage(store, sink, WithAuditLogger(log.New(&logs, "", 0)))
+
+	// The call succeeds even if the record can't be written.
+	store.EXPECT().DeleteNote(ctx, "p", "n").Return(nil)
+	if err := s.DeleteNote(ctx, "p", "n"); err != nil {
+		t.Errorf("unexpected err: %v", err)
+	}
+	s.Close()
+	if !bytes.Contains(logs.Bytes(), []byte("sink is down")) {
+		t.Errorf("got logs %q, want the failure of the sink", logs.String())
+	}
+}
+
+// blockingAuditSink is an AuditBatchSink which keeps the written batches, and blocks the first write until unblock is closed.
+type blockingAuditSink struct {
+	mu      sync.Mutex
+	batches [][]*AuditRecord
+	started chan struct{}
+	unblock chan struct{}
+	once    sync.Once
+}
+
+func newBlockingAuditSink() *blockingAuditSink {
+	return &blockingAuditSink{started: make(chan struct{}), unblock: make(chan struct{})}
+}
+
+func (s *blockingAuditSink) Write(ctx context.Context, r *AuditRecord) error {
+	return s.WriteBatch(ctx, []*AuditRecord{r})
+}
+
+func (s *blockingAuditSink) WriteBatch(_ context.Context, rs []*AuditRecord) error {
+	s.once.Do(func() {
+		close(s.started)
+		<-s.unblock
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, rs)
+	return nil
+}
+
+func TestAuditedStorageWritesInBackground(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	store.EXPECT().DeleteNote(ctx, "p", gomock.Any()).Times(4).Return(nil)
+	sink := newBlockingAuditSink()
+	var logs bytes.Buffer
+	s := NewAuditedStorage(store, sink, WithAuditQueueSize(2), WithAuditLogger(log.New(&logs, "", 0)))
+
+	// The calls return while the sink is blocked.
+	if err := s.DeleteNote(ctx, "p", "n1"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	<-sink.started
+	for _, nID := range []string{"n2", "n3", "n4"} {
+		if err := s.DeleteNote(ctx, "p", nID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	// The record which doesn't fit in the queue is logged instead.
+	if !strings.Contains(logs.String(), errMsgAuditQueue) || !strings.Contains(logs.String(), "projects/p/notes/n4") {
+		t.Errorf("got logs %q, want the dropped record", logs.String())
+	}
+
+	// The queued records are written in a batch by Close.
+	close(sink.unblock)
+	s.Close()
+	var got [][]string
+	for _, batch := range sink.batches {
+		var resources []string
+		for _, r := range batch {
+			resources = append(resources, r.Resource)
+		}
+		got = append(got, resources)
+	}
+	want := [][]string{{"projects/p/notes/n1"}, {"projects/p/notes/n2", "projects/p/notes/n3"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got batches %v, want %v", got, want)
+	}
+}
+
+func TestAuditedStorageClose(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	store := newClosableStorage(mockCtrl, nil)
+	sink := &fakeAuditSink{}
+	if err := NewAuditedStorage(store, sink).Close(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !store.isClosed() || !sink.closed {
+		t.Errorf("got storage closed %v and sink closed %v, want both closed", store.isClosed(), sink.closed)
+	}
+}
+
+func TestFileAuditSink(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	records := []*AuditRecord{
+		{Method: "CreateNote", Resource: "projects/p/notes/n", Code: "OK"},
+		{Method: "DeleteNote", Resource: "projects/p/notes/n", Code: "OK"},
+	}
+	// The records are appended to the existing ones.
+	for _, r := range records {
+		sink, err := OpenFileAuditSink(path)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := sink.Write(context.Background(), r); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []*AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("malformed line %q, err: %v", scanner.Text(), err)
+		}
+		got = append(got, &r)
+	}
+	if !reflect.DeepEqual(got, records) {
+		t.Errorf("got records %v, want %v", got, records)
+	}
+}
+
+func TestLogAuditSink(t *testing.T) {
+	t.Parallel()
+
+	var logs bytes.Buffer
+	sink := NewLogAuditSink(log.New(&logs, "", 0))
+	if err := sink.Write(context.Background(), &AuditRecord{Method: "DeleteNote", Resource: "projects/p/notes/n", Code: "OK"}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want := `audit: {"time":"0001-01-01T00:00:00Z","method":"DeleteNote","resource":"projects/p/notes/n","code":"OK"}` + "\n"
+	if got := logs.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStorageProviderWithAudit(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	conf := config.StorageConfiguration(rdsconfig.Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLRootCert: "testdata/ca.pem",
+	})
+	store := mocks.NewMockStorage(mockCtrl)
+	store.EXPECT().SetMaxOpenConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetMaxIdleConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxLifetime(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxIdleTime(gomock.Any()).AnyTimes()
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Times(1).Return(store, nil)
+	sink := &fakeAuditSink{}
+	var sinkConnector driver.Connector
+
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator,
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithAudit(func(writerConnector driver.Connector) AuditSink {
+			sinkConnector = writerConnector
+			return sink
+		}, WithAuditCallerKeys("x-user")))
+	provided, err := provider.Provide("", &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	a, ok := provided.Gs.(*AuditedStorage)
+	if !ok {
+		t.Fatalf("got %T, want *AuditedStorage", provided.Gs)
+	}
+	if a.sink != sink || sinkConnector == nil || !reflect.DeepEqual(a.callerKeys, []string{"x-user"}) {
+		t.Errorf("the audit is not configured by the options: sink %v, connector %v, caller keys %v", a.sink, sinkConnector, a.callerKeys)
+	}
+}
+
+func TestStorageProviderAuditReadsUnderCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	conf := config.StorageConfiguration(rdsconfig.Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLRootCert: "testdata/ca.pem",
+	})
+	store := mocks.NewMockStorage(mockCtrl)
+	store.EXPECT().SetMaxOpenConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetMaxIdleConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxLifetime(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxIdleTime(gomock.Any()).AnyTimes()
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Times(1).Return(store, nil)
+	sink := &fakeAuditSink{}
+
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator,
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithCache(),
+		WithAudit(func(driver.Connector) AuditSink { return sink }))
+	provided, err := provider.Provide("", &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// The note is cached, and then changed through another replica.
+	cached := &gpb.Note{Name: "projects/p/notes/n", ShortDescription: "cached"}
+	current := &gpb.Note{Name: "projects/p/notes/n", ShortDescription: "current"}
+	updated := &gpb.Note{Name: "projects/p/notes/n", ShortDescription: "new"}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"short_description"}}
+	gomock.InOrder(
+		store.EXPECT().GetNote(ctx, "p", "n").Return(cached, nil),
+		store.EXPECT().GetNote(ctx, "p", "n").Return(current, nil),
+		store.EXPECT().UpdateNote(ctx, "p", "n", gomock.Any(), mask).Return(updated, nil),
+	)
+	if _, err := provided.Gs.GetNote(ctx, "p", "n"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := provided.Gs.UpdateNote(ctx, "p", "n", updated, mask); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	provided.Gs.(io.Closer).Close()
+
+	// The diff is computed from the note read under the cache.
+	if len(sink.records) != 1 || sink.records[0].Diff == nil {
+		t.Fatalf("got records %v, want the one of the update", sink.records)
+	}
+	var old map[string]string
+	if err := json.Unmarshal(sink.records[0].Diff.Old, &old); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if want := map[string]string{"shortDescription": "current"}; !reflect.DeepEqual(old, want) {
+		t.Errorf("got old %v, want %v", old, want)
+	}
+}
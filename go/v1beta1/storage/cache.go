@@ -0,0 +1,388 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/grafeas/grafeas/go/name"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// MetricCacheRequests is the counter of the reads served by CachedStorage.
+// It's labeled with "method" (e.g. GetNote) and "result" (hit or miss).
+const MetricCacheRequests = "grafeas_rds_cache_requests_total"
+
+const (
+	defaultCacheSize = 10000
+	defaultCacheTTL  = time.Minute
+
+	// cacheSubscribeRetryInterval is how long to wait before subscribing to the invalidations again after a failure.
+	cacheSubscribeRetryInterval = 5 * time.Second
+	// cachePublishTimeout is how long to wait for the CacheInvalidator to publish an invalidation.
+	cachePublishTimeout = 5 * time.Second
+)
+
+// CacheInvalidator broadcasts the invalidations of the cached resources among the replicas,
+// e.g. through PostgreSQL LISTEN/NOTIFY (see pgsql.CacheInvalidator).
+// The implementation must be safe for concurrent use.
+type CacheInvalidator interface {
+	// Publish notifies the replicas, including this one, that the resource identified by name has changed.
+	Publish(ctx context.Context, name string) error
+	// Subscribe invokes invalidate with every published name until ctx is done.
+	// It returns an error if it stops receiving the names for any other reason.
+	Subscribe(ctx context.Context, invalidate func(name string)) error
+}
+
+// CacheOption configures optional behaviors of CachedStorage.
+type CacheOption func(*CachedStorage)
+
+// WithCacheSize sets the maximum number of the cached resources. It's 10000 by default.
+func WithCacheSize(size int) CacheOption {
+	return func(c *CachedStorage) {
+		c.size = size
+	}
+}
+
+// WithCacheTTL sets how long a resource is cached. It's 1 minute by default.
+// A change made through another replica is served until the TTL expires, unless WithCacheInvalidator is given.
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(c *CachedStorage) {
+		c.ttl = ttl
+	}
+}
+
+// WithCacheInvalidator makes the CachedStorage publish its changes to, and receive the others' changes from, inv.
+func WithCacheInvalidator(inv CacheInvalidator) CacheOption {
+	return func(c *CachedStorage) {
+		c.invalidator = inv
+	}
+}
+
+// WithCacheMetrics makes the CachedStorage count the hits and the misses (see MetricCacheRequests) in m.
+func WithCacheMetrics(m Metrics) CacheOption {
+	return func(c *CachedStorage) {
+		c.metrics = m
+	}
+}
+
+// WithCacheLogger makes the CachedStorage log to logger instead of log.Default().
+func WithCacheLogger(logger *log.Logger) CacheOption {
+	return func(c *CachedStorage) {
+		c.logger = logger
+	}
+}
+
+// cacheEntry is a cached resource, keyed by the name of the project, the note or the occurrence.
+// The resource of an occurrence is its note.
+type cacheEntry struct {
+	key     string
+	value   proto.Message
+	expires time.Time
+}
+
+// CachedStorage is a Storage which caches the results of GetProject, GetNote and GetOccurrenceNote
+// in a bounded LRU cache with a TTL.
+// The cached resources are invalidated by the updates and the deletions made through the same CachedStorage,
+// or through any replica if a CacheInvalidator is given.
+// The errors, including codes.NotFound, are not cached.
+type CachedStorage struct {
+	Storage
+
+	size        int
+	ttl         time.Duration
+	invalidator CacheInvalidator
+	metrics     Metrics
+	logger      *log.Logger
+	now         func() time.Time
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	// occurrences indexes the keys of the cached occurrences by the names of their notes,
+	// so that they're invalidated along with the notes without scanning the cache.
+	occurrences map[string]map[string]struct{}
+	// generation is incremented by every invalidation,
+	// so that a resource read before an invalidation is not cached after it.
+	generation uint64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewCachedStorage returns a CachedStorage wrapping s, configured with opts.
+// If a CacheInvalidator is given, it's subscribed to until Close is invoked.
+func NewCachedStorage(s Storage, opts ...CacheOption) *CachedStorage {
+	c := &CachedStorage{
+		Storage: s,
+		size:    defaultCacheSize,
+		ttl:     defaultCacheTTL,
+		metrics: nopMetrics{},
+		logger:  log.Default(),
+		now:     time.Now,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+		done:    make(chan struct{}),
+
+		occurrences: make(map[string]map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	if c.invalidator == nil {
+		close(c.done)
+		return c
+	}
+	go c.subscribe(ctx)
+	return c
+}
+
+// subscribe receives the invalidations until ctx is done, retrying after a failure.
+func (c *CachedStorage) subscribe(ctx context.Context) {
+	defer close(c.done)
+	for {
+		err := c.invalidator.Subscribe(ctx, c.invalidate)
+		if ctx.Err() != nil {
+			return
+		}
+		// The changes may have been missed, so nothing cached so far can be trusted.
+		c.purge()
+		c.logger.Printf("failed to subscribe to the cache invalidations, retrying in %s, err: %v", cacheSubscribeRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cacheSubscribeRetryInterval):
+		}
+	}
+}
+
+// Close stops receiving the invalidations, and closes the wrapped Storage and the CacheInvalidator if they implement io.Closer.
+func (c *CachedStorage) Close() error {
+	c.cancel()
+	<-c.done
+	if closer, ok := c.invalidator.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			c.logger.Printf("failed to close the cache invalidator, err: %v", err)
+		}
+	}
+	if closer, ok := c.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// get returns a copy of the cached resource of key if any, and the current generation otherwise.
+func (c *CachedStorage) get(method, key string) (proto.Message, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*cacheEntry)
+		if c.now().Before(e.expires) {
+			c.lru.MoveToFront(elem)
+			c.metrics.AddCounter(MetricCacheRequests, map[string]string{"method": method, "result": "hit"}, 1)
+			return proto.Clone(e.value), 0
+		}
+		c.remove(elem)
+	}
+	c.metrics.AddCounter(MetricCacheRequests, map[string]string{"method": method, "result": "miss"}, 1)
+	return nil, c.generation
+}
+
+// put caches a copy of value for key, unless anything has been invalidated since generation.
+func (c *CachedStorage) put(key string, value proto.Message, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation || c.size <= 0 {
+		return
+	}
+	e := &cacheEntry{key: key, value: proto.Clone(value), expires: c.now().Add(c.ttl)}
+	if elem, ok := c.items[key]; ok {
+		c.unindex(elem.Value.(*cacheEntry))
+		elem.Value = e
+		c.index(e)
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.lru.PushFront(e)
+	c.index(e)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes elem from the cache. c.mu must be locked.
+func (c *CachedStorage) remove(elem *list.Element) {
+	e := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.items, e.key)
+	c.unindex(e)
+}
+
+// noteOf returns the name of the note cached as the resource of an occurrence by e, or an empty string otherwise.
+func noteOf(e *cacheEntry) string {
+	n, ok := e.value.(*gpb.Note)
+	if !ok || n.GetName() == e.key {
+		return ""
+	}
+	return n.GetName()
+}
+
+// index adds e to c.occurrences if it's an occurrence. c.mu must be locked.
+func (c *CachedStorage) index(e *cacheEntry) {
+	note := noteOf(e)
+	if note == "" {
+		return
+	}
+	keys, ok := c.occurrences[note]
+	if !ok {
+		keys = make(map[string]struct{})
+		c.occurrences[note] = keys
+	}
+	keys[e.key] = struct{}{}
+}
+
+// unindex removes e from c.occurrences. c.mu must be locked.
+func (c *CachedStorage) unindex(e *cacheEntry) {
+	note := noteOf(e)
+	keys, ok := c.occurrences[note]
+	if !ok {
+		return
+	}
+	delete(keys, e.key)
+	if len(keys) == 0 {
+		delete(c.occurrences, note)
+	}
+}
+
+// invalidate removes the resource identified by name from the cache,
+// along with the notes of the occurrences if it's a note.
+func (c *CachedStorage) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if elem, ok := c.items[name]; ok {
+		c.remove(elem)
+	}
+	for key := range c.occurrences[name] {
+		c.remove(c.items[key])
+	}
+}
+
+// purge removes all the resources from the cache.
+func (c *CachedStorage) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.occurrences = make(map[string]map[string]struct{})
+}
+
+// changed invalidates the resource identified by name after it's updated or deleted.
+// The change is published to the other replicas if a CacheInvalidator is given.
+// It's invoked even if the change failed, since it may have been made anyway, e.g. on a timeout.
+func (c *CachedStorage) changed(name string) {
+	c.invalidate(name)
+	if c.invalidator == nil {
+		return
+	}
+	// The change is published even if the call has been canceled, since the other replicas would serve the stale resource otherwise.
+	ctx, cancel := context.WithTimeout(context.Background(), cachePublishTimeout)
+	defer cancel()
+	if err := c.invalidator.Publish(ctx, name); err != nil {
+		c.logger.Printf("failed to publish the cache invalidation of %s, err: %v", name, err)
+	}
+}
+
+// GetProject gets the specified project from the cache or the wrapped Storage.
+func (c *CachedStorage) GetProject(ctx context.Context, pID string) (*prpb.Project, error) {
+	key := name.FormatProject(pID)
+	cached, generation := c.get("GetProject", key)
+	if cached != nil {
+		return cached.(*prpb.Project), nil
+	}
+	p, err := c.Storage.GetProject(ctx, pID)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, p, generation)
+	return p, nil
+}
+
+// DeleteProject deletes the specified project, and invalidates it.
+func (c *CachedStorage) DeleteProject(ctx context.Context, pID string) error {
+	err := c.Storage.DeleteProject(ctx, pID)
+	c.changed(name.FormatProject(pID))
+	return err
+}
+
+// GetNote gets the specified note from the cache or the wrapped Storage.
+func (c *CachedStorage) GetNote(ctx context.Context, pID, nID string) (*gpb.Note, error) {
+	key := name.FormatNote(pID, nID)
+	cached, generation := c.get("GetNote", key)
+	if cached != nil {
+		return cached.(*gpb.Note), nil
+	}
+	n, err := c.Storage.GetNote(ctx, pID, nID)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, n, generation)
+	return n, nil
+}
+
+// UpdateNote updates the specified note, and invalidates it.
+func (c *CachedStorage) UpdateNote(ctx context.Context, pID, nID string, n *gpb.Note, mask *fieldmaskpb.FieldMask) (*gpb.Note, error) {
+	updated, err := c.Storage.UpdateNote(ctx, pID, nID, n, mask)
+	c.changed(name.FormatNote(pID, nID))
+	return updated, err
+}
+
+// DeleteNote deletes the specified note, and invalidates it.
+func (c *CachedStorage) DeleteNote(ctx context.Context, pID, nID string) error {
+	err := c.Storage.DeleteNote(ctx, pID, nID)
+	c.changed(name.FormatNote(pID, nID))
+	return err
+}
+
+// GetOccurrenceNote gets the note of the specified occurrence from the cache or the wrapped Storage.
+func (c *CachedStorage) GetOccurrenceNote(ctx context.Context, pID, oID string) (*gpb.Note, error) {
+	key := name.FormatOccurrence(pID, oID)
+	cached, generation := c.get("GetOccurrenceNote", key)
+	if cached != nil {
+		return cached.(*gpb.Note), nil
+	}
+	n, err := c.Storage.GetOccurrenceNote(ctx, pID, oID)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, n, generation)
+	return n, nil
+}
+
+// UpdateOccurrence updates the specified occurrence, and invalidates its note.
+func (c *CachedStorage) UpdateOccurrence(ctx context.Context, pID, oID string, o *gpb.Occurrence, mask *fieldmaskpb.FieldMask) (*gpb.Occurrence, error) {
+	updated, err := c.Storage.UpdateOccurrence(ctx, pID, oID, o, mask)
+	c.changed(name.FormatOccurrence(pID, oID))
+	return updated, err
+}
+
+// DeleteOccurrence deletes the specified occurrence, and invalidates its note.
+func (c *CachedStorage) DeleteOccurrence(ctx context.Context, pID, oID string) error {
+	err := c.Storage.DeleteOccurrence(ctx, pID, oID)
+	c.changed(name.FormatOccurrence(pID, oID))
+	return err
+}
+
+var _ Storage = (*CachedStorage)(nil)
@@ -0,0 +1,376 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"io"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafeas/grafeas/go/config"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+// fakeInvalidator is an in-process CacheInvalidator shared by CachedStorages.
+type fakeInvalidator struct {
+	mu          sync.Mutex
+	subscribers []func(name string)
+	subscribed  chan struct{}
+}
+
+func newFakeInvalidator() *fakeInvalidator {
+	return &fakeInvalidator{subscribed: make(chan struct{}, 10)}
+}
+
+func (i *fakeInvalidator) Publish(ctx context.Context, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, invalidate := range i.subscribers {
+		invalidate(name)
+	}
+	return nil
+}
+
+func (i *fakeInvalidator) Subscribe(ctx context.Context, invalidate func(name string)) error {
+	i.mu.Lock()
+	i.subscribers = append(i.subscribers, invalidate)
+	i.mu.Unlock()
+	i.subscribed <- struct{}{}
+	<-ctx.Done()
+	return nil
+}
+
+func newTestCachedStorage(t *testing.T, s Storage, opts ...CacheOption) *CachedStorage {
+	t.Helper()
+	c := NewCachedStorage(s, append([]CacheOption{WithCacheLogger(log.New(io.Discard, "", 0))}, opts...)...)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCachedStorageGet(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	metrics := newFakeMetrics()
+	c := newTestCachedStorage(t, store, WithCacheMetrics(metrics))
+
+	note := &gpb.Note{Name: "projects/p/notes/n", ShortDescription: "short"}
+	store.EXPECT().GetNote(ctx, "p", "n").Times(1).Return(note, nil)
+	for i := 0; i < 3; i++ {
+		got, err := c.GetNote(ctx, "p", "n")
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if got.GetShortDescription() != "short" {
+			t.Fatalf("got %v, want %v", got, note)
+		}
+		// The cached note is not affected by the changes of the returned one.
+		got.ShortDescription = "changed"
+	}
+	if got := metrics.counter(MetricCacheRequests, map[string]string{"method": "GetNote", "result": "hit"}); got != 2 {
+		t.Errorf("got %v hits, want 2", got)
+	}
+	if got := metrics.counter(MetricCacheRequests, map[string]string{"method": "GetNote", "result": "miss"}); got != 1 {
+		t.Errorf("got %v misses, want 1", got)
+	}
+
+	project := &prpb.Project{Name: "projects/p"}
+	store.EXPECT().GetProject(ctx, "p").Times(1).Return(project, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetProject(ctx, "p"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	store.EXPECT().GetOccurrenceNote(ctx, "p", "o").Times(1).Return(note, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetOccurrenceNote(ctx, "p", "o"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	// The errors are not cached.
+	notFound := status.Error(codes.NotFound, "not found")
+	store.EXPECT().GetNote(ctx, "p", "missing").Times(2).Return(nil, notFound)
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetNote(ctx, "p", "missing"); status.Code(err) != codes.NotFound {
+			t.Fatalf("got err %v, want NotFound", err)
+		}
+	}
+}
+
+func TestCachedStorageExpiration(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	c := newTestCachedStorage(t, store, WithCacheSize(2), WithCacheTTL(time.Minute))
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for _, nID := range []string{"n1", "n2", "n3"} {
+		store.EXPECT().GetNote(ctx, "p", nID).Times(1).Return(&gpb.Note{Name: "projects/p/notes/" + nID}, nil)
+		if _, err := c.GetNote(ctx, "p", nID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	// n1 is evicted as the least recently used one.
+	store.EXPECT().GetNote(ctx, "p", "n1").Times(1).Return(&gpb.Note{Name: "projects/p/notes/n1"}, nil)
+	for _, nID := range []string{"n3", "n1"} {
+		if _, err := c.GetNote(ctx, "p", nID); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	// Every note expires after the TTL.
+	now = now.Add(time.Minute)
+	store.EXPECT().GetNote(ctx, "p", "n3").Times(1).Return(&gpb.Note{Name: "projects/p/notes/n3"}, nil)
+	if _, err := c.GetNote(ctx, "p", "n3"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestCachedStorageInvalidation(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	note := &gpb.Note{Name: "projects/p/notes/n"}
+	tests := []struct {
+		name   string
+		change func(c *CachedStorage, store *mocks.MockStorage)
+		// wantGetNote and wantGetOccurrenceNote report whether the note is read from the storage again.
+		wantGetNote           bool
+		wantGetOccurrenceNote bool
+	}{
+		{
+			name: "UpdateNote",
+			change: func(c *CachedStorage, store *mocks.MockStorage) {
+				store.EXPECT().UpdateNote(ctx, "p", "n", gomock.Any(), gomock.Any()).Return(note, nil)
+				c.UpdateNote(ctx, "p", "n", note, nil)
+			},
+			wantGetNote:           true,
+			wantGetOccurrenceNote: true,
+		},
+		{
+			name: "DeleteNote",
+			change: func(c *CachedStorage, store *mocks.MockStorage) {
+				store.EXPECT().DeleteNote(ctx, "p", "n").Return(nil)
+				c.DeleteNote(ctx, "p", "n")
+			},
+			wantGetNote:           true,
+			wantGetOccurrenceNote: true,
+		},
+		{
+			name: "UpdateOccurrence",
+			change: func(c *CachedStorage, store *mocks.MockStorage) {
+				store.EXPECT().UpdateOccurrence(ctx, "p", "o", gomock.Any(), gomock.Any()).Return(&gpb.Occurrence{}, nil)
+				c.UpdateOccurrence(ctx, "p", "o", &gpb.Occurrence{}, nil)
+			},
+			wantGetOccurrenceNote: true,
+		},
+		{
+			name: "DeleteOccurrence",
+			change: func(c *CachedStorage, store *mocks.MockStorage) {
+				store.EXPECT().DeleteOccurrence(ctx, "p", "o").Return(nil)
+				c.DeleteOccurrence(ctx, "p", "o")
+			},
+			wantGetOccurrenceNote: true,
+		},
+		{
+			name: "failed change",
+			change: func(c *CachedStorage, store *mocks.MockStorage) {
+				store.EXPECT().DeleteNote(ctx, "p", "n").Return(status.Error(codes.Unavailable, "timeout"))
+				c.DeleteNote(ctx, "p", "n")
+			},
+			wantGetNote:           true,
+			wantGetOccurrenceNote: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			store := mocks.NewMockStorage(mockCtrl)
+			c := newTestCachedStorage(t, store)
+			times := func(reread bool) int {
+				if reread {
+					return 2
+				}
+				return 1
+			}
+			store.EXPECT().GetNote(ctx, "p", "n").Times(times(tt.wantGetNote)).Return(note, nil)
+			store.EXPECT().GetOccurrenceNote(ctx, "p", "o").Times(times(tt.wantGetOccurrenceNote)).Return(note, nil)
+
+			c.GetNote(ctx, "p", "n")
+			c.GetOccurrenceNote(ctx, "p", "o")
+			tt.change(c, store)
+			c.GetNote(ctx, "p", "n")
+			c.GetOccurrenceNote(ctx, "p", "o")
+		})
+	}
+}
+
+func TestCachedStorageInvalidator(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	invalidator := newFakeInvalidator()
+	store1 := mocks.NewMockStorage(mockCtrl)
+	store2 := mocks.NewMockStorage(mockCtrl)
+	c1 := newTestCachedStorage(t, store1, WithCacheInvalidator(invalidator))
+	c2 := newTestCachedStorage(t, store2, WithCacheInvalidator(invalidator))
+	<-invalidator.subscribed
+	<-invalidator.subscribed
+
+	project := &prpb.Project{Name: "projects/p"}
+	store2.EXPECT().GetProject(ctx, "p").Times(2).Return(project, nil)
+	if _, err := c2.GetProject(ctx, "p"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// The deletion through c1 invalidates the project cached by c2, even if the call has been canceled.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	store1.EXPECT().DeleteProject(canceledCtx, "p").Return(nil)
+	if err := c1.DeleteProject(canceledCtx, "p"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := c2.GetProject(ctx, "p"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestCachedStorageOccurrenceIndex(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	c := newTestCachedStorage(t, store, WithCacheSize(2))
+	n1 := &gpb.Note{Name: "projects/p/notes/n1"}
+	n2 := &gpb.Note{Name: "projects/p/notes/n2"}
+	indexed := func() map[string]map[string]struct{} {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		indexed := make(map[string]map[string]struct{})
+		for note, keys := range c.occurrences {
+			indexed[note] = make(map[string]struct{})
+			for key := range keys {
+				indexed[note][key] = struct{}{}
+			}
+		}
+		return indexed
+	}
+	o1 := "projects/p/occurrences/o1"
+	o2 := "projects/p/occurrences/o2"
+
+	store.EXPECT().GetOccurrenceNote(ctx, "p", "o1").Return(n1, nil)
+	store.EXPECT().GetOccurrenceNote(ctx, "p", "o2").Return(n1, nil)
+	c.GetOccurrenceNote(ctx, "p", "o1")
+	c.GetOccurrenceNote(ctx, "p", "o2")
+	want := map[string]map[string]struct{}{n1.Name: {o1: {}, o2: {}}}
+	if got := indexed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The occurrence re-cached with another note is indexed by the new one.
+	c.invalidate(o1)
+	store.EXPECT().GetOccurrenceNote(ctx, "p", "o1").Return(n2, nil)
+	c.GetOccurrenceNote(ctx, "p", "o1")
+	want = map[string]map[string]struct{}{n1.Name: {o2: {}}, n2.Name: {o1: {}}}
+	if got := indexed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The evicted occurrence is removed from the index.
+	store.EXPECT().GetNote(ctx, "p", "n1").Return(n1, nil)
+	c.GetNote(ctx, "p", "n1")
+	want = map[string]map[string]struct{}{n2.Name: {o1: {}}}
+	if got := indexed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The invalidation of the note removes its occurrences.
+	c.invalidate(n2.Name)
+	if got := indexed(); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+}
+
+func TestCachedStorageClose(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	store := newClosableStorage(mockCtrl, nil)
+	invalidator := newFakeInvalidator()
+	c := NewCachedStorage(store, WithCacheInvalidator(invalidator))
+	<-invalidator.subscribed
+	if err := c.Close(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !store.isClosed() {
+		t.Error("the wrapped storage is not closed")
+	}
+}
+
+func TestStorageProviderWithCache(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	conf := config.StorageConfiguration(rdsconfig.Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLRootCert: "testdata/ca.pem",
+	})
+	store := mocks.NewMockStorage(mockCtrl)
+	store.EXPECT().SetMaxOpenConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetMaxIdleConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxLifetime(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxIdleTime(gomock.Any()).AnyTimes()
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Times(1).Return(store, nil)
+	invalidator := newFakeInvalidator()
+	var invalidatorConnector driver.Connector
+
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator,
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithCache(WithCacheSize(1)),
+		WithCacheInvalidation(func(writerConnector driver.Connector) CacheInvalidator {
+			invalidatorConnector = writerConnector
+			return invalidator
+		}))
+	provided, err := provider.Provide("", &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	c, ok := provided.Gs.(*CachedStorage)
+	if !ok {
+		t.Fatalf("got %T, want *CachedStorage", provided.Gs)
+	}
+	t.Cleanup(func() { c.Close() })
+	if c.size != 1 || c.invalidator != invalidator || invalidatorConnector == nil {
+		t.Errorf("the cache is not configured by the options: size %d, invalidator %v, connector %v", c.size, c.invalidator, invalidatorConnector)
+	}
+}
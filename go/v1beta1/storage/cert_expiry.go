@@ -0,0 +1,112 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MetricCertExpiryDays is the gauge of the days until the earliest unexpired certificate in a file expires.
+// It's labeled with "kind" (root or client) and "file", and it becomes negative once every certificate has expired.
+const MetricCertExpiryDays = "grafeas_rds_cert_expiry_days"
+
+// certExpiryCheckInterval is how often the certificates are checked after startup.
+const certExpiryCheckInterval = time.Hour
+
+const errMsgCheckCertExpiry = "failed to check the expiration of the certificate"
+
+// certExpiry is the certificate in a file which expires first.
+type certExpiry struct {
+	subject  string
+	notAfter time.Time
+}
+
+// readCertExpiry returns the certificate in the PEM file at path which expires first after now.
+// The expired certificates are skipped as validateCertificates does, e.g. the retired CAs kept in a bundle,
+// unless every certificate has expired, in which case the one which expired last is returned.
+func readCertExpiry(path string, now time.Time) (certExpiry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return certExpiry{}, err
+	}
+	var earliest, latestExpired certExpiry
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return certExpiry{}, err
+		}
+		expiry := certExpiry{subject: cert.Subject.String(), notAfter: cert.NotAfter}
+		if now.After(cert.NotAfter) {
+			if cert.NotAfter.After(latestExpired.notAfter) {
+				latestExpired = expiry
+			}
+			continue
+		}
+		if earliest.notAfter.IsZero() || cert.NotAfter.Before(earliest.notAfter) {
+			earliest = expiry
+		}
+	}
+	if !earliest.notAfter.IsZero() {
+		return earliest, nil
+	}
+	if !latestExpired.notAfter.IsZero() {
+		return latestExpired, nil
+	}
+	return certExpiry{}, errors.New("no PEM certificate is found")
+}
+
+// certFiles returns the paths of the certificates used by c keyed by their kind.
+func (c *connector) certFiles() map[string]string {
+	files := make(map[string]string)
+	if c.sslRootCert != "" {
+		files["root"] = c.sslRootCert
+	}
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+	if c.clientCert != nil {
+		files["client"] = c.clientCert.certFile
+	}
+	return files
+}
+
+// checkCertExpiry reports the days until each certificate file of c expires,
+// and warns if it expires within threshold.
+func (c *connector) checkCertExpiry(now time.Time, threshold time.Duration, metrics Metrics) {
+	for kind, path := range c.certFiles() {
+		expiry, err := readCertExpiry(path, now)
+		if err != nil {
+			c.logger.Printf("%s %s, err: %v", errMsgCheckCertExpiry, path, err)
+			continue
+		}
+		remaining := expiry.notAfter.Sub(now)
+		metrics.SetGauge(MetricCertExpiryDays, map[string]string{"kind": kind, "file": path}, remaining.Hours()/24)
+		if remaining < threshold {
+			c.logger.Printf("WARNING: the %s certificate %q in %s expires at %s, in %.1f days",
+				kind, expiry.subject, path, expiry.notAfter.Format(time.RFC3339), remaining.Hours()/24)
+		}
+	}
+}
+
+// monitorCertExpiry checks the certificates immediately,
+// and then keeps checking them on the given interval in the background until ctx is done.
+func (c *connector) monitorCertExpiry(ctx context.Context, interval, threshold time.Duration, metrics Metrics) {
+	c.checkCertExpiry(time.Now(), threshold, metrics)
+	go runPeriodically(ctx, interval, func() {
+		c.checkCertExpiry(time.Now(), threshold, metrics)
+	})
+}
@@ -0,0 +1,190 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMetrics records the measurements.
+type fakeMetrics struct {
+	mu         sync.Mutex
+	gauges     map[string]float64
+	counters   map[string]float64
+	histograms map[string][]float64
+}
+
+func newFakeMetrics() *fakeMetrics {
+	return &fakeMetrics{
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]float64),
+		histograms: make(map[string][]float64),
+	}
+}
+
+func (m *fakeMetrics) SetGauge(name string, labels map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[metricKey(name, labels)] = value
+}
+
+func (m *fakeMetrics) AddCounter(name string, labels map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[metricKey(name, labels)] += value
+}
+
+func (m *fakeMetrics) counter(name string, labels map[string]string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[metricKey(name, labels)]
+}
+
+func (m *fakeMetrics) ObserveHistogram(name string, labels map[string]string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey(name, labels)
+	m.histograms[key] = append(m.histograms[key], value)
+}
+
+func (m *fakeMetrics) histogram(name string, labels map[string]string) []float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.histograms[metricKey(name, labels)]
+}
+
+func (m *fakeMetrics) gauge(name string, labels map[string]string) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.gauges[metricKey(name, labels)]
+	return v, ok
+}
+
+func metricKey(name string, labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+func TestReadCertExpiry(t *testing.T) {
+	t.Parallel()
+
+	valid, err := os.ReadFile("testdata/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := os.ReadFile("testdata/expired_ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mixedPath := filepath.Join(t.TempDir(), "mixed_ca.pem")
+	if err := os.WriteFile(mixedPath, append(append([]byte{}, expired...), valid...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		path string
+		want time.Time
+	}{
+		{
+			name: "valid",
+			path: "testdata/ca.pem",
+			want: time.Date(2121, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "the expired cert is skipped while another is valid",
+			path: mixedPath,
+			want: time.Date(2121, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "every cert has expired",
+			path: "testdata/expired_ca.pem",
+			want: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := readCertExpiry(tt.path, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.notAfter.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got.notAfter, tt.want)
+			}
+		})
+	}
+	if _, err := readCertExpiry("testdata/not_a_cert.pem", now); err == nil {
+		t.Error("got nil error, but want an error because there is no certificate")
+	}
+}
+
+func TestConnectorCheckCertExpiry(t *testing.T) {
+	t.Parallel()
+
+	clientCert, err := loadClientCert("testdata/client.crt", "testdata/client.key", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2120, 12, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		threshold   time.Duration
+		wantWarning bool
+	}{
+		{
+			name:      "far from the expiration",
+			threshold: 7 * 24 * time.Hour,
+		},
+		{
+			name:        "within the threshold",
+			threshold:   60 * 24 * time.Hour,
+			wantWarning: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			c := &connector{sslRootCert: "testdata/ca.pem", clientCert: clientCert, logger: log.New(&buf, "", 0)}
+			metrics := newFakeMetrics()
+			c.checkCertExpiry(now, tt.threshold, metrics)
+
+			for _, labels := range []map[string]string{
+				{"kind": "root", "file": "testdata/ca.pem"},
+				{"kind": "client", "file": "testdata/client.crt"},
+			} {
+				days, ok := metrics.gauge(MetricCertExpiryDays, labels)
+				if !ok {
+					t.Errorf("no gauge for %v", labels)
+					continue
+				}
+				if days != 31 {
+					t.Errorf("got %v days for %v, want 31", days, labels)
+				}
+			}
+			if warned := strings.Contains(buf.String(), "WARNING"); warned != tt.wantWarning {
+				t.Errorf("got logs %q, but want a warning: %v", buf.String(), tt.wantWarning)
+			}
+		})
+	}
+}
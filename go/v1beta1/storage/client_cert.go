@@ -0,0 +1,168 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// clientCertPollInterval is how often the client certificate and key are checked for rotation.
+const clientCertPollInterval = time.Minute
+
+const (
+	errMsgLoadClientCert   = "failed to load the client certificate"
+	errMsgReloadClientCert = "failed to reload the client certificate"
+	errMsgDecryptSSLKey    = "failed to decrypt the client key"
+	errMsgWriteSSLKey      = "failed to write the decrypted client key"
+)
+
+// clientCert is the certificate and the key which the connector presents to the server.
+type clientCert struct {
+	certFile    string
+	keyFile     string
+	keyPassword string
+	// decryptedKey is the decrypted keyFile if it's encrypted, and nil otherwise.
+	// It's kept in memory and only written to a file while a connection is being opened (see openWithKey),
+	// because lib/pq can neither decrypt the key nor read it from anything but a file.
+	decryptedKey []byte
+	// keyPair is presented by go-sql-driver/mysql, which takes a tls.Certificate rather than the files.
+	keyPair tls.Certificate
+
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// loadClientCert reads the certificate and the key, and verifies that they match.
+func loadClientCert(certFile, keyFile, keyPassword string) (*clientCert, error) {
+	cc := &clientCert{certFile: certFile, keyFile: keyFile, keyPassword: keyPassword}
+	var err error
+	if cc.certModTime, err = modTime(certFile); err != nil {
+		return nil, err
+	}
+	if cc.keyModTime, err = modTime(keyFile); err != nil {
+		return nil, err
+	}
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := false
+	if keyPassword != "" {
+		if keyPEM, decrypted, err = decryptKey(keyPEM, keyPassword); err != nil {
+			return nil, fmt.Errorf("%s, err: %v", errMsgDecryptSSLKey, err)
+		}
+	}
+	if cc.keyPair, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	if decrypted {
+		cc.decryptedKey = keyPEM
+	}
+	return cc, nil
+}
+
+// changed returns true if the certificate or the key has been modified since they were loaded.
+func (cc *clientCert) changed() (bool, error) {
+	certModTime, err := modTime(cc.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyModTime, err := modTime(cc.keyFile)
+	if err != nil {
+		return false, err
+	}
+	return !certModTime.Equal(cc.certModTime) || !keyModTime.Equal(cc.keyModTime), nil
+}
+
+func modTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// decryptKey returns the decrypted key and true if keyPEM is encrypted,
+// or keyPEM itself and false otherwise.
+func decryptKey(keyPEM []byte, password string) ([]byte, bool, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, false, errors.New("no PEM block is found")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" {
+		return nil, false, errors.New("encrypted PKCS#8 keys are not supported")
+	}
+	//nolint:staticcheck // Legacy PEM encryption is the only one supported by the standard library.
+	if !x509.IsEncryptedPEMBlock(block) {
+		return keyPEM, false, nil
+	}
+	//nolint:staticcheck // See above.
+	der, err := x509.DecryptPEMBlock(block, []byte(password))
+	if err != nil {
+		return nil, false, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}), true, nil
+}
+
+// openWithKey opens a connection to dsn with drv.
+// If key is not nil, it's written to a temporary file in a directory which only the owner can access,
+// and the file is passed to lib/pq as sslkey and removed as soon as the connection is opened,
+// since lib/pq reads the key only during the handshake.
+func openWithKey(drv driver.Driver, dsn string, key []byte) (driver.Conn, error) {
+	if key == nil {
+		return drv.Open(dsn)
+	}
+	dir, err := os.MkdirTemp("", "grafeas-rds-key-")
+	if err != nil {
+		return nil, fmt.Errorf("%s, err: %v", errMsgWriteSSLKey, err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "client.key")
+	// lib/pq rejects a key file which the others can read.
+	if err := os.WriteFile(path, key, 0o600); err != nil {
+		return nil, fmt.Errorf("%s, err: %v", errMsgWriteSSLKey, err)
+	}
+	return drv.Open(fmt.Sprintf("%s sslkey=%s", dsn, quoteDSNValue(path)))
+}
+
+// reloadClientCert loads the client certificate again if the files have been rotated,
+// and uses it for the new connections.
+func (c *connector) reloadClientCert() error {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+	changed, err := c.clientCert.changed()
+	if err != nil || !changed {
+		return err
+	}
+	cert, err := loadClientCert(c.clientCert.certFile, c.clientCert.keyFile, c.clientCert.keyPassword)
+	if err != nil {
+		return err
+	}
+	c.clientCert = cert
+	c.updateDSN()
+	return nil
+}
+
+func (c *connector) reloadClientCertPeriodically(ctx context.Context, interval time.Duration, logger *log.Logger) {
+	runPeriodically(ctx, interval, func() {
+		if err := c.reloadClientCert(); err != nil {
+			logger.Printf("%s, err: %v", errMsgReloadClientCert, err)
+		}
+	})
+}
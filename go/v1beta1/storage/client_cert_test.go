@@ -0,0 +1,221 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+const testSSLKeyPassword = "dummy-password-for-unit-tests-only"
+
+func TestLoadClientCert(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		certFile      string
+		keyFile       string
+		keyPassword   string
+		wantDecrypted bool
+		wantErrMsg    string
+	}{
+		{
+			name:     "plain key",
+			certFile: "testdata/client.crt",
+			keyFile:  "testdata/client.key",
+		},
+		{
+			name:          "encrypted key",
+			certFile:      "testdata/client.crt",
+			keyFile:       "testdata/client_encrypted.key",
+			keyPassword:   testSSLKeyPassword,
+			wantDecrypted: true,
+		},
+		{
+			name:        "password for a plain key",
+			certFile:    "testdata/client.crt",
+			keyFile:     "testdata/client.key",
+			keyPassword: testSSLKeyPassword,
+		},
+		{
+			name:        "wrong password",
+			certFile:    "testdata/client.crt",
+			keyFile:     "testdata/client_encrypted.key",
+			keyPassword: "wrong-password",
+			wantErrMsg:  errMsgDecryptSSLKey,
+		},
+		{
+			name:       "encrypted key without password",
+			certFile:   "testdata/client.crt",
+			keyFile:    "testdata/client_encrypted.key",
+			wantErrMsg: "private key",
+		},
+		{
+			name:       "mismatched key",
+			certFile:   "testdata/client.crt",
+			keyFile:    "testdata/other_client.key",
+			wantErrMsg: "private key does not match public key",
+		},
+		{
+			name:       "missing cert",
+			certFile:   "testdata/missing.crt",
+			keyFile:    "testdata/client.key",
+			wantErrMsg: "no such file or directory",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cc, err := loadClientCert(tt.certFile, tt.keyFile, tt.keyPassword)
+			if (err != nil) != (tt.wantErrMsg != "") {
+				if err != nil {
+					t.Errorf("don't want error, but got %q", err)
+				} else {
+					t.Errorf("got nil error, but want error to include %q", tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("want %q to include %q", err.Error(), tt.wantErrMsg)
+				}
+				return
+			}
+			if decrypted := cc.decryptedKey != nil; decrypted != tt.wantDecrypted {
+				t.Errorf("got decrypted key %v, want %v", decrypted, tt.wantDecrypted)
+			}
+		})
+	}
+}
+
+func TestConnectorReloadClientCert(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	copyFile(t, "testdata/client.crt", certFile)
+	copyFile(t, "testdata/client_encrypted.key", keyFile)
+
+	cc, err := loadClientCert(certFile, keyFile, testSSLKeyPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &connector{clientCert: cc}
+	c.updateDSN()
+
+	// Nothing happens if the files are not rotated.
+	if err := c.reloadClientCert(); err != nil {
+		t.Fatal(err)
+	}
+	if c.clientCert != cc {
+		t.Error("the client certificate should not be reloaded if the files are not rotated")
+	}
+
+	// The files are reloaded, and the decrypted key is passed along with the DSN instead of being written to a file.
+	touch(t, certFile, keyFile)
+	if err := c.reloadClientCert(); err != nil {
+		t.Fatal(err)
+	}
+	if c.clientCert == cc {
+		t.Fatal("the client certificate should be reloaded after the files are rotated")
+	}
+	dsn, key := c.readDSNWithKey()
+	if !strings.Contains(dsn, "sslcert="+certFile) || strings.Contains(dsn, "sslkey=") {
+		t.Errorf("got %q, but want it to include the certificate and not the key", dsn)
+	}
+	if !bytes.Equal(key, c.clientCert.decryptedKey) {
+		t.Error("the decrypted key should be passed along with the DSN")
+	}
+
+	// A rotation which leaves a mismatched pair keeps the current one.
+	current := c.clientCert
+	copyFile(t, "testdata/other_client.crt", certFile)
+	touch(t, certFile)
+	if err := c.reloadClientCert(); err == nil {
+		t.Error("got nil error, but want an error because the key does not match the certificate")
+	}
+	if c.clientCert != current {
+		t.Error("the current client certificate should be kept if the rotated one is invalid")
+	}
+}
+
+func TestOpenWithKey(t *testing.T) {
+	t.Parallel()
+
+	mockDriver := mocks.NewMockDriver(gomock.NewController(t))
+	key := []byte("dummy-key-for-unit-tests-only")
+	var keyPath string
+	mockDriver.EXPECT().Open(gomock.Any()).Times(1).DoAndReturn(func(dsn string) (driver.Conn, error) {
+		i := strings.Index(dsn, " sslkey=")
+		if i < 0 {
+			t.Fatalf("got %q, want it to include sslkey", dsn)
+		}
+		keyPath = dsn[i+len(" sslkey="):]
+		// The key is only readable by the owner while the connection is opened.
+		info, err := os.Stat(keyPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Errorf("got permission %v of the key, want 0600", perm)
+		}
+		dirInfo, err := os.Stat(filepath.Dir(keyPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := dirInfo.Mode().Perm(); perm != 0o700 {
+			t.Errorf("got permission %v of the directory, want 0700", perm)
+		}
+		if b, err := os.ReadFile(keyPath); err != nil || !bytes.Equal(b, key) {
+			t.Errorf("got %q and err %v, want the key", b, err)
+		}
+		return &fakeConn{}, nil
+	})
+	if _, err := openWithKey(mockDriver, "host=localhost sslcert=client.crt", key); err != nil {
+		t.Fatal(err)
+	}
+	// The key is removed as soon as the connection is opened.
+	if _, err := os.Stat(filepath.Dir(keyPath)); !os.IsNotExist(err) {
+		t.Errorf("the decrypted key should be removed, but got %v", err)
+	}
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	b, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// touch moves the modification time of the files forward, as if they had been rotated.
+func touch(t *testing.T, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := info.ModTime().Add(time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
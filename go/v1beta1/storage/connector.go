@@ -4,14 +4,16 @@
 package storage
 
 import (
+	"crypto/tls"
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
 	"golang.org/x/net/context"
 
 	"github.com/theparanoids/grafeas-rds/go/config"
@@ -21,17 +23,27 @@ const (
 	// A temporary DB password requested via IAM auth is only valid for 15 minutes.
 	// Ref: https://docs.aws.amazon.com/AmazonRDS/latest/UserGuide/UsingWithRDS.IAMDBAuth.Connecting.html
 	refreshAuthTokenInterval = 10 * time.Minute
+	authTokenLifetime        = 15 * time.Minute
+	// minForcedRefreshInterval limits how often the credentials are refreshed because the DB rejects them,
+	// so that a misconfigured user does not flood the API behind the password source.
+	minForcedRefreshInterval = 10 * time.Second
 
-	errMsgCreateCredentials = "failed to create AWS credentials"
-	errMsgRefreshAuthToken  = "failed to refresh auth token"
-	errMsgSetupIAMAuth      = "failed to set up IAM auth"
+	errMsgCreateCredentials   = "failed to create AWS credentials"
+	errMsgRefreshAuthToken    = "failed to refresh auth token"
+	errMsgRefreshSecret       = "failed to refresh the secret"
+	errMsgSetupIAMAuth        = "failed to set up IAM auth"
+	errMsgSetupSecretsManager = "failed to set up AWS Secrets Manager"
+	errMsgInitStatement       = "failed to run the init statement"
 
-	logsOptInIAMAuth = "Opt in IAM Authentication..."
+	logsOptInIAMAuth        = "Opt in IAM Authentication..."
+	logsOptInSecretsManager = "Opt in AWS Secrets Manager..."
 )
 
 // connector implements driver.Connector
 // Reference implementation: sql.dsnConnector.
+// It assembles libpq DSNs, or go-sql-driver/mysql ones if the engine is MySQL.
 type connector struct {
+	engine      string
 	host        string
 	port        int
 	dbName      string
@@ -39,90 +51,378 @@ type connector struct {
 	password    string
 	sslMode     string
 	sslRootCert string
+	// applicationName is omitted from the DSN if it's empty.
+	applicationName string
+	// connectTimeout and statementTimeout are omitted from the DSN if they are zero.
+	connectTimeout   time.Duration
+	statementTimeout time.Duration
+	// clientCert is nil if no client certificate is configured.
+	// It's guarded by refreshLock because it's reloaded when the files are rotated.
+	clientCert *clientCert
+	// initStatements are run on every new connection, e.g. SET lock_timeout = '5s'.
+	initStatements []string
+	// tokenHost is the host which the IAM auth tokens are generated for,
+	// which is the endpoint of RDS Proxy if host is an alias of it, or empty to use host.
+	tokenHost string
+	// allowCleartextPasswords is true if the password is an IAM auth token,
+	// which MySQL only accepts via the cleartext plugin.
+	allowCleartextPasswords bool
+	// mysqlTLSConfig is the name of the TLS config registered to go-sql-driver/mysql,
+	// or empty if the engine is not MySQL or the connection is not encrypted.
+	mysqlTLSConfig string
+	closeOnce      sync.Once
+	// hostFromSecret is true if the host and the port should be taken from the secret,
+	// which only happens when the host is not configured.
+	hostFromSecret bool
 
 	driver driver.Driver
+	logger *log.Logger
+	// source is nil if the password is static.
+	source passwordSource
+	// refreshLock serializes the refreshes of the credentials,
+	// which happen periodically and when the DB rejects the current ones.
+	refreshLock sync.Mutex
+	// lastForcedRefresh is guarded by refreshLock.
+	lastForcedRefresh time.Time
+
 	// dsn refers to data source name.
 	// Only this variable should be accessed concurrently.
 	dsn string
+	// dsnKey is the decrypted client key which is passed along with dsn, or nil if there is none.
+	dsnKey []byte
+	// tlsCert is the client certificate presented by go-sql-driver/mysql, or nil if there is none.
+	tlsCert *tls.Certificate
 	// reader: when a new connection to DB is needed.
 	// writer: when the AWS auth token is refreshed.
 	dsnLock sync.RWMutex
+	// credentialsExpiration is the time after which the current credentials are no longer valid.
+	// It is guarded by dsnLock and stays zero if the credentials do not expire, e.g. a static password.
+	credentialsExpiration time.Time
 }
 
-func newConnector(ctx context.Context, conf *config.Config, driver driver.Driver, cc CredentialsCreator, logger *log.Logger, overwriteHost string) (*connector, error) {
+func newConnector(ctx context.Context, conf *config.Config, driver driver.Driver, cc CredentialsCreator, logger *log.Logger, overwriteHost string) (_ *connector, err error) {
 	host := conf.Host
 	if overwriteHost != "" {
 		host = overwriteHost
 	}
+	sslRootCert, err := resolveSSLRootCert(conf, rdsCABundle, logger)
+	if err != nil {
+		return nil, err
+	}
 	c := &connector{
+		engine:      conf.Engine,
 		host:        host,
 		port:        conf.Port,
 		dbName:      conf.DBName,
 		user:        conf.User,
 		password:    conf.Password,
 		sslMode:     conf.SSLMode,
-		sslRootCert: conf.SSLRootCert,
+		sslRootCert: sslRootCert,
 		driver:      driver,
+		logger:      logger,
+
+		initStatements:   conf.InitStatements,
+		applicationName:  conf.ApplicationName,
+		connectTimeout:   time.Duration(conf.ConnectTimeout),
+		statementTimeout: time.Duration(conf.StatementTimeout),
+	}
+	if conf.Proxy.Enabled {
+		c.tokenHost = conf.Proxy.Endpoint
+		if overwriteHost != "" {
+			c.tokenHost = conf.Proxy.ReaderEndpoint
+		}
+	}
+	if conf.SSLCert != "" {
+		if c.clientCert, err = loadClientCert(conf.SSLCert, conf.SSLKey, conf.SSLKeyPassword); err != nil {
+			return nil, fmt.Errorf("%s, err: %v", errMsgLoadClientCert, err)
+		}
 	}
-	if cc == nil {
+	if c.engine == config.EngineMySQL {
+		if c.applicationName != "" {
+			logger.Println("application_name is ignored because go-sql-driver/mysql can't send it")
+		}
+		if err := c.registerMySQLTLSConfig(); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				c.Close()
+			}
+		}()
+	}
+	switch {
+	case conf.UsesSecretsManager():
+		logger.Printf("%s", logsOptInSecretsManager)
+		c.hostFromSecret = host == ""
+		if err := c.setupSecretsManager(ctx, conf, cc, logger); err != nil {
+			return nil, fmt.Errorf("%s, err: %v", errMsgSetupSecretsManager, err)
+		}
+	case cc == nil:
 		c.updateDSN()
-	} else {
+	default:
 		logger.Printf("%s", logsOptInIAMAuth)
 		if err := c.setupIAMAuth(ctx, conf.IAMAuth, cc, logger); err != nil {
 			return nil, fmt.Errorf("%s, err: %v", errMsgSetupIAMAuth, err)
 		}
 	}
+	// The background tasks are started only once the setup has succeeded, so that nothing is left behind on an error.
+	if c.clientCert != nil {
+		go c.reloadClientCertPeriodically(ctx, clientCertPollInterval, logger)
+	}
 	return c, nil
 }
 
-func (c *connector) Connect(context.Context) (driver.Conn, error) {
-	dsn := c.readDSN()
-	return c.driver.Open(dsn)
+// Connect opens a new connection to the DB.
+// If the DB rejects the credentials, they are refreshed and the connection is attempted once more,
+// because they may have been rotated or expired before the next scheduled refresh.
+// The init statements are run on the new connection before it's returned.
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.open(ctx)
+	if err != nil || len(c.initStatements) == 0 {
+		return conn, err
+	}
+	return c.initConn(ctx, conn)
+}
+
+func (c *connector) open(ctx context.Context) (driver.Conn, error) {
+	dsn, key := c.readDSNWithKey()
+	conn, err := openWithKey(c.driver, dsn, key)
+	if err == nil || c.source == nil || !isAuthError(err) {
+		return conn, err
+	}
+	c.forceRefreshCredentials(ctx)
+	dsn, key = c.readDSNWithKey()
+	return openWithKey(c.driver, dsn, key)
+}
+
+// initConn runs the init statements on conn in order.
+// If any of them fails, conn is closed rather than returned in an unexpected state.
+func (c *connector) initConn(ctx context.Context, conn driver.Conn) (driver.Conn, error) {
+	for i, stmt := range c.initStatements {
+		if err := execStatement(ctx, conn, stmt); err != nil {
+			conn.Close()
+			// The statement itself is not included because it may contain a secret.
+			return nil, fmt.Errorf("%s #%d, err: %w", errMsgInitStatement, i, err)
+		}
+	}
+	return conn, nil
+}
+
+// execStatement executes stmt on conn in the same way as sql.DB, i.e.
+// via driver.ExecerContext if it's implemented and otherwise via a prepared statement.
+func execStatement(ctx context.Context, conn driver.Conn, stmt string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(ctx, stmt, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	var prepared driver.Stmt
+	var err error
+	if preparer, ok := conn.(driver.ConnPrepareContext); ok {
+		prepared, err = preparer.PrepareContext(ctx, stmt)
+	} else {
+		prepared, err = conn.Prepare(stmt)
+	}
+	if err != nil {
+		return err
+	}
+	defer prepared.Close()
+	if execer, ok := prepared.(driver.StmtExecContext); ok {
+		_, err = execer.ExecContext(ctx, nil)
+		return err
+	}
+	//nolint:staticcheck // Stmt.Exec is the fallback for the drivers which do not implement StmtExecContext.
+	_, err = prepared.Exec(nil)
+	return err
 }
 
 func (c *connector) Driver() driver.Driver {
 	return c.driver
 }
 
+// Close implements io.Closer, which sql.DB.Close invokes,
+// and releases the TLS config registered to go-sql-driver/mysql if any.
+func (c *connector) Close() error {
+	c.closeOnce.Do(c.deregisterMySQLTLSConfig)
+	return nil
+}
+
+// String implements fmt.Stringer without the password and the DSN,
+// which may contain a static password or an IAM auth token.
+func (c *connector) String() string {
+	// The user and the host may be updated by refreshCredentials.
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+	return fmt.Sprintf("connector{host: %s, port: %d, dbName: %s, user: %s, sslMode: %s, sslRootCert: %s}",
+		c.host, c.port, c.dbName, c.user, c.sslMode, c.sslRootCert)
+}
+
+// GoString implements fmt.GoStringer in the same way as String, so that %#v does not expose the secrets either.
+func (c *connector) GoString() string {
+	return c.String()
+}
+
+// MarshalJSON implements json.Marshaler in the same way as String.
+func (c *connector) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+// ping opens a new connection to the DB, pings it if the driver supports it, and closes it.
+// A new connection is used on purpose so that the current credentials are verified as well.
+func (c *connector) ping(ctx context.Context) error {
+	conn, err := c.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if pinger, ok := conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// readCredentialsExpiration returns the time after which the current credentials are no longer valid,
+// which is zero if they do not expire.
+func (c *connector) readCredentialsExpiration() time.Time {
+	c.dsnLock.RLock()
+	defer c.dsnLock.RUnlock()
+	return c.credentialsExpiration
+}
+
 func (c *connector) setupIAMAuth(ctx context.Context, conf config.IAMAuthConfig, cc CredentialsCreator, logger *log.Logger) error {
 	var err error
 	creds, err := cc.Create(conf)
 	if err != nil {
 		return fmt.Errorf("%s, err: %v", errMsgCreateCredentials, err)
 	}
+	c.allowCleartextPasswords = true
 	if err := c.refreshAuthToken(creds, conf.Region); err != nil {
 		return fmt.Errorf("%s, err: %v", errMsgRefreshAuthToken, err)
 	}
+	c.source = c.newIAMTokenSource(creds, conf.Region)
 	go c.refreshAuthTokenPeriodically(ctx, creds, conf.Region, refreshAuthTokenInterval, logger)
 	return nil
 }
 
+func (c *connector) newIAMTokenSource(creds *credentials.Credentials, region string) *iamTokenSource {
+	// RDS Proxy only accepts the tokens generated for its own endpoint.
+	host := c.host
+	if c.tokenHost != "" {
+		host = c.tokenHost
+	}
+	return &iamTokenSource{
+		endpoint: fmt.Sprintf("%s:%d", host, c.port),
+		region:   region,
+		user:     c.user,
+		creds:    creds,
+	}
+}
+
 func (c *connector) refreshAuthToken(creds *credentials.Credentials, region string) error {
-	endpoint := fmt.Sprintf("%s:%d", c.host, c.port)
-	authToken, err := rdsutils.BuildAuthToken(endpoint, region, c.user, creds)
+	// The source is created under refreshLock because the endpoint may be updated by setEndpoint.
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+	return c.refreshCredentialsLocked(context.Background(), c.newIAMTokenSource(creds, region))
+}
+
+func (c *connector) refreshAuthTokenPeriodically(ctx context.Context, creds *credentials.Credentials, region string, interval time.Duration, logger *log.Logger) {
+	runPeriodically(ctx, interval, func() {
+		logger.Println("try to refresh auth token")
+		if err := c.refreshAuthToken(creds, region); err != nil {
+			logger.Printf("%s, err: %v", errMsgRefreshAuthToken, err)
+		}
+	})
+}
+
+func (c *connector) setupSecretsManager(ctx context.Context, conf *config.Config, cc CredentialsCreator, logger *log.Logger) error {
+	// The AWS credentials to access the secret are created in the same way as the ones for IAM auth if possible,
+	// otherwise the default credential chain of AWS SDK is used.
+	var creds *credentials.Credentials
+	if cc != nil {
+		var err error
+		if creds, err = cc.Create(conf.IAMAuth); err != nil {
+			return fmt.Errorf("%s, err: %v", errMsgCreateCredentials, err)
+		}
+	}
+	source, err := newSecretsManagerSource(conf.SecretsManager, creds)
 	if err != nil {
 		return err
 	}
-	c.updatePassword(authToken)
+	c.source = source
+	if err := c.refreshCredentials(ctx, source); err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgRefreshSecret, err)
+	}
+	interval := time.Duration(conf.SecretsManager.RefreshInterval)
+	go c.refreshSecretPeriodically(ctx, interval, logger)
 	return nil
 }
 
-func (c *connector) refreshAuthTokenPeriodically(ctx context.Context, creds *credentials.Credentials, region string, interval time.Duration, logger *log.Logger) {
+func (c *connector) refreshSecretPeriodically(ctx context.Context, interval time.Duration, logger *log.Logger) {
+	runPeriodically(ctx, interval, func() {
+		if err := c.refreshCredentials(ctx, c.source); err != nil {
+			logger.Printf("%s, err: %v", errMsgRefreshSecret, err)
+		}
+	})
+}
+
+// refreshCredentials fetches fresh credentials from source and uses them for the new connections.
+func (c *connector) refreshCredentials(ctx context.Context, source passwordSource) error {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+	return c.refreshCredentialsLocked(ctx, source)
+}
+
+func (c *connector) refreshCredentialsLocked(ctx context.Context, source passwordSource) error {
+	creds, err := source.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if creds.user != "" {
+		c.user = creds.user
+	}
+	if c.hostFromSecret && creds.host != "" {
+		c.host = creds.host
+		if creds.port != 0 {
+			c.port = creds.port
+		}
+	}
+	c.updatePassword(creds.password)
+	c.dsnLock.Lock()
+	defer c.dsnLock.Unlock()
+	c.credentialsExpiration = creds.expiration
+	return nil
+}
+
+// forceRefreshCredentials refreshes the credentials after the DB rejected them,
+// unless it has been done within minForcedRefreshInterval.
+func (c *connector) forceRefreshCredentials(ctx context.Context) {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+	if time.Since(c.lastForcedRefresh) < minForcedRefreshInterval {
+		return
+	}
+	c.lastForcedRefresh = time.Now()
+	if err := c.refreshCredentialsLocked(ctx, c.source); err != nil && c.logger != nil {
+		c.logger.Printf("failed to refresh the credentials rejected by the DB, err: %v", err)
+	}
+}
+
+// runPeriodically invokes f on the given interval until ctx is done.
+func runPeriodically(ctx context.Context, interval time.Duration, f func()) {
 	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			logger.Println("try to refresh auth token")
-			if err := c.refreshAuthToken(creds, region); err != nil {
-				logger.Printf("%s, err: %v", errMsgRefreshAuthToken, err)
-			}
+			f()
 		}
 	}
 }
 
-// updatePassword should only be invoked by updateAuthToken.
+// updatePassword should only be invoked by refreshCredentials.
 func (c *connector) updatePassword(password string) {
 	c.password = password
 	c.updateDSN()
@@ -134,19 +434,79 @@ func (c *connector) readDSN() string {
 	return c.dsn
 }
 
+// readDSNWithKey returns the DSN and the decrypted client key to open a connection with.
+func (c *connector) readDSNWithKey() (string, []byte) {
+	c.dsnLock.RLock()
+	defer c.dsnLock.RUnlock()
+	return c.dsn, c.dsnKey
+}
+
+// readTLSCert returns the client certificate which go-sql-driver/mysql presents, or nil if there is none.
+func (c *connector) readTLSCert() *tls.Certificate {
+	c.dsnLock.RLock()
+	defer c.dsnLock.RUnlock()
+	return c.tlsCert
+}
+
 func (c *connector) updateDSN() {
-	dsn := c.assembleDSN()
+	var dsn string
+	var key []byte
+	var cert *tls.Certificate
+	if c.engine == config.EngineMySQL {
+		dsn = c.assembleMySQLDSN()
+		if c.clientCert != nil {
+			cert = &c.clientCert.keyPair
+		}
+	} else {
+		dsn = c.assembleDSN()
+		if c.clientCert != nil {
+			key = c.clientCert.decryptedKey
+		}
+	}
 	c.dsnLock.Lock()
 	defer c.dsnLock.Unlock()
 	c.dsn = dsn
+	c.dsnKey = key
+	c.tlsCert = cert
 }
 
+// assembleDSN returns the DSN in libpq's key=value format.
+// The values which may contain arbitrary characters are quoted,
+// so that e.g. a password with a space cannot break the DSN or inject another parameter.
 func (c *connector) assembleDSN() string {
 	dsn := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=%s",
-		c.host, c.port, c.dbName, c.user, c.password, c.sslMode,
+		quoteDSNValue(c.host), c.port, quoteDSNValue(c.dbName), quoteDSNValue(c.user), quoteDSNValue(c.password), c.sslMode,
 	)
 	if c.sslRootCert != "" {
-		dsn = fmt.Sprintf("%s sslrootcert=%s", dsn, c.sslRootCert)
+		dsn = fmt.Sprintf("%s sslrootcert=%s", dsn, quoteDSNValue(c.sslRootCert))
+	}
+	// A decrypted key is passed as sslkey by openWithKey instead.
+	if c.clientCert != nil {
+		dsn = fmt.Sprintf("%s sslcert=%s", dsn, quoteDSNValue(c.clientCert.certFile))
+		if c.clientCert.decryptedKey == nil {
+			dsn = fmt.Sprintf("%s sslkey=%s", dsn, quoteDSNValue(c.clientCert.keyFile))
+		}
+	}
+	if c.applicationName != "" {
+		dsn = fmt.Sprintf("%s application_name=%s", dsn, quoteDSNValue(c.applicationName))
+	}
+	// connect_timeout is in seconds, so a fraction of a second is rounded up rather than disabling the timeout.
+	if c.connectTimeout > 0 {
+		dsn = fmt.Sprintf("%s connect_timeout=%d", dsn, (c.connectTimeout+time.Second-1)/time.Second)
+	}
+	// statement_timeout is in milliseconds, and it's sent to the DB as a run-time parameter.
+	// A fraction of a millisecond is rounded up as well, because 0 would disable the timeout.
+	if c.statementTimeout > 0 {
+		dsn = fmt.Sprintf("%s statement_timeout=%d", dsn, (c.statementTimeout+time.Millisecond-1)/time.Millisecond)
 	}
 	return dsn
 }
+
+// quoteDSNValue quotes value if it's empty or contains a space, a quote or a backslash,
+// which libpq would otherwise treat as the end of the value.
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\n\r\v\f'\\") {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
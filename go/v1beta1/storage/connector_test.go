@@ -6,8 +6,13 @@ package storage
 import (
 	"bytes"
 	"context"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -103,6 +108,94 @@ func TestConnectorConnect(t *testing.T) {
 	}
 }
 
+// execerConn is a fakeConn which records the executed statements and fails the one equal to failingStmt.
+type execerConn struct {
+	fakeConn
+	failingStmt string
+	executed    []string
+	closed      bool
+}
+
+func (c *execerConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if query == c.failingStmt {
+		return nil, errors.New("some error")
+	}
+	c.executed = append(c.executed, query)
+	return driver.RowsAffected(0), nil
+}
+
+func (c *execerConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestConnectorConnectRunsInitStatements(t *testing.T) {
+	t.Parallel()
+
+	initStatements := []string{"SET lock_timeout = '1s'", "SET search_path TO grafeas"}
+	tests := []struct {
+		name         string
+		conn         driver.Conn
+		failingStmt  string
+		wantExecuted []string
+		wantErrMsg   string
+	}{
+		{
+			name:         "all statements succeed",
+			conn:         &execerConn{},
+			wantExecuted: initStatements,
+		},
+		{
+			name:         "a statement fails",
+			conn:         &execerConn{failingStmt: initStatements[1]},
+			wantExecuted: initStatements[:1],
+			wantErrMsg:   errMsgInitStatement + " #1",
+		},
+		{
+			name:       "the statements cannot be prepared",
+			conn:       &fakeConn{},
+			wantErrMsg: errMsgInitStatement + " #0",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockDriver := mocks.NewMockDriver(gomock.NewController(t))
+			c := &connector{dsn: "some dsn", driver: mockDriver, initStatements: initStatements}
+			mockDriver.EXPECT().Open(c.dsn).Return(tt.conn, nil)
+			conn, err := c.Connect(context.Background())
+			if (err != nil) != (tt.wantErrMsg != "") {
+				if err != nil {
+					t.Errorf("don't want error, but got %q", err)
+				} else {
+					t.Errorf("got nil error, but want error to include %q", tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("want %q to include %q", err.Error(), tt.wantErrMsg)
+				}
+				if conn != nil {
+					t.Error("the connection should be discarded")
+				}
+			}
+			ec, ok := tt.conn.(*execerConn)
+			if !ok {
+				return
+			}
+			if !reflect.DeepEqual(ec.executed, tt.wantExecuted) {
+				t.Errorf("got executed statements %v, want %v", ec.executed, tt.wantExecuted)
+			}
+			if ec.closed != (err != nil) {
+				t.Errorf("got closed %v, but want the connection to be closed only if a statement fails", ec.closed)
+			}
+		})
+	}
+}
+
 func TestConnectorDriver(t *testing.T) {
 	t.Parallel()
 
@@ -178,16 +271,27 @@ func TestSetupIAMAuth(t *testing.T) {
 func TestRefreshAuthToken(t *testing.T) {
 	t.Parallel()
 	tests := []struct {
-		name    string
-		region  string
-		creds   *credentials.Credentials
-		wantErr bool
+		name      string
+		region    string
+		creds     *credentials.Credentials
+		tokenHost string
+		// wantEndpoint is the endpoint which the token is generated for.
+		wantEndpoint string
+		wantErr      bool
 	}{
 		{
-			name:    "happy path",
-			region:  "some-region",
-			creds:   credentials.NewStaticCredentials("a", "b", "c"),
-			wantErr: false,
+			name:         "happy path",
+			region:       "some-region",
+			creds:        credentials.NewStaticCredentials("a", "b", "c"),
+			wantEndpoint: "some-host.rds.amazonaws.com:5432",
+			wantErr:      false,
+		},
+		{
+			name:         "RDS Proxy behind an alias",
+			region:       "some-region",
+			creds:        credentials.NewStaticCredentials("a", "b", "c"),
+			tokenHost:    "some-proxy.proxy-xyz.some-region.rds.amazonaws.com",
+			wantEndpoint: "some-proxy.proxy-xyz.some-region.rds.amazonaws.com:5432",
 		},
 		{
 			name:    "empty secret key in credentials should fail",
@@ -199,7 +303,7 @@ func TestRefreshAuthToken(t *testing.T) {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			c := &connector{}
+			c := &connector{host: "some-host.rds.amazonaws.com", port: 5432, tokenHost: tt.tokenHost}
 			err := c.refreshAuthToken(tt.creds, tt.region)
 			hasErr := err != nil
 			if tt.wantErr != hasErr {
@@ -216,6 +320,9 @@ func TestRefreshAuthToken(t *testing.T) {
 			if !strings.Contains(c.password, tt.region) {
 				t.Errorf("the password %q should contain the specified region %q", c.password, tt.region)
 			}
+			if !strings.HasPrefix(c.password, tt.wantEndpoint+"?") {
+				t.Errorf("the password %q should be generated for %q", c.password, tt.wantEndpoint)
+			}
 			dsn := c.readDSN()
 			if !strings.Contains(dsn, tt.region) {
 				t.Errorf("the dsn %q should contain the specified region %q", dsn, tt.region)
@@ -297,19 +404,79 @@ func TestAssembleDSN(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		name        string
-		sslRootCert string
-		want        string
+		name             string
+		password         string
+		sslRootCert      string
+		clientCert       *clientCert
+		applicationName  string
+		connectTimeout   time.Duration
+		statementTimeout time.Duration
+		want             string
 	}{
 		{
-			name: "ssl root cert is not given",
-			want: "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full",
+			name:     "ssl root cert is not given",
+			password: "dummy-password-for-unit-tests-only",
+			want:     "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full",
 		},
 		{
 			name:        "ssl root cert is given",
+			password:    "dummy-password-for-unit-tests-only",
 			sslRootCert: "ca.pem",
 			want:        "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full sslrootcert=ca.pem",
 		},
+		{
+			name:       "client cert is given",
+			password:   "dummy-password-for-unit-tests-only",
+			clientCert: &clientCert{certFile: "client.crt", keyFile: "client.key"},
+			want:       "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full sslcert=client.crt sslkey=client.key",
+		},
+		{
+			name:       "decrypted client key is left out",
+			password:   "dummy-password-for-unit-tests-only",
+			clientCert: &clientCert{certFile: "client.crt", keyFile: "client_encrypted.key", decryptedKey: []byte("key")},
+			want:       "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full sslcert=client.crt",
+		},
+		{
+			name:            "application name is given",
+			password:        "dummy-password-for-unit-tests-only",
+			applicationName: "grafeas",
+			want:            "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full application_name=grafeas",
+		},
+		{
+			name:            "application name is quoted",
+			password:        "dummy-password-for-unit-tests-only",
+			applicationName: `grafeas 'rds'`,
+			want:            `host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full application_name='grafeas \'rds\''`,
+		},
+		{
+			name:             "timeouts are given",
+			password:         "dummy-password-for-unit-tests-only",
+			connectTimeout:   1500 * time.Millisecond,
+			statementTimeout: 30 * time.Second,
+			want:             "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full connect_timeout=2 statement_timeout=30000",
+		},
+		{
+			name:             "sub-millisecond statement timeout is rounded up",
+			password:         "dummy-password-for-unit-tests-only",
+			statementTimeout: 1500 * time.Microsecond,
+			want:             "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full statement_timeout=2",
+		},
+		{
+			name:             "statement timeout under a millisecond is not disabled",
+			password:         "dummy-password-for-unit-tests-only",
+			statementTimeout: time.Nanosecond,
+			want:             "host=localhost port=5432 dbname=grafeas user=grafeas_rw password=dummy-password-for-unit-tests-only sslmode=verify-full statement_timeout=1",
+		},
+		{
+			name:     "password is quoted",
+			password: `dummy pass'word\ sslmode=disable`,
+			want:     `host=localhost port=5432 dbname=grafeas user=grafeas_rw password='dummy pass\'word\\ sslmode=disable' sslmode=verify-full`,
+		},
+		{
+			name:     "empty password is quoted",
+			password: "",
+			want:     "host=localhost port=5432 dbname=grafeas user=grafeas_rw password='' sslmode=verify-full",
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -320,9 +487,14 @@ func TestAssembleDSN(t *testing.T) {
 				port:        5432,
 				dbName:      "grafeas",
 				user:        "grafeas_rw",
-				password:    "dummy-password-for-unit-tests-only",
+				password:    tt.password,
 				sslMode:     "verify-full",
 				sslRootCert: tt.sslRootCert,
+				clientCert:  tt.clientCert,
+
+				applicationName:  tt.applicationName,
+				connectTimeout:   tt.connectTimeout,
+				statementTimeout: tt.statementTimeout,
 			}
 			got := c.assembleDSN()
 			if got != tt.want {
@@ -331,3 +503,206 @@ func TestAssembleDSN(t *testing.T) {
 		})
 	}
 }
+
+func TestNewConnectorWithSecretsManager(t *testing.T) {
+	t.Parallel()
+
+	const secretID = "grafeas-db"
+	sm := newFakeSecretsManager(t, secretID,
+		`{"username": "grafeas_secret", "password": "dummy-password-for-unit-tests-only", "host": "secret-host.rds.amazonaws.com", "port": 5433}`)
+
+	tests := []struct {
+		name          string
+		host          string
+		overwriteHost string
+		secretID      string
+		wantDSN       string
+		wantErrMsg    string
+	}{
+		{
+			name:     "host from secret",
+			secretID: secretID,
+			wantDSN:  "host=secret-host.rds.amazonaws.com port=5433 dbname=grafeas user=grafeas_secret password=dummy-password-for-unit-tests-only",
+		},
+		{
+			name:     "configured host",
+			host:     "some-host.rds.amazonaws.com",
+			secretID: secretID,
+			wantDSN:  "host=some-host.rds.amazonaws.com port=5432 dbname=grafeas user=grafeas_secret password=dummy-password-for-unit-tests-only",
+		},
+		{
+			name:          "reader host",
+			overwriteHost: "some-host-ro.rds.amazonaws.com",
+			secretID:      secretID,
+			wantDSN:       "host=some-host-ro.rds.amazonaws.com port=5432 dbname=grafeas user=grafeas_secret password=dummy-password-for-unit-tests-only",
+		},
+		{
+			name:       "secret not found",
+			secretID:   "some-other-secret",
+			wantErrMsg: errMsgSetupSecretsManager,
+		},
+	}
+
+	mockCtrl := gomock.NewController(t)
+	mockCredentialsCreator := mocks.NewMockCredentialsCreator(mockCtrl)
+	mockCredentialsCreator.EXPECT().Create(gomock.Any()).Return(credentials.NewStaticCredentials("a", "b", "c"), nil).AnyTimes()
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			conf := config.Config{
+				Host:           tt.host,
+				Port:           5432,
+				DBName:         "grafeas",
+				User:           "grafeas_rw",
+				SSLMode:        "verify-full",
+				SSLRootCert:    "testdata/ca.pem",
+				SecretsManager: sm.config(tt.secretID),
+			}
+			var buf bytes.Buffer
+			c, err := newConnector(ctx, &conf, mocks.NewMockDriver(mockCtrl), mockCredentialsCreator, log.New(&buf, "", 0), tt.overwriteHost)
+			if (err != nil) != (tt.wantErrMsg != "") {
+				if err != nil {
+					t.Errorf("don't want error, but got %q", err)
+				} else {
+					t.Errorf("got nil error, but want error to include %q", tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("want %q to include %q", err.Error(), tt.wantErrMsg)
+				}
+				return
+			}
+			if logs := buf.String(); !strings.Contains(logs, logsOptInSecretsManager) {
+				t.Errorf("got %q, but want it to include %q", logs, logsOptInSecretsManager)
+			}
+			if dsn := c.readDSN(); !strings.HasPrefix(dsn, tt.wantDSN) {
+				t.Errorf("got %q, but want it to start with %q", dsn, tt.wantDSN)
+			}
+		})
+	}
+}
+
+// sequenceSource returns the passwords in order on every fetch.
+type sequenceSource struct {
+	passwords []string
+	fetches   int
+}
+
+func (s *sequenceSource) fetch(context.Context) (dbCredentials, error) {
+	if s.fetches >= len(s.passwords) {
+		return dbCredentials{}, errors.New("no more passwords")
+	}
+	s.fetches++
+	return dbCredentials{password: s.passwords[s.fetches-1]}, nil
+}
+
+func TestConnectorConnectRefreshesRejectedCredentials(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		openErr       error
+		recentRefresh bool
+		wantRefresh   bool
+		wantReopen    bool
+	}{
+		{
+			name:        "credentials are rejected",
+			openErr:     &fakePQError{code: "28P01"},
+			wantRefresh: true,
+			wantReopen:  true,
+		},
+		{
+			name:          "credentials are rejected right after a forced refresh",
+			openErr:       &fakePQError{code: "28P01"},
+			recentRefresh: true,
+			wantReopen:    true,
+		},
+		{
+			name:    "other errors",
+			openErr: errors.New("some error"),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockDriver := mocks.NewMockDriver(gomock.NewController(t))
+			source := &sequenceSource{passwords: []string{"old-password", "new-password"}}
+			c := &connector{driver: mockDriver, source: source}
+			if err := c.refreshCredentials(context.Background(), source); err != nil {
+				t.Fatal(err)
+			}
+			if tt.recentRefresh {
+				c.lastForcedRefresh = time.Now()
+			}
+			oldDSN := c.readDSN()
+			mockDriver.EXPECT().Open(oldDSN).Times(1).Return(nil, tt.openErr)
+			if tt.wantReopen {
+				mockDriver.EXPECT().Open(gomock.Any()).Times(1).Return(&fakeConn{}, nil)
+			}
+			_, err := c.Connect(context.Background())
+			if (err == nil) != tt.wantReopen {
+				t.Errorf("got error %v, but want the connection to be reopened: %v", err, tt.wantReopen)
+			}
+			refreshed := c.readDSN() != oldDSN
+			if refreshed != tt.wantRefresh {
+				t.Errorf("got refreshed %v, want %v", refreshed, tt.wantRefresh)
+			}
+		})
+	}
+}
+
+func TestConnectorStringRedactsSecrets(t *testing.T) {
+	t.Parallel()
+
+	c := &connector{
+		host:     "localhost",
+		port:     5432,
+		dbName:   "grafeas",
+		user:     "grafeas_rw",
+		password: "dummy-password-for-unit-tests-only",
+		sslMode:  "verify-full",
+	}
+	c.updateDSN()
+
+	// Every unexported string field which looks like a secret must be left out.
+	secretFieldRegexp := regexp.MustCompile(`(?i)(password|secret|token|key|credential|dsn)`)
+	var secrets []string
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.Type.Kind() == reflect.String && secretFieldRegexp.MatchString(field.Name) {
+			secrets = append(secrets, v.Field(i).String())
+		}
+	}
+	if len(secrets) == 0 {
+		t.Fatal("no secret field is found")
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]string{
+		"%v":          fmt.Sprintf("%v", c),
+		"%+v":         fmt.Sprintf("%+v", c),
+		"%#v":         fmt.Sprintf("%#v", c),
+		"MarshalJSON": string(b),
+	} {
+		if !strings.Contains(s, c.host) {
+			t.Errorf("%s: got %s, want it to include the host", name, s)
+		}
+		for _, secret := range secrets {
+			if secret != "" && strings.Contains(s, secret) {
+				t.Errorf("%s: got %s, but it exposes a secret", name, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"golang.org/x/net/context"
+
+	"github.com/theparanoids/grafeas-rds/go/config"
+)
+
+const (
+	errMsgSetupDiscovery  = "failed to set up the discovery of the endpoints"
+	errMsgDiscover        = "failed to discover the endpoints"
+	errMsgUpdateEndpoint  = "failed to update the endpoint"
+	errMsgClusterNotFound = "the cluster is not found"
+	errMsgWriterNotFound  = "the writer of the cluster is not found"
+)
+
+// instanceStatusAvailable is the status of the instances which can accept connections.
+const instanceStatusAvailable = "available"
+
+// endpoint is the host and the port which a connector connects to.
+type endpoint struct {
+	host string
+	port int
+}
+
+func (e endpoint) String() string {
+	return fmt.Sprintf("%s:%d", e.host, e.port)
+}
+
+// topology contains the endpoints of an Aurora cluster which the connectors use.
+type topology struct {
+	// writer is the endpoint of the writer instance.
+	// It's used instead of the cluster endpoint, so that a failover is followed without waiting for the DNS.
+	writer endpoint
+	// reader is the reader endpoint of the cluster, which balances the connections among the readers,
+	// or the writer if no reader is available.
+	reader endpoint
+}
+
+// discoverer finds the topology of an Aurora cluster via the RDS API.
+type discoverer struct {
+	client            rdsiface.RDSAPI
+	clusterIdentifier string
+}
+
+func newDiscoverer(conf config.DiscoveryConfig, creds *credentials.Credentials) (*discoverer, error) {
+	awsConf := aws.NewConfig().WithRegion(conf.Region)
+	if conf.Endpoint != "" {
+		awsConf = awsConf.WithEndpoint(conf.Endpoint)
+	}
+	// The default credential chain is used if creds is nil.
+	if creds != nil {
+		awsConf = awsConf.WithCredentials(creds)
+	}
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		return nil, err
+	}
+	return &discoverer{
+		client:            rds.New(sess),
+		clusterIdentifier: conf.ClusterIdentifier,
+	}, nil
+}
+
+// discoverEndpoints returns a copy of conf whose Host and Reader are replaced by the discovered endpoints,
+// and the discoverer to follow the changes of them.
+func discoverEndpoints(ctx context.Context, conf *config.Config, cc CredentialsCreator) (*config.Config, *discoverer, error) {
+	// The AWS credentials are created in the same way as the ones for AWS Secrets Manager.
+	var creds *credentials.Credentials
+	if cc != nil {
+		var err error
+		if creds, err = cc.Create(conf.IAMAuth); err != nil {
+			return nil, nil, fmt.Errorf("%s, err: %v", errMsgCreateCredentials, err)
+		}
+	}
+	d, err := newDiscoverer(conf.Discovery, creds)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := d.discover(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s, err: %v", errMsgDiscover, err)
+	}
+	discovered := *conf
+	discovered.Host = t.writer.host
+	discovered.Port = t.writer.port
+	discovered.Reader = t.reader.host
+	return &discovered, d, nil
+}
+
+func (d *discoverer) discover(ctx context.Context) (topology, error) {
+	clusters, err := d.client.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(d.clusterIdentifier),
+	})
+	if err != nil {
+		return topology{}, err
+	}
+	if len(clusters.DBClusters) == 0 {
+		return topology{}, errors.New(errMsgClusterNotFound)
+	}
+	cluster := clusters.DBClusters[0]
+
+	instances := map[string]*rds.DBInstance{}
+	err = d.client.DescribeDBInstancesPagesWithContext(ctx, &rds.DescribeDBInstancesInput{
+		Filters: []*rds.Filter{{
+			Name:   aws.String("db-cluster-id"),
+			Values: []*string{aws.String(d.clusterIdentifier)},
+		}},
+	}, func(page *rds.DescribeDBInstancesOutput, _ bool) bool {
+		for _, instance := range page.DBInstances {
+			instances[aws.StringValue(instance.DBInstanceIdentifier)] = instance
+		}
+		return true
+	})
+	if err != nil {
+		return topology{}, err
+	}
+
+	var t topology
+	hasReader := false
+	for _, member := range cluster.DBClusterMembers {
+		instance, ok := instances[aws.StringValue(member.DBInstanceIdentifier)]
+		if !ok || instance.Endpoint == nil || aws.StringValue(instance.DBInstanceStatus) != instanceStatusAvailable {
+			continue
+		}
+		if aws.BoolValue(member.IsClusterWriter) {
+			t.writer = endpoint{
+				host: aws.StringValue(instance.Endpoint.Address),
+				port: int(aws.Int64Value(instance.Endpoint.Port)),
+			}
+		} else {
+			hasReader = true
+		}
+	}
+	if t.writer.host == "" {
+		return topology{}, errors.New(errMsgWriterNotFound)
+	}
+	t.reader = t.writer
+	if hasReader && cluster.ReaderEndpoint != nil {
+		t.reader = endpoint{host: aws.StringValue(cluster.ReaderEndpoint), port: int(aws.Int64Value(cluster.Port))}
+	}
+	return t, nil
+}
+
+// updateTopologyPeriodically discovers the topology again on the given interval,
+// and makes the new connections of the writer and the reader follow it.
+// reader can be nil if the storage only connects to the writer.
+func (d *discoverer) updateTopologyPeriodically(ctx context.Context, interval time.Duration, writer, reader *connector, logger *log.Logger) {
+	runPeriodically(ctx, interval, func() {
+		t, err := d.discover(ctx)
+		if err != nil {
+			logger.Printf("%s, err: %v", errMsgDiscover, err)
+			return
+		}
+		if err := writer.setEndpoint(ctx, t.writer); err != nil {
+			logger.Printf("%s, err: %v", errMsgUpdateEndpoint, err)
+		}
+		if reader == nil {
+			return
+		}
+		if err := reader.setEndpoint(ctx, t.reader); err != nil {
+			logger.Printf("%s, err: %v", errMsgUpdateEndpoint, err)
+		}
+	})
+}
+
+// setEndpoint makes the new connections go to e.
+// The IAM auth token is generated again because it's only valid for the endpoint which it's generated for.
+func (c *connector) setEndpoint(ctx context.Context, e endpoint) error {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+	if c.host == e.host && c.port == e.port {
+		return nil
+	}
+	if c.logger != nil {
+		c.logger.Printf("the endpoint changed from %s:%d to %s", c.host, c.port, e)
+	}
+	c.host, c.port = e.host, e.port
+	if source, ok := c.source.(*iamTokenSource); ok {
+		source.endpoint = e.String()
+		return c.refreshCredentialsLocked(ctx, source)
+	}
+	c.updateDSN()
+	return nil
+}
@@ -0,0 +1,332 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/golang/mock/gomock"
+
+	"github.com/theparanoids/grafeas-rds/go/config"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+const fakeClusterIdentifier = "grafeas"
+
+// fakeInstance is an instance of the cluster served by fakeRDS.
+type fakeInstance struct {
+	identifier string
+	host       string
+	writer     bool
+	status     string
+}
+
+// fakeRDS serves DescribeDBClusters and DescribeDBInstances of the RDS API for a single Aurora cluster.
+type fakeRDS struct {
+	*httptest.Server
+	mu        sync.Mutex
+	instances []fakeInstance
+}
+
+func newFakeRDS(t *testing.T, instances ...fakeInstance) *fakeRDS {
+	t.Helper()
+	f := &fakeRDS{instances: instances}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		switch r.PostForm.Get("Action") {
+		case "DescribeDBClusters":
+			if r.PostForm.Get("DBClusterIdentifier") != fakeClusterIdentifier {
+				writeRDSError(w, "DBClusterNotFoundFault", "the cluster is not found")
+				return
+			}
+			f.writeClusters(w)
+		case "DescribeDBInstances":
+			if r.PostForm.Get("Filters.Filter.1.Name") != "db-cluster-id" ||
+				r.PostForm.Get("Filters.Filter.1.Values.Value.1") != fakeClusterIdentifier {
+				writeRDSError(w, "InvalidParameterValue", "unexpected filters")
+				return
+			}
+			f.writeInstances(w)
+		default:
+			writeRDSError(w, "InvalidAction", "unexpected action")
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRDS) setInstances(instances ...fakeInstance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances = instances
+}
+
+func (f *fakeRDS) writeClusters(w http.ResponseWriter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var members strings.Builder
+	for _, instance := range f.instances {
+		fmt.Fprintf(&members, "<DBClusterMember><DBInstanceIdentifier>%s</DBInstanceIdentifier><IsClusterWriter>%t</IsClusterWriter></DBClusterMember>",
+			instance.identifier, instance.writer)
+	}
+	fmt.Fprintf(w, `<DescribeDBClustersResponse xmlns="http://rds.amazonaws.com/doc/2014-10-31/">
+  <DescribeDBClustersResult>
+    <DBClusters>
+      <DBCluster>
+        <DBClusterIdentifier>%[1]s</DBClusterIdentifier>
+        <Endpoint>%[1]s.cluster-xyz.us-west-2.rds.amazonaws.com</Endpoint>
+        <ReaderEndpoint>%[1]s.cluster-ro-xyz.us-west-2.rds.amazonaws.com</ReaderEndpoint>
+        <Port>5432</Port>
+        <DBClusterMembers>%[2]s</DBClusterMembers>
+      </DBCluster>
+    </DBClusters>
+  </DescribeDBClustersResult>
+  <ResponseMetadata><RequestId>some-request</RequestId></ResponseMetadata>
+</DescribeDBClustersResponse>`, fakeClusterIdentifier, members.String())
+}
+
+func (f *fakeRDS) writeInstances(w http.ResponseWriter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var instances strings.Builder
+	for _, instance := range f.instances {
+		fmt.Fprintf(&instances, "<DBInstance><DBInstanceIdentifier>%s</DBInstanceIdentifier><DBInstanceStatus>%s</DBInstanceStatus><Endpoint><Address>%s</Address><Port>5432</Port></Endpoint></DBInstance>",
+			instance.identifier, instance.status, instance.host)
+	}
+	fmt.Fprintf(w, `<DescribeDBInstancesResponse xmlns="http://rds.amazonaws.com/doc/2014-10-31/">
+  <DescribeDBInstancesResult>
+    <DBInstances>%s</DBInstances>
+  </DescribeDBInstancesResult>
+  <ResponseMetadata><RequestId>some-request</RequestId></ResponseMetadata>
+</DescribeDBInstancesResponse>`, instances.String())
+}
+
+func writeRDSError(w http.ResponseWriter, code, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `<ErrorResponse xmlns="http://rds.amazonaws.com/doc/2014-10-31/">
+  <Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error>
+  <RequestId>some-request</RequestId>
+</ErrorResponse>`, code, message)
+}
+
+func (f *fakeRDS) config(clusterIdentifier string) config.DiscoveryConfig {
+	return config.DiscoveryConfig{
+		ClusterIdentifier: clusterIdentifier,
+		Region:            "us-west-2",
+		Endpoint:          f.URL,
+		RefreshInterval:   config.Duration(10 * time.Millisecond),
+	}
+}
+
+var (
+	fakeWriter = fakeInstance{
+		identifier: "grafeas-1",
+		host:       "grafeas-1.xyz.us-west-2.rds.amazonaws.com",
+		writer:     true,
+		status:     instanceStatusAvailable,
+	}
+	fakeReader = fakeInstance{
+		identifier: "grafeas-2",
+		host:       "grafeas-2.xyz.us-west-2.rds.amazonaws.com",
+		status:     instanceStatusAvailable,
+	}
+	fakeReaderEndpoint = endpoint{host: "grafeas.cluster-ro-xyz.us-west-2.rds.amazonaws.com", port: 5432}
+)
+
+func TestDiscover(t *testing.T) {
+	t.Parallel()
+
+	rebootingReader := fakeReader
+	rebootingReader.status = "rebooting"
+	promotedReader := fakeReader
+	promotedReader.writer = true
+
+	tests := []struct {
+		name              string
+		clusterIdentifier string
+		instances         []fakeInstance
+		want              topology
+		wantErrMsg        string
+	}{
+		{
+			name:              "writer and reader",
+			clusterIdentifier: fakeClusterIdentifier,
+			instances:         []fakeInstance{fakeWriter, fakeReader},
+			want: topology{
+				writer: endpoint{host: fakeWriter.host, port: 5432},
+				reader: fakeReaderEndpoint,
+			},
+		},
+		{
+			name:              "writer only",
+			clusterIdentifier: fakeClusterIdentifier,
+			instances:         []fakeInstance{fakeWriter},
+			want: topology{
+				writer: endpoint{host: fakeWriter.host, port: 5432},
+				reader: endpoint{host: fakeWriter.host, port: 5432},
+			},
+		},
+		{
+			name:              "unavailable reader",
+			clusterIdentifier: fakeClusterIdentifier,
+			instances:         []fakeInstance{fakeWriter, rebootingReader},
+			want: topology{
+				writer: endpoint{host: fakeWriter.host, port: 5432},
+				reader: endpoint{host: fakeWriter.host, port: 5432},
+			},
+		},
+		{
+			name:              "failed over",
+			clusterIdentifier: fakeClusterIdentifier,
+			instances:         []fakeInstance{promotedReader},
+			want: topology{
+				writer: endpoint{host: fakeReader.host, port: 5432},
+				reader: endpoint{host: fakeReader.host, port: 5432},
+			},
+		},
+		{
+			name:              "no writer",
+			clusterIdentifier: fakeClusterIdentifier,
+			instances:         []fakeInstance{fakeReader},
+			wantErrMsg:        errMsgWriterNotFound,
+		},
+		{
+			name:              "cluster not found",
+			clusterIdentifier: "some-other-cluster",
+			instances:         []fakeInstance{fakeWriter},
+			wantErrMsg:        "DBClusterNotFoundFault",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			f := newFakeRDS(t, tt.instances...)
+			d, err := newDiscoverer(f.config(tt.clusterIdentifier), credentials.NewStaticCredentials("a", "b", "c"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := d.discover(context.Background())
+			if (err != nil) != (tt.wantErrMsg != "") {
+				if err != nil {
+					t.Errorf("don't want error, but got %q", err)
+				} else {
+					t.Errorf("got nil error, but want error to include %q", tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("want %q to include %q", err.Error(), tt.wantErrMsg)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateTopologyPeriodically(t *testing.T) {
+	t.Parallel()
+
+	f := newFakeRDS(t, fakeWriter)
+	conf := config.Config{
+		Port:        5432,
+		DBName:      "grafeas",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLMode:     "verify-full",
+		SSLRootCert: "testdata/ca.pem",
+		Discovery:   f.config(fakeClusterIdentifier),
+	}
+	mockCtrl := gomock.NewController(t)
+	mockCredentialsCreator := mocks.NewMockCredentialsCreator(mockCtrl)
+	mockCredentialsCreator.EXPECT().Create(conf.IAMAuth).Return(credentials.NewStaticCredentials("a", "b", "c"), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	discovered, d, err := discoverEndpoints(ctx, &conf, mockCredentialsCreator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discovered.Host != fakeWriter.host || discovered.Reader != fakeWriter.host {
+		t.Fatalf("got host %q and reader %q, want both to be %q", discovered.Host, discovered.Reader, fakeWriter.host)
+	}
+
+	// The static password is used, so the connectors are created without a CredentialsCreator.
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+	writer, err := newConnector(ctx, discovered, mocks.NewMockDriver(mockCtrl), nil, logger, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := newConnector(ctx, discovered, mocks.NewMockDriver(mockCtrl), nil, logger, discovered.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.updateTopologyPeriodically(ctx, time.Duration(conf.Discovery.RefreshInterval), writer, reader, logger)
+
+	// A reader is added, and then the cluster fails over to it.
+	f.setInstances(fakeWriter, fakeReader)
+	eventually(t, func() bool {
+		return strings.HasPrefix(reader.readDSN(), "host="+fakeReaderEndpoint.host+" ")
+	}, "the reader should connect to the reader endpoint")
+	promotedReader := fakeReader
+	promotedReader.writer = true
+	f.setInstances(promotedReader)
+	eventually(t, func() bool {
+		return strings.HasPrefix(writer.readDSN(), "host="+fakeReader.host+" ")
+	}, "the writer should connect to the promoted reader")
+	eventually(t, func() bool {
+		return strings.HasPrefix(reader.readDSN(), "host="+fakeReader.host+" ")
+	}, "the reader should connect to the writer if there is no reader")
+}
+
+func TestSetEndpointRegeneratesAuthToken(t *testing.T) {
+	t.Parallel()
+
+	creds := credentials.NewStaticCredentials("a", "b", "c")
+	c := &connector{
+		host:    "some-host.rds.amazonaws.com",
+		port:    5432,
+		dbName:  "grafeas",
+		user:    "grafeas_rw",
+		sslMode: "verify-full",
+	}
+	if err := c.refreshAuthToken(creds, "us-west-2"); err != nil {
+		t.Fatal(err)
+	}
+	c.source = c.newIAMTokenSource(creds, "us-west-2")
+
+	e := endpoint{host: "other-host.rds.amazonaws.com", port: 5433}
+	if err := c.setEndpoint(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.source.(*iamTokenSource).endpoint, e.String(); got != want {
+		t.Errorf("got token endpoint %q, want %q", got, want)
+	}
+	dsn := c.readDSN()
+	if !strings.HasPrefix(dsn, "host=other-host.rds.amazonaws.com port=5433 ") {
+		t.Errorf("got %q, but want it to connect to %s", dsn, e)
+	}
+	// The token contains the endpoint which it's generated for.
+	if !strings.Contains(dsn, "password="+e.String()) {
+		t.Errorf("got %q, but want the token to be generated for %s", dsn, e)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"syscall"
+
+	"github.com/go-sql-driver/mysql"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// statusError is a gRPC status error which keeps its cause, so that the cause can be classified
+// without being exposed to the clients, which only see the status.
+type statusError struct {
+	status *status.Status
+	cause  error
+}
+
+func (e *statusError) Error() string              { return e.status.Err().Error() }
+func (e *statusError) GRPCStatus() *status.Status { return e.status }
+func (e *statusError) Unwrap() error              { return e.cause }
+
+// InternalError returns an error with codes.Internal and msg, which wraps cause.
+// The Storages should return it for the errors of the drivers,
+// so that RetryingStorage can retry the transient ones and map them to the proper codes.
+func InternalError(msg string, cause error) error {
+	return &statusError{status: status.New(codes.Internal, msg), cause: cause}
+}
+
+// The following functions classify the errors returned by the drivers.
+// The PostgreSQL drivers are matched by the methods exposing SQLSTATE, so that either lib/pq or pgx can be used,
+// and MySQL is matched by the error types of go-sql-driver, which don't expose the error number via any method.
+
+// sqlStateClassInvalidAuthorization is the SQLSTATE class of errors like "invalid_password".
+// Ref: https://www.postgresql.org/docs/current/errcodes-appendix.html
+const sqlStateClassInvalidAuthorization = "28"
+
+// The SQLSTATE codes of the transient errors.
+// Ref: https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	// sqlStateClassConnectionException is the class of errors like "connection_failure".
+	sqlStateClassConnectionException = "08"
+	sqlStateSerializationFailure     = "40001"
+	sqlStateDeadlockDetected         = "40P01"
+	// sqlStateReadOnlyTransaction is raised by a writer which has been demoted to a reader by a failover.
+	sqlStateReadOnlyTransaction = "25006"
+	sqlStateAdminShutdown       = "57P01"
+	sqlStateCrashShutdown       = "57P02"
+	sqlStateCannotConnectNow    = "57P03"
+)
+
+// The MySQL error numbers.
+// Ref: https://dev.mysql.com/doc/mysql-errors/8.0/en/server-error-reference.html
+const (
+	// mysqlErrAccessDenied is ER_ACCESS_DENIED_ERROR.
+	mysqlErrAccessDenied = 1045
+	// mysqlErrLockDeadlock is ER_LOCK_DEADLOCK.
+	mysqlErrLockDeadlock = 1213
+	// mysqlErrOptionPreventsStatement is ER_OPTION_PREVENTS_STATEMENT,
+	// which is raised by a writer which has been demoted to a reader because it runs with --read-only.
+	mysqlErrOptionPreventsStatement = 1290
+)
+
+// transientClass is the class of an error which may not happen again if the operation is retried.
+type transientClass int
+
+const (
+	notTransient transientClass = iota
+	// transientConnection means that the connection was lost, so the operation may or may not have been applied.
+	transientConnection
+	// transientReadOnly means that the writer rejected the operation because it has been demoted by a failover.
+	transientReadOnly
+	// transientConflict means that the transaction was rolled back because of a serialization failure or a deadlock.
+	transientConflict
+)
+
+// code returns the gRPC code of the errors of c.
+func (c transientClass) code() codes.Code {
+	switch c {
+	case transientConnection, transientReadOnly:
+		return codes.Unavailable
+	case transientConflict:
+		return codes.Aborted
+	}
+	return codes.Internal
+}
+
+// classifyTransientError returns the class of err, or notTransient if it's not transient.
+func classifyTransientError(err error) transientClass {
+	if err == nil {
+		return notTransient
+	}
+	if code, ok := sqlState(err); ok {
+		switch {
+		case code == sqlStateSerializationFailure, code == sqlStateDeadlockDetected:
+			return transientConflict
+		case code == sqlStateReadOnlyTransaction:
+			return transientReadOnly
+		case strings.HasPrefix(code, sqlStateClassConnectionException),
+			code == sqlStateAdminShutdown, code == sqlStateCrashShutdown, code == sqlStateCannotConnectNow:
+			return transientConnection
+		}
+		return notTransient
+	}
+	if number, ok := mysqlErrorNumber(err); ok {
+		switch number {
+		case mysqlErrLockDeadlock:
+			return transientConflict
+		case mysqlErrOptionPreventsStatement:
+			return transientReadOnly
+		}
+		return notTransient
+	}
+	// mysql.ErrInvalidConn is returned by go-sql-driver when the connection is lost in the middle of a query.
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return transientConnection
+	}
+	return notTransient
+}
+
+// isAuthError returns true if err means that the DB rejected the credentials.
+func isAuthError(err error) bool {
+	if code, ok := sqlState(err); ok {
+		return strings.HasPrefix(code, sqlStateClassInvalidAuthorization)
+	}
+	if number, ok := mysqlErrorNumber(err); ok {
+		return number == mysqlErrAccessDenied
+	}
+	return false
+}
+
+// sqlState returns the SQLSTATE code of err if any error in its chain carries one.
+// lib/pq exposes it via Get('C'), and pgx exposes it via SQLState().
+func sqlState(err error) (string, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		switch e := err.(type) {
+		case interface{ SQLState() string }:
+			return e.SQLState(), true
+		case interface{ Get(byte) string }:
+			if code := e.Get('C'); code != "" {
+				return code, true
+			}
+		}
+	}
+	return "", false
+}
+
+// mysqlErrorNumber returns the error number of err if any error in its chain is a mysql.MySQLError of go-sql-driver.
+func mysqlErrorNumber(err error) (uint16, bool) {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number, true
+	}
+	return 0, false
+}
@@ -0,0 +1,197 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakePQError mimics pq.Error, which exposes its fields via Get.
+type fakePQError struct {
+	code string
+}
+
+func (e *fakePQError) Error() string { return "pq: " + e.code }
+
+func (e *fakePQError) Get(k byte) string {
+	if k == 'C' {
+		return e.code
+	}
+	return ""
+}
+
+// fakePGXError mimics pgconn.PgError, which exposes the code via SQLState.
+type fakePGXError struct {
+	code string
+}
+
+func (e *fakePGXError) Error() string    { return "pgx: " + e.code }
+func (e *fakePGXError) SQLState() string { return e.code }
+
+func TestIsAuthError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "pq invalid_password",
+			err:  &fakePQError{code: "28P01"},
+			want: true,
+		},
+		{
+			name: "wrapped pq invalid_authorization_specification",
+			err:  fmt.Errorf("failed to connect: %w", &fakePQError{code: "28000"}),
+			want: true,
+		},
+		{
+			name: "pq unique_violation",
+			err:  &fakePQError{code: "23505"},
+		},
+		{
+			name: "pgx invalid_password",
+			err:  &fakePGXError{code: "28P01"},
+			want: true,
+		},
+		{
+			name: "mysql access denied",
+			err:  &mysql.MySQLError{Number: 1045, Message: "Access denied"},
+			want: true,
+		},
+		{
+			name: "mysql deadlock",
+			err:  &mysql.MySQLError{Number: 1213, Message: "Deadlock found"},
+		},
+		{
+			name: "unknown error",
+			err:  errors.New("password authentication failed"),
+		},
+		{
+			name: "nil error",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := isAuthError(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassifyTransientError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		err  error
+		want transientClass
+	}{
+		{
+			name: "pq serialization_failure",
+			err:  InternalError("failed to update the note", &fakePQError{code: "40001"}),
+			want: transientConflict,
+		},
+		{
+			name: "pgx deadlock_detected",
+			err:  &fakePGXError{code: "40P01"},
+			want: transientConflict,
+		},
+		{
+			name: "pq read_only_sql_transaction",
+			err:  &fakePQError{code: "25006"},
+			want: transientReadOnly,
+		},
+		{
+			name: "pq admin_shutdown",
+			err:  &fakePQError{code: "57P01"},
+			want: transientConnection,
+		},
+		{
+			name: "pq connection_failure",
+			err:  &fakePQError{code: "08006"},
+			want: transientConnection,
+		},
+		{
+			name: "pq unique_violation",
+			err:  &fakePQError{code: "23505"},
+		},
+		{
+			name: "mysql deadlock",
+			err:  &mysql.MySQLError{Number: 1213, Message: "Deadlock found"},
+			want: transientConflict,
+		},
+		{
+			name: "mysql read only",
+			err:  fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1290, Message: "--read-only"}),
+			want: transientReadOnly,
+		},
+		{
+			name: "mysql duplicate entry",
+			err:  &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"},
+		},
+		{
+			name: "connection reset",
+			err:  &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+			want: transientConnection,
+		},
+		{
+			name: "bad connection",
+			err:  fmt.Errorf("query: %w", driver.ErrBadConn),
+			want: transientConnection,
+		},
+		{
+			name: "mysql invalid connection",
+			err:  InternalError("failed to query the note", mysql.ErrInvalidConn),
+			want: transientConnection,
+		},
+		{
+			name: "status without cause",
+			err:  status.Error(codes.NotFound, "not found"),
+		},
+		{
+			name: "nil error",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := classifyTransientError(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInternalError(t *testing.T) {
+	t.Parallel()
+
+	cause := &fakePQError{code: "40001"}
+	err := InternalError("failed to update the note", cause)
+	if got := status.Code(err); got != codes.Internal {
+		t.Errorf("got code %v, want %v", got, codes.Internal)
+	}
+	// The clients only see the message.
+	if got, want := status.Convert(err).Message(), "failed to update the note"; got != want {
+		t.Errorf("got message %q, want %q", got, want)
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("got %v, want it to wrap %v", err, cause)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// HealthServiceWriter is the service name under which the health of the writer is reported.
+	HealthServiceWriter = "grafeas-rds.writer"
+	// HealthServiceReader is the service name under which the health of the reader is reported.
+	// If no reader is configured, it reflects the health of the writer because the reads go to the writer.
+	HealthServiceReader = "grafeas-rds.reader"
+
+	defaultHealthCheckInterval = 10 * time.Second
+
+	errMsgPing             = "failed to ping the DB"
+	errMsgStaleCredentials = "the credentials are stale"
+	errMsgPoolSaturated    = "the connection pool is saturated"
+)
+
+// PoolStatsReporter can be optionally implemented by a Storage to report the statistics of its connection pools,
+// which allows HealthServer to detect pool saturation.
+// For a Storage created by StorageCreator.Create, both methods should return the statistics of the only pool.
+type PoolStatsReporter interface {
+	WriterStats() sql.DBStats
+	ReaderStats() sql.DBStats
+}
+
+// HealthServer implements grpc_health_v1.HealthServer,
+// and the serving status of each service is derived from the storages built by GrafeasStorageProvider.
+// It can be registered to the Grafeas gRPC server via grpc_health_v1.RegisterHealthServer.
+//
+// A service is considered serving when all of the following are true:
+//
+//   - a new connection can be established and pinged;
+//   - the credentials, if they expire (e.g. an IAM auth token), were refreshed before they expired;
+//   - the connection pool, if the storage implements PoolStatsReporter, is not saturated,
+//     i.e. all the connections are in use and new requests have been waiting since the last check.
+//
+// The overall status (i.e. the empty service name) is serving only if all the registered services are serving.
+type HealthServer struct {
+	server   *health.Server
+	interval time.Duration
+	logger   *log.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards statuses.
+	mu       sync.Mutex
+	statuses map[string]healthpb.HealthCheckResponse_ServingStatus
+}
+
+// NewHealthServer returns a HealthServer which checks each registered service on the given interval.
+// If interval is not positive, a default value is used.
+func NewHealthServer(interval time.Duration, logger *log.Logger) *HealthServer {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &HealthServer{
+		server:   health.NewServer(),
+		interval: interval,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+		statuses: map[string]healthpb.HealthCheckResponse_ServingStatus{},
+	}
+	// Nothing is serving until a storage is provided.
+	s.server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return s
+}
+
+// Check implements grpc_health_v1.HealthServer.
+func (s *HealthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return s.server.Check(ctx, req)
+}
+
+// Watch implements grpc_health_v1.HealthServer.
+func (s *HealthServer) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	return s.server.Watch(req, stream)
+}
+
+// Shutdown stops the periodic checks and sets all the services to NOT_SERVING.
+// It is meant to be called when the Grafeas server is shutting down gracefully.
+func (s *HealthServer) Shutdown() {
+	s.cancel()
+	s.server.Shutdown()
+}
+
+// healthTarget contains what is needed to check the health of a service.
+type healthTarget struct {
+	connector *connector
+	// stats is nil if the storage does not implement PoolStatsReporter.
+	stats         func() sql.DBStats
+	lastWaitCount int64
+}
+
+// register starts checking the service periodically until the server shuts down or ctx is done.
+// A new service is marked as NOT_SERVING until the first check completes,
+// and a registered one keeps its status, so that replacing its target does not make it flap.
+func (s *HealthServer) register(ctx context.Context, service string, target *healthTarget) {
+	s.mu.Lock()
+	_, ok := s.statuses[service]
+	s.mu.Unlock()
+	if !ok {
+		s.setStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	go s.checkPeriodically(ctx, service, target)
+}
+
+func (s *HealthServer) checkPeriodically(ctx context.Context, service string, target *healthTarget) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.update(ctx, service, target)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *HealthServer) update(ctx context.Context, service string, target *healthTarget) {
+	checkCtx, cancel := context.WithTimeout(ctx, s.interval)
+	defer cancel()
+	servingStatus := healthpb.HealthCheckResponse_SERVING
+	if err := s.check(checkCtx, target); err != nil {
+		if ctx.Err() != nil {
+			// The server is shutting down or the target is replaced, so the failure is not meaningful.
+			return
+		}
+		s.logger.Printf("health check of %q failed, err: %v", service, err)
+		servingStatus = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	s.setStatus(service, servingStatus)
+}
+
+// check returns a non-nil error if the target is not healthy.
+func (s *HealthServer) check(ctx context.Context, target *healthTarget) error {
+	if expiration := target.connector.readCredentialsExpiration(); !expiration.IsZero() && !time.Now().Before(expiration) {
+		return fmt.Errorf("%s, they expired at %v", errMsgStaleCredentials, expiration)
+	}
+	if target.stats != nil {
+		stats := target.stats()
+		lastWaitCount := target.lastWaitCount
+		target.lastWaitCount = stats.WaitCount
+		if stats.MaxOpenConnections > 0 && stats.InUse >= stats.MaxOpenConnections && stats.WaitCount > lastWaitCount {
+			return fmt.Errorf("%s, %d connections are in use and %d requests waited since the last check",
+				errMsgPoolSaturated, stats.InUse, stats.WaitCount-lastWaitCount)
+		}
+	}
+	if err := target.connector.ping(ctx); err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgPing, err)
+	}
+	return nil
+}
+
+// setStatus updates the status of the service and the overall status.
+func (s *HealthServer) setStatus(service string, servingStatus healthpb.HealthCheckResponse_ServingStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.statuses[service]; ok && prev != servingStatus {
+		s.logger.Printf("health status of %q changed from %v to %v", service, prev, servingStatus)
+	}
+	s.statuses[service] = servingStatus
+	s.server.SetServingStatus(service, servingStatus)
+
+	overall := healthpb.HealthCheckResponse_SERVING
+	for _, st := range s.statuses {
+		if st != healthpb.HealthCheckResponse_SERVING {
+			overall = healthpb.HealthCheckResponse_NOT_SERVING
+			break
+		}
+	}
+	s.server.SetServingStatus("", overall)
+}
+
+// registerHealthTargets registers the writer and reader connectors of a provided storage to hs
+// until ctx is done, and they replace the ones registered before.
+// readerConnector may be nil if the storage only connects to the writer.
+func registerHealthTargets(ctx context.Context, hs *HealthServer, rdsStorage Storage, writerConnector, readerConnector *connector) {
+	writer := &healthTarget{connector: writerConnector}
+	reader := &healthTarget{connector: readerConnector}
+	if readerConnector == nil {
+		reader.connector = writerConnector
+	}
+	if reporter, ok := rdsStorage.(PoolStatsReporter); ok {
+		writer.stats = reporter.WriterStats
+		reader.stats = reporter.ReaderStats
+	}
+	hs.register(ctx, HealthServiceWriter, writer)
+	hs.register(ctx, HealthServiceReader, reader)
+}
@@ -0,0 +1,196 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+// fakeConn is a minimal driver.Conn which also implements driver.Pinger.
+type fakeConn struct {
+	pingErr error
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not implemented") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not implemented") }
+func (c *fakeConn) Ping(context.Context) error          { return c.pingErr }
+
+func TestHealthServerCheck(t *testing.T) {
+	t.Parallel()
+
+	type testCase struct {
+		name                  string
+		expect                func(*mocks.MockDriver)
+		credentialsExpiration time.Time
+		stats                 *sql.DBStats
+		lastWaitCount         int64
+		wantErrMsg            string
+	}
+	tests := []testCase{
+		{
+			name: "healthy",
+			expect: func(d *mocks.MockDriver) {
+				d.EXPECT().Open(gomock.Any()).Return(&fakeConn{}, nil)
+			},
+			credentialsExpiration: time.Now().Add(authTokenLifetime),
+			stats:                 &sql.DBStats{MaxOpenConnections: 2, InUse: 1},
+		},
+		{
+			name: "failed to connect",
+			expect: func(d *mocks.MockDriver) {
+				d.EXPECT().Open(gomock.Any()).Return(nil, errors.New("some error"))
+			},
+			wantErrMsg: errMsgPing,
+		},
+		{
+			name: "failed to ping",
+			expect: func(d *mocks.MockDriver) {
+				d.EXPECT().Open(gomock.Any()).Return(&fakeConn{pingErr: errors.New("some error")}, nil)
+			},
+			wantErrMsg: errMsgPing,
+		},
+		{
+			name:                  "stale credentials",
+			credentialsExpiration: time.Now(),
+			wantErrMsg:            errMsgStaleCredentials,
+		},
+		{
+			name:       "saturated pool",
+			stats:      &sql.DBStats{MaxOpenConnections: 2, InUse: 2, WaitCount: 3},
+			wantErrMsg: errMsgPoolSaturated,
+		},
+		{
+			name: "all connections are in use but nobody is waiting",
+			expect: func(d *mocks.MockDriver) {
+				d.EXPECT().Open(gomock.Any()).Return(&fakeConn{}, nil)
+			},
+			stats:         &sql.DBStats{MaxOpenConnections: 2, InUse: 2, WaitCount: 3},
+			lastWaitCount: 3,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockDriver := mocks.NewMockDriver(gomock.NewController(t))
+			if tt.expect != nil {
+				tt.expect(mockDriver)
+			}
+			target := &healthTarget{
+				connector:     &connector{driver: mockDriver, credentialsExpiration: tt.credentialsExpiration},
+				lastWaitCount: tt.lastWaitCount,
+			}
+			if tt.stats != nil {
+				target.stats = func() sql.DBStats { return *tt.stats }
+			}
+			s := NewHealthServer(0, log.New(io.Discard, "", 0))
+			defer s.Shutdown()
+			err := s.check(context.Background(), target)
+			if (err != nil) != (tt.wantErrMsg != "") {
+				if err != nil {
+					t.Errorf("don't want error, but got %q", err)
+				} else {
+					t.Errorf("got nil error, but want error to include %q", tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErrMsg) {
+				t.Errorf("want %q to include %q", err.Error(), tt.wantErrMsg)
+			}
+		})
+	}
+}
+
+// poolStatsStorage is a Storage which also implements PoolStatsReporter.
+type poolStatsStorage struct {
+	*mocks.MockStorage
+	stats sql.DBStats
+}
+
+func (s *poolStatsStorage) WriterStats() sql.DBStats { return s.stats }
+func (s *poolStatsStorage) ReaderStats() sql.DBStats { return s.stats }
+
+func TestHealthServerServingStatus(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	healthyDriver := mocks.NewMockDriver(mockCtrl)
+	healthyDriver.EXPECT().Open(gomock.Any()).Return(&fakeConn{}, nil).AnyTimes()
+	unhealthyDriver := mocks.NewMockDriver(mockCtrl)
+	unhealthyDriver.EXPECT().Open(gomock.Any()).Return(nil, errors.New("some error")).AnyTimes()
+
+	s := NewHealthServer(10*time.Millisecond, log.New(io.Discard, "", 0))
+	defer s.Shutdown()
+
+	wantStatus := func(service string, want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		var got healthpb.HealthCheckResponse_ServingStatus
+		for i := 0; i < 100; i++ {
+			resp, err := s.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+			if err != nil {
+				t.Fatalf("failed to check %q: %v", service, err)
+			}
+			if got = resp.Status; got == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("the status of %q is %v, want %v", service, got, want)
+	}
+
+	wantStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	_, err := s.Check(context.Background(), &healthpb.HealthCheckRequest{Service: HealthServiceWriter})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v, but want a NotFound error before any storage is registered", err)
+	}
+
+	rdsStorage := &poolStatsStorage{MockStorage: mocks.NewMockStorage(mockCtrl)}
+	registerHealthTargets(context.Background(), s, rdsStorage, &connector{driver: healthyDriver}, &connector{driver: unhealthyDriver})
+	wantStatus(HealthServiceWriter, healthpb.HealthCheckResponse_SERVING)
+	wantStatus(HealthServiceReader, healthpb.HealthCheckResponse_NOT_SERVING)
+	wantStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+	s.Shutdown()
+	wantStatus(HealthServiceWriter, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+func TestRegisterHealthTargetsWithoutReader(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	mockDriver := mocks.NewMockDriver(mockCtrl)
+	mockDriver.EXPECT().Open(gomock.Any()).Return(&fakeConn{}, nil).AnyTimes()
+
+	s := NewHealthServer(10*time.Millisecond, log.New(io.Discard, "", 0))
+	defer s.Shutdown()
+	registerHealthTargets(context.Background(), s, mocks.NewMockStorage(mockCtrl), &connector{driver: mockDriver}, nil)
+	for i := 0; i < 100; i++ {
+		resp, err := s.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status == healthpb.HealthCheckResponse_SERVING {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("the overall status should be serving when the writer is healthy")
+}
@@ -0,0 +1,273 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	// MetricStorageCalls is the counter of the calls to the storage methods.
+	// It's labeled with "method" (e.g. CreateOccurrence), "role" (reader or writer),
+	// "code" (the gRPC code of the error, or OK), and "project" if WithProjectLabel is given.
+	// A batch method is labeled with the code of its first error if any.
+	MetricStorageCalls = "grafeas_rds_storage_calls_total"
+	// MetricStorageCallDuration is the histogram of the latencies of the storage methods in seconds.
+	// It's labeled in the same way as MetricStorageCalls except for "code".
+	MetricStorageCallDuration = "grafeas_rds_storage_call_duration_seconds"
+)
+
+const (
+	roleReader = "reader"
+	roleWriter = "writer"
+
+	// otherProjects labels the projects beyond the limit of WithProjectLabel.
+	otherProjects = "other"
+)
+
+// InstrumentOption configures optional behaviors of InstrumentedStorage.
+type InstrumentOption func(*InstrumentedStorage)
+
+// WithProjectLabel labels the measurements with the project IDs of the calls.
+// Only the first maxProjects projects are labeled to bound the cardinality, and the others are labeled as "other".
+func WithProjectLabel(maxProjects int) InstrumentOption {
+	return func(s *InstrumentedStorage) {
+		s.maxProjects = maxProjects
+	}
+}
+
+// InstrumentedStorage is a Storage which reports the count, the errors and the latency of every call
+// of the methods of Grafeas (see MetricStorageCalls and MetricStorageCallDuration).
+// The methods reading the resources are labeled with the reader role, and the others with the writer role.
+type InstrumentedStorage struct {
+	Storage
+
+	metrics     Metrics
+	maxProjects int
+	now         func() time.Time
+
+	mu sync.Mutex
+	// projects are the labeled projects.
+	projects map[string]bool
+}
+
+// NewInstrumentedStorage returns an InstrumentedStorage wrapping s, which reports to m and is configured with opts.
+func NewInstrumentedStorage(s Storage, m Metrics, opts ...InstrumentOption) *InstrumentedStorage {
+	i := &InstrumentedStorage{
+		Storage:  s,
+		metrics:  m,
+		now:      time.Now,
+		projects: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// Close closes the wrapped Storage if it implements io.Closer.
+func (i *InstrumentedStorage) Close() error {
+	if closer, ok := i.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// projectLabel returns the label of pID, registering it if the limit is not reached yet.
+func (i *InstrumentedStorage) projectLabel(pID string) string {
+	if pID == "" {
+		return ""
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.projects[pID] {
+		return pID
+	}
+	if len(i.projects) < i.maxProjects {
+		i.projects[pID] = true
+		return pID
+	}
+	return otherProjects
+}
+
+// observe reports a call of method on the project pID, which started at start and failed with err if it's not nil.
+func (i *InstrumentedStorage) observe(method, role, pID string, start time.Time, err error) {
+	labels := map[string]string{"method": method, "role": role}
+	if i.maxProjects > 0 {
+		labels["project"] = i.projectLabel(pID)
+	}
+	i.metrics.ObserveHistogram(MetricStorageCallDuration, labels, i.now().Sub(start).Seconds())
+	labels["code"] = status.Code(err).String()
+	i.metrics.AddCounter(MetricStorageCalls, labels, 1)
+}
+
+// firstError returns the first error of a batch method if any.
+func firstError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs[0]
+}
+
+// CreateProject creates the project via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error) {
+	start := i.now()
+	created, err := i.Storage.CreateProject(ctx, pID, p)
+	i.observe("CreateProject", roleWriter, pID, start, err)
+	return created, err
+}
+
+// GetProject gets the project via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) GetProject(ctx context.Context, pID string) (*prpb.Project, error) {
+	start := i.now()
+	p, err := i.Storage.GetProject(ctx, pID)
+	i.observe("GetProject", roleReader, pID, start, err)
+	return p, err
+}
+
+// ListProjects lists the projects via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error) {
+	start := i.now()
+	projects, next, err := i.Storage.ListProjects(ctx, filter, pageSize, pageToken)
+	i.observe("ListProjects", roleReader, "", start, err)
+	return projects, next, err
+}
+
+// DeleteProject deletes the project via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) DeleteProject(ctx context.Context, pID string) error {
+	start := i.now()
+	err := i.Storage.DeleteProject(ctx, pID)
+	i.observe("DeleteProject", roleWriter, pID, start, err)
+	return err
+}
+
+// GetOccurrence gets the occurrence via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) GetOccurrence(ctx context.Context, pID, oID string) (*gpb.Occurrence, error) {
+	start := i.now()
+	o, err := i.Storage.GetOccurrence(ctx, pID, oID)
+	i.observe("GetOccurrence", roleReader, pID, start, err)
+	return o, err
+}
+
+// ListOccurrences lists the occurrences via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*gpb.Occurrence, string, error) {
+	start := i.now()
+	occs, next, err := i.Storage.ListOccurrences(ctx, pID, filter, pageToken, pageSize)
+	i.observe("ListOccurrences", roleReader, pID, start, err)
+	return occs, next, err
+}
+
+// CreateOccurrence creates the occurrence via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) CreateOccurrence(ctx context.Context, pID, uID string, o *gpb.Occurrence) (*gpb.Occurrence, error) {
+	start := i.now()
+	created, err := i.Storage.CreateOccurrence(ctx, pID, uID, o)
+	i.observe("CreateOccurrence", roleWriter, pID, start, err)
+	return created, err
+}
+
+// BatchCreateOccurrences creates the occurrences via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*gpb.Occurrence) ([]*gpb.Occurrence, []error) {
+	start := i.now()
+	created, errs := i.Storage.BatchCreateOccurrences(ctx, pID, uID, occs)
+	i.observe("BatchCreateOccurrences", roleWriter, pID, start, firstError(errs))
+	return created, errs
+}
+
+// UpdateOccurrence updates the occurrence via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) UpdateOccurrence(ctx context.Context, pID, oID string, o *gpb.Occurrence, mask *fieldmaskpb.FieldMask) (*gpb.Occurrence, error) {
+	start := i.now()
+	updated, err := i.Storage.UpdateOccurrence(ctx, pID, oID, o, mask)
+	i.observe("UpdateOccurrence", roleWriter, pID, start, err)
+	return updated, err
+}
+
+// DeleteOccurrence deletes the occurrence via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) DeleteOccurrence(ctx context.Context, pID, oID string) error {
+	start := i.now()
+	err := i.Storage.DeleteOccurrence(ctx, pID, oID)
+	i.observe("DeleteOccurrence", roleWriter, pID, start, err)
+	return err
+}
+
+// GetNote gets the note via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) GetNote(ctx context.Context, pID, nID string) (*gpb.Note, error) {
+	start := i.now()
+	n, err := i.Storage.GetNote(ctx, pID, nID)
+	i.observe("GetNote", roleReader, pID, start, err)
+	return n, err
+}
+
+// ListNotes lists the notes via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*gpb.Note, string, error) {
+	start := i.now()
+	notes, next, err := i.Storage.ListNotes(ctx, pID, filter, pageToken, pageSize)
+	i.observe("ListNotes", roleReader, pID, start, err)
+	return notes, next, err
+}
+
+// CreateNote creates the note via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) CreateNote(ctx context.Context, pID, nID, uID string, n *gpb.Note) (*gpb.Note, error) {
+	start := i.now()
+	created, err := i.Storage.CreateNote(ctx, pID, nID, uID, n)
+	i.observe("CreateNote", roleWriter, pID, start, err)
+	return created, err
+}
+
+// BatchCreateNotes creates the notes via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*gpb.Note) ([]*gpb.Note, []error) {
+	start := i.now()
+	created, errs := i.Storage.BatchCreateNotes(ctx, pID, uID, notes)
+	i.observe("BatchCreateNotes", roleWriter, pID, start, firstError(errs))
+	return created, errs
+}
+
+// UpdateNote updates the note via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) UpdateNote(ctx context.Context, pID, nID string, n *gpb.Note, mask *fieldmaskpb.FieldMask) (*gpb.Note, error) {
+	start := i.now()
+	updated, err := i.Storage.UpdateNote(ctx, pID, nID, n, mask)
+	i.observe("UpdateNote", roleWriter, pID, start, err)
+	return updated, err
+}
+
+// DeleteNote deletes the note via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) DeleteNote(ctx context.Context, pID, nID string) error {
+	start := i.now()
+	err := i.Storage.DeleteNote(ctx, pID, nID)
+	i.observe("DeleteNote", roleWriter, pID, start, err)
+	return err
+}
+
+// GetOccurrenceNote gets the note of the occurrence via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) GetOccurrenceNote(ctx context.Context, pID, oID string) (*gpb.Note, error) {
+	start := i.now()
+	n, err := i.Storage.GetOccurrenceNote(ctx, pID, oID)
+	i.observe("GetOccurrenceNote", roleReader, pID, start, err)
+	return n, err
+}
+
+// ListNoteOccurrences lists the occurrences of the note via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*gpb.Occurrence, string, error) {
+	start := i.now()
+	occs, next, err := i.Storage.ListNoteOccurrences(ctx, pID, nID, filter, pageToken, pageSize)
+	i.observe("ListNoteOccurrences", roleReader, pID, start, err)
+	return occs, next, err
+}
+
+// GetVulnerabilityOccurrencesSummary summarizes the vulnerability occurrences via the wrapped Storage, and measures the call.
+func (i *InstrumentedStorage) GetVulnerabilityOccurrencesSummary(ctx context.Context, pID, filter string) (*gpb.VulnerabilityOccurrencesSummary, error) {
+	start := i.now()
+	summary, err := i.Storage.GetVulnerabilityOccurrencesSummary(ctx, pID, filter)
+	i.observe("GetVulnerabilityOccurrencesSummary", roleReader, pID, start, err)
+	return summary, err
+}
+
+var _ Storage = (*InstrumentedStorage)(nil)
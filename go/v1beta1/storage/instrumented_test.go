@@ -0,0 +1,154 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafeas/grafeas/go/config"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+func TestInstrumentedStorage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tests := []struct {
+		name       string
+		call       func(s *InstrumentedStorage, store *mocks.MockStorage)
+		wantLabels map[string]string
+	}{
+		{
+			name: "read",
+			call: func(s *InstrumentedStorage, store *mocks.MockStorage) {
+				store.EXPECT().GetNote(ctx, "p", "n").Return(&gpb.Note{}, nil)
+				s.GetNote(ctx, "p", "n")
+			},
+			wantLabels: map[string]string{"method": "GetNote", "role": "reader", "code": "OK"},
+		},
+		{
+			name: "write",
+			call: func(s *InstrumentedStorage, store *mocks.MockStorage) {
+				store.EXPECT().CreateOccurrence(ctx, "p", "u", gomock.Any()).Return(&gpb.Occurrence{}, nil)
+				s.CreateOccurrence(ctx, "p", "u", &gpb.Occurrence{})
+			},
+			wantLabels: map[string]string{"method": "CreateOccurrence", "role": "writer", "code": "OK"},
+		},
+		{
+			name: "error",
+			call: func(s *InstrumentedStorage, store *mocks.MockStorage) {
+				store.EXPECT().ListProjects(ctx, "", 10, "").Return(nil, "", status.Error(codes.InvalidArgument, "invalid page token"))
+				s.ListProjects(ctx, "", 10, "")
+			},
+			wantLabels: map[string]string{"method": "ListProjects", "role": "reader", "code": "InvalidArgument"},
+		},
+		{
+			name: "batch with errors",
+			call: func(s *InstrumentedStorage, store *mocks.MockStorage) {
+				errs := []error{status.Error(codes.AlreadyExists, "exists"), status.Error(codes.Internal, "internal")}
+				store.EXPECT().BatchCreateNotes(ctx, "p", "u", gomock.Any()).Return([]*gpb.Note{}, errs)
+				s.BatchCreateNotes(ctx, "p", "u", map[string]*gpb.Note{})
+			},
+			wantLabels: map[string]string{"method": "BatchCreateNotes", "role": "writer", "code": "AlreadyExists"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			store := mocks.NewMockStorage(mockCtrl)
+			metrics := newFakeMetrics()
+			s := NewInstrumentedStorage(store, metrics)
+			start := time.Now()
+			calls := 0
+			s.now = func() time.Time {
+				// The call takes 2 seconds.
+				calls++
+				return start.Add(time.Duration(calls-1) * 2 * time.Second)
+			}
+			tt.call(s, store)
+
+			if got := metrics.counter(MetricStorageCalls, tt.wantLabels); got != 1 {
+				t.Errorf("got %v calls labeled with %v, want 1", got, tt.wantLabels)
+			}
+			durationLabels := map[string]string{"method": tt.wantLabels["method"], "role": tt.wantLabels["role"]}
+			if got := metrics.histogram(MetricStorageCallDuration, durationLabels); len(got) != 1 || got[0] != 2 {
+				t.Errorf("got durations %v labeled with %v, want [2]", got, durationLabels)
+			}
+		})
+	}
+}
+
+func TestInstrumentedStorageProjectLabel(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	metrics := newFakeMetrics()
+	s := NewInstrumentedStorage(store, metrics, WithProjectLabel(2))
+
+	store.EXPECT().GetProject(ctx, gomock.Any()).AnyTimes().Return(&prpb.Project{}, nil)
+	for _, pID := range []string{"p1", "p2", "p3", "p1", "p4"} {
+		s.GetProject(ctx, pID)
+	}
+	for project, want := range map[string]float64{"p1": 2, "p2": 1, "other": 2} {
+		labels := map[string]string{"method": "GetProject", "role": "reader", "code": "OK", "project": project}
+		if got := metrics.counter(MetricStorageCalls, labels); got != want {
+			t.Errorf("got %v calls labeled with %v, want %v", got, labels, want)
+		}
+	}
+}
+
+func TestStorageProviderWithInstrumentation(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	conf := config.StorageConfiguration(rdsconfig.Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLRootCert: "testdata/ca.pem",
+	})
+	store := mocks.NewMockStorage(mockCtrl)
+	store.EXPECT().SetMaxOpenConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetMaxIdleConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxLifetime(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxIdleTime(gomock.Any()).AnyTimes()
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Times(1).Return(store, nil)
+	metrics := newFakeMetrics()
+
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator,
+		WithMetrics(metrics), WithInstrumentation(), WithCache())
+	provided, err := provider.Provide("", &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	t.Cleanup(func() { provided.Gs.(*CachedStorage).Close() })
+
+	// Only the call reaching the storage is measured.
+	ctx := context.Background()
+	store.EXPECT().GetNote(ctx, "p", "n").Times(1).Return(&gpb.Note{}, nil)
+	for i := 0; i < 2; i++ {
+		if _, err := provided.Gs.GetNote(ctx, "p", "n"); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	labels := map[string]string{"method": "GetNote", "role": "reader", "code": "OK"}
+	if got := metrics.counter(MetricStorageCalls, labels); got != 1 {
+		t.Errorf("got %v calls labeled with %v, want 1", got, labels)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+
+// Package fieldmask applies the field masks of the update requests to the Grafeas resources.
+package fieldmask
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// Apply copies the fields in mask from src to dst, which must be of the same type.
+// A field is cleared in dst if it's not set in src.
+// It returns an error if any path in mask doesn't exist in the message.
+func Apply(dst, src proto.Message, mask *fieldmaskpb.FieldMask) error {
+	if !mask.IsValid(dst) {
+		return fmt.Errorf("invalid field mask %v", mask.GetPaths())
+	}
+	for _, path := range mask.GetPaths() {
+		d, s := dst.ProtoReflect(), src.ProtoReflect()
+		names := strings.Split(path, ".")
+		for _, name := range names[:len(names)-1] {
+			fd := d.Descriptor().Fields().ByName(protoreflect.Name(name))
+			d = d.Mutable(fd).Message()
+			s = s.Get(fd).Message()
+		}
+		fd := d.Descriptor().Fields().ByName(protoreflect.Name(names[len(names)-1]))
+		if s.Has(fd) {
+			d.Set(fd, s.Get(fd))
+		} else {
+			d.Clear(fd)
+		}
+	}
+	return nil
+}
+
+// keep contains the fields of a note or an occurrence which an update must not change.
+var keep = &fieldmaskpb.FieldMask{Paths: []string{"name", "create_time"}}
+
+// Update updates current, which is a note or an occurrence, with m.
+// Only the fields in mask are taken from m, or all the fields if mask is empty.
+// The name and the creation time are always kept.
+func Update(current, m proto.Message, mask *fieldmaskpb.FieldMask) error {
+	original := proto.Clone(current)
+	if len(mask.GetPaths()) == 0 {
+		proto.Reset(current)
+		proto.Merge(current, m)
+	} else if err := Apply(current, m, mask); err != nil {
+		return err
+	}
+	return Apply(current, original, keep)
+}
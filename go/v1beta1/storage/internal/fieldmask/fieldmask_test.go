@@ -0,0 +1,172 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package fieldmask
+
+import (
+	"testing"
+
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestApplyFieldMask(t *testing.T) {
+	t.Parallel()
+
+	newDst := func() *gpb.Note {
+		return &gpb.Note{
+			Name:             "projects/p/notes/n",
+			ShortDescription: "old short",
+			LongDescription:  "old long",
+			Type: &gpb.Note_Vulnerability{
+				Vulnerability: &vpb.Vulnerability{CvssScore: 1, Severity: vpb.Severity_LOW},
+			},
+		}
+	}
+	src := &gpb.Note{
+		Name:             "projects/other/notes/other",
+		ShortDescription: "new short",
+		Type: &gpb.Note_Vulnerability{
+			Vulnerability: &vpb.Vulnerability{CvssScore: 9, Severity: vpb.Severity_CRITICAL},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    *gpb.Note
+		wantErr bool
+	}{
+		{
+			name:  "top-level field",
+			paths: []string{"short_description"},
+			want: &gpb.Note{
+				Name:             "projects/p/notes/n",
+				ShortDescription: "new short",
+				LongDescription:  "old long",
+				Type: &gpb.Note_Vulnerability{
+					Vulnerability: &vpb.Vulnerability{CvssScore: 1, Severity: vpb.Severity_LOW},
+				},
+			},
+		},
+		{
+			name:  "field unset in src is cleared",
+			paths: []string{"long_description"},
+			want: &gpb.Note{
+				Name:             "projects/p/notes/n",
+				ShortDescription: "old short",
+				Type: &gpb.Note_Vulnerability{
+					Vulnerability: &vpb.Vulnerability{CvssScore: 1, Severity: vpb.Severity_LOW},
+				},
+			},
+		},
+		{
+			name:  "nested field",
+			paths: []string{"vulnerability.cvss_score"},
+			want: &gpb.Note{
+				Name:             "projects/p/notes/n",
+				ShortDescription: "old short",
+				LongDescription:  "old long",
+				Type: &gpb.Note_Vulnerability{
+					Vulnerability: &vpb.Vulnerability{CvssScore: 9, Severity: vpb.Severity_LOW},
+				},
+			},
+		},
+		{
+			name:    "unknown field",
+			paths:   []string{"no_such_field"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			dst := newDst()
+			err := Apply(dst, src, &fieldmaskpb.FieldMask{Paths: tt.paths})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got nil err, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !proto.Equal(dst, tt.want) {
+				t.Errorf("got %v, want %v", dst, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	t.Parallel()
+
+	newCurrent := func() *gpb.Note {
+		return &gpb.Note{
+			Name:             "projects/p/notes/n",
+			ShortDescription: "old short",
+			LongDescription:  "old long",
+			CreateTime:       &timestamppb.Timestamp{Seconds: 1},
+		}
+	}
+	m := &gpb.Note{
+		Name:             "projects/other/notes/other",
+		ShortDescription: "new short",
+		CreateTime:       &timestamppb.Timestamp{Seconds: 2},
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    *gpb.Note
+		wantErr bool
+	}{
+		{
+			name: "empty mask replaces all the fields",
+			want: &gpb.Note{
+				Name:             "projects/p/notes/n",
+				ShortDescription: "new short",
+				CreateTime:       &timestamppb.Timestamp{Seconds: 1},
+			},
+		},
+		{
+			name:  "mask",
+			paths: []string{"long_description", "create_time"},
+			want: &gpb.Note{
+				Name:             "projects/p/notes/n",
+				ShortDescription: "old short",
+				CreateTime:       &timestamppb.Timestamp{Seconds: 1},
+			},
+		},
+		{
+			name:    "invalid mask",
+			paths:   []string{"no_such_field"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			current := newCurrent()
+			err := Update(current, m, &fieldmaskpb.FieldMask{Paths: tt.paths})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got nil err, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !proto.Equal(current, tt.want) {
+				t.Errorf("got %v, want %v", current, tt.want)
+			}
+		})
+	}
+}
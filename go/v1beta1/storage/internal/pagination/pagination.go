@@ -0,0 +1,58 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+
+// Package pagination provides the page sizes and the encrypted page tokens shared by the storages.
+package pagination
+
+import (
+	"strconv"
+
+	"github.com/fernet/fernet-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 1000
+)
+
+// NormalizePageSize returns the default page size if pageSize isn't positive, and caps it at maxPageSize.
+func NormalizePageSize(pageSize int) int {
+	switch {
+	case pageSize <= 0:
+		return defaultPageSize
+	case pageSize > maxPageSize:
+		return maxPageSize
+	default:
+		return pageSize
+	}
+}
+
+// EncodePageToken encrypts the ID of the last row of a page,
+// so that the clients can neither read nor forge the position in the table.
+func EncodePageToken(lastID int64, key *fernet.Key) (string, error) {
+	tok, err := fernet.EncryptAndSign([]byte(strconv.FormatInt(lastID, 10)), key)
+	if err != nil {
+		return "", err
+	}
+	return string(tok), nil
+}
+
+// DecodePageToken returns the ID after which the next page starts.
+// The page starts from the beginning of the table if token is empty.
+func DecodePageToken(token string, key *fernet.Key) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	msg := fernet.VerifyAndDecrypt([]byte(token), 0, []*fernet.Key{key})
+	if msg == nil {
+		return 0, status.Error(codes.InvalidArgument, "invalid page token")
+	}
+	id, err := strconv.ParseInt(string(msg), 10, 64)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, "invalid page token")
+	}
+	return id, nil
+}
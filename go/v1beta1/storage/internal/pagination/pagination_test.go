@@ -0,0 +1,87 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package pagination
+
+import (
+	"testing"
+
+	"github.com/fernet/fernet-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNormalizePageSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		pageSize int
+		want     int
+	}{
+		{name: "zero", pageSize: 0, want: defaultPageSize},
+		{name: "negative", pageSize: -1, want: defaultPageSize},
+		{name: "in range", pageSize: 50, want: 50},
+		{name: "too large", pageSize: maxPageSize + 1, want: maxPageSize},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := NormalizePageSize(tt.pageSize); got != tt.want {
+				t.Errorf("NormalizePageSize(%d) = %d, want %d", tt.pageSize, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageToken(t *testing.T) {
+	t.Parallel()
+
+	var key, otherKey fernet.Key
+	if err := key.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := otherKey.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	token, err := EncodePageToken(42, &key)
+	if err != nil {
+		t.Fatalf("EncodePageToken: %v", err)
+	}
+	otherToken, err := EncodePageToken(42, &otherKey)
+	if err != nil {
+		t.Fatalf("EncodePageToken: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		want     int64
+		wantCode codes.Code
+	}{
+		{name: "first page", token: "", want: 0},
+		{name: "next page", token: token, want: 42},
+		{name: "malformed token", token: "42", wantCode: codes.InvalidArgument},
+		{name: "token encrypted with another key", token: otherToken, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := DecodePageToken(tt.token, &key)
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Fatalf("got err %v, want code %v", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+)
+
+// AuditSink implements storage.AuditSink by inserting the records into the audit_log table created by the migrations.
+type AuditSink struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewAuditSink returns an AuditSink inserting into db, which it closes when it's closed.
+func NewAuditSink(db *sql.DB, dialect Dialect) *AuditSink {
+	return &AuditSink{db: db, dialect: dialect}
+}
+
+// Write inserts r.
+func (s *AuditSink) Write(ctx context.Context, r *storage.AuditRecord) error {
+	return s.insert(ctx, s.db.ExecContext, r)
+}
+
+// WriteBatch inserts rs in a transaction, so that they're committed at once.
+func (s *AuditSink) WriteBatch(ctx context.Context, rs []*storage.AuditRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, s.dialect.InsertAuditRecord)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	exec := func(ctx context.Context, _ string, args ...interface{}) (sql.Result, error) {
+		return stmt.ExecContext(ctx, args...)
+	}
+	for _, r := range rs {
+		if err := s.insert(ctx, exec, r); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// insert inserts r with exec.
+func (s *AuditSink) insert(ctx context.Context, exec func(context.Context, string, ...interface{}) (sql.Result, error), r *storage.AuditRecord) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = exec(ctx, s.dialect.InsertAuditRecord, r.Time.UTC(), r.Method, r.Resource, r.Caller, r.Code, string(data))
+	return err
+}
+
+// Close closes the DB.
+func (s *AuditSink) Close() error {
+	return s.db.Close()
+}
+
+var _ storage.AuditBatchSink = (*AuditSink)(nil)
@@ -0,0 +1,198 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	errMsgLoadMigrations       = "failed to load the migrations"
+	errMsgLockSchema           = "failed to acquire the schema migration lock"
+	errMsgUnlockSchema         = "failed to release the schema migration lock"
+	errMsgCreateVersionTable   = "failed to create the schema_version table"
+	errMsgQuerySchemaVersion   = "failed to query the schema version"
+	errMsgApplyMigration       = "failed to apply the migration"
+	errMsgUnknownSchemaVersion = "unknown schema version"
+)
+
+var (
+	// migrationFileName matches e.g. 0001_initial.up.sql, and captures the version, the name and the direction.
+	migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	// statementSeparator separates the statements in a migration file, which must end each statement at the end of a line.
+	statementSeparator = regexp.MustCompile(`;\s*(\n|$)`)
+)
+
+// migration is a version of the schema, with the statements which upgrade the previous version to it,
+// and the ones which downgrade it to the previous version.
+type migration struct {
+	version int
+	name    string
+	up      []string
+	down    []string
+}
+
+// loadMigrations reads the files named <version>_<name>.{up,down}.sql in the directory named migrations in fsys,
+// and returns the migrations in the ascending order of the versions.
+// The versions must start from 1 without any gap, and each of them must have both up and down files.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	fsys, err := fs.Sub(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		m := migrationFileName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, err
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{version: version, name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.name != m[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, mig.name, m[2])
+		}
+		if m[3] == "up" {
+			mig.up = splitStatements(string(content))
+		} else {
+			mig.down = splitStatements(string(content))
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, mig := range migrations {
+		if mig.version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if mig.up == nil || mig.down == nil {
+			return nil, fmt.Errorf("migration %d must have both up and down files", mig.version)
+		}
+	}
+	return migrations, nil
+}
+
+func splitStatements(content string) []string {
+	statements := []string{}
+	for _, stmt := range statementSeparator.Split(content, -1) {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
+
+// MigrateSchema applies the pending migrations, and it's safe to be invoked by many instances at once
+// because they are serialized by an advisory lock.
+func (s *Store) MigrateSchema(ctx context.Context) error {
+	return s.migrateTo(ctx, len(s.migrations))
+}
+
+// RollbackSchema reverts the migrations newer than version.
+func (s *Store) RollbackSchema(ctx context.Context, version int) error {
+	if version < 0 || version > len(s.migrations) {
+		return fmt.Errorf("%s %d", errMsgUnknownSchemaVersion, version)
+	}
+	return s.migrateTo(ctx, version)
+}
+
+// VerifySchema returns an error if the schema is not at the latest version known by this Store.
+func (s *Store) VerifySchema(ctx context.Context) error {
+	var current int
+	if err := s.writer.QueryRowContext(ctx, s.dialect.SelectSchemaVersion).Scan(&current); err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgQuerySchemaVersion, err)
+	}
+	if current != len(s.migrations) {
+		return fmt.Errorf("schema version is %d, want %d", current, len(s.migrations))
+	}
+	return nil
+}
+
+// migrateTo applies the up or down migrations between the current version and target
+// on a dedicated connection, which holds the advisory lock in the meantime.
+func (s *Store) migrateTo(ctx context.Context, target int) (err error) {
+	conn, err := s.writer.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgLockSchema, err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, s.dialect.LockSchema); err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgLockSchema, err)
+	}
+	defer func() {
+		// The lock is released with a new context because ctx may be done.
+		if _, unlockErr := conn.ExecContext(context.Background(), s.dialect.UnlockSchema); unlockErr != nil && err == nil {
+			err = fmt.Errorf("%s, err: %v", errMsgUnlockSchema, unlockErr)
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, s.dialect.CreateSchemaVersionTable); err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgCreateVersionTable, err)
+	}
+	var current int
+	if err := conn.QueryRowContext(ctx, s.dialect.SelectSchemaVersion).Scan(&current); err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgQuerySchemaVersion, err)
+	}
+	if current > len(s.migrations) {
+		return fmt.Errorf("%s %d; the schema is newer than this binary", errMsgUnknownSchemaVersion, current)
+	}
+	for ; current < target; current++ {
+		mig := s.migrations[current]
+		s.logger.Printf("applying the schema migration %d_%s", mig.version, mig.name)
+		if err := s.applyMigration(ctx, conn, mig.up, s.dialect.InsertSchemaVersion, mig.version); err != nil {
+			return fmt.Errorf("%s %d_%s, err: %v", errMsgApplyMigration, mig.version, mig.name, err)
+		}
+	}
+	for ; current > target; current-- {
+		mig := s.migrations[current-1]
+		s.logger.Printf("reverting the schema migration %d_%s", mig.version, mig.name)
+		if err := s.applyMigration(ctx, conn, mig.down, s.dialect.DeleteSchemaVersion, mig.version); err != nil {
+			return fmt.Errorf("%s %d_%s, err: %v", errMsgApplyMigration, mig.version, mig.name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs the statements and records the version in a transaction.
+// Note that the statements are not rolled back on failure if the DBMS commits DDL implicitly, like MySQL.
+func (s *Store) applyMigration(ctx context.Context, conn *sql.Conn, statements []string, versionQuery string, version int) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, versionQuery, version); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,331 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		files      fstest.MapFS
+		want       []migration
+		wantErrMsg string
+	}{
+		{
+			name: "happy path",
+			files: fstest.MapFS{
+				"migrations/0002_index.up.sql":     {Data: []byte("CREATE INDEX i ON t (c);\n")},
+				"migrations/0002_index.down.sql":   {Data: []byte("DROP INDEX i;")},
+				"migrations/0001_initial.up.sql":   {Data: []byte("-- comment\nCREATE TABLE t (c INT);\nCREATE TABLE u (c INT) ;\n\n")},
+				"migrations/0001_initial.down.sql": {Data: []byte("DROP TABLE u;\nDROP TABLE t;\n")},
+				"migrations/README.md":             {Data: []byte("ignored")},
+			},
+			want: []migration{
+				{
+					version: 1,
+					name:    "initial",
+					up:      []string{"-- comment\nCREATE TABLE t (c INT)", "CREATE TABLE u (c INT)"},
+					down:    []string{"DROP TABLE u", "DROP TABLE t"},
+				},
+				{
+					version: 2,
+					name:    "index",
+					up:      []string{"CREATE INDEX i ON t (c)"},
+					down:    []string{"DROP INDEX i"},
+				},
+			},
+		},
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"migrations/0001_initial.up.sql": {Data: []byte("CREATE TABLE t (c INT);")},
+			},
+			wantErrMsg: "migration 1 must have both up and down files",
+		},
+		{
+			name: "gap",
+			files: fstest.MapFS{
+				"migrations/0002_index.up.sql":   {Data: []byte("CREATE INDEX i ON t (c);")},
+				"migrations/0002_index.down.sql": {Data: []byte("DROP INDEX i;")},
+			},
+			wantErrMsg: "migration 1 is missing",
+		},
+		{
+			name: "different names",
+			files: fstest.MapFS{
+				"migrations/0001_initial.up.sql": {Data: []byte("CREATE TABLE t (c INT);")},
+				"migrations/0001_other.down.sql": {Data: []byte("DROP TABLE t;")},
+			},
+			wantErrMsg: "migration 1 has different names",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := loadMigrations(tt.files)
+			if tt.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("got err %v, want it to include %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingDB is a driver.Connector whose connections record the executed statements,
+// and the schema version is derived from the recorded INSERT and DELETE statements of schema_version.
+type recordingDB struct {
+	mu         sync.Mutex
+	statements []string
+	version    int
+	// failOn makes the statements containing it fail.
+	failOn string
+}
+
+func (d *recordingDB) Connect(context.Context) (driver.Conn, error) {
+	return &recordingConn{db: d}, nil
+}
+func (d *recordingDB) Driver() driver.Driver { return nil }
+
+func (d *recordingDB) exec(query string, args []driver.NamedValue) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failOn != "" && strings.Contains(query, d.failOn) {
+		return errors.New("some DB error")
+	}
+	d.statements = append(d.statements, query)
+	switch query {
+	case testQueries.InsertSchemaVersion:
+		d.version = int(args[0].Value.(int64))
+	case testQueries.DeleteSchemaVersion:
+		d.version = int(args[0].Value.(int64)) - 1
+	}
+	return nil
+}
+
+type recordingConn struct {
+	db *recordingDB
+}
+
+func (c *recordingConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c *recordingConn) Close() error                        { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error)           { return c, nil }
+func (c *recordingConn) Commit() error                       { return c.db.exec("COMMIT", nil) }
+func (c *recordingConn) Rollback() error                     { return c.db.exec("ROLLBACK", nil) }
+
+func (c *recordingConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.db.exec(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	if query != testQueries.SelectSchemaVersion {
+		return nil, errors.New("unexpected query")
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	return &versionRows{version: int64(c.db.version)}, nil
+}
+
+type versionRows struct {
+	version int64
+	done    bool
+}
+
+func (r *versionRows) Columns() []string { return []string{"version"} }
+func (r *versionRows) Close() error      { return nil }
+func (r *versionRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.version
+	return nil
+}
+
+var testQueries = Queries{
+	LockSchema:               "LOCK",
+	UnlockSchema:             "UNLOCK",
+	CreateSchemaVersionTable: "CREATE schema_version",
+	SelectSchemaVersion:      "SELECT version",
+	InsertSchemaVersion:      "INSERT version",
+	DeleteSchemaVersion:      "DELETE version",
+}
+
+var testMigrations = fstest.MapFS{
+	"migrations/0001_initial.up.sql":   {Data: []byte("CREATE TABLE t (c INT);")},
+	"migrations/0001_initial.down.sql": {Data: []byte("DROP TABLE t;")},
+	"migrations/0002_index.up.sql":     {Data: []byte("CREATE INDEX i ON t (c);")},
+	"migrations/0002_index.down.sql":   {Data: []byte("DROP INDEX i;")},
+}
+
+func newRecordingStore(t *testing.T, db *recordingDB) *Store {
+	t.Helper()
+	sqlDB := sql.OpenDB(db)
+	t.Cleanup(func() { sqlDB.Close() })
+	s, err := New(sqlDB, sqlDB, "", log.New(io.Discard, "", 0), Dialect{Queries: testQueries, Migrations: testMigrations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMigrateSchema(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		currentVersion int
+		failOn         string
+		want           []string
+		wantVersion    int
+		wantErrMsg     string
+	}{
+		{
+			name: "from scratch",
+			want: []string{
+				"LOCK", "CREATE schema_version",
+				"CREATE TABLE t (c INT)", "INSERT version", "COMMIT",
+				"CREATE INDEX i ON t (c)", "INSERT version", "COMMIT",
+				"UNLOCK",
+			},
+			wantVersion: 2,
+		},
+		{
+			name:           "pending migration",
+			currentVersion: 1,
+			want: []string{
+				"LOCK", "CREATE schema_version",
+				"CREATE INDEX i ON t (c)", "INSERT version", "COMMIT",
+				"UNLOCK",
+			},
+			wantVersion: 2,
+		},
+		{
+			name:           "up to date",
+			currentVersion: 2,
+			want:           []string{"LOCK", "CREATE schema_version", "UNLOCK"},
+			wantVersion:    2,
+		},
+		{
+			name:           "newer schema",
+			currentVersion: 3,
+			want:           []string{"LOCK", "CREATE schema_version", "UNLOCK"},
+			wantVersion:    3,
+			wantErrMsg:     errMsgUnknownSchemaVersion,
+		},
+		{
+			name:   "failed migration",
+			failOn: "CREATE INDEX",
+			want: []string{
+				"LOCK", "CREATE schema_version",
+				"CREATE TABLE t (c INT)", "INSERT version", "COMMIT",
+				"ROLLBACK",
+				"UNLOCK",
+			},
+			wantVersion: 1,
+			wantErrMsg:  errMsgApplyMigration + " 2_index",
+		},
+		{
+			name:       "lock failure",
+			failOn:     "LOCK",
+			wantErrMsg: errMsgLockSchema,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			db := &recordingDB{version: tt.currentVersion, failOn: tt.failOn}
+			s := newRecordingStore(t, db)
+			err := s.MigrateSchema(context.Background())
+			if tt.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("got err %v, want it to include %q", err, tt.wantErrMsg)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !reflect.DeepEqual(db.statements, tt.want) {
+				t.Errorf("got statements %q, want %q", db.statements, tt.want)
+			}
+			if db.version != tt.wantVersion {
+				t.Errorf("got version %d, want %d", db.version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestRollbackSchema(t *testing.T) {
+	t.Parallel()
+
+	db := &recordingDB{version: 2}
+	s := newRecordingStore(t, db)
+	if err := s.RollbackSchema(context.Background(), 0); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	want := []string{
+		"LOCK", "CREATE schema_version",
+		"DROP INDEX i", "DELETE version", "COMMIT",
+		"DROP TABLE t", "DELETE version", "COMMIT",
+		"UNLOCK",
+	}
+	if !reflect.DeepEqual(db.statements, want) {
+		t.Errorf("got statements %q, want %q", db.statements, want)
+	}
+	if db.version != 0 {
+		t.Errorf("got version %d, want 0", db.version)
+	}
+	if err := s.RollbackSchema(context.Background(), 3); err == nil || !strings.Contains(err.Error(), errMsgUnknownSchemaVersion) {
+		t.Errorf("got err %v, want it to include %q", err, errMsgUnknownSchemaVersion)
+	}
+}
+
+func TestVerifySchema(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		currentVersion int
+		wantErr        bool
+	}{
+		{name: "latest", currentVersion: 2},
+		{name: "outdated", currentVersion: 1, wantErr: true},
+		{name: "newer", currentVersion: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s := newRecordingStore(t, &recordingDB{version: tt.currentVersion})
+			if err := s.VerifySchema(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("got err %v, want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
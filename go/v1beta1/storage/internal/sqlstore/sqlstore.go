@@ -0,0 +1,228 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+
+// Package sqlstore implements the Grafeas storage on top of database/sql,
+// and it's shared by the StorageCreators of the supported DBMSes, which provide a Dialect.
+//
+// The resources are stored as JSON (see protojson) in JSON columns.
+// The writes go to the writer and the reads go to the reader,
+// so a storage with a separate reader may not read its own writes immediately because of the replication lag.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"time"
+
+	"github.com/fernet/fernet-go"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+)
+
+const (
+	errMsgGeneratePaginationKey = "failed to generate the pagination key"
+	errMsgInvalidPaginationKey  = "invalid pagination key; must be 256-bit URL-safe base64"
+)
+
+// Queries contains the SQL statements of a DBMS. Their parameters are described on each field.
+type Queries struct {
+	// LockSchema acquires the advisory lock serializing the schema migrations, waiting for it if necessary.
+	LockSchema string
+	// UnlockSchema releases the advisory lock.
+	UnlockSchema string
+	// CreateSchemaVersionTable creates the schema_version table if it doesn't exist.
+	CreateSchemaVersionTable string
+	// SelectSchemaVersion returns the current version, which is 0 if no migration has been applied.
+	SelectSchemaVersion string
+	// InsertSchemaVersion takes the version which has been applied.
+	InsertSchemaVersion string
+	// DeleteSchemaVersion takes the version which has been reverted.
+	DeleteSchemaVersion string
+
+	// InsertProject takes the project ID.
+	InsertProject string
+	// ProjectExists takes the project ID and returns a boolean.
+	ProjectExists string
+	// DeleteProject takes the project ID.
+	DeleteProject string
+	// ListProjects takes the ID of the last row of the previous page and the limit, and returns (id, project ID).
+	ListProjects string
+
+	// InsertNote takes the project ID, the note ID and the JSON.
+	InsertNote string
+	// SearchNote takes the project ID and the note ID, and returns the JSON.
+	SearchNote string
+	// SearchNoteForUpdate is SearchNote which locks the row until the end of the transaction.
+	SearchNoteForUpdate string
+	// UpdateNote takes the JSON, the project ID and the note ID.
+	UpdateNote string
+	// DeleteNote takes the project ID and the note ID.
+	DeleteNote string
+	// ListNotes takes the project ID, the ID of the last row of the previous page and the limit, and returns (id, JSON).
+	ListNotes string
+
+	// InsertOccurrence takes the project ID, the occurrence ID, the project ID and the note ID of its note, and the JSON.
+	// The ID of the note must be looked up so that a missing note violates the NOT NULL constraint.
+	InsertOccurrence string
+	// SearchOccurrence takes the project ID and the occurrence ID, and returns the JSON.
+	SearchOccurrence string
+	// SearchOccurrenceForUpdate is SearchOccurrence which locks the row until the end of the transaction.
+	SearchOccurrenceForUpdate string
+	// UpdateOccurrence takes the JSON, the project ID and the occurrence ID.
+	UpdateOccurrence string
+	// DeleteOccurrence takes the project ID and the occurrence ID.
+	DeleteOccurrence string
+	// ListOccurrences takes the project ID, the ID of the last row of the previous page and the limit, and returns (id, JSON).
+	ListOccurrences string
+	// SearchOccurrenceNote takes the project ID and the occurrence ID, and returns the JSON of its note.
+	SearchOccurrenceNote string
+	// ListNoteOccurrences takes the project ID and the note ID, the ID of the last row of the previous page and the limit,
+	// and returns (id, JSON).
+	ListNoteOccurrences string
+
+	// SummarizeVulnerabilityOccurrences takes the project ID,
+	// and returns (resource URI, severity, fixable count, total count) of the vulnerability occurrences.
+	// An occurrence is fixable if any of its packages has a fixed version, i.e. a version other than MAXIMUM.
+	SummarizeVulnerabilityOccurrences string
+
+	// SelectReadOnly returns a boolean which is true if the session can't write, e.g. because the DB is a replica.
+	SelectReadOnly string
+
+	// InsertAuditRecord takes the time, the method, the resource, the caller, the code and the JSON of an audit record.
+	InsertAuditRecord string
+}
+
+// Dialect contains what differs between the DBMSes.
+type Dialect struct {
+	Queries
+	// Migrations contains the files named <version>_<name>.{up,down}.sql, e.g. 0001_initial.up.sql,
+	// in the directory named migrations.
+	Migrations fs.FS
+	// IsUniqueViolation reports whether err is caused by a resource with the same name.
+	IsUniqueViolation func(err error) bool
+	// IsNotNullViolation reports whether err is caused by the missing note of a new occurrence.
+	IsNotNullViolation func(err error) bool
+	// IsForeignKeyViolation reports whether err is caused by deleting a note which still has occurrences.
+	IsForeignKeyViolation func(err error) bool
+}
+
+// Store implements storage.Storage, storage.PoolStatsReporter and storage.ReadOnlyDetector with a SQL DB.
+// The writer and the reader may be the same sql.DB.
+type Store struct {
+	writer        *sql.DB
+	reader        *sql.DB
+	paginationKey *fernet.Key
+	logger        *log.Logger
+	dialect       Dialect
+	migrations    []migration
+}
+
+// New returns a Store. The schema is managed by MigrateSchema, which must be invoked before the Store is used.
+// The page tokens are encrypted with paginationKey, which is generated if it's empty.
+func New(writer, reader *sql.DB, paginationKey string, logger *log.Logger, dialect Dialect) (*Store, error) {
+	key, err := decodePaginationKey(paginationKey, logger)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations(dialect.Migrations)
+	if err != nil {
+		return nil, fmt.Errorf("%s, err: %v", errMsgLoadMigrations, err)
+	}
+	return &Store{
+		writer:        writer,
+		reader:        reader,
+		paginationKey: key,
+		logger:        logger,
+		dialect:       dialect,
+		migrations:    migrations,
+	}, nil
+}
+
+// decodePaginationKey returns a new key if paginationKey is empty,
+// in which case the page tokens are only valid in this process.
+func decodePaginationKey(paginationKey string, logger *log.Logger) (*fernet.Key, error) {
+	if paginationKey == "" {
+		logger.Println("pagination key is empty, generating one which is not shared with the other instances")
+		var key fernet.Key
+		if err := key.Generate(); err != nil {
+			return nil, fmt.Errorf("%s, err: %v", errMsgGeneratePaginationKey, err)
+		}
+		return &key, nil
+	}
+	key, err := fernet.DecodeKey(paginationKey)
+	if err != nil {
+		return nil, errors.New(errMsgInvalidPaginationKey)
+	}
+	return key, nil
+}
+
+// forEachDB invokes f on the writer, and on the reader as well if it's different from the writer.
+func (s *Store) forEachDB(f func(*sql.DB)) {
+	f(s.writer)
+	if s.reader != s.writer {
+		f(s.reader)
+	}
+}
+
+// SetMaxOpenConns sets the limit of each connection pool.
+func (s *Store) SetMaxOpenConns(n int) {
+	s.forEachDB(func(db *sql.DB) { db.SetMaxOpenConns(n) })
+}
+
+// SetMaxIdleConns sets the limit of each connection pool.
+func (s *Store) SetMaxIdleConns(n int) {
+	s.forEachDB(func(db *sql.DB) { db.SetMaxIdleConns(n) })
+}
+
+// SetConnMaxLifetime sets the limit of each connection pool.
+func (s *Store) SetConnMaxLifetime(d time.Duration) {
+	s.forEachDB(func(db *sql.DB) { db.SetConnMaxLifetime(d) })
+}
+
+// SetConnMaxIdleTime sets the limit of each connection pool.
+func (s *Store) SetConnMaxIdleTime(d time.Duration) {
+	s.forEachDB(func(db *sql.DB) { db.SetConnMaxIdleTime(d) })
+}
+
+// WriterStats implements storage.PoolStatsReporter.
+func (s *Store) WriterStats() sql.DBStats {
+	return s.writer.Stats()
+}
+
+// ReaderStats implements storage.PoolStatsReporter.
+func (s *Store) ReaderStats() sql.DBStats {
+	return s.reader.Stats()
+}
+
+// WriterReadOnly implements storage.ReadOnlyDetector.
+func (s *Store) WriterReadOnly(ctx context.Context) (bool, error) {
+	var readOnly bool
+	err := s.writer.QueryRowContext(ctx, s.dialect.SelectReadOnly).Scan(&readOnly)
+	return readOnly, err
+}
+
+// Close closes the connection pools.
+func (s *Store) Close() error {
+	var errs []error
+	s.forEachDB(func(db *sql.DB) {
+		if err := db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	})
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+var (
+	_ storage.Storage           = (*Store)(nil)
+	_ storage.PoolStatsReporter = (*Store)(nil)
+	_ storage.SchemaManager     = (*Store)(nil)
+	_ storage.ReadOnlyDetector  = (*Store)(nil)
+)
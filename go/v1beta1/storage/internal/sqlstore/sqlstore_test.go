@@ -0,0 +1,43 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package sqlstore
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+func TestDecodePaginationKey(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		paginationKey string
+		wantErrMsg    string
+	}{
+		{name: "generated", paginationKey: ""},
+		{name: "valid", paginationKey: "cWdWlc1Xu6kVrZBBvCXCHnYtWdazJVQuF6mRRSJDTwM="},
+		{name: "invalid", paginationKey: "some_random_key", wantErrMsg: errMsgInvalidPaginationKey},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			key, err := decodePaginationKey(tt.paginationKey, log.New(io.Discard, "", 0))
+			if tt.wantErrMsg != "" {
+				if err == nil || err.Error() != tt.wantErrMsg {
+					t.Fatalf("got err %v, want %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if key == nil {
+				t.Fatal("got nil key")
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/grafeas/grafeas/go/name"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/fieldmask"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/pagination"
+)
+
+const (
+	errMsgInsertProject     = "failed to insert the project"
+	errMsgQueryProject      = "failed to query the project"
+	errMsgDeleteProject     = "failed to delete the project"
+	errMsgListProjects      = "failed to list the projects"
+	errMsgInsertNote        = "failed to insert the note"
+	errMsgQueryNote         = "failed to query the note"
+	errMsgUpdateNote        = "failed to update the note"
+	errMsgDeleteNote        = "failed to delete the note"
+	errMsgListNotes         = "failed to list the notes"
+	errMsgInsertOccurrence  = "failed to insert the occurrence"
+	errMsgQueryOccurrence   = "failed to query the occurrence"
+	errMsgUpdateOccurrence  = "failed to update the occurrence"
+	errMsgDeleteOccurrence  = "failed to delete the occurrence"
+	errMsgListOccurrences   = "failed to list the occurrences"
+	errMsgSummarize         = "failed to summarize the vulnerability occurrences"
+	errMsgGenerateID        = "failed to generate the occurrence ID"
+	errMsgEncodePageToken   = "failed to encode the page token"
+	errMsgMarshalResource   = "failed to marshal the resource"
+	errMsgUnmarshalResource = "failed to unmarshal the resource"
+)
+
+var unmarshalOptions = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+// internalError logs err with msg and returns an error which doesn't leak the details to the clients,
+// but keeps err to be classified by storage.RetryingStorage.
+func (s *Store) internalError(msg string, err error) error {
+	s.logger.Printf("%s, err: %v", msg, err)
+	return storage.InternalError(msg, err)
+}
+
+// CreateProject creates the specified project.
+func (s *Store) CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error) {
+	if _, err := s.writer.ExecContext(ctx, s.dialect.InsertProject, pID); err != nil {
+		if s.dialect.IsUniqueViolation(err) {
+			return nil, status.Errorf(codes.AlreadyExists, "project %q already exists", pID)
+		}
+		return nil, s.internalError(errMsgInsertProject, err)
+	}
+	return &prpb.Project{Name: name.FormatProject(pID)}, nil
+}
+
+// GetProject gets the specified project.
+func (s *Store) GetProject(ctx context.Context, pID string) (*prpb.Project, error) {
+	var exists bool
+	if err := s.reader.QueryRowContext(ctx, s.dialect.ProjectExists, pID).Scan(&exists); err != nil {
+		return nil, s.internalError(errMsgQueryProject, err)
+	}
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "project %q does not exist", pID)
+	}
+	return &prpb.Project{Name: name.FormatProject(pID)}, nil
+}
+
+// ListProjects returns up to pageSize projects after pageToken. The filter is ignored.
+func (s *Store) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error) {
+	var projects []*prpb.Project
+	next, err := s.list(ctx, s.dialect.ListProjects, errMsgListProjects, pageSize, pageToken, nil, func(rows *sql.Rows) (int64, error) {
+		var id int64
+		var pID string
+		if err := rows.Scan(&id, &pID); err != nil {
+			return 0, err
+		}
+		projects = append(projects, &prpb.Project{Name: name.FormatProject(pID)})
+		return id, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return projects, next, nil
+}
+
+// DeleteProject deletes the specified project. Its notes and occurrences are kept.
+func (s *Store) DeleteProject(ctx context.Context, pID string) error {
+	return s.delete(ctx, s.dialect.DeleteProject, errMsgDeleteProject, name.FormatProject(pID), pID)
+}
+
+// GetOccurrence gets the specified occurrence.
+func (s *Store) GetOccurrence(ctx context.Context, pID, oID string) (*gpb.Occurrence, error) {
+	o := &gpb.Occurrence{}
+	if err := s.get(ctx, s.reader, s.dialect.SearchOccurrence, errMsgQueryOccurrence, name.FormatOccurrence(pID, oID), o, pID, oID); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ListOccurrences returns up to pageSize occurrences of the project after pageToken. The filter is ignored.
+func (s *Store) ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*gpb.Occurrence, string, error) {
+	return s.listOccurrences(ctx, s.dialect.ListOccurrences, int(pageSize), pageToken, pID)
+}
+
+// CreateOccurrence creates the specified occurrence with a random ID.
+// The note of the occurrence must exist.
+func (s *Store) CreateOccurrence(ctx context.Context, pID, uID string, o *gpb.Occurrence) (*gpb.Occurrence, error) {
+	nPID, nID, err := name.ParseNote(o.GetNoteName())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid note name %q", o.GetNoteName())
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, s.internalError(errMsgGenerateID, err)
+	}
+	o = proto.Clone(o).(*gpb.Occurrence)
+	o.Name = name.FormatOccurrence(pID, id.String())
+	o.CreateTime = timestamppb.Now()
+	o.UpdateTime = o.CreateTime
+	data, err := protojson.Marshal(o)
+	if err != nil {
+		return nil, s.internalError(errMsgMarshalResource, err)
+	}
+	if _, err := s.writer.ExecContext(ctx, s.dialect.InsertOccurrence, pID, id.String(), nPID, nID, string(data)); err != nil {
+		switch {
+		case s.dialect.IsUniqueViolation(err):
+			return nil, status.Errorf(codes.AlreadyExists, "occurrence %q already exists", o.Name)
+		case s.dialect.IsNotNullViolation(err):
+			return nil, status.Errorf(codes.NotFound, "note %q does not exist", o.NoteName)
+		}
+		return nil, s.internalError(errMsgInsertOccurrence, err)
+	}
+	return o, nil
+}
+
+// BatchCreateOccurrences creates the specified occurrences,
+// and returns the created ones along with the errors of the others.
+func (s *Store) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*gpb.Occurrence) ([]*gpb.Occurrence, []error) {
+	created := []*gpb.Occurrence{}
+	errs := []error{}
+	for _, o := range occs {
+		occ, err := s.CreateOccurrence(ctx, pID, uID, o)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		created = append(created, occ)
+	}
+	return created, errs
+}
+
+// UpdateOccurrence updates the fields of the specified occurrence in mask, or all the fields if mask is empty.
+func (s *Store) UpdateOccurrence(ctx context.Context, pID, oID string, o *gpb.Occurrence, mask *fieldmaskpb.FieldMask) (*gpb.Occurrence, error) {
+	updated := &gpb.Occurrence{}
+	err := s.update(ctx, s.dialect.SearchOccurrenceForUpdate, s.dialect.UpdateOccurrence, errMsgUpdateOccurrence, name.FormatOccurrence(pID, oID), updated, o, mask, pID, oID)
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteOccurrence deletes the specified occurrence.
+func (s *Store) DeleteOccurrence(ctx context.Context, pID, oID string) error {
+	return s.delete(ctx, s.dialect.DeleteOccurrence, errMsgDeleteOccurrence, name.FormatOccurrence(pID, oID), pID, oID)
+}
+
+// GetNote gets the specified note.
+func (s *Store) GetNote(ctx context.Context, pID, nID string) (*gpb.Note, error) {
+	n := &gpb.Note{}
+	if err := s.get(ctx, s.reader, s.dialect.SearchNote, errMsgQueryNote, name.FormatNote(pID, nID), n, pID, nID); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListNotes returns up to pageSize notes of the project after pageToken. The filter is ignored.
+func (s *Store) ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*gpb.Note, string, error) {
+	var notes []*gpb.Note
+	next, err := s.list(ctx, s.dialect.ListNotes, errMsgListNotes, int(pageSize), pageToken, []interface{}{pID}, func(rows *sql.Rows) (int64, error) {
+		n := &gpb.Note{}
+		id, err := scanResource(rows, n)
+		if err != nil {
+			return 0, err
+		}
+		notes = append(notes, n)
+		return id, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return notes, next, nil
+}
+
+// CreateNote creates the specified note.
+func (s *Store) CreateNote(ctx context.Context, pID, nID, uID string, n *gpb.Note) (*gpb.Note, error) {
+	n = proto.Clone(n).(*gpb.Note)
+	n.Name = name.FormatNote(pID, nID)
+	n.CreateTime = timestamppb.Now()
+	n.UpdateTime = n.CreateTime
+	data, err := protojson.Marshal(n)
+	if err != nil {
+		return nil, s.internalError(errMsgMarshalResource, err)
+	}
+	if _, err := s.writer.ExecContext(ctx, s.dialect.InsertNote, pID, nID, string(data)); err != nil {
+		if s.dialect.IsUniqueViolation(err) {
+			return nil, status.Errorf(codes.AlreadyExists, "note %q already exists", n.Name)
+		}
+		return nil, s.internalError(errMsgInsertNote, err)
+	}
+	return n, nil
+}
+
+// BatchCreateNotes creates the specified notes keyed by their IDs,
+// and returns the created ones along with the errors of the others.
+func (s *Store) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*gpb.Note) ([]*gpb.Note, []error) {
+	created := []*gpb.Note{}
+	errs := []error{}
+	for nID, n := range notes {
+		note, err := s.CreateNote(ctx, pID, nID, uID, n)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		created = append(created, note)
+	}
+	return created, errs
+}
+
+// UpdateNote updates the fields of the specified note in mask, or all the fields if mask is empty.
+func (s *Store) UpdateNote(ctx context.Context, pID, nID string, n *gpb.Note, mask *fieldmaskpb.FieldMask) (*gpb.Note, error) {
+	updated := &gpb.Note{}
+	err := s.update(ctx, s.dialect.SearchNoteForUpdate, s.dialect.UpdateNote, errMsgUpdateNote, name.FormatNote(pID, nID), updated, n, mask, pID, nID)
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// DeleteNote deletes the specified note. It fails if the note still has occurrences.
+func (s *Store) DeleteNote(ctx context.Context, pID, nID string) error {
+	return s.delete(ctx, s.dialect.DeleteNote, errMsgDeleteNote, name.FormatNote(pID, nID), pID, nID)
+}
+
+// GetOccurrenceNote gets the note of the specified occurrence.
+func (s *Store) GetOccurrenceNote(ctx context.Context, pID, oID string) (*gpb.Note, error) {
+	n := &gpb.Note{}
+	if err := s.get(ctx, s.reader, s.dialect.SearchOccurrenceNote, errMsgQueryNote, "note of "+name.FormatOccurrence(pID, oID), n, pID, oID); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListNoteOccurrences returns up to pageSize occurrences of the note after pageToken. The filter is ignored.
+func (s *Store) ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*gpb.Occurrence, string, error) {
+	if _, err := s.GetNote(ctx, pID, nID); err != nil {
+		return nil, "", err
+	}
+	return s.listOccurrences(ctx, s.dialect.ListNoteOccurrences, int(pageSize), pageToken, pID, nID)
+}
+
+// GetVulnerabilityOccurrencesSummary counts the vulnerability occurrences of the project by the resource and the severity.
+// The filter is ignored.
+func (s *Store) GetVulnerabilityOccurrencesSummary(ctx context.Context, pID, filter string) (*gpb.VulnerabilityOccurrencesSummary, error) {
+	rows, err := s.reader.QueryContext(ctx, s.dialect.SummarizeVulnerabilityOccurrences, pID)
+	if err != nil {
+		return nil, s.internalError(errMsgSummarize, err)
+	}
+	defer rows.Close()
+	summary := &gpb.VulnerabilityOccurrencesSummary{}
+	for rows.Next() {
+		var uri, severity string
+		c := &gpb.VulnerabilityOccurrencesSummary_FixableTotalByDigest{}
+		if err := rows.Scan(&uri, &severity, &c.FixableCount, &c.TotalCount); err != nil {
+			return nil, s.internalError(errMsgSummarize, err)
+		}
+		c.Resource = &gpb.Resource{Uri: uri}
+		c.Severity = vpb.Severity(vpb.Severity_value[severity])
+		summary.Counts = append(summary.Counts, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, s.internalError(errMsgSummarize, err)
+	}
+	return summary, nil
+}
+
+// queryRower is implemented by sql.DB and sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// get unmarshals the resource selected by query into m. resource describes it in the NotFound error.
+func (s *Store) get(ctx context.Context, q queryRower, query, errMsg, resource string, m proto.Message, args ...interface{}) error {
+	var data []byte
+	if err := q.QueryRowContext(ctx, query, args...).Scan(&data); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return status.Errorf(codes.NotFound, "%s does not exist", resource)
+		}
+		return s.internalError(errMsg, err)
+	}
+	if err := unmarshalOptions.Unmarshal(data, m); err != nil {
+		return s.internalError(errMsgUnmarshalResource, err)
+	}
+	return nil
+}
+
+// update replaces the resource selected by selectQuery with a merge of itself and m in a transaction.
+// Only the fields in mask are taken from m, or all the fields if mask is empty.
+// The name and the creation time are always kept, and the update time is set to now.
+func (s *Store) update(ctx context.Context, selectQuery, updateQuery, errMsg, resource string, updated, m proto.Message, mask *fieldmaskpb.FieldMask, pID, id string) (err error) {
+	tx, err := s.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return s.internalError(errMsg, err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err := s.get(ctx, tx, selectQuery, errMsg, resource, updated, pID, id); err != nil {
+		return err
+	}
+	if err := fieldmask.Update(updated, m, mask); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	switch u := updated.(type) {
+	case *gpb.Note:
+		u.UpdateTime = timestamppb.Now()
+	case *gpb.Occurrence:
+		u.UpdateTime = timestamppb.Now()
+	}
+	data, err := protojson.Marshal(updated)
+	if err != nil {
+		return s.internalError(errMsgMarshalResource, err)
+	}
+	if _, err := tx.ExecContext(ctx, updateQuery, string(data), pID, id); err != nil {
+		return s.internalError(errMsg, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return s.internalError(errMsg, err)
+	}
+	return nil
+}
+
+// delete deletes the resource selected by query. resource describes it in the errors returned to the clients.
+func (s *Store) delete(ctx context.Context, query, errMsg, resource string, args ...interface{}) error {
+	res, err := s.writer.ExecContext(ctx, query, args...)
+	if err != nil {
+		if s.dialect.IsForeignKeyViolation(err) {
+			return status.Errorf(codes.FailedPrecondition, "%s still has occurrences", resource)
+		}
+		return s.internalError(errMsg, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return s.internalError(errMsg, err)
+	}
+	if n == 0 {
+		return status.Errorf(codes.NotFound, "%s does not exist", resource)
+	}
+	return nil
+}
+
+// list runs query with args followed by the ID after pageToken and the page size,
+// and invokes scan on each row, which returns the ID of the row.
+// It fetches one more row than the page size to know if there is a next page,
+// and it returns the token of the next page if any.
+func (s *Store) list(ctx context.Context, query, errMsg string, pageSize int, pageToken string, args []interface{}, scan func(*sql.Rows) (int64, error)) (string, error) {
+	after, err := pagination.DecodePageToken(pageToken, s.paginationKey)
+	if err != nil {
+		return "", err
+	}
+	pageSize = pagination.NormalizePageSize(pageSize)
+	rows, err := s.reader.QueryContext(ctx, query, append(args, after, pageSize+1)...)
+	if err != nil {
+		return "", s.internalError(errMsg, err)
+	}
+	defer rows.Close()
+	var lastID int64
+	count := 0
+	for rows.Next() {
+		if count == pageSize {
+			next, err := pagination.EncodePageToken(lastID, s.paginationKey)
+			if err != nil {
+				return "", s.internalError(errMsgEncodePageToken, err)
+			}
+			return next, nil
+		}
+		if lastID, err = scan(rows); err != nil {
+			return "", s.internalError(errMsg, err)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return "", s.internalError(errMsg, err)
+	}
+	return "", nil
+}
+
+func (s *Store) listOccurrences(ctx context.Context, query string, pageSize int, pageToken string, args ...interface{}) ([]*gpb.Occurrence, string, error) {
+	var occs []*gpb.Occurrence
+	next, err := s.list(ctx, query, errMsgListOccurrences, pageSize, pageToken, args, func(rows *sql.Rows) (int64, error) {
+		o := &gpb.Occurrence{}
+		id, err := scanResource(rows, o)
+		if err != nil {
+			return 0, err
+		}
+		occs = append(occs, o)
+		return id, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return occs, next, nil
+}
+
+// scanResource unmarshals the resource in the row of (id, data) into m, and returns the ID.
+func scanResource(rows *sql.Rows, m proto.Message) (int64, error) {
+	var id int64
+	var data []byte
+	if err := rows.Scan(&id, &data); err != nil {
+		return 0, err
+	}
+	return id, unmarshalOptions.Unmarshal(data, m)
+}
@@ -0,0 +1,145 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+
+// Package memstore provides a storage.Storage which keeps the Grafeas resources in memory,
+// for the tests and the local development without a database.
+//
+// It behaves the same as the PostgreSQL and MySQL storages, including the gRPC codes and the page tokens,
+// but the resources are lost when the process exits.
+package memstore
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fernet/fernet-go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/pagination"
+)
+
+const (
+	errMsgGeneratePaginationKey = "failed to generate the pagination key"
+	errMsgEncodePageToken       = "failed to encode the page token"
+)
+
+// entry is a stored resource.
+type entry struct {
+	// id orders the resources in the lists like the sequential IDs of the SQL storages.
+	id int64
+	// pID is the ID of the project which the resource belongs to.
+	pID string
+	// noteName is the name of the note of an occurrence at its creation,
+	// which isn't changed by the updates of the occurrence.
+	noteName string
+	m        proto.Message
+}
+
+// Store implements storage.Storage in memory. It's safe for concurrent use.
+type Store struct {
+	mu            sync.RWMutex
+	paginationKey *fernet.Key
+	lastID        int64
+	// projects are keyed by the project IDs, and the notes and the occurrences by their names.
+	projects    map[string]*entry
+	notes       map[string]*entry
+	occurrences map[string]*entry
+}
+
+// New returns an empty Store. Its page tokens are only valid in this process.
+func New() (*Store, error) {
+	var key fernet.Key
+	if err := key.Generate(); err != nil {
+		return nil, fmt.Errorf("%s, err: %v", errMsgGeneratePaginationKey, err)
+	}
+	return &Store{
+		paginationKey: &key,
+		projects:      map[string]*entry{},
+		notes:         map[string]*entry{},
+		occurrences:   map[string]*entry{},
+	}, nil
+}
+
+// nextID returns a new ID of an entry. s.mu must be locked.
+func (s *Store) nextID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+// list returns up to pageSize of the entries matching match after pageToken in the order of their IDs,
+// along with the token of the next page if any. s.mu must be locked at least for reading.
+func (s *Store) list(entries map[string]*entry, match func(*entry) bool, pageSize int, pageToken string) ([]*entry, string, error) {
+	after, err := pagination.DecodePageToken(pageToken, s.paginationKey)
+	if err != nil {
+		return nil, "", err
+	}
+	var matched []*entry
+	for _, e := range entries {
+		if e.id > after && match(e) {
+			matched = append(matched, e)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].id < matched[j].id })
+	pageSize = pagination.NormalizePageSize(pageSize)
+	if len(matched) <= pageSize {
+		return matched, "", nil
+	}
+	matched = matched[:pageSize]
+	next, err := pagination.EncodePageToken(matched[pageSize-1].id, s.paginationKey)
+	if err != nil {
+		return nil, "", internalError(errMsgEncodePageToken)
+	}
+	return matched, next, nil
+}
+
+// SetMaxOpenConns does nothing since there are no connections.
+func (s *Store) SetMaxOpenConns(int) {}
+
+// SetMaxIdleConns does nothing since there are no connections.
+func (s *Store) SetMaxIdleConns(int) {}
+
+// SetConnMaxLifetime does nothing since there are no connections.
+func (s *Store) SetConnMaxLifetime(time.Duration) {}
+
+// SetConnMaxIdleTime does nothing since there are no connections.
+func (s *Store) SetConnMaxIdleTime(time.Duration) {}
+
+var _ storage.Storage = (*Store)(nil)
+
+// StorageCreator implements storage.StorageCreator by returning the same Store every time,
+// so that the resources are kept when GrafeasStorageProvider creates a storage again, e.g. on a reload.
+type StorageCreator struct {
+	mu    sync.Mutex
+	store *Store
+}
+
+// NewStorageCreator returns a StorageCreator.
+func NewStorageCreator() *StorageCreator {
+	return &StorageCreator{}
+}
+
+// Create returns the Store of c, which is created on the first invocation. The arguments are ignored.
+func (c *StorageCreator) Create(driver.Connector, string) (storage.Storage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		s, err := New()
+		if err != nil {
+			return nil, err
+		}
+		c.store = s
+	}
+	return c.store, nil
+}
+
+// CreateRW returns the Store of c like Create. The arguments are ignored.
+func (c *StorageCreator) CreateRW(readerConnector driver.Connector, writerConnector driver.Connector, paginationKey string) (storage.Storage, error) {
+	return c.Create(writerConnector, paginationKey)
+}
+
+var _ storage.StorageCreator = (*StorageCreator)(nil)
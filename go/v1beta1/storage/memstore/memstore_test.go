@@ -0,0 +1,72 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package memstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grafeas/grafeas/go/config"
+	grafeas "github.com/grafeas/grafeas/go/v1beta1/api"
+	"github.com/grafeas/grafeas/go/v1beta1/project"
+	gstorage "github.com/grafeas/grafeas/go/v1beta1/storage"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/storagetest"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStorage(t *testing.T) {
+	t.Parallel()
+
+	gstorage.DoTestStorage(t, func(t *testing.T) (grafeas.Storage, project.Storage, func()) {
+		s := newTestStore(t)
+		return s, s, func() {}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	t.Parallel()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return newTestStore(t)
+	})
+}
+
+func TestStorageCreator(t *testing.T) {
+	t.Parallel()
+
+	conf := config.StorageConfiguration(rdsconfig.Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLRootCert: "../testdata/ca.pem",
+	})
+	provider := storage.NewGrafeasStorageProvider(nil, nil, NewStorageCreator())
+	first, err := provider.Provide("", &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := first.Ps.CreateProject(context.Background(), "p1", nil); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// The resources are kept when the provider creates a storage again.
+	second, err := provider.ProvideRW("", &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := second.Ps.GetProject(context.Background(), "p1"); err != nil {
+		t.Errorf("the project created in the first storage is not found in the second one, err: %v", err)
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package memstore
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/grafeas/grafeas/go/name"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	pkgpb "github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/fieldmask"
+)
+
+const errMsgGenerateID = "failed to generate the occurrence ID"
+
+// internalError returns an error which has the same code and message as the ones of the SQL storages.
+func internalError(msg string) error {
+	return status.Error(codes.Internal, msg)
+}
+
+// notFoundError returns the error of a missing resource.
+func notFoundError(resource string) error {
+	return status.Errorf(codes.NotFound, "%s does not exist", resource)
+}
+
+// CreateProject creates the specified project.
+func (s *Store) CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.projects[pID]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "project %q already exists", pID)
+	}
+	p = &prpb.Project{Name: name.FormatProject(pID)}
+	s.projects[pID] = &entry{id: s.nextID(), pID: pID, m: p}
+	return proto.Clone(p).(*prpb.Project), nil
+}
+
+// GetProject gets the specified project.
+func (s *Store) GetProject(ctx context.Context, pID string) (*prpb.Project, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.projects[pID]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "project %q does not exist", pID)
+	}
+	return proto.Clone(e.m).(*prpb.Project), nil
+}
+
+// ListProjects returns up to pageSize projects after pageToken. The filter is ignored.
+func (s *Store) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, next, err := s.list(s.projects, func(*entry) bool { return true }, pageSize, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	projects := make([]*prpb.Project, 0, len(entries))
+	for _, e := range entries {
+		projects = append(projects, proto.Clone(e.m).(*prpb.Project))
+	}
+	return projects, next, nil
+}
+
+// DeleteProject deletes the specified project. Its notes and occurrences are kept.
+func (s *Store) DeleteProject(ctx context.Context, pID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.projects[pID]; !ok {
+		return notFoundError(name.FormatProject(pID))
+	}
+	delete(s.projects, pID)
+	return nil
+}
+
+// GetOccurrence gets the specified occurrence.
+func (s *Store) GetOccurrence(ctx context.Context, pID, oID string) (*gpb.Occurrence, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	oName := name.FormatOccurrence(pID, oID)
+	e, ok := s.occurrences[oName]
+	if !ok {
+		return nil, notFoundError(oName)
+	}
+	return proto.Clone(e.m).(*gpb.Occurrence), nil
+}
+
+// ListOccurrences returns up to pageSize occurrences of the project after pageToken. The filter is ignored.
+func (s *Store) ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*gpb.Occurrence, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.listOccurrences(func(e *entry) bool { return e.pID == pID }, int(pageSize), pageToken)
+}
+
+// CreateOccurrence creates the specified occurrence with a random ID.
+// The note of the occurrence must exist.
+func (s *Store) CreateOccurrence(ctx context.Context, pID, uID string, o *gpb.Occurrence) (*gpb.Occurrence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createOccurrence(pID, o)
+}
+
+// createOccurrence creates the specified occurrence. s.mu must be locked.
+func (s *Store) createOccurrence(pID string, o *gpb.Occurrence) (*gpb.Occurrence, error) {
+	if _, _, err := name.ParseNote(o.GetNoteName()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid note name %q", o.GetNoteName())
+	}
+	if _, ok := s.notes[o.GetNoteName()]; !ok {
+		return nil, status.Errorf(codes.NotFound, "note %q does not exist", o.GetNoteName())
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, internalError(errMsgGenerateID)
+	}
+	o = proto.Clone(o).(*gpb.Occurrence)
+	o.Name = name.FormatOccurrence(pID, id.String())
+	o.CreateTime = timestamppb.Now()
+	o.UpdateTime = o.CreateTime
+	if _, ok := s.occurrences[o.Name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "occurrence %q already exists", o.Name)
+	}
+	s.occurrences[o.Name] = &entry{id: s.nextID(), pID: pID, noteName: o.NoteName, m: o}
+	return proto.Clone(o).(*gpb.Occurrence), nil
+}
+
+// BatchCreateOccurrences creates the specified occurrences,
+// and returns the created ones along with the errors of the others.
+func (s *Store) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*gpb.Occurrence) ([]*gpb.Occurrence, []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	created := []*gpb.Occurrence{}
+	errs := []error{}
+	for _, o := range occs {
+		occ, err := s.createOccurrence(pID, o)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		created = append(created, occ)
+	}
+	return created, errs
+}
+
+// UpdateOccurrence updates the fields of the specified occurrence in mask, or all the fields if mask is empty.
+func (s *Store) UpdateOccurrence(ctx context.Context, pID, oID string, o *gpb.Occurrence, mask *fieldmaskpb.FieldMask) (*gpb.Occurrence, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oName := name.FormatOccurrence(pID, oID)
+	e, ok := s.occurrences[oName]
+	if !ok {
+		return nil, notFoundError(oName)
+	}
+	updated := proto.Clone(e.m).(*gpb.Occurrence)
+	if err := fieldmask.Update(updated, o, mask); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	updated.UpdateTime = timestamppb.Now()
+	e.m = updated
+	return proto.Clone(updated).(*gpb.Occurrence), nil
+}
+
+// DeleteOccurrence deletes the specified occurrence.
+func (s *Store) DeleteOccurrence(ctx context.Context, pID, oID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oName := name.FormatOccurrence(pID, oID)
+	if _, ok := s.occurrences[oName]; !ok {
+		return notFoundError(oName)
+	}
+	delete(s.occurrences, oName)
+	return nil
+}
+
+// GetNote gets the specified note.
+func (s *Store) GetNote(ctx context.Context, pID, nID string) (*gpb.Note, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nName := name.FormatNote(pID, nID)
+	e, ok := s.notes[nName]
+	if !ok {
+		return nil, notFoundError(nName)
+	}
+	return proto.Clone(e.m).(*gpb.Note), nil
+}
+
+// ListNotes returns up to pageSize notes of the project after pageToken. The filter is ignored.
+func (s *Store) ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) ([]*gpb.Note, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, next, err := s.list(s.notes, func(e *entry) bool { return e.pID == pID }, int(pageSize), pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	notes := make([]*gpb.Note, 0, len(entries))
+	for _, e := range entries {
+		notes = append(notes, proto.Clone(e.m).(*gpb.Note))
+	}
+	return notes, next, nil
+}
+
+// CreateNote creates the specified note.
+func (s *Store) CreateNote(ctx context.Context, pID, nID, uID string, n *gpb.Note) (*gpb.Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.createNote(pID, nID, n)
+}
+
+// createNote creates the specified note. s.mu must be locked.
+func (s *Store) createNote(pID, nID string, n *gpb.Note) (*gpb.Note, error) {
+	n = proto.Clone(n).(*gpb.Note)
+	n.Name = name.FormatNote(pID, nID)
+	if _, ok := s.notes[n.Name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "note %q already exists", n.Name)
+	}
+	n.CreateTime = timestamppb.Now()
+	n.UpdateTime = n.CreateTime
+	s.notes[n.Name] = &entry{id: s.nextID(), pID: pID, m: n}
+	return proto.Clone(n).(*gpb.Note), nil
+}
+
+// BatchCreateNotes creates the specified notes keyed by their IDs,
+// and returns the created ones along with the errors of the others.
+func (s *Store) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*gpb.Note) ([]*gpb.Note, []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	created := []*gpb.Note{}
+	errs := []error{}
+	for nID, n := range notes {
+		note, err := s.createNote(pID, nID, n)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		created = append(created, note)
+	}
+	return created, errs
+}
+
+// UpdateNote updates the fields of the specified note in mask, or all the fields if mask is empty.
+func (s *Store) UpdateNote(ctx context.Context, pID, nID string, n *gpb.Note, mask *fieldmaskpb.FieldMask) (*gpb.Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nName := name.FormatNote(pID, nID)
+	e, ok := s.notes[nName]
+	if !ok {
+		return nil, notFoundError(nName)
+	}
+	updated := proto.Clone(e.m).(*gpb.Note)
+	if err := fieldmask.Update(updated, n, mask); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	updated.UpdateTime = timestamppb.Now()
+	e.m = updated
+	return proto.Clone(updated).(*gpb.Note), nil
+}
+
+// DeleteNote deletes the specified note. It fails if the note still has occurrences.
+func (s *Store) DeleteNote(ctx context.Context, pID, nID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nName := name.FormatNote(pID, nID)
+	if _, ok := s.notes[nName]; !ok {
+		return notFoundError(nName)
+	}
+	for _, e := range s.occurrences {
+		if e.noteName == nName {
+			return status.Errorf(codes.FailedPrecondition, "%s still has occurrences", nName)
+		}
+	}
+	delete(s.notes, nName)
+	return nil
+}
+
+// GetOccurrenceNote gets the note of the specified occurrence.
+func (s *Store) GetOccurrenceNote(ctx context.Context, pID, oID string) (*gpb.Note, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	oName := name.FormatOccurrence(pID, oID)
+	o, ok := s.occurrences[oName]
+	if !ok {
+		return nil, notFoundError("note of " + oName)
+	}
+	n, ok := s.notes[o.noteName]
+	if !ok {
+		return nil, notFoundError("note of " + oName)
+	}
+	return proto.Clone(n.m).(*gpb.Note), nil
+}
+
+// ListNoteOccurrences returns up to pageSize occurrences of the note after pageToken. The filter is ignored.
+func (s *Store) ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) ([]*gpb.Occurrence, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	nName := name.FormatNote(pID, nID)
+	if _, ok := s.notes[nName]; !ok {
+		return nil, "", notFoundError(nName)
+	}
+	return s.listOccurrences(func(e *entry) bool { return e.noteName == nName }, int(pageSize), pageToken)
+}
+
+// listOccurrences lists the occurrences matching match. s.mu must be locked at least for reading.
+func (s *Store) listOccurrences(match func(*entry) bool, pageSize int, pageToken string) ([]*gpb.Occurrence, string, error) {
+	entries, next, err := s.list(s.occurrences, match, pageSize, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	occs := make([]*gpb.Occurrence, 0, len(entries))
+	for _, e := range entries {
+		occs = append(occs, proto.Clone(e.m).(*gpb.Occurrence))
+	}
+	return occs, next, nil
+}
+
+// GetVulnerabilityOccurrencesSummary counts the vulnerability occurrences of the project by the resource and the severity.
+// The filter is ignored.
+func (s *Store) GetVulnerabilityOccurrencesSummary(ctx context.Context, pID, filter string) (*gpb.VulnerabilityOccurrencesSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	type key struct {
+		uri      string
+		severity string
+	}
+	counts := map[key]*gpb.VulnerabilityOccurrencesSummary_FixableTotalByDigest{}
+	for _, e := range s.occurrences {
+		o := e.m.(*gpb.Occurrence)
+		if e.pID != pID || o.GetKind() != cpb.NoteKind_VULNERABILITY {
+			continue
+		}
+		k := key{uri: o.GetResource().GetUri(), severity: o.GetVulnerability().GetSeverity().String()}
+		c, ok := counts[k]
+		if !ok {
+			c = &gpb.VulnerabilityOccurrencesSummary_FixableTotalByDigest{
+				Resource: &gpb.Resource{Uri: k.uri},
+				Severity: o.GetVulnerability().GetSeverity(),
+			}
+			counts[k] = c
+		}
+		if isFixable(o) {
+			c.FixableCount++
+		}
+		c.TotalCount++
+	}
+	keys := make([]key, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	// The counts are sorted by the resource and the name of the severity like the SQL storages.
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].uri != keys[j].uri {
+			return keys[i].uri < keys[j].uri
+		}
+		return keys[i].severity < keys[j].severity
+	})
+	summary := &gpb.VulnerabilityOccurrencesSummary{}
+	for _, k := range keys {
+		summary.Counts = append(summary.Counts, counts[k])
+	}
+	return summary, nil
+}
+
+// isFixable reports whether any package issue of the vulnerability occurrence is fixed in a specific version.
+func isFixable(o *gpb.Occurrence) bool {
+	for _, issue := range o.GetVulnerability().GetPackageIssue() {
+		switch issue.GetFixedLocation().GetVersion().GetKind() {
+		case pkgpb.Version_VERSION_KIND_UNSPECIFIED, pkgpb.Version_MAXIMUM:
+		default:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,24 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+// Metrics receives the measurements taken by this package.
+// It can be implemented on top of any monitoring system (e.g. Prometheus or StatsD),
+// and it's plugged into GrafeasStorageProvider via WithMetrics.
+// The implementation must be safe for concurrent use.
+type Metrics interface {
+	// SetGauge sets the gauge identified by name and labels to value.
+	SetGauge(name string, labels map[string]string, value float64)
+	// AddCounter adds value to the counter identified by name and labels.
+	AddCounter(name string, labels map[string]string, value float64)
+	// ObserveHistogram adds value to the histogram identified by name and labels.
+	ObserveHistogram(name string, labels map[string]string, value float64)
+}
+
+// nopMetrics discards every measurement, and it's used if no Metrics is given.
+type nopMetrics struct{}
+
+func (nopMetrics) SetGauge(string, map[string]string, float64)         {}
+func (nopMetrics) AddCounter(string, map[string]string, float64)       {}
+func (nopMetrics) ObserveHistogram(string, map[string]string, float64) {}
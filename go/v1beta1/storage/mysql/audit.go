@@ -0,0 +1,26 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package mysql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/sqlstore"
+)
+
+// AuditSink implements storage.AuditSink by inserting the records into the audit_log table of MySQL,
+// which is created by the migrations.
+type AuditSink struct {
+	*sqlstore.AuditSink
+}
+
+// NewAuditSink returns an AuditSink which connects to the DB with connector,
+// e.g. the writer connector passed to storage.WithAudit.
+func NewAuditSink(connector driver.Connector) *AuditSink {
+	return &AuditSink{AuditSink: sqlstore.NewAuditSink(sql.OpenDB(connector), dialect)}
+}
+
+var _ storage.AuditBatchSink = (*AuditSink)(nil)
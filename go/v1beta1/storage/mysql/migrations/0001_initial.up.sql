@@ -0,0 +1,25 @@
+-- Copyright Yahoo 2021
+-- Licensed under the terms of the Apache License 2.0.
+-- See LICENSE file in project root for terms.
+CREATE TABLE IF NOT EXISTS projects (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	UNIQUE KEY (name)
+) ENGINE = InnoDB;
+CREATE TABLE IF NOT EXISTS notes (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	project_name VARCHAR(255) NOT NULL,
+	note_name VARCHAR(255) NOT NULL,
+	data JSON NOT NULL,
+	UNIQUE KEY (project_name, note_name)
+) ENGINE = InnoDB;
+-- The foreign key creates the index on note_id.
+CREATE TABLE IF NOT EXISTS occurrences (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	project_name VARCHAR(255) NOT NULL,
+	occurrence_name VARCHAR(255) NOT NULL,
+	note_id BIGINT NOT NULL,
+	data JSON NOT NULL,
+	UNIQUE KEY (project_name, occurrence_name),
+	FOREIGN KEY (note_id) REFERENCES notes (id)
+) ENGINE = InnoDB;
@@ -0,0 +1,4 @@
+-- Copyright Yahoo 2021
+-- Licensed under the terms of the Apache License 2.0.
+-- See LICENSE file in project root for terms.
+DROP TABLE audit_log;
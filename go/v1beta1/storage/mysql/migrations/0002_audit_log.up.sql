@@ -0,0 +1,14 @@
+-- Copyright Yahoo 2021
+-- Licensed under the terms of the Apache License 2.0.
+-- See LICENSE file in project root for terms.
+-- The record column contains the whole storage.AuditRecord, and the other columns are copied from it to be queried.
+CREATE TABLE IF NOT EXISTS audit_log (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	time DATETIME(6) NOT NULL,
+	method VARCHAR(255) NOT NULL,
+	resource VARCHAR(767) NOT NULL,
+	caller VARCHAR(255) NOT NULL,
+	code VARCHAR(255) NOT NULL,
+	record JSON NOT NULL,
+	KEY (resource)
+) ENGINE = InnoDB;
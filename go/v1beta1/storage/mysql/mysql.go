@@ -0,0 +1,107 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+
+// Package mysql provides a storage.StorageCreator which stores the Grafeas resources in MySQL 8 or Aurora MySQL 3.
+//
+// The resources are stored as JSON (see protojson) in JSON columns,
+// and the tables are created and upgraded by the embedded migrations (see storage.SchemaManager),
+// which GrafeasStorageProvider applies unless it's configured to only verify the schema version.
+// It behaves the same as the PostgreSQL storage, including the page tokens and the vulnerability summary.
+package mysql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"log"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/sqlstore"
+)
+
+const (
+	// erDupEntry is raised when a resource with the same name exists.
+	erDupEntry = 1062
+	// erBadNullError is raised when the note of a new occurrence doesn't exist,
+	// because its ID is looked up by a subquery. It requires the strict SQL mode, which is the default.
+	erBadNullError = 1048
+	// erRowIsReferenced2 is raised when a note to delete still has occurrences.
+	erRowIsReferenced2 = 1451
+)
+
+// migrations contains the versions of the schema. A released migration must not be modified.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+var dialect = sqlstore.Dialect{
+	Queries:               queries,
+	Migrations:            migrations,
+	IsUniqueViolation:     hasNumber(erDupEntry),
+	IsNotNullViolation:    hasNumber(erBadNullError),
+	IsForeignKeyViolation: hasNumber(erRowIsReferenced2),
+}
+
+// hasNumber returns a function reporting whether an error is returned by MySQL with the error number.
+func hasNumber(number uint16) func(error) bool {
+	return func(err error) bool {
+		var mysqlErr *mysqldriver.MySQLError
+		return errors.As(err, &mysqlErr) && mysqlErr.Number == number
+	}
+}
+
+// StorageCreator implements storage.StorageCreator for MySQL.
+type StorageCreator struct {
+	logger *log.Logger
+}
+
+// Option configures optional behaviors of StorageCreator.
+type Option func(*StorageCreator)
+
+// WithLogger makes the created storages log to logger instead of log.Default().
+func WithLogger(logger *log.Logger) Option {
+	return func(c *StorageCreator) {
+		c.logger = logger
+	}
+}
+
+// NewStorageCreator returns a StorageCreator configured with opts.
+func NewStorageCreator(opts ...Option) *StorageCreator {
+	c := &StorageCreator{logger: log.Default()}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Create returns a storage which reads from and writes to the DB connected by connector.
+func (c *StorageCreator) Create(connector driver.Connector, paginationKey string) (storage.Storage, error) {
+	db := sql.OpenDB(connector)
+	s, err := sqlstore.New(db, db, paginationKey, c.logger, dialect)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// CreateRW returns a storage which reads from the DB connected by readerConnector,
+// and writes to the DB connected by writerConnector.
+// It may not read its own writes immediately because of the replication lag.
+func (c *StorageCreator) CreateRW(readerConnector driver.Connector, writerConnector driver.Connector, paginationKey string) (storage.Storage, error) {
+	writer := sql.OpenDB(writerConnector)
+	reader := sql.OpenDB(readerConnector)
+	s, err := sqlstore.New(writer, reader, paginationKey, c.logger, dialect)
+	if err != nil {
+		writer.Close()
+		reader.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+var _ storage.StorageCreator = (*StorageCreator)(nil)
@@ -0,0 +1,149 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+	grafeas "github.com/grafeas/grafeas/go/v1beta1/api"
+	"github.com/grafeas/grafeas/go/v1beta1/project"
+	gstorage "github.com/grafeas/grafeas/go/v1beta1/storage"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/sqlstore"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/storagetest"
+)
+
+// testDSNEnv is the environment variable containing the DSN of the MySQL server to run the storage tests against,
+// e.g. "user:password@tcp(localhost:3306)/". The tests are skipped if it's not set.
+const testDSNEnv = "GRAFEAS_RDS_TEST_MYSQL_DSN"
+
+func TestErrorClassification(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name                    string
+		err                     error
+		wantUniqueViolation     bool
+		wantNotNullViolation    bool
+		wantForeignKeyViolation bool
+	}{
+		{
+			name:                "duplicate entry",
+			err:                 &mysqldriver.MySQLError{Number: erDupEntry},
+			wantUniqueViolation: true,
+		},
+		{
+			name:                 "wrapped null column",
+			err:                  fmt.Errorf("insert: %w", &mysqldriver.MySQLError{Number: erBadNullError}),
+			wantNotNullViolation: true,
+		},
+		{
+			name:                    "referenced row",
+			err:                     &mysqldriver.MySQLError{Number: erRowIsReferenced2},
+			wantForeignKeyViolation: true,
+		},
+		{
+			name: "other error",
+			err:  sql.ErrConnDone,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := dialect.IsUniqueViolation(tt.err); got != tt.wantUniqueViolation {
+				t.Errorf("IsUniqueViolation() = %v, want %v", got, tt.wantUniqueViolation)
+			}
+			if got := dialect.IsNotNullViolation(tt.err); got != tt.wantNotNullViolation {
+				t.Errorf("IsNotNullViolation() = %v, want %v", got, tt.wantNotNullViolation)
+			}
+			if got := dialect.IsForeignKeyViolation(tt.err); got != tt.wantForeignKeyViolation {
+				t.Errorf("IsForeignKeyViolation() = %v, want %v", got, tt.wantForeignKeyViolation)
+			}
+		})
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	t.Parallel()
+
+	// New fails if the embedded migrations are malformed.
+	if _, err := sqlstore.New(nil, nil, "", log.New(io.Discard, "", 0), dialect); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	gstorage.DoTestStorage(t, func(t *testing.T) (grafeas.Storage, project.Storage, func()) {
+		s := newTestStorage(t, newTestConnector(t, dsn))
+		return s, s, func() {}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return newTestStorage(t, newTestConnector(t, dsn))
+	})
+}
+
+// newTestStorage returns a migrated storage connected by connector, which is closed when the test finishes.
+func newTestStorage(t *testing.T, connector driver.Connector) storage.Storage {
+	s, err := NewStorageCreator(WithLogger(log.New(io.Discard, "", 0))).Create(connector, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(storage.SchemaManager).MigrateSchema(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.(io.Closer).Close() })
+	return s
+}
+
+// newTestConnector returns a connector to a new database, which is dropped when the test finishes.
+func newTestConnector(t *testing.T, dsn string) driver.Connector {
+	// Every test case gets its own database to start with empty tables.
+	database := "test_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+	admin, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.Exec(fmt.Sprintf("CREATE DATABASE %s", database)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(fmt.Sprintf("DROP DATABASE %s", database)); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+	cfg, err := mysqldriver.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.DBName = database
+	connector, err := mysqldriver.NewConnector(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connector
+}
@@ -0,0 +1,66 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package mysql
+
+import "github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/sqlstore"
+
+var queries = sqlstore.Queries{
+	// A negative timeout makes GET_LOCK wait for the lock indefinitely, or until the context is done.
+	LockSchema:   `SELECT GET_LOCK('grafeas-rds schema migration', -1)`,
+	UnlockSchema: `SELECT RELEASE_LOCK('grafeas-rds schema migration')`,
+	CreateSchemaVersionTable: `CREATE TABLE IF NOT EXISTS schema_version (
+			version BIGINT PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		) ENGINE = InnoDB`,
+	SelectSchemaVersion: `SELECT COALESCE(MAX(version), 0) FROM schema_version`,
+	InsertSchemaVersion: `INSERT INTO schema_version (version) VALUES (?)`,
+	DeleteSchemaVersion: `DELETE FROM schema_version WHERE version = ?`,
+
+	InsertProject: `INSERT INTO projects (name) VALUES (?)`,
+	ProjectExists: `SELECT EXISTS (SELECT 1 FROM projects WHERE name = ?)`,
+	DeleteProject: `DELETE FROM projects WHERE name = ?`,
+	ListProjects:  `SELECT id, name FROM projects WHERE id > ? ORDER BY id LIMIT ?`,
+
+	InsertNote:          `INSERT INTO notes (project_name, note_name, data) VALUES (?, ?, ?)`,
+	SearchNote:          `SELECT data FROM notes WHERE project_name = ? AND note_name = ?`,
+	SearchNoteForUpdate: `SELECT data FROM notes WHERE project_name = ? AND note_name = ? FOR UPDATE`,
+	UpdateNote:          `UPDATE notes SET data = ? WHERE project_name = ? AND note_name = ?`,
+	DeleteNote:          `DELETE FROM notes WHERE project_name = ? AND note_name = ?`,
+	ListNotes:           `SELECT id, data FROM notes WHERE project_name = ? AND id > ? ORDER BY id LIMIT ?`,
+
+	InsertOccurrence: `INSERT INTO occurrences (project_name, occurrence_name, note_id, data)
+		VALUES (?, ?, (SELECT id FROM notes WHERE project_name = ? AND note_name = ?), ?)`,
+	SearchOccurrence:          `SELECT data FROM occurrences WHERE project_name = ? AND occurrence_name = ?`,
+	SearchOccurrenceForUpdate: `SELECT data FROM occurrences WHERE project_name = ? AND occurrence_name = ? FOR UPDATE`,
+	UpdateOccurrence:          `UPDATE occurrences SET data = ? WHERE project_name = ? AND occurrence_name = ?`,
+	DeleteOccurrence:          `DELETE FROM occurrences WHERE project_name = ? AND occurrence_name = ?`,
+	ListOccurrences:           `SELECT id, data FROM occurrences WHERE project_name = ? AND id > ? ORDER BY id LIMIT ?`,
+	SearchOccurrenceNote: `SELECT n.data FROM occurrences AS o JOIN notes AS n ON n.id = o.note_id
+		WHERE o.project_name = ? AND o.occurrence_name = ?`,
+	ListNoteOccurrences: `SELECT o.id, o.data FROM occurrences AS o JOIN notes AS n ON n.id = o.note_id
+		WHERE n.project_name = ? AND n.note_name = ? AND o.id > ?
+		ORDER BY o.id LIMIT ?`,
+
+	// JSON_TABLE referring to the outer query requires MySQL 8.0.14 or later.
+	SummarizeVulnerabilityOccurrences: `SELECT uri, severity, CAST(SUM(fixable) AS SIGNED), COUNT(*)
+		FROM (
+			SELECT
+				COALESCE(o.data->>'$.resource.uri', '') AS uri,
+				COALESCE(o.data->>'$.vulnerability.severity', '') AS severity,
+				EXISTS (
+					SELECT 1 FROM JSON_TABLE(o.data, '$.vulnerability.packageIssue[*]'
+						COLUMNS (kind VARCHAR(32) PATH '$.fixedLocation.version.kind')) AS p
+					WHERE p.kind <> 'MAXIMUM'
+				) AS fixable
+			FROM occurrences AS o
+			WHERE o.project_name = ? AND o.data->>'$.kind' = 'VULNERABILITY'
+		) AS v
+		GROUP BY uri, severity
+		ORDER BY uri, severity`,
+
+	// read_only is set on a replica, e.g. a writer demoted by a failover, and innodb_read_only on an Aurora reader.
+	SelectReadOnly: `SELECT @@transaction_read_only OR @@global.read_only OR @@global.innodb_read_only`,
+
+	InsertAuditRecord: `INSERT INTO audit_log (time, method, resource, caller, code, record) VALUES (?, ?, ?, ?, ?, ?)`,
+}
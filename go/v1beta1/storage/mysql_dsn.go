@@ -0,0 +1,151 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	mysqldriver "github.com/go-sql-driver/mysql"
+
+	"github.com/theparanoids/grafeas-rds/go/config"
+)
+
+const (
+	errMsgRegisterTLSConfig = "failed to register the TLS config of go-sql-driver/mysql"
+	errMsgNoServerCert      = "the server presented no certificate"
+)
+
+// mysqlTLSConfigCount numbers the TLS configs registered to go-sql-driver/mysql, so that their names are unique.
+var mysqlTLSConfigCount int64
+
+// driverEngine returns the engine which drv connects to, or an empty string if it's unknown.
+// Only go-sql-driver/mysql is recognized, because any other driver is assumed to accept libpq DSNs.
+func driverEngine(drv driver.Driver) string {
+	switch drv.(type) {
+	case mysqldriver.MySQLDriver, *mysqldriver.MySQLDriver:
+		return config.EngineMySQL
+	}
+	return ""
+}
+
+// registerMySQLTLSConfig registers the TLS config for sslMode to go-sql-driver/mysql,
+// which only accepts a custom tls.Config by its name in the DSN.
+// Nothing is registered if sslMode does not encrypt the connection.
+// The client certificate is read on every handshake, so that a rotated one is used without registering it again.
+func (c *connector) registerMySQLTLSConfig() error {
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.clientCert != nil {
+		tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.readTLSCert(), nil
+		}
+	}
+	switch c.sslMode {
+	case "DISABLED":
+		return nil
+	case "PREFERRED", "REQUIRED":
+		tlsConf.InsecureSkipVerify = true
+	case "VERIFY_CA":
+		roots, err := loadCertPool(c.sslRootCert)
+		if err != nil {
+			return err
+		}
+		// The chain is verified by verifyChain instead, because the host name must not be verified.
+		tlsConf.InsecureSkipVerify = true
+		tlsConf.VerifyPeerCertificate = verifyChain(roots)
+	default:
+		roots, err := loadCertPool(c.sslRootCert)
+		if err != nil {
+			return err
+		}
+		// ServerName is populated with the host by the driver.
+		tlsConf.RootCAs = roots
+	}
+	name := fmt.Sprintf("grafeas-rds-%d", atomic.AddInt64(&mysqlTLSConfigCount, 1))
+	if err := mysqldriver.RegisterTLSConfig(name, tlsConf); err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgRegisterTLSConfig, err)
+	}
+	c.mysqlTLSConfig = name
+	return nil
+}
+
+// loadCertPool returns the pool of the certificates in the PEM file at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s, err: %v", errMsgReadRootCert, err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s %s", errMsgInvalidRootCert, path)
+	}
+	return roots, nil
+}
+
+// verifyChain returns a tls.Config.VerifyPeerCertificate which verifies the certificate chain against roots
+// without verifying the host name, as VERIFY_CA does.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New(errMsgNoServerCert)
+		}
+		intermediates := x509.NewCertPool()
+		var leaf *x509.Certificate
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				leaf = cert
+			} else {
+				intermediates.AddCert(cert)
+			}
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+		return err
+	}
+}
+
+// deregisterMySQLTLSConfig removes the TLS config registered by registerMySQLTLSConfig if any.
+func (c *connector) deregisterMySQLTLSConfig() {
+	if c.mysqlTLSConfig != "" {
+		mysqldriver.DeregisterTLSConfig(c.mysqlTLSConfig)
+	}
+}
+
+// assembleMySQLDSN returns the DSN in go-sql-driver/mysql's format, which is formatted by the driver itself,
+// so that the values are escaped as it expects.
+func (c *connector) assembleMySQLDSN() string {
+	cfg := mysqldriver.NewConfig()
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(c.host, strconv.Itoa(c.port))
+	cfg.DBName = c.dbName
+	cfg.User = c.user
+	cfg.Passwd = c.password
+	// An IAM auth token is sent by the cleartext plugin, which is safe because the server is always verified.
+	cfg.AllowCleartextPasswords = c.allowCleartextPasswords
+	cfg.TLSConfig = "false"
+	if c.mysqlTLSConfig != "" {
+		cfg.TLSConfig = c.mysqlTLSConfig
+	}
+	cfg.AllowFallbackToPlaintext = c.sslMode == "PREFERRED"
+	cfg.Timeout = c.connectTimeout
+	// max_execution_time is in milliseconds, and it's sent to the DB by SET on every new connection.
+	// A fraction of a millisecond is rounded up, because 0 would disable the timeout.
+	if c.statementTimeout > 0 {
+		cfg.Params = map[string]string{
+			"max_execution_time": strconv.FormatInt(int64((c.statementTimeout+time.Millisecond-1)/time.Millisecond), 10),
+		}
+	}
+	return cfg.FormatDSN()
+}
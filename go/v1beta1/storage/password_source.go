@@ -0,0 +1,130 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+
+	"github.com/theparanoids/grafeas-rds/go/config"
+)
+
+const (
+	errMsgGetSecret   = "failed to get the secret from AWS Secrets Manager"
+	errMsgParseSecret = "failed to parse the secret"
+)
+
+// dbCredentials are what a passwordSource supplies to connect to the DB.
+type dbCredentials struct {
+	// user is optional, and it overrides the one in the config if not empty.
+	user     string
+	password string
+	// host and port are optional, and they are only used if the host is not configured.
+	host string
+	port int
+	// expiration is the time after which the credentials are no longer accepted by the DB,
+	// and it is zero if they do not expire.
+	expiration time.Time
+}
+
+// passwordSource supplies the credentials to connect to the DB,
+// e.g. a temporary IAM auth token, or a secret stored in AWS Secrets Manager.
+type passwordSource interface {
+	// fetch returns fresh credentials.
+	// It is invoked when the credentials are due to be refreshed or when the DB rejects them,
+	// and the connector keeps using the current ones if it fails.
+	fetch(ctx context.Context) (dbCredentials, error)
+}
+
+// iamTokenSource supplies a temporary auth token generated from AWS credentials as the password.
+// The token is generated by every fetch because it's done locally without any API call.
+type iamTokenSource struct {
+	// endpoint is the host and the port of the DB which the token is generated for.
+	endpoint string
+	region   string
+	user     string
+	creds    *credentials.Credentials
+}
+
+func (s *iamTokenSource) fetch(context.Context) (dbCredentials, error) {
+	authToken, err := rdsutils.BuildAuthToken(s.endpoint, s.region, s.user, s.creds)
+	if err != nil {
+		return dbCredentials{}, err
+	}
+	return dbCredentials{
+		password:   authToken,
+		expiration: time.Now().Add(authTokenLifetime),
+	}, nil
+}
+
+// secretsManagerSource supplies the credentials stored in a secret of AWS Secrets Manager.
+// The secret is fetched by every fetch, so that a rotated password is picked up.
+type secretsManagerSource struct {
+	client   secretsmanageriface.SecretsManagerAPI
+	secretID string
+}
+
+func newSecretsManagerSource(conf config.SecretsManagerConfig, creds *credentials.Credentials) (*secretsManagerSource, error) {
+	awsConf := aws.NewConfig().WithRegion(conf.Region)
+	if conf.Endpoint != "" {
+		awsConf = awsConf.WithEndpoint(conf.Endpoint)
+	}
+	// The default credential chain is used if creds is nil.
+	if creds != nil {
+		awsConf = awsConf.WithCredentials(creds)
+	}
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		return nil, err
+	}
+	return &secretsManagerSource{
+		client:   secretsmanager.New(sess),
+		secretID: conf.SecretID,
+	}, nil
+}
+
+// secret is the format of the secrets managed by RDS.
+// Ref: https://docs.aws.amazon.com/secretsmanager/latest/userguide/reference_secret_json_structure.html
+type secret struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+}
+
+func (s *secretsManagerSource) fetch(ctx context.Context) (dbCredentials, error) {
+	out, err := s.client.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(s.secretID),
+	})
+	if err != nil {
+		return dbCredentials{}, fmt.Errorf("%s, err: %v", errMsgGetSecret, err)
+	}
+	raw := out.SecretBinary
+	if out.SecretString != nil {
+		raw = []byte(*out.SecretString)
+	}
+	var sec secret
+	if err := json.Unmarshal(raw, &sec); err != nil {
+		return dbCredentials{}, fmt.Errorf("%s, err: %v", errMsgParseSecret, err)
+	}
+	if sec.Password == "" {
+		return dbCredentials{}, fmt.Errorf("%s, err: %v", errMsgParseSecret, errors.New(`"password" is empty`))
+	}
+	return dbCredentials{
+		user:     sec.Username,
+		password: sec.Password,
+		host:     sec.Host,
+		port:     sec.Port,
+	}, nil
+}
@@ -0,0 +1,200 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+
+	"github.com/theparanoids/grafeas-rds/go/config"
+)
+
+// fakeSecretsManager serves GetSecretValue of AWS Secrets Manager for the secret with the given ID.
+type fakeSecretsManager struct {
+	*httptest.Server
+	secretID string
+	// secret is a string containing the JSON secret.
+	secret atomic.Value
+	calls  int32
+}
+
+func newFakeSecretsManager(t *testing.T, secretID, secret string) *fakeSecretsManager {
+	t.Helper()
+	f := &fakeSecretsManager{secretID: secretID}
+	f.secret.Store(secret)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&f.calls, 1)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		var input struct{ SecretId string }
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || json.NewDecoder(r.Body).Decode(&input) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "InvalidRequestException", "message": "unexpected request"}`))
+			return
+		}
+		if input.SecretId != f.secretID {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type": "ResourceNotFoundException", "message": "secret not found"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"ARN":          "arn:aws:secretsmanager:us-west-2:123456789012:secret:" + f.secretID,
+			"Name":         f.secretID,
+			"SecretString": f.secret.Load().(string),
+			"VersionId":    "some-version",
+		})
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSecretsManager) config(secretID string) config.SecretsManagerConfig {
+	return config.SecretsManagerConfig{
+		SecretID:        secretID,
+		Region:          "us-west-2",
+		Endpoint:        f.URL,
+		RefreshInterval: config.Duration(time.Second),
+	}
+}
+
+func TestSecretsManagerSourceFetch(t *testing.T) {
+	t.Parallel()
+
+	const secretID = "grafeas-db"
+	tests := []struct {
+		name       string
+		secretID   string
+		secret     string
+		want       dbCredentials
+		wantErrMsg string
+	}{
+		{
+			name:     "happy path",
+			secretID: secretID,
+			secret:   `{"username": "grafeas_rw", "password": "dummy-password-for-unit-tests-only", "host": "some-host.rds.amazonaws.com", "port": 5433}`,
+			want: dbCredentials{
+				user:     "grafeas_rw",
+				password: "dummy-password-for-unit-tests-only",
+				host:     "some-host.rds.amazonaws.com",
+				port:     5433,
+			},
+		},
+		{
+			name:     "password only",
+			secretID: secretID,
+			secret:   `{"password": "dummy-password-for-unit-tests-only"}`,
+			want:     dbCredentials{password: "dummy-password-for-unit-tests-only"},
+		},
+		{
+			name:       "secret not found",
+			secretID:   "some-other-secret",
+			wantErrMsg: errMsgGetSecret,
+		},
+		{
+			name:       "not a JSON secret",
+			secretID:   secretID,
+			secret:     "dummy-password-for-unit-tests-only",
+			wantErrMsg: errMsgParseSecret,
+		},
+		{
+			name:       "empty password",
+			secretID:   secretID,
+			secret:     `{"username": "grafeas_rw"}`,
+			wantErrMsg: errMsgParseSecret,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			sm := newFakeSecretsManager(t, secretID, tt.secret)
+			source, err := newSecretsManagerSource(sm.config(tt.secretID), credentials.NewStaticCredentials("a", "b", "c"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := source.fetch(context.Background())
+			if (err != nil) != (tt.wantErrMsg != "") {
+				if err != nil {
+					t.Errorf("don't want error, but got %q", err)
+				} else {
+					t.Errorf("got nil error, but want error to include %q", tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("want %q to include %q", err.Error(), tt.wantErrMsg)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretsManagerSourceFetchesRotatedSecret(t *testing.T) {
+	t.Parallel()
+
+	const secretID = "grafeas-db"
+	sm := newFakeSecretsManager(t, secretID, `{"password": "old-password"}`)
+	source, err := newSecretsManagerSource(sm.config(secretID), credentials.NewStaticCredentials("a", "b", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchPassword := func() string {
+		t.Helper()
+		creds, err := source.fetch(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return creds.password
+	}
+
+	if got := fetchPassword(); got != "old-password" {
+		t.Errorf("got %q, want %q", got, "old-password")
+	}
+	sm.secret.Store(`{"password": "new-password"}`)
+	if got := fetchPassword(); got != "new-password" {
+		t.Errorf("got %q, but want the rotated password %q", got, "new-password")
+	}
+	if calls := atomic.LoadInt32(&sm.calls); calls != 2 {
+		t.Errorf("the secret should be fetched twice, but it's fetched %d times", calls)
+	}
+}
+
+func TestIAMTokenSourceFetch(t *testing.T) {
+	t.Parallel()
+
+	source := &iamTokenSource{
+		endpoint: "some-host.rds.amazonaws.com:5432",
+		region:   "some-region",
+		user:     "grafeas_rw",
+		creds:    credentials.NewStaticCredentials("a", "b", "c"),
+	}
+	creds, err := source.fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(creds.password, source.region) {
+		t.Errorf("the token %q should contain the specified region %q", creds.password, source.region)
+	}
+	if time.Until(creds.expiration) > authTokenLifetime {
+		t.Errorf("the token should expire within %v, but it expires at %v", authTokenLifetime, creds.expiration)
+	}
+
+	source.creds = credentials.AnonymousCredentials
+	if _, err := source.fetch(context.Background()); err == nil {
+		t.Error("want error for invalid credentials, but no error is returned")
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+)
+
+func TestAuditSink(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	connector := newTestConnector(t, dsn)
+	// The storage creates the audit_log table.
+	newTestStorage(t, connector)
+	sink := NewAuditSink(connector)
+	defer sink.Close()
+
+	r := &storage.AuditRecord{
+		Time:     time.Now(),
+		Method:   "DeleteNote",
+		Resource: "projects/p/notes/n",
+		Caller:   "alice",
+		Code:     "OK",
+	}
+	if err := sink.Write(context.Background(), r); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	var method, resource, caller, code string
+	row := db.QueryRow("SELECT method, resource, caller, code FROM audit_log WHERE method = 'DeleteNote'")
+	if err := row.Scan(&method, &resource, &caller, &code); err != nil {
+		t.Fatal(err)
+	}
+	if method != r.Method || resource != r.Resource || caller != r.Caller || code != r.Code {
+		t.Errorf("got (%s, %s, %s, %s), want (%s, %s, %s, %s)", method, resource, caller, code, r.Method, r.Resource, r.Caller, r.Code)
+	}
+
+	batch := []*storage.AuditRecord{
+		{Time: time.Now(), Method: "BatchCreateNotes", Resource: "projects/p/notes/n1", Code: "OK"},
+		{Time: time.Now(), Method: "BatchCreateNotes", Resource: "projects/p/notes/n2", Code: "OK"},
+	}
+	if err := sink.WriteBatch(context.Background(), batch); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE method = 'BatchCreateNotes'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(batch) {
+		t.Errorf("got %d records of the batch, want %d", count, len(batch))
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+)
+
+const (
+	errMsgNotPQConn = "the connection for LISTEN is not of lib/pq"
+	errMsgListen    = "failed to listen to the channel"
+	errMsgPoll      = "failed to poll the notifications"
+)
+
+const (
+	defaultCacheChannel      = "grafeas_rds_cache"
+	defaultCachePollInterval = time.Second
+)
+
+// CacheInvalidator implements storage.CacheInvalidator with LISTEN/NOTIFY,
+// so that every replica connected to the same PostgreSQL DB invalidates the resources changed by any of them.
+//
+// Since lib/pq receives the notifications only while a query is running,
+// the listening connection is pinged at the poll interval,
+// which is the upper bound of the delay of the invalidations.
+type CacheInvalidator struct {
+	connector    driver.Connector
+	db           *sql.DB
+	channel      string
+	pollInterval time.Duration
+}
+
+// CacheInvalidatorOption configures optional behaviors of CacheInvalidator.
+type CacheInvalidatorOption func(*CacheInvalidator)
+
+// WithChannel sets the channel of the notifications. It's "grafeas_rds_cache" by default.
+func WithChannel(channel string) CacheInvalidatorOption {
+	return func(i *CacheInvalidator) {
+		i.channel = channel
+	}
+}
+
+// WithPollInterval sets how often the notifications are received. It's 1 second by default.
+func WithPollInterval(interval time.Duration) CacheInvalidatorOption {
+	return func(i *CacheInvalidator) {
+		i.pollInterval = interval
+	}
+}
+
+// NewCacheInvalidator returns a CacheInvalidator which connects to the DB with connector,
+// e.g. the writer connector passed to storage.WithCacheInvalidation. The connections must be of lib/pq.
+func NewCacheInvalidator(connector driver.Connector, opts ...CacheInvalidatorOption) *CacheInvalidator {
+	i := &CacheInvalidator{
+		connector:    connector,
+		db:           sql.OpenDB(connector),
+		channel:      defaultCacheChannel,
+		pollInterval: defaultCachePollInterval,
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// Publish notifies the listeners of the channel of name.
+func (i *CacheInvalidator) Publish(ctx context.Context, name string) error {
+	_, err := i.db.ExecContext(ctx, `SELECT pg_notify($1, $2)`, i.channel, name)
+	return err
+}
+
+// Subscribe listens to the channel on a dedicated connection, and invokes invalidate with every notified name until ctx is done.
+func (i *CacheInvalidator) Subscribe(ctx context.Context, invalidate func(name string)) error {
+	conn, err := i.connector.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := setNotificationHandler(conn, func(n *pq.Notification) {
+		if n.Channel == i.channel {
+			invalidate(n.Extra)
+		}
+	}); err != nil {
+		return err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	pinger, ok2 := conn.(driver.Pinger)
+	if !ok || !ok2 {
+		return errors.New(errMsgNotPQConn)
+	}
+	if _, err := execer.ExecContext(ctx, "LISTEN "+pq.QuoteIdentifier(i.channel), nil); err != nil {
+		return fmt.Errorf("%s, err: %v", errMsgListen, err)
+	}
+
+	ticker := time.NewTicker(i.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := pinger.Ping(ctx); err != nil && ctx.Err() == nil {
+				return fmt.Errorf("%s, err: %v", errMsgPoll, err)
+			}
+		}
+	}
+}
+
+// Close closes the connections used to publish.
+func (i *CacheInvalidator) Close() error {
+	return i.db.Close()
+}
+
+// setNotificationHandler sets handler on conn, and returns an error instead of panicking if conn is not of lib/pq.
+func setNotificationHandler(conn driver.Conn, handler func(*pq.Notification)) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = errors.New(errMsgNotPQConn)
+		}
+	}()
+	pq.SetNotificationHandler(conn, handler)
+	return nil
+}
+
+var _ storage.CacheInvalidator = (*CacheInvalidator)(nil)
@@ -0,0 +1,83 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package pgsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// fakeConnector connects with fakeConn.
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{}, nil }
+func (fakeConnector) Driver() driver.Driver                        { return nil }
+
+// fakeConn is a connection which is not of lib/pq.
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+func TestCacheInvalidatorNotPQConn(t *testing.T) {
+	t.Parallel()
+
+	i := NewCacheInvalidator(fakeConnector{})
+	defer i.Close()
+	err := i.Subscribe(context.Background(), func(string) {})
+	if err == nil || !strings.Contains(err.Error(), errMsgNotPQConn) {
+		t.Errorf("got err %v, want it to include %q", err, errMsgNotPQConn)
+	}
+}
+
+func TestCacheInvalidator(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A channel per test run keeps the concurrent runs from interfering.
+	channel := "test_" + uuid.New().String()[:8]
+	subscriber := NewCacheInvalidator(connector, WithChannel(channel), WithPollInterval(10*time.Millisecond))
+	defer subscriber.Close()
+	publisher := NewCacheInvalidator(connector, WithChannel(channel))
+	defer publisher.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	names := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- subscriber.Subscribe(ctx, func(name string) { names <- name })
+	}()
+
+	// The notifications published before LISTEN are not received, so they're published until one arrives.
+	var got string
+	for got == "" {
+		if err := publisher.Publish(context.Background(), "projects/p/notes/n"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got = <-names:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if got != "projects/p/notes/n" {
+		t.Errorf("got %q, want %q", got, "projects/p/notes/n")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("unexpected err: %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+-- Copyright Yahoo 2021
+-- Licensed under the terms of the Apache License 2.0.
+-- See LICENSE file in project root for terms.
+CREATE TABLE IF NOT EXISTS projects (
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+CREATE TABLE IF NOT EXISTS notes (
+	id BIGSERIAL PRIMARY KEY,
+	project_name TEXT NOT NULL,
+	note_name TEXT NOT NULL,
+	data JSONB NOT NULL,
+	UNIQUE (project_name, note_name)
+);
+CREATE TABLE IF NOT EXISTS occurrences (
+	id BIGSERIAL PRIMARY KEY,
+	project_name TEXT NOT NULL,
+	occurrence_name TEXT NOT NULL,
+	note_id BIGINT NOT NULL REFERENCES notes,
+	data JSONB NOT NULL,
+	UNIQUE (project_name, occurrence_name)
+);
+CREATE INDEX IF NOT EXISTS occurrences_note_id_idx ON occurrences (note_id);
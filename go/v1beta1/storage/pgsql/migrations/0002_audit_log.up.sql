@@ -0,0 +1,14 @@
+-- Copyright Yahoo 2021
+-- Licensed under the terms of the Apache License 2.0.
+-- See LICENSE file in project root for terms.
+-- The record column contains the whole storage.AuditRecord, and the other columns are copied from it to be queried.
+CREATE TABLE IF NOT EXISTS audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	time TIMESTAMPTZ NOT NULL,
+	method TEXT NOT NULL,
+	resource TEXT NOT NULL,
+	caller TEXT NOT NULL,
+	code TEXT NOT NULL,
+	record JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_resource_idx ON audit_log (resource);
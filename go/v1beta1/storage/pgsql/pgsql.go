@@ -0,0 +1,106 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+
+// Package pgsql provides a storage.StorageCreator which stores the Grafeas resources in PostgreSQL 12 or later.
+//
+// The resources are stored as JSON (see protojson) in JSONB columns,
+// and the tables are created and upgraded by the embedded migrations (see storage.SchemaManager),
+// which GrafeasStorageProvider applies unless it's configured to only verify the schema version.
+package pgsql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"errors"
+	"log"
+
+	"github.com/lib/pq"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/sqlstore"
+)
+
+const (
+	// pqUniqueViolation is raised when a resource with the same name exists.
+	pqUniqueViolation = "23505"
+	// pqNotNullViolation is raised when the note of a new occurrence doesn't exist,
+	// because its ID is looked up by a subquery.
+	pqNotNullViolation = "23502"
+	// pqForeignKeyViolation is raised when a note to delete still has occurrences.
+	pqForeignKeyViolation = "23503"
+)
+
+// migrations contains the versions of the schema. A released migration must not be modified.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+var dialect = sqlstore.Dialect{
+	Queries:               queries,
+	Migrations:            migrations,
+	IsUniqueViolation:     hasCode(pqUniqueViolation),
+	IsNotNullViolation:    hasCode(pqNotNullViolation),
+	IsForeignKeyViolation: hasCode(pqForeignKeyViolation),
+}
+
+// hasCode returns a function reporting whether an error is returned by PostgreSQL with the SQLSTATE code.
+func hasCode(code pq.ErrorCode) func(error) bool {
+	return func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == code
+	}
+}
+
+// StorageCreator implements storage.StorageCreator for PostgreSQL.
+type StorageCreator struct {
+	logger *log.Logger
+}
+
+// Option configures optional behaviors of StorageCreator.
+type Option func(*StorageCreator)
+
+// WithLogger makes the created storages log to logger instead of log.Default().
+func WithLogger(logger *log.Logger) Option {
+	return func(c *StorageCreator) {
+		c.logger = logger
+	}
+}
+
+// NewStorageCreator returns a StorageCreator configured with opts.
+func NewStorageCreator(opts ...Option) *StorageCreator {
+	c := &StorageCreator{logger: log.Default()}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Create returns a storage which reads from and writes to the DB connected by connector.
+func (c *StorageCreator) Create(connector driver.Connector, paginationKey string) (storage.Storage, error) {
+	db := sql.OpenDB(connector)
+	s, err := sqlstore.New(db, db, paginationKey, c.logger, dialect)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// CreateRW returns a storage which reads from the DB connected by readerConnector,
+// and writes to the DB connected by writerConnector.
+// It may not read its own writes immediately because of the replication lag.
+func (c *StorageCreator) CreateRW(readerConnector driver.Connector, writerConnector driver.Connector, paginationKey string) (storage.Storage, error) {
+	writer := sql.OpenDB(writerConnector)
+	reader := sql.OpenDB(readerConnector)
+	s, err := sqlstore.New(writer, reader, paginationKey, c.logger, dialect)
+	if err != nil {
+		writer.Close()
+		reader.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+var _ storage.StorageCreator = (*StorageCreator)(nil)
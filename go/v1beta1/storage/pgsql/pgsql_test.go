@@ -0,0 +1,96 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package pgsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	grafeas "github.com/grafeas/grafeas/go/v1beta1/api"
+	"github.com/grafeas/grafeas/go/v1beta1/project"
+	gstorage "github.com/grafeas/grafeas/go/v1beta1/storage"
+	"github.com/lib/pq"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/sqlstore"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage/storagetest"
+)
+
+// testDSNEnv is the environment variable containing the DSN of the PostgreSQL DB to run the storage tests against.
+// The tests are skipped if it's not set.
+const testDSNEnv = "GRAFEAS_RDS_TEST_PGSQL_DSN"
+
+func TestMigrations(t *testing.T) {
+	t.Parallel()
+
+	// New fails if the embedded migrations are malformed.
+	if _, err := sqlstore.New(nil, nil, "", log.New(io.Discard, "", 0), dialect); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	gstorage.DoTestStorage(t, func(t *testing.T) (grafeas.Storage, project.Storage, func()) {
+		s := newTestStorage(t, newTestConnector(t, dsn))
+		return s, s, func() {}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return newTestStorage(t, newTestConnector(t, dsn))
+	})
+}
+
+// newTestStorage returns a migrated storage connected by connector, which is closed when the test finishes.
+func newTestStorage(t *testing.T, connector driver.Connector) storage.Storage {
+	s, err := NewStorageCreator(WithLogger(log.New(io.Discard, "", 0))).Create(connector, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(storage.SchemaManager).MigrateSchema(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.(io.Closer).Close() })
+	return s
+}
+
+// newTestConnector returns a connector to a new schema, which is dropped when the test finishes.
+func newTestConnector(t *testing.T, dsn string) driver.Connector {
+	// Every test case gets its own schema to start with empty tables.
+	schema := "test_" + uuid.New().String()[:8]
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.Exec(fmt.Sprintf("CREATE SCHEMA %s", schema)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(fmt.Sprintf("DROP SCHEMA %s CASCADE", schema)); err != nil {
+			t.Error(err)
+		}
+		admin.Close()
+	})
+	connector, err := pq.NewConnector(fmt.Sprintf("%s search_path=%s", dsn, schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return connector
+}
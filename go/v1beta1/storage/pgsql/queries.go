@@ -0,0 +1,61 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package pgsql
+
+import "github.com/theparanoids/grafeas-rds/go/v1beta1/storage/internal/sqlstore"
+
+var queries = sqlstore.Queries{
+	// The advisory lock is identified by a hash of a fixed string, and it's held by the session.
+	LockSchema:   `SELECT pg_advisory_lock(hashtext('grafeas-rds schema migration'))`,
+	UnlockSchema: `SELECT pg_advisory_unlock(hashtext('grafeas-rds schema migration'))`,
+	CreateSchemaVersionTable: `CREATE TABLE IF NOT EXISTS schema_version (
+			version BIGINT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+	SelectSchemaVersion: `SELECT COALESCE(MAX(version), 0) FROM schema_version`,
+	InsertSchemaVersion: `INSERT INTO schema_version (version) VALUES ($1)`,
+	DeleteSchemaVersion: `DELETE FROM schema_version WHERE version = $1`,
+
+	InsertProject: `INSERT INTO projects (name) VALUES ($1)`,
+	ProjectExists: `SELECT EXISTS (SELECT 1 FROM projects WHERE name = $1)`,
+	DeleteProject: `DELETE FROM projects WHERE name = $1`,
+	ListProjects:  `SELECT id, name FROM projects WHERE id > $1 ORDER BY id LIMIT $2`,
+
+	InsertNote:          `INSERT INTO notes (project_name, note_name, data) VALUES ($1, $2, $3)`,
+	SearchNote:          `SELECT data FROM notes WHERE project_name = $1 AND note_name = $2`,
+	SearchNoteForUpdate: `SELECT data FROM notes WHERE project_name = $1 AND note_name = $2 FOR UPDATE`,
+	UpdateNote:          `UPDATE notes SET data = $1 WHERE project_name = $2 AND note_name = $3`,
+	DeleteNote:          `DELETE FROM notes WHERE project_name = $1 AND note_name = $2`,
+	ListNotes:           `SELECT id, data FROM notes WHERE project_name = $1 AND id > $2 ORDER BY id LIMIT $3`,
+
+	InsertOccurrence: `INSERT INTO occurrences (project_name, occurrence_name, note_id, data)
+		VALUES ($1, $2, (SELECT id FROM notes WHERE project_name = $3 AND note_name = $4), $5)`,
+	SearchOccurrence:          `SELECT data FROM occurrences WHERE project_name = $1 AND occurrence_name = $2`,
+	SearchOccurrenceForUpdate: `SELECT data FROM occurrences WHERE project_name = $1 AND occurrence_name = $2 FOR UPDATE`,
+	UpdateOccurrence:          `UPDATE occurrences SET data = $1 WHERE project_name = $2 AND occurrence_name = $3`,
+	DeleteOccurrence:          `DELETE FROM occurrences WHERE project_name = $1 AND occurrence_name = $2`,
+	ListOccurrences:           `SELECT id, data FROM occurrences WHERE project_name = $1 AND id > $2 ORDER BY id LIMIT $3`,
+	SearchOccurrenceNote: `SELECT n.data FROM occurrences AS o JOIN notes AS n ON n.id = o.note_id
+		WHERE o.project_name = $1 AND o.occurrence_name = $2`,
+	ListNoteOccurrences: `SELECT o.id, o.data FROM occurrences AS o JOIN notes AS n ON n.id = o.note_id
+		WHERE n.project_name = $1 AND n.note_name = $2 AND o.id > $3
+		ORDER BY o.id LIMIT $4`,
+
+	// jsonb_path_exists requires PostgreSQL 12 or later.
+	SummarizeVulnerabilityOccurrences: `SELECT
+			COALESCE(data->'resource'->>'uri', ''),
+			COALESCE(data->'vulnerability'->>'severity', ''),
+			COUNT(*) FILTER (WHERE jsonb_path_exists(data,
+				'$.vulnerability.packageIssue[*].fixedLocation.version.kind ? (@ != "MAXIMUM")')),
+			COUNT(*)
+		FROM occurrences
+		WHERE project_name = $1 AND data->>'kind' = 'VULNERABILITY'
+		GROUP BY 1, 2
+		ORDER BY 1, 2`,
+
+	// transaction_read_only is on in a session of a hot standby, e.g. a writer demoted by a failover.
+	SelectReadOnly: `SELECT current_setting('transaction_read_only') = 'on'`,
+
+	InsertAuditRecord: `INSERT INTO audit_log (time, method, resource, caller, code, record) VALUES ($1, $2, $3, $4, $5, $6)`,
+}
@@ -0,0 +1,152 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	// embed is imported for go:embed.
+	_ "embed"
+
+	"github.com/theparanoids/grafeas-rds/go/config"
+)
+
+//go:generate curl -sSfo certs/rds-global-bundle.pem https://truststore.pki.rds.amazonaws.com/global/global-bundle.pem
+
+// rdsCABundle contains the root and intermediate certificates of every AWS region,
+// so that the server can be verified without shipping a CA file along with each deployment.
+// Ref: https://docs.aws.amazon.com/AmazonRDS/latest/UserGuide/UsingWithRDS.SSL.html
+//
+//go:embed certs/rds-global-bundle.pem
+var rdsCABundle []byte
+
+const (
+	errMsgReadRootCert    = "failed to read the SSL root certificate"
+	errMsgInvalidRootCert = "invalid SSL root certificate"
+	errMsgInvalidCABundle = "invalid embedded RDS CA bundle, run `go generate` or set ssl_root_cert"
+	errMsgWriteCABundle   = "failed to write the embedded RDS CA bundle"
+)
+
+var (
+	// caBundleDir is the directory private to this process which the embedded RDS CA bundle is written to.
+	caBundleDir     string
+	caBundleDirLock sync.Mutex
+)
+
+// resolveSSLRootCert returns the path of the root certificate used to verify the server.
+// The configured file takes precedence,
+// and bundle, i.e. the embedded RDS CA bundle, is used if none is configured but the server has to be verified.
+// Either way, the certificates are validated, so that a broken file fails at startup
+// rather than when the first connection is made, and the expired ones are logged.
+func resolveSSLRootCert(conf *config.Config, bundle []byte, logger *log.Logger) (string, error) {
+	if conf.SSLRootCert != "" {
+		b, err := os.ReadFile(conf.SSLRootCert)
+		if err != nil {
+			return "", fmt.Errorf("%s, err: %v", errMsgReadRootCert, err)
+		}
+		if err := validateCertificates(b, time.Now(), conf.SSLRootCert, logger); err != nil {
+			return "", fmt.Errorf("%s %s, err: %v", errMsgInvalidRootCert, conf.SSLRootCert, err)
+		}
+		return conf.SSLRootCert, nil
+	}
+	if !conf.VerifiesServer() {
+		return "", nil
+	}
+	if err := validateCertificates(bundle, time.Now(), "the embedded RDS CA bundle", logger); err != nil {
+		return "", fmt.Errorf("%s, err: %v", errMsgInvalidCABundle, err)
+	}
+	dir, err := privateCABundleDir()
+	if err != nil {
+		return "", err
+	}
+	return writeCABundle(bundle, dir)
+}
+
+// privateCABundleDir returns the directory which only this process writes the CA bundles to, creating it on the first call.
+// A shared directory like /tmp is not used, because another user could plant a CA there.
+func privateCABundleDir() (string, error) {
+	caBundleDirLock.Lock()
+	defer caBundleDirLock.Unlock()
+	if caBundleDir == "" {
+		// The directory is created with the mode 0700.
+		dir, err := os.MkdirTemp("", "grafeas-rds-ca-")
+		if err != nil {
+			return "", fmt.Errorf("%s, err: %v", errMsgWriteCABundle, err)
+		}
+		caBundleDir = dir
+	}
+	return caBundleDir, nil
+}
+
+// validateCertificates returns an error if b contains a certificate which cannot be parsed,
+// or if it does not contain any PEM certificate which is valid at now.
+// The expired certificates are logged and skipped rather than rejecting the whole file,
+// because a CA bundle like the RDS one keeps the certificates close to their expiration along with their successors.
+// source describes b in the logs.
+func validateCertificates(b []byte, now time.Time, source string, logger *log.Logger) error {
+	var valid int
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		if now.After(cert.NotAfter) {
+			logger.Printf("WARNING: the certificate %q in %s expired at %s, so it's ignored",
+				cert.Subject, source, cert.NotAfter.Format(time.RFC3339))
+			continue
+		}
+		valid++
+	}
+	if valid == 0 {
+		return errors.New("no valid PEM certificate is found")
+	}
+	return nil
+}
+
+// writeCABundle writes bundle to dir, which must be private to this process (see privateCABundleDir),
+// and returns the path of the file.
+// The file is named after the hash of its content, so that it's written only once per bundle.
+func writeCABundle(bundle []byte, dir string) (string, error) {
+	sum := sha256.Sum256(bundle)
+	path := filepath.Join(dir, fmt.Sprintf("grafeas-rds-ca-%s.pem", hex.EncodeToString(sum[:8])))
+	if existing, err := os.ReadFile(path); err == nil && string(existing) == string(bundle) {
+		return path, nil
+	}
+	// The bundle is written to a temporary file and renamed,
+	// so that a concurrent reader never sees a partial bundle.
+	f, err := os.CreateTemp(dir, "grafeas-rds-ca-*.pem.tmp")
+	if err != nil {
+		return "", fmt.Errorf("%s, err: %v", errMsgWriteCABundle, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(bundle); err != nil {
+		f.Close()
+		return "", fmt.Errorf("%s, err: %v", errMsgWriteCABundle, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("%s, err: %v", errMsgWriteCABundle, err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", fmt.Errorf("%s, err: %v", errMsgWriteCABundle, err)
+	}
+	return path, nil
+}
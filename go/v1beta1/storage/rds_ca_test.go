@@ -0,0 +1,257 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theparanoids/grafeas-rds/go/config"
+)
+
+func TestResolveSSLRootCert(t *testing.T) {
+	t.Parallel()
+
+	valid, err := os.ReadFile("testdata/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := os.ReadFile("testdata/expired_ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mixed := append(append([]byte{}, valid...), expired...)
+	mixedPath := filepath.Join(t.TempDir(), "mixed_ca.pem")
+	if err := os.WriteFile(mixedPath, mixed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		conf config.Config
+		// bundle is used as the embedded RDS CA bundle.
+		bundle []byte
+		want   string
+		// wantBundle is true if the returned file should contain bundle.
+		wantBundle bool
+		wantLog    string
+		wantErrMsg string
+	}{
+		{
+			name: "configured root cert",
+			conf: config.Config{SSLMode: "verify-full", SSLRootCert: "testdata/ca.pem"},
+			want: "testdata/ca.pem",
+		},
+		{
+			name: "configured root cert is used even if the server is not verified",
+			conf: config.Config{SSLMode: "require", SSLRootCert: "testdata/ca.pem"},
+			want: "testdata/ca.pem",
+		},
+		{
+			name:    "configured root cert with an expired cert",
+			conf:    config.Config{SSLMode: "verify-full", SSLRootCert: mixedPath},
+			want:    mixedPath,
+			wantLog: "expired",
+		},
+		{
+			name:       "embedded bundle",
+			conf:       config.Config{SSLMode: "verify-full"},
+			bundle:     valid,
+			wantBundle: true,
+		},
+		{
+			name:       "embedded bundle with an expired cert",
+			conf:       config.Config{SSLMode: "verify-ca"},
+			bundle:     mixed,
+			wantBundle: true,
+			wantLog:    "expired",
+		},
+		{
+			name:       "embedded bundle without any cert",
+			conf:       config.Config{SSLMode: "verify-full"},
+			bundle:     []byte("# placeholder\n"),
+			wantErrMsg: errMsgInvalidCABundle,
+		},
+		{
+			name:       "embedded bundle with only expired certs",
+			conf:       config.Config{SSLMode: "verify-full"},
+			bundle:     expired,
+			wantErrMsg: errMsgInvalidCABundle,
+		},
+		{
+			name:   "no root cert is needed",
+			conf:   config.Config{SSLMode: "require"},
+			bundle: valid,
+		},
+		{
+			name:       "missing root cert",
+			conf:       config.Config{SSLMode: "verify-full", SSLRootCert: "testdata/missing.pem"},
+			wantErrMsg: errMsgReadRootCert,
+		},
+		{
+			name:       "expired root cert",
+			conf:       config.Config{SSLMode: "verify-full", SSLRootCert: "testdata/expired_ca.pem"},
+			wantErrMsg: errMsgInvalidRootCert,
+		},
+		{
+			name:       "not a PEM file",
+			conf:       config.Config{SSLMode: "verify-full", SSLRootCert: "testdata/not_a_cert.pem"},
+			wantErrMsg: errMsgInvalidRootCert,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			got, err := resolveSSLRootCert(&tt.conf, tt.bundle, log.New(&buf, "", 0))
+			if (err != nil) != (tt.wantErrMsg != "") {
+				if err != nil {
+					t.Errorf("don't want error, but got %q", err)
+				} else {
+					t.Errorf("got nil error, but want error to include %q", tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Errorf("want %q to include %q", err.Error(), tt.wantErrMsg)
+				}
+				return
+			}
+			if tt.wantBundle {
+				// The bundle is written to the private directory, and never to the shared one.
+				if dir, err := privateCABundleDir(); err != nil || filepath.Dir(got) != dir {
+					t.Errorf("got %q, want it in the private directory %q (err: %v)", got, dir, err)
+				}
+				b, err := os.ReadFile(got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, tt.bundle) {
+					t.Errorf("got %q, want the bundle %q", b, tt.bundle)
+				}
+			} else if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if logs := buf.String(); !strings.Contains(logs, tt.wantLog) || (tt.wantLog == "" && logs != "") {
+				t.Errorf("got logs %q, want them to include %q", logs, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestEmbeddedRDSCABundle(t *testing.T) {
+	t.Parallel()
+
+	// The committed bundle must be the real one, since it's used whenever ssl_root_cert is omitted.
+	var buf bytes.Buffer
+	if err := validateCertificates(rdsCABundle, time.Now(), "the embedded RDS CA bundle", log.New(&buf, "", 0)); err != nil {
+		t.Fatalf("don't want error, but got %q; run `go generate` to download the bundle", err)
+	}
+	if logs := buf.String(); logs != "" {
+		t.Logf("the bundle contains expired certificates, consider running `go generate` to update it: %s", logs)
+	}
+}
+
+func TestValidateCertificates(t *testing.T) {
+	t.Parallel()
+
+	valid, err := os.ReadFile("testdata/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := os.ReadFile("testdata/expired_ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	logger := log.New(io.Discard, "", 0)
+	if err := validateCertificates(valid, now, "valid", logger); err != nil {
+		t.Errorf("don't want error, but got %q", err)
+	}
+	var buf bytes.Buffer
+	if err := validateCertificates(append(append([]byte{}, expired...), valid...), now, "mixed", log.New(&buf, "", 0)); err != nil {
+		t.Errorf("don't want error while a certificate is valid, but got %q", err)
+	}
+	if logs := buf.String(); !strings.Contains(logs, "mixed") || !strings.Contains(logs, "expired") {
+		t.Errorf("got logs %q, want them to report the expired certificate", logs)
+	}
+	if err := validateCertificates(expired, now, "expired", logger); err == nil {
+		t.Error("got nil error, but want an error because every certificate is expired")
+	}
+	if err := validateCertificates(expired, time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), "expired", logger); err != nil {
+		t.Errorf("don't want error before the expiration, but got %q", err)
+	}
+	if err := validateCertificates(nil, now, "empty", logger); err == nil {
+		t.Error("got nil error, but want an error because there is no certificate")
+	}
+}
+
+func TestWriteCABundle(t *testing.T) {
+	t.Parallel()
+
+	bundle, err := os.ReadFile("testdata/ca.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path, err := writeCABundle(bundle, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(bundle) {
+		t.Errorf("got %q, want %q", got, bundle)
+	}
+
+	// The same file is reused for the same bundle.
+	again, err := writeCABundle(bundle, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != path {
+		t.Errorf("got %q, want %q", again, path)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("got %d files, want only the bundle", len(entries))
+	}
+}
+
+func TestPrivateCABundleDir(t *testing.T) {
+	t.Parallel()
+
+	dir, err := privateCABundleDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0o700 {
+		t.Errorf("got mode %v, want a directory only the owner can access", info.Mode())
+	}
+	if dir == os.TempDir() {
+		t.Errorf("got the shared %q, want a private directory", dir)
+	}
+	// The directory is created once per process.
+	if again, err := privateCABundleDir(); err != nil || again != dir {
+		t.Errorf("got %q (err: %v), want %q", again, err, dir)
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+)
+
+const errMsgDetectReadOnly = "failed to check whether the writer is read-only"
+
+// MetricReadOnly is the gauge which is 1 while the storage is read-only and 0 otherwise.
+// It's labeled with "reason", which is "switched" for the mode switched by the config or a signal,
+// and "writer" for the mode detected from the writer.
+const MetricReadOnly = "grafeas_rds_read_only"
+
+const (
+	readOnlyReasonSwitched = "switched"
+	readOnlyReasonWriter   = "writer"
+)
+
+// ReadOnlyDetector can be implemented by a Storage which can tell whether its writer accepts writes,
+// e.g. the ones created by pgsql and mysql.
+type ReadOnlyDetector interface {
+	// WriterReadOnly reports whether the writer is read-only, e.g. because it has been demoted by a failover.
+	WriterReadOnly(ctx context.Context) (bool, error)
+}
+
+// ReadOnlyOption configures optional behaviors of ReadOnlyStorage.
+type ReadOnlyOption func(*ReadOnlyStorage)
+
+// WithReadOnlyLogger makes ReadOnlyStorage log the switches of the mode to logger instead of log.Default().
+func WithReadOnlyLogger(logger *log.Logger) ReadOnlyOption {
+	return func(r *ReadOnlyStorage) {
+		r.logger = logger
+	}
+}
+
+// WithReadOnlyMetrics makes ReadOnlyStorage report MetricReadOnly to m.
+func WithReadOnlyMetrics(m Metrics) ReadOnlyOption {
+	return func(r *ReadOnlyStorage) {
+		r.metrics = m
+	}
+}
+
+// ReadOnlyStorage is a Storage which can be switched to the read-only mode at runtime,
+// in which it keeps serving the reads and fails the methods creating, updating or deleting resources
+// with codes.Unavailable and a RetryInfo detail telling the clients when to retry.
+//
+// It's read-only while it's switched by the config, SetReadOnly or ToggleOnSignal,
+// or while the writer is read-only if DetectWriterReadOnly is running.
+// A switch by SetReadOnly or ToggleOnSignal overrides the config until the config itself is switched (see Configure).
+type ReadOnlyStorage struct {
+	Storage
+
+	logger  *log.Logger
+	metrics Metrics
+
+	mu sync.RWMutex
+	// enabled is the mode in the config, and switched is the mode in effect, which may have been overridden since.
+	enabled    bool
+	switched   bool
+	detected   bool
+	retryAfter time.Duration
+}
+
+// NewReadOnlyStorage returns a ReadOnlyStorage wrapping s, which is configured with conf and opts.
+func NewReadOnlyStorage(s Storage, conf rdsconfig.ReadOnlyConfig, opts ...ReadOnlyOption) *ReadOnlyStorage {
+	r := &ReadOnlyStorage{
+		Storage: s,
+		logger:  log.Default(),
+		metrics: nopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.enabled = conf.Enabled
+	r.retryAfter = time.Duration(conf.RetryAfter)
+	r.setSwitchedLocked(conf.Enabled)
+	return r
+}
+
+// Close closes the wrapped Storage if it implements io.Closer.
+func (r *ReadOnlyStorage) Close() error {
+	if closer, ok := r.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Configure sets the hint returned to the clients to conf.RetryAfter,
+// and switches the mode to conf.Enabled if it differs from the previous config.
+// Otherwise the mode switched by SetReadOnly or ToggleOnSignal is kept.
+func (r *ReadOnlyStorage) Configure(conf rdsconfig.ReadOnlyConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.retryAfter = time.Duration(conf.RetryAfter)
+	if conf.Enabled != r.enabled {
+		r.enabled = conf.Enabled
+		r.setSwitchedLocked(conf.Enabled)
+	}
+}
+
+// inheritSwitch keeps the mode switched on prev, which r replaces, unless the config has been switched since.
+func (r *ReadOnlyStorage) inheritSwitch(prev *ReadOnlyStorage) {
+	prev.mu.RLock()
+	enabled, switched := prev.enabled, prev.switched
+	prev.mu.RUnlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.enabled == enabled {
+		r.setSwitchedLocked(switched)
+	}
+}
+
+// SetReadOnly switches the mode.
+func (r *ReadOnlyStorage) SetReadOnly(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setSwitchedLocked(enabled)
+}
+
+// ToggleOnSignal switches the mode every time one of sigs is received until ctx is done, e.g. on SIGUSR1.
+func (r *ReadOnlyStorage) ToggleOnSignal(ctx context.Context, sigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			r.mu.Lock()
+			r.setSwitchedLocked(!r.switched)
+			r.mu.Unlock()
+		}
+	}
+}
+
+// DetectWriterReadOnly checks the writer with detector on the given interval until ctx is done,
+// and the storage is read-only while the writer is. The mode is kept if the check fails.
+func (r *ReadOnlyStorage) DetectWriterReadOnly(ctx context.Context, detector ReadOnlyDetector, interval time.Duration) {
+	runPeriodically(ctx, interval, func() {
+		readOnly, err := detector.WriterReadOnly(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.Printf("%s, err: %v", errMsgDetectReadOnly, err)
+			}
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if readOnly != r.detected {
+			r.logger.Printf("the writer became read-only: %v", readOnly)
+		}
+		r.detected = readOnly
+		r.metrics.SetGauge(MetricReadOnly, map[string]string{"reason": readOnlyReasonWriter}, gaugeValue(readOnly))
+	})
+}
+
+// setSwitchedLocked must be invoked with mu held.
+func (r *ReadOnlyStorage) setSwitchedLocked(enabled bool) {
+	if enabled != r.switched {
+		r.logger.Printf("the storage is switched to read-only: %v", enabled)
+	}
+	r.switched = enabled
+	r.metrics.SetGauge(MetricReadOnly, map[string]string{"reason": readOnlyReasonSwitched}, gaugeValue(enabled))
+}
+
+// gaugeValue returns 1 if b is true, and 0 otherwise.
+func gaugeValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ReadOnly reports whether the storage is read-only.
+func (r *ReadOnlyStorage) ReadOnly() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.switched || r.detected
+}
+
+// checkWritable returns the error of a write if the storage is read-only.
+func (r *ReadOnlyStorage) checkWritable() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var msg string
+	switch {
+	case r.switched:
+		msg = "the storage is read-only for maintenance"
+	case r.detected:
+		msg = "the writer of the storage is read-only"
+	default:
+		return nil
+	}
+	st := status.New(codes.Unavailable, fmt.Sprintf("%s, retry after %s", msg, r.retryAfter))
+	if detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(r.retryAfter)}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// CreateProject fails while the storage is read-only, and creates the project via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) CreateProject(ctx context.Context, pID string, p *prpb.Project) (*prpb.Project, error) {
+	if err := r.checkWritable(); err != nil {
+		return nil, err
+	}
+	return r.Storage.CreateProject(ctx, pID, p)
+}
+
+// DeleteProject fails while the storage is read-only, and deletes the project via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) DeleteProject(ctx context.Context, pID string) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+	return r.Storage.DeleteProject(ctx, pID)
+}
+
+// CreateOccurrence fails while the storage is read-only, and creates the occurrence via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) CreateOccurrence(ctx context.Context, pID, uID string, o *gpb.Occurrence) (*gpb.Occurrence, error) {
+	if err := r.checkWritable(); err != nil {
+		return nil, err
+	}
+	return r.Storage.CreateOccurrence(ctx, pID, uID, o)
+}
+
+// BatchCreateOccurrences fails while the storage is read-only, and creates the occurrences via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*gpb.Occurrence) ([]*gpb.Occurrence, []error) {
+	if err := r.checkWritable(); err != nil {
+		return nil, []error{err}
+	}
+	return r.Storage.BatchCreateOccurrences(ctx, pID, uID, occs)
+}
+
+// UpdateOccurrence fails while the storage is read-only, and updates the occurrence via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) UpdateOccurrence(ctx context.Context, pID, oID string, o *gpb.Occurrence, mask *fieldmaskpb.FieldMask) (*gpb.Occurrence, error) {
+	if err := r.checkWritable(); err != nil {
+		return nil, err
+	}
+	return r.Storage.UpdateOccurrence(ctx, pID, oID, o, mask)
+}
+
+// DeleteOccurrence fails while the storage is read-only, and deletes the occurrence via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) DeleteOccurrence(ctx context.Context, pID, oID string) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+	return r.Storage.DeleteOccurrence(ctx, pID, oID)
+}
+
+// CreateNote fails while the storage is read-only, and creates the note via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) CreateNote(ctx context.Context, pID, nID, uID string, n *gpb.Note) (*gpb.Note, error) {
+	if err := r.checkWritable(); err != nil {
+		return nil, err
+	}
+	return r.Storage.CreateNote(ctx, pID, nID, uID, n)
+}
+
+// BatchCreateNotes fails while the storage is read-only, and creates the notes via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*gpb.Note) ([]*gpb.Note, []error) {
+	if err := r.checkWritable(); err != nil {
+		return nil, []error{err}
+	}
+	return r.Storage.BatchCreateNotes(ctx, pID, uID, notes)
+}
+
+// UpdateNote fails while the storage is read-only, and updates the note via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) UpdateNote(ctx context.Context, pID, nID string, n *gpb.Note, mask *fieldmaskpb.FieldMask) (*gpb.Note, error) {
+	if err := r.checkWritable(); err != nil {
+		return nil, err
+	}
+	return r.Storage.UpdateNote(ctx, pID, nID, n, mask)
+}
+
+// DeleteNote fails while the storage is read-only, and deletes the note via the wrapped Storage otherwise.
+func (r *ReadOnlyStorage) DeleteNote(ctx context.Context, pID, nID string) error {
+	if err := r.checkWritable(); err != nil {
+		return err
+	}
+	return r.Storage.DeleteNote(ctx, pID, nID)
+}
+
+var _ Storage = (*ReadOnlyStorage)(nil)
@@ -0,0 +1,288 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafeas/grafeas/go/config"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+// fakeDetector reports readOnly, or fails with err if it's set.
+type fakeDetector struct {
+	mu       sync.Mutex
+	readOnly bool
+	err      error
+}
+
+func (d *fakeDetector) WriterReadOnly(context.Context) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readOnly, d.err
+}
+
+func (d *fakeDetector) set(readOnly bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.readOnly, d.err = readOnly, err
+}
+
+// detectingStorage is a Storage implementing ReadOnlyDetector.
+type detectingStorage struct {
+	*mocks.MockStorage
+	*fakeDetector
+}
+
+func newTestReadOnlyStorage(s Storage, enabled bool) *ReadOnlyStorage {
+	conf := rdsconfig.ReadOnlyConfig{Enabled: enabled, RetryAfter: rdsconfig.Duration(time.Minute)}
+	return NewReadOnlyStorage(s, conf, WithReadOnlyLogger(log.New(io.Discard, "", 0)))
+}
+
+// wantReadOnlyError checks that err rejects a write with the retry-after hint.
+func wantReadOnlyError(t *testing.T, err error) {
+	t.Helper()
+	st := status.Convert(err)
+	if st.Code() != codes.Unavailable {
+		t.Fatalf("got %v, want code %v", err, codes.Unavailable)
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			if got := info.GetRetryDelay().AsDuration(); got != time.Minute {
+				t.Errorf("got retry delay %v, want %v", got, time.Minute)
+			}
+			return
+		}
+	}
+	t.Errorf("got details %v, want a RetryInfo", st.Details())
+}
+
+func TestReadOnlyStorage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	s := newTestReadOnlyStorage(store, true)
+
+	// The writes are rejected without reaching the storage.
+	writes := map[string]func() error{
+		"CreateProject": func() error { _, err := s.CreateProject(ctx, "p", &prpb.Project{}); return err },
+		"DeleteProject": func() error { return s.DeleteProject(ctx, "p") },
+		"CreateNote":    func() error { _, err := s.CreateNote(ctx, "p", "n", "u", &gpb.Note{}); return err },
+		"UpdateNote":    func() error { _, err := s.UpdateNote(ctx, "p", "n", &gpb.Note{}, nil); return err },
+		"DeleteNote":    func() error { return s.DeleteNote(ctx, "p", "n") },
+		"BatchCreateNotes": func() error {
+			_, errs := s.BatchCreateNotes(ctx, "p", "u", map[string]*gpb.Note{"n": {}})
+			return firstError(errs)
+		},
+		"CreateOccurrence": func() error { _, err := s.CreateOccurrence(ctx, "p", "u", &gpb.Occurrence{}); return err },
+		"UpdateOccurrence": func() error { _, err := s.UpdateOccurrence(ctx, "p", "o", &gpb.Occurrence{}, nil); return err },
+		"DeleteOccurrence": func() error { return s.DeleteOccurrence(ctx, "p", "o") },
+		"BatchCreateOccurrences": func() error {
+			_, errs := s.BatchCreateOccurrences(ctx, "p", "u", []*gpb.Occurrence{{}})
+			return firstError(errs)
+		},
+	}
+	for method, write := range writes {
+		t.Run(method, func(t *testing.T) {
+			wantReadOnlyError(t, write())
+		})
+	}
+
+	// The reads are served.
+	store.EXPECT().GetNote(ctx, "p", "n").Times(1).Return(&gpb.Note{}, nil)
+	if _, err := s.GetNote(ctx, "p", "n"); err != nil {
+		t.Errorf("unexpected err: %v", err)
+	}
+
+	// The writes are accepted again once it's switched back.
+	s.SetReadOnly(false)
+	store.EXPECT().DeleteNote(ctx, "p", "n").Times(1).Return(nil)
+	if err := s.DeleteNote(ctx, "p", "n"); err != nil {
+		t.Errorf("unexpected err: %v", err)
+	}
+}
+
+func TestReadOnlyStorageConfigure(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	s := newTestReadOnlyStorage(mocks.NewMockStorage(mockCtrl), false)
+	steps := []struct {
+		name     string
+		switched *bool
+		enabled  bool
+		want     bool
+	}{
+		{name: "switched by a signal", switched: boolPtr(true), want: true},
+		{name: "the same config keeps the switch", want: true},
+		{name: "the switched config wins", enabled: true, want: true},
+		{name: "switched back by a signal", switched: boolPtr(false), enabled: true},
+		{name: "the config switched back", want: false},
+		{name: "the config switched again", enabled: true, want: true},
+	}
+	for _, step := range steps {
+		if step.switched != nil {
+			s.SetReadOnly(*step.switched)
+		} else {
+			s.Configure(rdsconfig.ReadOnlyConfig{Enabled: step.enabled, RetryAfter: rdsconfig.Duration(2 * time.Minute)})
+		}
+		if got := s.ReadOnly(); got != step.want {
+			t.Errorf("%s: got read-only %v, want %v", step.name, got, step.want)
+		}
+	}
+	if s.retryAfter != 2*time.Minute {
+		t.Errorf("got retry after %v, want %v", s.retryAfter, 2*time.Minute)
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func TestReadOnlyStorageDetectWriterReadOnly(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockCtrl := gomock.NewController(t)
+	metrics := newFakeMetrics()
+	s := NewReadOnlyStorage(mocks.NewMockStorage(mockCtrl), rdsconfig.ReadOnlyConfig{RetryAfter: rdsconfig.Duration(time.Minute)},
+		WithReadOnlyLogger(log.New(io.Discard, "", 0)), WithReadOnlyMetrics(metrics))
+	detector := &fakeDetector{readOnly: true}
+	go s.DetectWriterReadOnly(ctx, detector, 10*time.Millisecond)
+
+	eventually(t, s.ReadOnly, "the storage didn't follow the read-only writer")
+	wantReadOnlyError(t, s.DeleteNote(ctx, "p", "n"))
+	if v, _ := metrics.gauge(MetricReadOnly, map[string]string{"reason": "writer"}); v != 1 {
+		t.Errorf("got gauge %v, want 1", v)
+	}
+
+	// A failed check keeps the mode.
+	detector.set(false, errors.New("connection refused"))
+	time.Sleep(50 * time.Millisecond)
+	if !s.ReadOnly() {
+		t.Errorf("the mode changed on a failed check")
+	}
+
+	detector.set(false, nil)
+	eventually(t, func() bool { return !s.ReadOnly() }, "the storage didn't follow the writable writer")
+}
+
+func TestReadOnlyStorageToggleOnSignal(t *testing.T) {
+	t.Parallel()
+
+	// The test also receives the signal, so that it never reaches the default handler terminating the process.
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, syscall.SIGUSR1)
+	defer signal.Stop(received)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockCtrl := gomock.NewController(t)
+	s := newTestReadOnlyStorage(mocks.NewMockStorage(mockCtrl), false)
+	go s.ToggleOnSignal(ctx, syscall.SIGUSR1)
+
+	// The signal is sent until it's handled, because the handler may not be registered yet.
+	eventually(t, func() bool {
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		time.Sleep(10 * time.Millisecond)
+		return s.ReadOnly()
+	}, "the storage wasn't switched by the signal")
+}
+
+func TestCanApplyInPlace(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	prev := &rdsconfig.Config{Host: "some-host.rds.amazonaws.com", ReadOnly: rdsconfig.ReadOnlyConfig{RetryAfter: 1}}
+	tests := []struct {
+		name    string
+		next    rdsconfig.Config
+		storage Storage
+		want    bool
+	}{
+		{
+			name:    "read-only switched",
+			next:    rdsconfig.Config{Host: "some-host.rds.amazonaws.com", ReadOnly: rdsconfig.ReadOnlyConfig{Enabled: true, RetryAfter: 2}},
+			storage: newTestReadOnlyStorage(store, false),
+			want:    true,
+		},
+		{
+			name:    "read-only switched without ReadOnlyStorage",
+			next:    rdsconfig.Config{Host: "some-host.rds.amazonaws.com", ReadOnly: rdsconfig.ReadOnlyConfig{Enabled: true, RetryAfter: 1}},
+			storage: store,
+		},
+		{
+			name:    "detection enabled",
+			next:    rdsconfig.Config{Host: "some-host.rds.amazonaws.com", ReadOnly: rdsconfig.ReadOnlyConfig{RetryAfter: 1, DetectInterval: 1}},
+			storage: newTestReadOnlyStorage(store, false),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := canApplyInPlace(prev, &tt.next, tt.storage); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorageProviderWithReadOnly(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	conf := config.StorageConfiguration(rdsconfig.Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLRootCert: "testdata/ca.pem",
+		ReadOnly:    rdsconfig.ReadOnlyConfig{DetectInterval: rdsconfig.Duration(10 * time.Millisecond)},
+	})
+	store := mocks.NewMockStorage(mockCtrl)
+	store.EXPECT().SetMaxOpenConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetMaxIdleConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxLifetime(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxIdleTime(gomock.Any()).AnyTimes()
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Times(1).
+		Return(&detectingStorage{MockStorage: store, fakeDetector: &fakeDetector{readOnly: true}}, nil)
+
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator,
+		WithLogger(log.New(io.Discard, "", 0)), WithRetry())
+	provided, err := provider.Provide("", &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	r, ok := provided.Gs.(*ReadOnlyStorage)
+	if !ok {
+		t.Fatalf("got %T, want *ReadOnlyStorage", provided.Gs)
+	}
+	// The writer is checked through the storage under the other wrappers.
+	eventually(t, r.ReadOnly, "the storage didn't detect the read-only writer")
+	if got := r.retryAfter; got != 30*time.Second {
+		t.Errorf("got retry after %v, want the default 30s", got)
+	}
+}
@@ -0,0 +1,498 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/grafeas/grafeas/go/config"
+	"github.com/grafeas/grafeas/go/v1beta1/storage"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	fieldmaskpb "google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+)
+
+// defaultReloadInterval is how often the config file is checked for changes if no interval is given.
+const defaultReloadInterval = 30 * time.Second
+
+const (
+	errMsgReadConfigFile = "failed to read the config file"
+	errMsgReloadConfig   = "failed to reload the config"
+	errMsgCloseStorage   = "failed to close the replaced storage"
+	errMsgStorageClosed  = "the storage is closed"
+)
+
+// ReloadableProvider provides storages which follow the changes of the config file without restarting the server.
+//
+// The file is polled, and when the connection parameters (e.g. host, reader or credentials) change,
+// new connectors and a new storage are created and atomically swapped in under the provided storage.
+// The replaced storage is drained, i.e. closed once the calls which are already using it return,
+// if it implements io.Closer.
+// A change to conn_pool alone is applied to the current storage in place,
+// and so are the changes to read_only.enabled and read_only.retry_after if the storage is a ReadOnlyStorage.
+// The read-only mode switched by a signal is kept by both, until read_only.enabled is changed.
+// If the new config is invalid, the current storage keeps being used and the error is logged.
+type ReloadableProvider struct {
+	provider *GrafeasStorageProvider
+	path     string
+	interval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewReloadableProvider returns a ReloadableProvider which creates the storages via provider,
+// and reloads them when the Grafeas config file at path changes.
+// The file is checked on the given interval, which defaults to 30 seconds if it's not positive.
+func NewReloadableProvider(provider *GrafeasStorageProvider, path string, interval time.Duration) *ReloadableProvider {
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ReloadableProvider{
+		provider: provider,
+		path:     path,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Provide is the reloadable version of GrafeasStorageProvider.Provide.
+func (r *ReloadableProvider) Provide(_ string, confi *config.StorageConfiguration) (*storage.Storage, error) {
+	return r.provide(confi, false)
+}
+
+// ProvideRW is the reloadable version of GrafeasStorageProvider.ProvideRW.
+func (r *ReloadableProvider) ProvideRW(_ string, confi *config.StorageConfiguration) (*storage.Storage, error) {
+	return r.provide(confi, true)
+}
+
+// Close stops watching the config file and drains the provided storages.
+// The calls made after that fail with codes.Unavailable.
+func (r *ReloadableProvider) Close() {
+	r.cancel()
+}
+
+func (r *ReloadableProvider) provide(confi *config.StorageConfiguration, rw bool) (*storage.Storage, error) {
+	conf, err := r.provider.newConfig(confi)
+	if err != nil {
+		return nil, err
+	}
+	// The content is read before the storage is created, which can take long (e.g. discovery and migrations),
+	// so that a change saved in the meantime triggers a reload rather than becoming the baseline.
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		r.provider.logger.Printf("%s %s, err: %v", errMsgReadConfigFile, r.path, err)
+	}
+	s, err := newReloadableStorage(r.ctx, r.provider, conf, rw)
+	if err != nil {
+		return nil, err
+	}
+	go s.watch(r.ctx, r.path, content, r.interval)
+	return &storage.Storage{
+		Ps: s,
+		Gs: s,
+	}, nil
+}
+
+// generation is a storage created from a version of the config.
+type generation struct {
+	conf    *rdsconfig.Config
+	storage Storage
+	// cancel stops the background tasks of the connectors.
+	cancel context.CancelFunc
+	// inflight counts the calls using storage.
+	inflight sync.WaitGroup
+	// closed is set under the write lock of reloadableStorage.mu before g is drained on shutdown,
+	// so that no call is added to inflight while it's waited for.
+	closed bool
+}
+
+func (g *generation) release() {
+	g.inflight.Done()
+}
+
+// drain waits for the calls using g to return, and then closes it.
+func (g *generation) drain() error {
+	g.inflight.Wait()
+	g.cancel()
+	if closer, ok := g.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// reloadableStorage is a Storage which delegates every call to the current generation.
+type reloadableStorage struct {
+	provider *GrafeasStorageProvider
+	rw       bool
+
+	// mu guards current.
+	// The read lock is held while a call starts using the current generation,
+	// so that no call starts using a generation after it has been replaced.
+	mu      sync.RWMutex
+	current *generation
+}
+
+func newReloadableStorage(ctx context.Context, provider *GrafeasStorageProvider, conf *rdsconfig.Config, rw bool) (*reloadableStorage, error) {
+	s := &reloadableStorage{provider: provider, rw: rw}
+	g, err := s.newGeneration(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	s.current = g
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		current := s.current
+		current.closed = true
+		s.mu.Unlock()
+		if err := current.drain(); err != nil {
+			provider.logger.Printf("%s, err: %v", errMsgCloseStorage, err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *reloadableStorage) newGeneration(ctx context.Context, conf *rdsconfig.Config) (*generation, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	rdsStorage, err := s.provider.create(ctx, conf, s.rw)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &generation{conf: conf, storage: rdsStorage, cancel: cancel}, nil
+}
+
+// acquire returns the current generation, which must be released after use.
+// It fails with codes.Unavailable once the storage is closed.
+func (s *reloadableStorage) acquire() (*generation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	g := s.current
+	if g.closed {
+		return nil, status.Error(codes.Unavailable, errMsgStorageClosed)
+	}
+	g.inflight.Add(1)
+	return g, nil
+}
+
+// watch reloads the storage whenever the content of the config file at path changes until ctx is done.
+func (s *reloadableStorage) watch(ctx context.Context, path string, content []byte, interval time.Duration) {
+	runPeriodically(ctx, interval, func() {
+		latest, err := os.ReadFile(path)
+		if err != nil {
+			s.provider.logger.Printf("%s %s, err: %v", errMsgReadConfigFile, path, err)
+			return
+		}
+		if bytes.Equal(latest, content) {
+			return
+		}
+		content = latest
+		if err := s.reloadFile(ctx, path); err != nil {
+			s.provider.logger.Printf("%s, err: %v", errMsgReloadConfig, err)
+		}
+	})
+}
+
+func (s *reloadableStorage) reloadFile(ctx context.Context, path string) error {
+	grafeasConf, err := config.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	conf, err := s.provider.newConfig(grafeasConf.StorageConfig)
+	if err != nil {
+		return err
+	}
+	return s.reload(ctx, conf)
+}
+
+// reload applies conf to the storage.
+func (s *reloadableStorage) reload(ctx context.Context, conf *rdsconfig.Config) error {
+	s.mu.RLock()
+	current := s.current
+	s.mu.RUnlock()
+
+	if reflect.DeepEqual(conf, current.conf) {
+		return nil
+	}
+	if canApplyInPlace(current.conf, conf, current.storage) {
+		s.provider.logger.Println("apply the new connection pool and read-only settings in place")
+		setConnPoolParams(current.storage, conf.ConnPool)
+		if r, ok := current.storage.(*ReadOnlyStorage); ok {
+			r.Configure(conf.ReadOnly)
+		}
+		s.mu.Lock()
+		current.conf = conf
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.provider.logger.Println("the connection parameters changed, so a new storage is created")
+	g, err := s.newGeneration(ctx, conf)
+	if err != nil {
+		return err
+	}
+	if r, ok := g.storage.(*ReadOnlyStorage); ok {
+		if prev, ok := current.storage.(*ReadOnlyStorage); ok {
+			r.inheritSwitch(prev)
+		}
+	}
+	s.mu.Lock()
+	if current.closed {
+		// The storage has been closed while the new one was being created, so the new one is not used.
+		s.mu.Unlock()
+		if err := g.drain(); err != nil {
+			s.provider.logger.Printf("%s, err: %v", errMsgCloseStorage, err)
+		}
+		return status.Error(codes.Unavailable, errMsgStorageClosed)
+	}
+	s.current = g
+	s.mu.Unlock()
+	go func() {
+		if err := current.drain(); err != nil {
+			s.provider.logger.Printf("%s, err: %v", errMsgCloseStorage, err)
+		}
+	}()
+	return nil
+}
+
+// canApplyInPlace returns true if next differs from prev only in the settings which can be applied to s in place,
+// i.e. ConnPool, and ReadOnly.Enabled and ReadOnly.RetryAfter if s is a ReadOnlyStorage.
+func canApplyInPlace(prev, next *rdsconfig.Config, s Storage) bool {
+	if _, ok := s.(*ReadOnlyStorage); ok {
+		withPrevReadOnly := *next
+		withPrevReadOnly.ReadOnly.Enabled = prev.ReadOnly.Enabled
+		withPrevReadOnly.ReadOnly.RetryAfter = prev.ReadOnly.RetryAfter
+		next = &withPrevReadOnly
+	}
+	return onlyConnPoolChanged(prev, next)
+}
+
+// onlyConnPoolChanged returns true if next differs from prev only in ConnPool.
+func onlyConnPoolChanged(prev, next *rdsconfig.Config) bool {
+	withPrevPool := *next
+	withPrevPool.ConnPool = prev.ConnPool
+	return reflect.DeepEqual(&withPrevPool, prev)
+}
+
+// The following methods delegate the calls to the current generation.
+
+func (s *reloadableStorage) GetOccurrence(ctx context.Context, projectID, occurrenceID string) (*gpb.Occurrence, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.GetOccurrence(ctx, projectID, occurrenceID)
+}
+
+func (s *reloadableStorage) ListOccurrences(ctx context.Context, projectID, filter, pageToken string, pageSize int32) ([]*gpb.Occurrence, string, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, "", err
+	}
+	defer g.release()
+	return g.storage.ListOccurrences(ctx, projectID, filter, pageToken, pageSize)
+}
+
+func (s *reloadableStorage) CreateOccurrence(ctx context.Context, projectID, userID string, o *gpb.Occurrence) (*gpb.Occurrence, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.CreateOccurrence(ctx, projectID, userID, o)
+}
+
+func (s *reloadableStorage) BatchCreateOccurrences(ctx context.Context, projectID, userID string, occs []*gpb.Occurrence) ([]*gpb.Occurrence, []error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer g.release()
+	return g.storage.BatchCreateOccurrences(ctx, projectID, userID, occs)
+}
+
+func (s *reloadableStorage) UpdateOccurrence(ctx context.Context, projectID, occurrenceID string, o *gpb.Occurrence, mask *fieldmaskpb.FieldMask) (*gpb.Occurrence, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.UpdateOccurrence(ctx, projectID, occurrenceID, o, mask)
+}
+
+func (s *reloadableStorage) DeleteOccurrence(ctx context.Context, projectID, occurrenceID string) error {
+	g, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer g.release()
+	return g.storage.DeleteOccurrence(ctx, projectID, occurrenceID)
+}
+
+func (s *reloadableStorage) GetNote(ctx context.Context, projectID, noteID string) (*gpb.Note, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.GetNote(ctx, projectID, noteID)
+}
+
+func (s *reloadableStorage) ListNotes(ctx context.Context, projectID, filter, pageToken string, pageSize int32) ([]*gpb.Note, string, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, "", err
+	}
+	defer g.release()
+	return g.storage.ListNotes(ctx, projectID, filter, pageToken, pageSize)
+}
+
+func (s *reloadableStorage) CreateNote(ctx context.Context, projectID, noteID, userID string, n *gpb.Note) (*gpb.Note, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.CreateNote(ctx, projectID, noteID, userID, n)
+}
+
+func (s *reloadableStorage) BatchCreateNotes(ctx context.Context, projectID, userID string, notes map[string]*gpb.Note) ([]*gpb.Note, []error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer g.release()
+	return g.storage.BatchCreateNotes(ctx, projectID, userID, notes)
+}
+
+func (s *reloadableStorage) UpdateNote(ctx context.Context, projectID, noteID string, n *gpb.Note, mask *fieldmaskpb.FieldMask) (*gpb.Note, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.UpdateNote(ctx, projectID, noteID, n, mask)
+}
+
+func (s *reloadableStorage) DeleteNote(ctx context.Context, projectID, noteID string) error {
+	g, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer g.release()
+	return g.storage.DeleteNote(ctx, projectID, noteID)
+}
+
+func (s *reloadableStorage) GetOccurrenceNote(ctx context.Context, projectID, occurrenceID string) (*gpb.Note, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.GetOccurrenceNote(ctx, projectID, occurrenceID)
+}
+
+func (s *reloadableStorage) ListNoteOccurrences(ctx context.Context, projectID, noteID, filter, pageToken string, pageSize int32) ([]*gpb.Occurrence, string, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, "", err
+	}
+	defer g.release()
+	return g.storage.ListNoteOccurrences(ctx, projectID, noteID, filter, pageToken, pageSize)
+}
+
+func (s *reloadableStorage) GetVulnerabilityOccurrencesSummary(ctx context.Context, projectID, filter string) (*gpb.VulnerabilityOccurrencesSummary, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.GetVulnerabilityOccurrencesSummary(ctx, projectID, filter)
+}
+
+func (s *reloadableStorage) CreateProject(ctx context.Context, projectID string, p *prpb.Project) (*prpb.Project, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.CreateProject(ctx, projectID, p)
+}
+
+func (s *reloadableStorage) GetProject(ctx context.Context, projectID string) (*prpb.Project, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer g.release()
+	return g.storage.GetProject(ctx, projectID)
+}
+
+func (s *reloadableStorage) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) ([]*prpb.Project, string, error) {
+	g, err := s.acquire()
+	if err != nil {
+		return nil, "", err
+	}
+	defer g.release()
+	return g.storage.ListProjects(ctx, filter, pageSize, pageToken)
+}
+
+func (s *reloadableStorage) DeleteProject(ctx context.Context, projectID string) error {
+	g, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer g.release()
+	return g.storage.DeleteProject(ctx, projectID)
+}
+
+func (s *reloadableStorage) SetMaxOpenConns(n int) {
+	g, err := s.acquire()
+	if err != nil {
+		return
+	}
+	defer g.release()
+	g.storage.SetMaxOpenConns(n)
+}
+
+func (s *reloadableStorage) SetMaxIdleConns(n int) {
+	g, err := s.acquire()
+	if err != nil {
+		return
+	}
+	defer g.release()
+	g.storage.SetMaxIdleConns(n)
+}
+
+func (s *reloadableStorage) SetConnMaxLifetime(d time.Duration) {
+	g, err := s.acquire()
+	if err != nil {
+		return
+	}
+	defer g.release()
+	g.storage.SetConnMaxLifetime(d)
+}
+
+func (s *reloadableStorage) SetConnMaxIdleTime(d time.Duration) {
+	g, err := s.acquire()
+	if err != nil {
+		return
+	}
+	defer g.release()
+	g.storage.SetConnMaxIdleTime(d)
+}
@@ -0,0 +1,338 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/grafeas/grafeas/go/config"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+// closableStorage is a Storage which records whether it has been closed.
+type closableStorage struct {
+	*mocks.MockStorage
+	closed int32
+}
+
+func (s *closableStorage) Close() error {
+	atomic.StoreInt32(&s.closed, 1)
+	return nil
+}
+
+func (s *closableStorage) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) == 1
+}
+
+// newClosableStorage returns a closableStorage which accepts any pool settings.
+// expect is invoked beforehand, so that it can expect specific pool settings.
+func newClosableStorage(mockCtrl *gomock.Controller, expect func(*mocks.MockStorage)) *closableStorage {
+	s := &closableStorage{MockStorage: mocks.NewMockStorage(mockCtrl)}
+	if expect != nil {
+		expect(s.MockStorage)
+	}
+	s.EXPECT().SetMaxOpenConns(gomock.Any()).AnyTimes()
+	s.EXPECT().SetMaxIdleConns(gomock.Any()).AnyTimes()
+	s.EXPECT().SetConnMaxLifetime(gomock.Any()).AnyTimes()
+	s.EXPECT().SetConnMaxIdleTime(gomock.Any()).AnyTimes()
+	return s
+}
+
+func writeGrafeasConfig(t *testing.T, path, host string, maxOpenConns int) {
+	t.Helper()
+	content := fmt.Sprintf(`grafeas:
+  storage_type: "rds"
+  rds:
+    host: %q
+    user: "grafeas_rw"
+    password: "dummy-password-for-unit-tests-only"
+    ssl_mode: "require"
+    conn_pool:
+      max_open_conns: %d
+`, host, maxOpenConns)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func eventually(t *testing.T, condition func() bool, msg string) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(msg)
+}
+
+func TestReloadableProvider(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeGrafeasConfig(t, path, "some-host.rds.amazonaws.com", 1)
+	grafeasConf, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var maxOpenConns int32
+	first := newClosableStorage(mockCtrl, func(s *mocks.MockStorage) {
+		s.EXPECT().SetMaxOpenConns(2).Do(func(n int) { atomic.StoreInt32(&maxOpenConns, int32(n)) })
+	})
+	second := newClosableStorage(mockCtrl, nil)
+	second.EXPECT().GetProject(gomock.Any(), "some-project").Return(&prpb.Project{Name: "projects/some-project"}, nil)
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	gomock.InOrder(
+		storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Return(first, nil),
+		storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Return(second, nil),
+	)
+
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator, WithLogger(log.New(io.Discard, "", 0)))
+	r := NewReloadableProvider(provider, path, 10*time.Millisecond)
+	defer r.Close()
+	s, err := r.Provide("", grafeasConf.StorageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A pool-only change is applied in place.
+	writeGrafeasConfig(t, path, "some-host.rds.amazonaws.com", 2)
+	eventually(t, func() bool { return atomic.LoadInt32(&maxOpenConns) == 2 }, "the new pool settings are not applied")
+	if first.isClosed() {
+		t.Fatal("the storage should not be replaced by a pool-only change")
+	}
+
+	// A connection parameter change replaces the storage.
+	writeGrafeasConfig(t, path, "other-host.rds.amazonaws.com", 2)
+	eventually(t, first.isClosed, "the replaced storage is not closed")
+	if _, err := s.Ps.GetProject(context.Background(), "some-project"); err != nil {
+		t.Errorf("don't want error, but got %q", err)
+	}
+
+	// An invalid config is ignored.
+	writeGrafeasConfig(t, path, "", 2)
+	time.Sleep(50 * time.Millisecond)
+	if second.isClosed() {
+		t.Error("the current storage should be kept if the new config is invalid")
+	}
+
+	r.Close()
+	eventually(t, second.isClosed, "the storage is not closed after the provider is closed")
+}
+
+func TestReloadableProviderAppliesChangesDuringCreation(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeGrafeasConfig(t, path, "some-host.rds.amazonaws.com", 1)
+	grafeasConf, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var maxOpenConns int32
+	store := newClosableStorage(mockCtrl, func(s *mocks.MockStorage) {
+		s.EXPECT().SetMaxOpenConns(2).Do(func(n int) { atomic.StoreInt32(&maxOpenConns, int32(n)) })
+	})
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	// The config is changed while the storage is being created.
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).DoAndReturn(func(driver.Connector, string) (Storage, error) {
+		writeGrafeasConfig(t, path, "some-host.rds.amazonaws.com", 2)
+		return store, nil
+	})
+
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator, WithLogger(log.New(io.Discard, "", 0)))
+	r := NewReloadableProvider(provider, path, 10*time.Millisecond)
+	defer r.Close()
+	if _, err := r.Provide("", grafeasConf.StorageConfig); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, func() bool { return atomic.LoadInt32(&maxOpenConns) == 2 }, "the change made during the creation is not applied")
+}
+
+func TestReloadableStorageDrainsInflightCalls(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	first := newClosableStorage(mockCtrl, nil)
+	second := newClosableStorage(mockCtrl, nil)
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	first.EXPECT().DeleteProject(gomock.Any(), "some-project").DoAndReturn(func(context.Context, string) error {
+		close(started)
+		<-unblock
+		return nil
+	})
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	gomock.InOrder(
+		storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Return(first, nil),
+		storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Return(second, nil),
+	)
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator, WithLogger(log.New(io.Discard, "", 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf := &rdsconfig.Config{Host: "some-host.rds.amazonaws.com", Port: 5432, Password: "dummy-password-for-unit-tests-only", SSLMode: "require"}
+	s, err := newReloadableStorage(ctx, provider, conf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.DeleteProject(context.Background(), "some-project") }()
+	<-started
+
+	next := *conf
+	next.Host = "other-host.rds.amazonaws.com"
+	if err := s.reload(ctx, &next); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if first.isClosed() {
+		t.Fatal("the replaced storage should not be closed while a call is using it")
+	}
+	close(unblock)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, first.isClosed, "the replaced storage is not closed after the call returns")
+}
+
+func TestReloadableStorageRejectsCallsAfterClose(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	first := newClosableStorage(mockCtrl, nil)
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Return(first, nil)
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator, WithLogger(log.New(io.Discard, "", 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	conf := &rdsconfig.Config{Host: "some-host.rds.amazonaws.com", Port: 5432, Password: "dummy-password-for-unit-tests-only", SSLMode: "require"}
+	s, err := newReloadableStorage(ctx, provider, conf, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	eventually(t, first.isClosed, "the storage is not closed after ctx is done")
+
+	// No call reaches the closed storage, whose mock doesn't expect any.
+	if err := s.DeleteProject(context.Background(), "some-project"); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want %v", err, codes.Unavailable)
+	}
+	if _, errs := s.BatchCreateNotes(context.Background(), "some-project", "some-user", nil); len(errs) != 1 || status.Code(errs[0]) != codes.Unavailable {
+		t.Errorf("got %v, want [%v]", errs, codes.Unavailable)
+	}
+	s.SetMaxOpenConns(1)
+}
+
+func TestReloadableStorageKeepsReadOnlySwitch(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Times(3).DoAndReturn(func(driver.Connector, string) (Storage, error) {
+		return newClosableStorage(mockCtrl, nil), nil
+	})
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator, WithLogger(log.New(io.Discard, "", 0)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conf := rdsconfig.Config{
+		Host: "some-host.rds.amazonaws.com", Port: 5432, Password: "dummy-password-for-unit-tests-only", SSLMode: "require",
+		// The detect interval keeps the storage wrapped while read_only.enabled is false, and it's ignored without a ReadOnlyDetector.
+		ReadOnly: rdsconfig.ReadOnlyConfig{Enabled: true, RetryAfter: rdsconfig.Duration(time.Minute), DetectInterval: rdsconfig.Duration(time.Hour)},
+	}
+	initial := conf
+	s, err := newReloadableStorage(ctx, provider, &initial, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnlyStorage := func() *ReadOnlyStorage {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.current.storage.(*ReadOnlyStorage)
+	}
+	reload := func(change func(c *rdsconfig.Config)) {
+		t.Helper()
+		change(&conf)
+		next := conf
+		if err := s.reload(ctx, &next); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The mode switched by a signal is kept by the reloads which don't change read_only.enabled.
+	readOnlyStorage().SetReadOnly(false)
+	reload(func(c *rdsconfig.Config) { c.ReadOnly.RetryAfter = rdsconfig.Duration(2 * time.Minute) })
+	if readOnlyStorage().ReadOnly() {
+		t.Error("the switch should be kept by a reload in place")
+	}
+	first := readOnlyStorage()
+	reload(func(c *rdsconfig.Config) { c.Host = "other-host.rds.amazonaws.com" })
+	if readOnlyStorage() == first {
+		t.Fatal("the storage should be replaced by a connection parameter change")
+	}
+	if readOnlyStorage().ReadOnly() {
+		t.Error("the switch should be kept by the new storage")
+	}
+
+	// A change of read_only.enabled overrides the switch.
+	readOnlyStorage().SetReadOnly(true)
+	reload(func(c *rdsconfig.Config) {
+		c.Host = "some-host.rds.amazonaws.com"
+		c.ReadOnly.Enabled = false
+	})
+	if readOnlyStorage().ReadOnly() {
+		t.Error("the changed config should override the switch")
+	}
+}
+
+func TestOnlyConnPoolChanged(t *testing.T) {
+	t.Parallel()
+
+	prev := &rdsconfig.Config{Host: "some-host.rds.amazonaws.com", ConnPool: rdsconfig.ConnPoolConfig{MaxOpenConns: 1}}
+	tests := []struct {
+		name string
+		next rdsconfig.Config
+		want bool
+	}{
+		{
+			name: "pool changed",
+			next: rdsconfig.Config{Host: "some-host.rds.amazonaws.com", ConnPool: rdsconfig.ConnPoolConfig{MaxOpenConns: 2}},
+			want: true,
+		},
+		{
+			name: "host changed",
+			next: rdsconfig.Config{Host: "other-host.rds.amazonaws.com", ConnPool: rdsconfig.ConnPoolConfig{MaxOpenConns: 2}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := onlyConnPoolChanged(prev, &tt.next); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
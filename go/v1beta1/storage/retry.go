@@ -0,0 +1,305 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	defaultRetryAttempts       = 3
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+)
+
+// RetryOption configures optional behaviors of RetryingStorage.
+type RetryOption func(*RetryingStorage)
+
+// WithRetryAttempts sets how many times an operation is attempted at most, including the first one. It's 3 by default.
+func WithRetryAttempts(attempts int) RetryOption {
+	return func(r *RetryingStorage) {
+		r.attempts = attempts
+	}
+}
+
+// WithRetryBackoff sets the wait before the first retry, which doubles for every retry up to max.
+// They're 50 milliseconds and 1 second by default, and a random jitter of up to half of the wait is subtracted.
+func WithRetryBackoff(initial, max time.Duration) RetryOption {
+	return func(r *RetryingStorage) {
+		r.initialBackoff = initial
+		r.maxBackoff = max
+	}
+}
+
+// RetryingStorage is a Storage which retries the operations failing with transient errors,
+// e.g. during a failover, and maps them to the proper gRPC codes instead of codes.Internal:
+//   - the lost connections and the writes rejected by a writer demoted to a reader
+//     (SQLSTATE 25006 or MySQL 1290) are mapped to codes.Unavailable,
+//   - the serialization failures and the deadlocks (SQLSTATE 40001 and 40P01, or MySQL 1213) to codes.Aborted.
+//
+// The errors are classified by their causes, so the Storage must return them with InternalError.
+// Since a lost connection leaves it unknown whether a write has been applied,
+// the operations failing with it are only retried if they're idempotent, i.e. the reads and the updates.
+// The others are retried on any transient error, which guarantees that they haven't been applied.
+// The batch methods are never retried, but their errors are mapped.
+type RetryingStorage struct {
+	Storage
+
+	attempts       int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	// sleep waits for d unless ctx is done first, in which case it returns the error of ctx.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewRetryingStorage returns a RetryingStorage wrapping s, which is configured with opts.
+func NewRetryingStorage(s Storage, opts ...RetryOption) *RetryingStorage {
+	r := &RetryingStorage{
+		Storage:        s,
+		attempts:       defaultRetryAttempts,
+		initialBackoff: defaultRetryInitialBackoff,
+		maxBackoff:     defaultRetryMaxBackoff,
+		sleep:          sleepContext,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// sleepContext waits for d unless ctx is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// Close closes the wrapped Storage if it implements io.Closer.
+func (r *RetryingStorage) Close() error {
+	if closer, ok := r.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// backoff returns the wait before the retry following the attempt, which starts from 1.
+func (r *RetryingStorage) backoff(attempt int) time.Duration {
+	d := r.initialBackoff
+	for i := 1; i < attempt && d < r.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.maxBackoff {
+		d = r.maxBackoff
+	}
+	if half := int64(d / 2); half > 0 {
+		d -= time.Duration(rand.Int63n(half))
+	}
+	return d
+}
+
+// do invokes f until it succeeds, it fails with an error which must not be retried, or the attempts run out.
+func (r *RetryingStorage) do(ctx context.Context, idempotent bool, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		class := classifyTransientError(err)
+		if class == notTransient {
+			return err
+		}
+		if attempt >= r.attempts || (class == transientConnection && !idempotent) {
+			return mapTransientError(err, class)
+		}
+		if r.sleep(ctx, r.backoff(attempt)) != nil {
+			return mapTransientError(err, class)
+		}
+	}
+}
+
+// mapTransientError returns err with the code of class, keeping its message and its cause.
+func mapTransientError(err error, class transientClass) error {
+	return &statusError{status: status.New(class.code(), status.Convert(err).Message()), cause: err}
+}
+
+// mapTransientErrors maps the transient errors of a batch method.
+func mapTransientErrors(errs []error) []error {
+	for i, err := range errs {
+		if class := classifyTransientError(err); class != notTransient {
+			errs[i] = mapTransientError(err, class)
+		}
+	}
+	return errs
+}
+
+// CreateProject creates the project via the wrapped Storage, retrying on the transient errors except a lost connection.
+func (r *RetryingStorage) CreateProject(ctx context.Context, pID string, p *prpb.Project) (created *prpb.Project, err error) {
+	err = r.do(ctx, false, func() error {
+		created, err = r.Storage.CreateProject(ctx, pID, p)
+		return err
+	})
+	return created, err
+}
+
+// GetProject gets the project via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) GetProject(ctx context.Context, pID string) (p *prpb.Project, err error) {
+	err = r.do(ctx, true, func() error {
+		p, err = r.Storage.GetProject(ctx, pID)
+		return err
+	})
+	return p, err
+}
+
+// ListProjects lists the projects via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) ListProjects(ctx context.Context, filter string, pageSize int, pageToken string) (projects []*prpb.Project, next string, err error) {
+	err = r.do(ctx, true, func() error {
+		projects, next, err = r.Storage.ListProjects(ctx, filter, pageSize, pageToken)
+		return err
+	})
+	return projects, next, err
+}
+
+// DeleteProject deletes the project via the wrapped Storage, retrying on the transient errors except a lost connection.
+func (r *RetryingStorage) DeleteProject(ctx context.Context, pID string) error {
+	return r.do(ctx, false, func() error {
+		return r.Storage.DeleteProject(ctx, pID)
+	})
+}
+
+// GetOccurrence gets the occurrence via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) GetOccurrence(ctx context.Context, pID, oID string) (o *gpb.Occurrence, err error) {
+	err = r.do(ctx, true, func() error {
+		o, err = r.Storage.GetOccurrence(ctx, pID, oID)
+		return err
+	})
+	return o, err
+}
+
+// ListOccurrences lists the occurrences via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) ListOccurrences(ctx context.Context, pID, filter, pageToken string, pageSize int32) (occs []*gpb.Occurrence, next string, err error) {
+	err = r.do(ctx, true, func() error {
+		occs, next, err = r.Storage.ListOccurrences(ctx, pID, filter, pageToken, pageSize)
+		return err
+	})
+	return occs, next, err
+}
+
+// CreateOccurrence creates the occurrence via the wrapped Storage, retrying on the transient errors except a lost connection.
+func (r *RetryingStorage) CreateOccurrence(ctx context.Context, pID, uID string, o *gpb.Occurrence) (created *gpb.Occurrence, err error) {
+	err = r.do(ctx, false, func() error {
+		created, err = r.Storage.CreateOccurrence(ctx, pID, uID, o)
+		return err
+	})
+	return created, err
+}
+
+// BatchCreateOccurrences creates the occurrences via the wrapped Storage without retrying, and maps the transient errors.
+func (r *RetryingStorage) BatchCreateOccurrences(ctx context.Context, pID string, uID string, occs []*gpb.Occurrence) ([]*gpb.Occurrence, []error) {
+	created, errs := r.Storage.BatchCreateOccurrences(ctx, pID, uID, occs)
+	return created, mapTransientErrors(errs)
+}
+
+// UpdateOccurrence updates the occurrence via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) UpdateOccurrence(ctx context.Context, pID, oID string, o *gpb.Occurrence, mask *fieldmaskpb.FieldMask) (updated *gpb.Occurrence, err error) {
+	err = r.do(ctx, true, func() error {
+		updated, err = r.Storage.UpdateOccurrence(ctx, pID, oID, o, mask)
+		return err
+	})
+	return updated, err
+}
+
+// DeleteOccurrence deletes the occurrence via the wrapped Storage, retrying on the transient errors except a lost connection.
+func (r *RetryingStorage) DeleteOccurrence(ctx context.Context, pID, oID string) error {
+	return r.do(ctx, false, func() error {
+		return r.Storage.DeleteOccurrence(ctx, pID, oID)
+	})
+}
+
+// GetNote gets the note via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) GetNote(ctx context.Context, pID, nID string) (n *gpb.Note, err error) {
+	err = r.do(ctx, true, func() error {
+		n, err = r.Storage.GetNote(ctx, pID, nID)
+		return err
+	})
+	return n, err
+}
+
+// ListNotes lists the notes via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) ListNotes(ctx context.Context, pID, filter, pageToken string, pageSize int32) (notes []*gpb.Note, next string, err error) {
+	err = r.do(ctx, true, func() error {
+		notes, next, err = r.Storage.ListNotes(ctx, pID, filter, pageToken, pageSize)
+		return err
+	})
+	return notes, next, err
+}
+
+// CreateNote creates the note via the wrapped Storage, retrying on the transient errors except a lost connection.
+func (r *RetryingStorage) CreateNote(ctx context.Context, pID, nID, uID string, n *gpb.Note) (created *gpb.Note, err error) {
+	err = r.do(ctx, false, func() error {
+		created, err = r.Storage.CreateNote(ctx, pID, nID, uID, n)
+		return err
+	})
+	return created, err
+}
+
+// BatchCreateNotes creates the notes via the wrapped Storage without retrying, and maps the transient errors.
+func (r *RetryingStorage) BatchCreateNotes(ctx context.Context, pID, uID string, notes map[string]*gpb.Note) ([]*gpb.Note, []error) {
+	created, errs := r.Storage.BatchCreateNotes(ctx, pID, uID, notes)
+	return created, mapTransientErrors(errs)
+}
+
+// UpdateNote updates the note via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) UpdateNote(ctx context.Context, pID, nID string, n *gpb.Note, mask *fieldmaskpb.FieldMask) (updated *gpb.Note, err error) {
+	err = r.do(ctx, true, func() error {
+		updated, err = r.Storage.UpdateNote(ctx, pID, nID, n, mask)
+		return err
+	})
+	return updated, err
+}
+
+// DeleteNote deletes the note via the wrapped Storage, retrying on the transient errors except a lost connection.
+func (r *RetryingStorage) DeleteNote(ctx context.Context, pID, nID string) error {
+	return r.do(ctx, false, func() error {
+		return r.Storage.DeleteNote(ctx, pID, nID)
+	})
+}
+
+// GetOccurrenceNote gets the note of the occurrence via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) GetOccurrenceNote(ctx context.Context, pID, oID string) (n *gpb.Note, err error) {
+	err = r.do(ctx, true, func() error {
+		n, err = r.Storage.GetOccurrenceNote(ctx, pID, oID)
+		return err
+	})
+	return n, err
+}
+
+// ListNoteOccurrences lists the occurrences of the note via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) ListNoteOccurrences(ctx context.Context, pID, nID, filter, pageToken string, pageSize int32) (occs []*gpb.Occurrence, next string, err error) {
+	err = r.do(ctx, true, func() error {
+		occs, next, err = r.Storage.ListNoteOccurrences(ctx, pID, nID, filter, pageToken, pageSize)
+		return err
+	})
+	return occs, next, err
+}
+
+// GetVulnerabilityOccurrencesSummary summarizes the vulnerability occurrences via the wrapped Storage, retrying on the transient errors.
+func (r *RetryingStorage) GetVulnerabilityOccurrencesSummary(ctx context.Context, pID, filter string) (summary *gpb.VulnerabilityOccurrencesSummary, err error) {
+	err = r.do(ctx, true, func() error {
+		summary, err = r.Storage.GetVulnerabilityOccurrencesSummary(ctx, pID, filter)
+		return err
+	})
+	return summary, err
+}
+
+var _ Storage = (*RetryingStorage)(nil)
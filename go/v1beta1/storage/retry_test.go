@@ -0,0 +1,204 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/golang/mock/gomock"
+	"github.com/grafeas/grafeas/go/config"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
+)
+
+func TestRetryingStorage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	connReset := InternalError("failed to query the note", driver.ErrBadConn)
+	deadlock := InternalError("failed to insert the note", &fakePQError{code: "40P01"})
+	readOnly := InternalError("failed to delete the note", &mysql.MySQLError{Number: 1290, Message: "--read-only"})
+	tests := []struct {
+		name      string
+		call      func(s *RetryingStorage, store *mocks.MockStorage) error
+		wantCode  codes.Code
+		wantCause error
+		wantWaits int
+	}{
+		{
+			name: "read retried on connection error",
+			call: func(s *RetryingStorage, store *mocks.MockStorage) error {
+				gomock.InOrder(
+					store.EXPECT().GetNote(ctx, "p", "n").Return(nil, connReset),
+					store.EXPECT().GetNote(ctx, "p", "n").Return(&gpb.Note{}, nil),
+				)
+				_, err := s.GetNote(ctx, "p", "n")
+				return err
+			},
+			wantCode:  codes.OK,
+			wantWaits: 1,
+		},
+		{
+			name: "create not retried on connection error",
+			call: func(s *RetryingStorage, store *mocks.MockStorage) error {
+				store.EXPECT().CreateOccurrence(ctx, "p", "u", gomock.Any()).Times(1).Return(nil, connReset)
+				_, err := s.CreateOccurrence(ctx, "p", "u", &gpb.Occurrence{})
+				return err
+			},
+			wantCode:  codes.Unavailable,
+			wantCause: driver.ErrBadConn,
+		},
+		{
+			name: "create retried on deadlock",
+			call: func(s *RetryingStorage, store *mocks.MockStorage) error {
+				gomock.InOrder(
+					store.EXPECT().CreateNote(ctx, "p", "n", "u", gomock.Any()).Return(nil, deadlock),
+					store.EXPECT().CreateNote(ctx, "p", "n", "u", gomock.Any()).Return(&gpb.Note{}, nil),
+				)
+				_, err := s.CreateNote(ctx, "p", "n", "u", &gpb.Note{})
+				return err
+			},
+			wantCode:  codes.OK,
+			wantWaits: 1,
+		},
+		{
+			name: "attempts run out",
+			call: func(s *RetryingStorage, store *mocks.MockStorage) error {
+				store.EXPECT().DeleteNote(ctx, "p", "n").Times(3).Return(readOnly)
+				return s.DeleteNote(ctx, "p", "n")
+			},
+			wantCode:  codes.Unavailable,
+			wantCause: readOnly,
+			wantWaits: 2,
+		},
+		{
+			name: "non-transient error",
+			call: func(s *RetryingStorage, store *mocks.MockStorage) error {
+				store.EXPECT().GetProject(ctx, "p").Times(1).Return(nil, status.Error(codes.NotFound, "not found"))
+				_, err := s.GetProject(ctx, "p")
+				return err
+			},
+			wantCode: codes.NotFound,
+		},
+		{
+			name: "batch errors mapped",
+			call: func(s *RetryingStorage, store *mocks.MockStorage) error {
+				errs := []error{deadlock, status.Error(codes.AlreadyExists, "exists")}
+				store.EXPECT().BatchCreateNotes(ctx, "p", "u", gomock.Any()).Times(1).Return(nil, errs)
+				_, errs = s.BatchCreateNotes(ctx, "p", "u", map[string]*gpb.Note{})
+				if got := status.Code(errs[1]); got != codes.AlreadyExists {
+					t.Errorf("got code %v, want %v", got, codes.AlreadyExists)
+				}
+				return errs[0]
+			},
+			wantCode:  codes.Aborted,
+			wantCause: deadlock,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			store := mocks.NewMockStorage(mockCtrl)
+			s := NewRetryingStorage(store)
+			waits := 0
+			s.sleep = func(context.Context, time.Duration) error {
+				waits++
+				return nil
+			}
+
+			err := tt.call(s, store)
+			if got := status.Code(err); got != tt.wantCode {
+				t.Errorf("got code %v, want %v, err: %v", got, tt.wantCode, err)
+			}
+			if tt.wantCause != nil && !errors.Is(err, tt.wantCause) {
+				t.Errorf("got %v, want it to wrap %v", err, tt.wantCause)
+			}
+			if waits != tt.wantWaits {
+				t.Errorf("got %d waits, want %d", waits, tt.wantWaits)
+			}
+		})
+	}
+}
+
+func TestRetryingStorageCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mockCtrl := gomock.NewController(t)
+	store := mocks.NewMockStorage(mockCtrl)
+	s := NewRetryingStorage(store, WithRetryAttempts(5), WithRetryBackoff(time.Hour, time.Hour))
+
+	// The wait is cut short by the context, and the last error is returned.
+	store.EXPECT().ListNotes(ctx, "p", "", "", int32(10)).Times(1).
+		Return(nil, "", InternalError("failed to list the notes", &fakePQError{code: "40001"}))
+	if _, _, err := s.ListNotes(ctx, "p", "", "", 10); status.Code(err) != codes.Aborted {
+		t.Errorf("got %v, want code %v", err, codes.Aborted)
+	}
+}
+
+func TestRetryingStorageBackoff(t *testing.T) {
+	t.Parallel()
+
+	s := NewRetryingStorage(nil, WithRetryBackoff(100*time.Millisecond, 300*time.Millisecond))
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 300 * time.Millisecond, 10: 300 * time.Millisecond} {
+		// The jitter subtracts up to half of the wait.
+		if got := s.backoff(attempt); got <= want/2 || got > want {
+			t.Errorf("got backoff %v after attempt %d, want it in (%v, %v]", got, attempt, want/2, want)
+		}
+	}
+}
+
+func TestStorageProviderWithRetry(t *testing.T) {
+	t.Parallel()
+
+	mockCtrl := gomock.NewController(t)
+	conf := config.StorageConfiguration(rdsconfig.Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLRootCert: "testdata/ca.pem",
+	})
+	store := mocks.NewMockStorage(mockCtrl)
+	store.EXPECT().SetMaxOpenConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetMaxIdleConns(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxLifetime(gomock.Any()).AnyTimes()
+	store.EXPECT().SetConnMaxIdleTime(gomock.Any()).AnyTimes()
+	storeCreator := NewMockStorageCreator(mockCtrl)
+	storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Times(1).Return(store, nil)
+	metrics := newFakeMetrics()
+
+	provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator,
+		WithMetrics(metrics), WithInstrumentation(), WithRetry(WithRetryBackoff(time.Millisecond, time.Millisecond)))
+	provided, err := provider.Provide("", &conf)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// The retried call is measured once with its final outcome.
+	ctx := context.Background()
+	gomock.InOrder(
+		store.EXPECT().GetNote(ctx, "p", "n").Return(nil, InternalError("failed to query the note", driver.ErrBadConn)),
+		store.EXPECT().GetNote(ctx, "p", "n").Return(&gpb.Note{}, nil),
+	)
+	if _, err := provided.Gs.GetNote(ctx, "p", "n"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	labels := map[string]string{"method": "GetNote", "role": "reader", "code": "OK"}
+	if got := metrics.counter(MetricStorageCalls, labels); got != 1 {
+		t.Errorf("got %v calls labeled with %v, want 1", got, labels)
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"context"
 	"database/sql/driver"
 	"fmt"
+	"io"
 	"log"
+	"os"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -17,9 +19,11 @@ import (
 )
 
 const (
-	errMsgInitConfig    = "failed to initialize config"
-	errMsgInitConnector = "failed to initialize connector"
-	errMsgInitStorage   = "failed to initialize store"
+	errMsgInitConfig     = "failed to initialize config"
+	errMsgInitConnector  = "failed to initialize connector"
+	errMsgInitStorage    = "failed to initialize store"
+	errMsgPrepareSchema  = "failed to prepare the schema"
+	errMsgEngineMismatch = "the engine does not match the driver"
 )
 
 // ConnPoolMgr manages a RDBMS connection pool.
@@ -47,6 +51,25 @@ type StorageCreator interface {
 	CreateRW(readerConnector driver.Connector, writerConnector driver.Connector, paginationKey string) (Storage, error)
 }
 
+// SchemaManager can be implemented by a Storage whose schema is versioned, e.g. the ones created by pgsql and mysql.
+type SchemaManager interface {
+	// MigrateSchema applies the pending migrations. It must be safe to be invoked by many instances at once.
+	MigrateSchema(ctx context.Context) error
+	// VerifySchema returns an error if the schema is not at the version which the Storage expects.
+	VerifySchema(ctx context.Context) error
+}
+
+// SchemaMode determines what the provider does to the schema of a Storage implementing SchemaManager.
+type SchemaMode int
+
+const (
+	// SchemaMigrate migrates the schema when a storage is created. It's the default.
+	SchemaMigrate SchemaMode = iota
+	// SchemaVerify only verifies the version of the schema when a storage is created,
+	// for the deployments which migrate it separately, e.g. with a dedicated job.
+	SchemaVerify
+)
+
 // CredentialsCreator can be implemented to create Credentials based on different types of providers.
 // Fields of IAMAuthConfig can be updated to incorporate such changes in the future.
 type CredentialsCreator interface {
@@ -58,37 +81,142 @@ type GrafeasStorageProvider struct {
 	drv                driver.Driver
 	credentialsCreator CredentialsCreator
 	storageCreator     StorageCreator
+	// healthServer is nil if the health of the provided storages is not reported.
+	healthServer *HealthServer
+	logger       *log.Logger
+	metrics      Metrics
+	schemaMode   SchemaMode
+	// retryOpts is nil if the transient errors of the provided storages are not retried.
+	retryOpts []RetryOption
+	// instrumentOpts is nil if the calls of the provided storages are not measured.
+	instrumentOpts []InstrumentOption
+	// cacheOpts is nil if the provided storages are not cached.
+	cacheOpts []CacheOption
+	// newCacheInvalidator is nil if the caches are not invalidated across the replicas.
+	newCacheInvalidator func(writerConnector driver.Connector) CacheInvalidator
+	// newAuditSink is nil if the calls of the provided storages are not audited.
+	newAuditSink func(writerConnector driver.Connector) AuditSink
+	auditOpts    []AuditOption
+	// readOnlySignals are empty if the read-only mode is not switched by signals.
+	readOnlySignals []os.Signal
+}
+
+// ProviderOption configures optional behaviors of GrafeasStorageProvider.
+type ProviderOption func(*GrafeasStorageProvider)
+
+// WithHealthServer makes the provider report the health of every provided storage to hs.
+func WithHealthServer(hs *HealthServer) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.healthServer = hs
+	}
+}
+
+// WithLogger makes the provider and the provided storages log to logger instead of log.Default().
+func WithLogger(logger *log.Logger) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.logger = logger
+	}
+}
+
+// WithMetrics makes the provider and the provided storages report their measurements to m.
+func WithMetrics(m Metrics) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.metrics = m
+	}
+}
+
+// WithSchemaMode makes the provider migrate or only verify the schema of the provided storages,
+// if they implement SchemaManager. The schema is migrated by default.
+func WithSchemaMode(mode SchemaMode) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.schemaMode = mode
+	}
+}
+
+// WithRetry makes the provider wrap the provided storages with NewRetryingStorage configured with opts.
+// The retries are made under the other wrappers, so an operation is measured and audited once with its final outcome.
+func WithRetry(opts ...RetryOption) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.retryOpts = append([]RetryOption{}, opts...)
+	}
+}
+
+// WithInstrumentation makes the provider wrap the provided storages with NewInstrumentedStorage configured with opts,
+// which reports to the Metrics given by WithMetrics.
+// It measures the calls reaching the storages, so the ones served by the cache of WithCache are not included.
+func WithInstrumentation(opts ...InstrumentOption) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.instrumentOpts = append([]InstrumentOption{}, opts...)
+	}
+}
+
+// WithCache makes the provider wrap the provided storages with NewCachedStorage configured with opts.
+// The hits and the misses are reported to the Metrics given by WithMetrics.
+func WithCache(opts ...CacheOption) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.cacheOpts = append([]CacheOption{}, opts...)
+	}
+}
+
+// WithCacheInvalidation makes the provider invalidate the caches of all the replicas
+// through the CacheInvalidator returned by newInvalidator for the writer of each provided storage,
+// e.g. pgsql.NewCacheInvalidator. It has no effect without WithCache.
+func WithCacheInvalidation(newInvalidator func(writerConnector driver.Connector) CacheInvalidator) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.newCacheInvalidator = newInvalidator
+	}
+}
+
+// WithAudit makes the provider wrap the provided storages with NewAuditedStorage configured with opts,
+// which writes to the AuditSink returned by newSink for the writer of each storage, e.g. pgsql.NewAuditSink.
+// The sinks which don't use the DB can ignore the connector, e.g. NewLogAuditSink.
+// The resources before the updates are read under WithCache, and the writes rejected by WithReadOnlySignal are not audited.
+func WithAudit(newSink func(writerConnector driver.Connector) AuditSink, opts ...AuditOption) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.newAuditSink = newSink
+		p.auditOpts = append([]AuditOption{}, opts...)
+	}
+}
+
+// WithReadOnlySignal makes the provider wrap the provided storages with NewReadOnlyStorage,
+// which switches the read-only mode every time one of sigs is received, e.g. SIGUSR1.
+// Without it, the storages are only wrapped if read_only is enabled or its detect_interval is set in the config.
+// The writes rejected in the read-only mode never reach the other wrappers, so they're neither measured nor audited.
+func WithReadOnlySignal(sigs ...os.Signal) ProviderOption {
+	return func(p *GrafeasStorageProvider) {
+		p.readOnlySignals = append([]os.Signal{}, sigs...)
+	}
 }
 
 // NewGrafeasStorageProvider returns a StorageProvider whose fields are populated with the arguments.
-func NewGrafeasStorageProvider(drv driver.Driver, credentialsCreator CredentialsCreator, storageCreator StorageCreator) *GrafeasStorageProvider {
-	return &GrafeasStorageProvider{
+func NewGrafeasStorageProvider(drv driver.Driver, credentialsCreator CredentialsCreator, storageCreator StorageCreator, opts ...ProviderOption) *GrafeasStorageProvider {
+	p := &GrafeasStorageProvider{
 		drv:                drv,
 		credentialsCreator: credentialsCreator,
 		storageCreator:     storageCreator,
+		logger:             log.Default(),
+		metrics:            nopMetrics{},
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	return p
 }
 
 // Provide returns a storage which is configured based on the receiver's fields.
 func (p GrafeasStorageProvider) Provide(_ string, confi *config.StorageConfiguration) (*storage.Storage, error) {
-	conf, err := rdsconfig.New(confi)
+	conf, err := p.newConfig(confi)
 	if err != nil {
-		return nil, fmt.Errorf("%s, err: %v", errMsgInitConfig, err)
+		return nil, err
 	}
 
 	// TODO: Use the context passed from main after
 	// the signature of RegisterStorageTypeProvider is updated to include it.
-	connector, err := newConnector(context.Background(), conf, p.drv, p.credentialsCreator, log.Default(), "")
+	rdsStorage, err := p.create(context.Background(), conf, false)
 	if err != nil {
-		return nil, fmt.Errorf("%s, err: %v", errMsgInitConnector, err)
+		return nil, err
 	}
 
-	rdsStorage, err := p.storageCreator.Create(connector, conf.PaginationKey)
-	if err != nil {
-		return nil, fmt.Errorf("%s, err: %v", errMsgInitStorage, err)
-	}
-	setConnPoolParams(rdsStorage, conf.ConnPool)
-
 	grafeasStorage := &storage.Storage{
 		Ps: rdsStorage,
 		Gs: rdsStorage,
@@ -98,38 +226,166 @@ func (p GrafeasStorageProvider) Provide(_ string, confi *config.StorageConfigura
 
 // ProvideRW returns a storage which is configured based on the receiver's fields. The storage connects to different reader/writer. If no reader is provided, then it will only connect to the writer.
 func (p GrafeasStorageProvider) ProvideRW(_ string, c *config.StorageConfiguration) (*storage.Storage, error) {
-	conf, err := rdsconfig.New(c)
+	conf, err := p.newConfig(c)
 	if err != nil {
-		return nil, fmt.Errorf("%s, err: %v", errMsgInitConfig, err)
+		return nil, err
 	}
 
 	// TODO: Use the context passed from main after
 	// the signature of RegisterStorageTypeProvider is updated to include it.
-	writerConnector, err := newConnector(context.Background(), conf, p.drv, p.credentialsCreator, log.Default(), "")
+	rdsStorage, err := p.create(context.Background(), conf, true)
 	if err != nil {
-		return nil, fmt.Errorf("%s, err: %v", errMsgInitConnector, err)
+		return nil, err
+	}
+
+	grafeasStorage := &storage.Storage{
+		Ps: rdsStorage,
+		Gs: rdsStorage,
+	}
+	return grafeasStorage, nil
+}
+
+// newConfig converts confi to a Config whose engine defaults to the one of the driver,
+// and rejects the engines which the driver can't connect to.
+func (p GrafeasStorageProvider) newConfig(confi *config.StorageConfiguration) (*rdsconfig.Config, error) {
+	opts := []rdsconfig.Option{rdsconfig.WithLogger(p.logger)}
+	engine := driverEngine(p.drv)
+	if engine != "" {
+		opts = append(opts, rdsconfig.WithDefaultEngine(engine))
+	}
+	conf, err := rdsconfig.New(confi, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%s, err: %w", errMsgInitConfig, err)
+	}
+	if engine != "" && conf.Engine != engine {
+		return nil, fmt.Errorf("%s, err: %s, engine: %s, driver: %s", errMsgInitConfig, errMsgEngineMismatch, conf.Engine, engine)
+	}
+	return conf, nil
+}
+
+// create returns a storage which connects to the writer, and to the reader as well if rw is true.
+// The background tasks of the connectors and the health checks of the storage stop when ctx is done,
+// or as soon as create fails, since ctx may never be done, e.g. in Provide.
+func (p GrafeasStorageProvider) create(ctx context.Context, conf *rdsconfig.Config, rw bool) (_ Storage, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	var d *discoverer
+	if conf.UsesDiscovery() {
+		var err error
+		if conf, d, err = discoverEndpoints(ctx, conf, p.credentialsCreator); err != nil {
+			return nil, fmt.Errorf("%s, err: %v", errMsgSetupDiscovery, err)
+		}
 	}
-	readerConnector, err := newConnector(context.Background(), conf, p.drv, p.credentialsCreator, log.Default(), conf.Reader)
+
+	writerConnector, err := newConnector(ctx, conf, p.drv, p.credentialsCreator, p.logger, "")
 	if err != nil {
 		return nil, fmt.Errorf("%s, err: %v", errMsgInitConnector, err)
 	}
+	// The connectors are closed by the storage once it's created, and it's fine to close them twice.
+	defer func() {
+		if err != nil {
+			writerConnector.Close()
+		}
+	}()
+	// The reader uses the same certificates, so only the writer monitors them.
+	writerConnector.monitorCertExpiry(ctx, certExpiryCheckInterval, time.Duration(conf.CertExpiryWarningThreshold), p.metrics)
 
-	rdsStorage, err := p.storageCreator.CreateRW(readerConnector, writerConnector, conf.PaginationKey)
+	var rdsStorage Storage
+	var readerConnector *connector
+	if rw {
+		readerConnector, err = newConnector(ctx, conf, p.drv, p.credentialsCreator, p.logger, conf.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("%s, err: %v", errMsgInitConnector, err)
+		}
+		defer func() {
+			if err != nil {
+				readerConnector.Close()
+			}
+		}()
+		rdsStorage, err = p.storageCreator.CreateRW(readerConnector, writerConnector, conf.PaginationKey)
+	} else {
+		rdsStorage, err = p.storageCreator.Create(writerConnector, conf.PaginationKey)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("%s, err: %v", errMsgInitStorage, err)
 	}
+	// The detector must be taken before the storage is wrapped.
+	detector, _ := rdsStorage.(ReadOnlyDetector)
+	if err := p.prepareSchema(ctx, rdsStorage); err != nil {
+		if closer, ok := rdsStorage.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, fmt.Errorf("%s, err: %v", errMsgPrepareSchema, err)
+	}
 	setConnPoolParams(rdsStorage, conf.ConnPool)
+	if d != nil {
+		go d.updateTopologyPeriodically(ctx, time.Duration(conf.Discovery.RefreshInterval), writerConnector, readerConnector, p.logger)
+	}
+	if p.healthServer != nil {
+		registerHealthTargets(ctx, p.healthServer, rdsStorage, writerConnector, readerConnector)
+	}
+	if p.retryOpts != nil {
+		rdsStorage = NewRetryingStorage(rdsStorage, p.retryOpts...)
+	}
+	if p.instrumentOpts != nil {
+		rdsStorage = NewInstrumentedStorage(rdsStorage, p.metrics, p.instrumentOpts...)
+	}
+	// The audited updates are diffed against the resources read under the cache.
+	uncached := rdsStorage
+	if p.cacheOpts != nil {
+		opts := []CacheOption{WithCacheMetrics(p.metrics), WithCacheLogger(p.logger)}
+		if p.newCacheInvalidator != nil {
+			opts = append(opts, WithCacheInvalidator(p.newCacheInvalidator(writerConnector)))
+		}
+		rdsStorage = NewCachedStorage(rdsStorage, append(opts, p.cacheOpts...)...)
+	}
+	if p.newAuditSink != nil {
+		opts := []AuditOption{WithAuditLogger(p.logger), WithAuditReader(uncached)}
+		rdsStorage = NewAuditedStorage(rdsStorage, p.newAuditSink(writerConnector), append(opts, p.auditOpts...)...)
+	}
+	if len(p.readOnlySignals) > 0 || conf.ReadOnly.Enabled || conf.ReadOnly.DetectInterval > 0 {
+		rdsStorage = p.newReadOnlyStorage(ctx, rdsStorage, conf.ReadOnly, detector)
+	}
+	return rdsStorage, nil
+}
 
-	grafeasStorage := &storage.Storage{
-		Ps: rdsStorage,
-		Gs: rdsStorage,
+// newReadOnlyStorage wraps s with NewReadOnlyStorage,
+// which is switched by the signals and follows the writer checked by detector until ctx is done.
+func (p GrafeasStorageProvider) newReadOnlyStorage(ctx context.Context, s Storage, conf rdsconfig.ReadOnlyConfig, detector ReadOnlyDetector) *ReadOnlyStorage {
+	r := NewReadOnlyStorage(s, conf, WithReadOnlyLogger(p.logger), WithReadOnlyMetrics(p.metrics))
+	if len(p.readOnlySignals) > 0 {
+		go r.ToggleOnSignal(ctx, p.readOnlySignals...)
 	}
-	return grafeasStorage, nil
+	if conf.DetectInterval > 0 {
+		if detector != nil {
+			go r.DetectWriterReadOnly(ctx, detector, time.Duration(conf.DetectInterval))
+		} else {
+			p.logger.Println("read_only.detect_interval is ignored because the storage can't detect whether the writer is read-only")
+		}
+	}
+	return r
+}
+
+// prepareSchema migrates or verifies the schema of s according to the schema mode, if s implements SchemaManager.
+func (p GrafeasStorageProvider) prepareSchema(ctx context.Context, s Storage) error {
+	sm, ok := s.(SchemaManager)
+	if !ok {
+		return nil
+	}
+	if p.schemaMode == SchemaVerify {
+		return sm.VerifySchema(ctx)
+	}
+	return sm.MigrateSchema(ctx)
 }
 
 func setConnPoolParams(mgr ConnPoolMgr, conf rdsconfig.ConnPoolConfig) {
 	mgr.SetMaxOpenConns(conf.MaxOpenConns)
 	mgr.SetMaxIdleConns(conf.MaxIdleConns)
-	mgr.SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetimeInSeconds) * time.Second)
-	mgr.SetConnMaxIdleTime(time.Duration(conf.ConnMaxIdleTimeInSeconds) * time.Second)
+	mgr.SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetime))
+	mgr.SetConnMaxIdleTime(time.Duration(conf.ConnMaxIdleTime))
 }
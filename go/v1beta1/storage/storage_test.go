@@ -4,6 +4,7 @@
 package storage
 
 import (
+	"context"
 	"errors"
 	"strings"
 	"testing"
@@ -12,6 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/golang/mock/gomock"
 	"github.com/grafeas/grafeas/go/config"
+	"github.com/grafeas/grafeas/go/v1beta1/storage"
 
 	rdsconfig "github.com/theparanoids/grafeas-rds/go/config"
 	"github.com/theparanoids/grafeas-rds/go/v1beta1/mocks"
@@ -25,13 +27,13 @@ func TestStorageProviderProvide(t *testing.T) {
 		Host:        "some-host.rds.amazonaws.com",
 		User:        "grafeas_rw",
 		Password:    "dummy-password-for-unit-tests-only",
-		SSLRootCert: "/opt/rds-ca-2019-root.pem",
+		SSLRootCert: "testdata/ca.pem",
 		// ConnPool is populated in order to test if setConnPoolParams is invoked in Provide.
 		ConnPool: rdsconfig.ConnPoolConfig{
-			MaxOpenConns:             1,
-			MaxIdleConns:             2,
-			ConnMaxLifetimeInSeconds: 3,
-			ConnMaxIdleTimeInSeconds: 4,
+			MaxOpenConns:    1,
+			MaxIdleConns:    2,
+			ConnMaxLifetime: rdsconfig.Duration(3 * time.Second),
+			ConnMaxIdleTime: rdsconfig.Duration(4 * time.Second),
 		},
 	})
 
@@ -54,8 +56,8 @@ func TestStorageProviderProvide(t *testing.T) {
 				conf := tt.conf.(rdsconfig.Config).ConnPool
 				tt.store.EXPECT().SetMaxOpenConns(conf.MaxOpenConns).Times(1)
 				tt.store.EXPECT().SetMaxIdleConns(conf.MaxIdleConns).Times(1)
-				tt.store.EXPECT().SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetimeInSeconds) * time.Second).Times(1)
-				tt.store.EXPECT().SetConnMaxIdleTime(time.Duration(conf.ConnMaxIdleTimeInSeconds) * time.Second).Times(1)
+				tt.store.EXPECT().SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetime)).Times(1)
+				tt.store.EXPECT().SetConnMaxIdleTime(time.Duration(conf.ConnMaxIdleTime)).Times(1)
 			},
 			conf:         validConf,
 			store:        mocks.NewMockStorage(mockCtrl),
@@ -130,13 +132,13 @@ func TestStorageProviderProvideRW(t *testing.T) {
 		Reader:      "some-host-ro.rds.amazonaws.com",
 		User:        "grafeas_rw",
 		Password:    "dummy-password-for-unit-tests-only",
-		SSLRootCert: "/opt/rds-ca-2019-root.pem",
+		SSLRootCert: "testdata/ca.pem",
 		// ConnPool is populated in order to test if setConnPoolParams is invoked in Provide.
 		ConnPool: rdsconfig.ConnPoolConfig{
-			MaxOpenConns:             1,
-			MaxIdleConns:             2,
-			ConnMaxLifetimeInSeconds: 3,
-			ConnMaxIdleTimeInSeconds: 4,
+			MaxOpenConns:    1,
+			MaxIdleConns:    2,
+			ConnMaxLifetime: rdsconfig.Duration(3 * time.Second),
+			ConnMaxIdleTime: rdsconfig.Duration(4 * time.Second),
 		},
 	})
 
@@ -159,8 +161,8 @@ func TestStorageProviderProvideRW(t *testing.T) {
 				conf := tt.conf.(rdsconfig.Config).ConnPool
 				tt.store.EXPECT().SetMaxOpenConns(conf.MaxOpenConns).Times(1)
 				tt.store.EXPECT().SetMaxIdleConns(conf.MaxIdleConns).Times(1)
-				tt.store.EXPECT().SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetimeInSeconds) * time.Second).Times(1)
-				tt.store.EXPECT().SetConnMaxIdleTime(time.Duration(conf.ConnMaxIdleTimeInSeconds) * time.Second).Times(1)
+				tt.store.EXPECT().SetConnMaxLifetime(time.Duration(conf.ConnMaxLifetime)).Times(1)
+				tt.store.EXPECT().SetConnMaxIdleTime(time.Duration(conf.ConnMaxIdleTime)).Times(1)
 			},
 			conf:         validConf,
 			store:        mocks.NewMockStorage(mockCtrl),
@@ -225,3 +227,111 @@ func TestStorageProviderProvideRW(t *testing.T) {
 		})
 	}
 }
+
+// schemaManagedStorage is a Storage implementing SchemaManager and io.Closer, which records the calls.
+type schemaManagedStorage struct {
+	*mocks.MockStorage
+	err      error
+	migrated bool
+	verified bool
+	closed   bool
+}
+
+func (s *schemaManagedStorage) MigrateSchema(context.Context) error {
+	s.migrated = true
+	return s.err
+}
+
+func (s *schemaManagedStorage) VerifySchema(context.Context) error {
+	s.verified = true
+	return s.err
+}
+
+func (s *schemaManagedStorage) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestStorageProviderSchemaMode(t *testing.T) {
+	t.Parallel()
+
+	conf := config.StorageConfiguration(rdsconfig.Config{
+		Host:        "some-host.rds.amazonaws.com",
+		User:        "grafeas_rw",
+		Password:    "dummy-password-for-unit-tests-only",
+		SSLRootCert: "testdata/ca.pem",
+	})
+	tests := []struct {
+		name         string
+		opts         []ProviderOption
+		err          error
+		wantMigrated bool
+		wantVerified bool
+		wantErrMsg   string
+	}{
+		{
+			name:         "migrate by default",
+			wantMigrated: true,
+		},
+		{
+			name:         "verify only",
+			opts:         []ProviderOption{WithSchemaMode(SchemaVerify)},
+			wantVerified: true,
+		},
+		{
+			name:         "verification failure",
+			opts:         []ProviderOption{WithSchemaMode(SchemaVerify)},
+			err:          errors.New("schema version is 1, want 2"),
+			wantVerified: true,
+			wantErrMsg:   errMsgPrepareSchema,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mockCtrl := gomock.NewController(t)
+			store := &schemaManagedStorage{MockStorage: mocks.NewMockStorage(mockCtrl), err: tt.err}
+			store.EXPECT().SetMaxOpenConns(gomock.Any()).AnyTimes()
+			store.EXPECT().SetMaxIdleConns(gomock.Any()).AnyTimes()
+			store.EXPECT().SetConnMaxLifetime(gomock.Any()).AnyTimes()
+			store.EXPECT().SetConnMaxIdleTime(gomock.Any()).AnyTimes()
+			storeCreator := NewMockStorageCreator(mockCtrl)
+			storeCreator.EXPECT().Create(gomock.Any(), gomock.Any()).Times(1).Return(store, nil)
+
+			provider := NewGrafeasStorageProvider(mocks.NewMockDriver(mockCtrl), nil, storeCreator, tt.opts...)
+			_, err := provider.Provide("", &conf)
+			if tt.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("got err %v, want it to include %q", err, tt.wantErrMsg)
+				}
+				if !store.closed {
+					t.Error("the storage whose schema failed to be prepared is not closed")
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if store.migrated != tt.wantMigrated || store.verified != tt.wantVerified {
+				t.Errorf("got migrated %v and verified %v, want %v and %v", store.migrated, store.verified, tt.wantMigrated, tt.wantVerified)
+			}
+		})
+	}
+}
+
+func TestStorageProviderValidationErrors(t *testing.T) {
+	t.Parallel()
+
+	storageProvider := NewGrafeasStorageProvider(nil, nil, nil)
+	conf := config.StorageConfiguration(rdsconfig.Config{})
+	for name, provide := range map[string]func(string, *config.StorageConfiguration) (*storage.Storage, error){
+		"Provide":   storageProvider.Provide,
+		"ProvideRW": storageProvider.ProvideRW,
+	} {
+		_, err := provide("", &conf)
+		var errs rdsconfig.ValidationErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: got %v, but want it to wrap rdsconfig.ValidationErrors", name, err)
+		}
+	}
+}
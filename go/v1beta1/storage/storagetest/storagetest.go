@@ -0,0 +1,528 @@
+// Copyright Yahoo 2021
+// Licensed under the terms of the Apache License 2.0.
+// See LICENSE file in project root for terms.
+
+// Package storagetest provides a conformance test suite for the implementations of storage.Storage,
+// e.g. the ones created by a custom storage.StorageCreator.
+//
+// Besides the basic CRUD, the suite expects the behaviors of the built-in storages:
+//   - a duplicate resource fails with codes.AlreadyExists, and a missing one with codes.NotFound,
+//     including the note of a new occurrence and the note whose occurrences are listed;
+//   - a note with occurrences can't be deleted (codes.FailedPrecondition);
+//   - the page tokens are opaque, and an invalid one fails with codes.InvalidArgument;
+//   - the batch methods create the valid resources and return an error for each of the others.
+//
+// The filters are not tested since the built-in storages ignore them.
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/grafeas/grafeas/go/name"
+	cpb "github.com/grafeas/grafeas/proto/v1beta1/common_go_proto"
+	gpb "github.com/grafeas/grafeas/proto/v1beta1/grafeas_go_proto"
+	pkgpb "github.com/grafeas/grafeas/proto/v1beta1/package_go_proto"
+	prpb "github.com/grafeas/grafeas/proto/v1beta1/project_go_proto"
+	vpb "github.com/grafeas/grafeas/proto/v1beta1/vulnerability_go_proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+
+	"github.com/theparanoids/grafeas-rds/go/v1beta1/storage"
+)
+
+// Factory returns an empty Storage for a test, and releases it by t.Cleanup if needed.
+type Factory func(t *testing.T) storage.Storage
+
+// Run runs the conformance test suite against the storages returned by newStorage.
+// Every subtest gets its own Storage, and they run in parallel.
+func Run(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{name: "Projects", test: testProjects},
+		{name: "Notes", test: testNotes},
+		{name: "Occurrences", test: testOccurrences},
+		{name: "Pagination", test: testPagination},
+		{name: "BatchCreateNotes", test: testBatchCreateNotes},
+		{name: "BatchCreateOccurrences", test: testBatchCreateOccurrences},
+		{name: "ListNoteOccurrences", test: testListNoteOccurrences},
+		{name: "GetVulnerabilityOccurrencesSummary", test: testGetVulnerabilityOccurrencesSummary},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+// wantCode fails the test if err doesn't have the gRPC code.
+func wantCode(t *testing.T, op string, err error, code codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != code {
+		t.Fatalf("%s: got code %v (err: %v), want %v", op, got, err, code)
+	}
+}
+
+// mustSucceed fails the test if err is not nil.
+func mustSucceed(t *testing.T, op string, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: unexpected err: %v", op, err)
+	}
+}
+
+func testProjects(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	p, err := s.CreateProject(ctx, "p1", nil)
+	mustSucceed(t, "CreateProject", err)
+	if want := name.FormatProject("p1"); p.GetName() != want {
+		t.Errorf("CreateProject: got name %q, want %q", p.GetName(), want)
+	}
+	_, err = s.CreateProject(ctx, "p1", nil)
+	wantCode(t, "CreateProject of an existing project", err, codes.AlreadyExists)
+
+	p, err = s.GetProject(ctx, "p1")
+	mustSucceed(t, "GetProject", err)
+	if want := name.FormatProject("p1"); p.GetName() != want {
+		t.Errorf("GetProject: got name %q, want %q", p.GetName(), want)
+	}
+	_, err = s.GetProject(ctx, "missing")
+	wantCode(t, "GetProject of a missing project", err, codes.NotFound)
+
+	mustSucceed(t, "DeleteProject", s.DeleteProject(ctx, "p1"))
+	_, err = s.GetProject(ctx, "p1")
+	wantCode(t, "GetProject of a deleted project", err, codes.NotFound)
+	wantCode(t, "DeleteProject of a deleted project", s.DeleteProject(ctx, "p1"), codes.NotFound)
+}
+
+func testNotes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	createProject(t, s, "p1")
+
+	n := &gpb.Note{
+		ShortDescription: "short",
+		LongDescription:  "long",
+		Kind:             cpb.NoteKind_VULNERABILITY,
+	}
+	created, err := s.CreateNote(ctx, "p1", "n1", "u1", n)
+	mustSucceed(t, "CreateNote", err)
+	if want := name.FormatNote("p1", "n1"); created.GetName() != want {
+		t.Errorf("CreateNote: got name %q, want %q", created.GetName(), want)
+	}
+	if created.GetShortDescription() != n.ShortDescription || created.GetLongDescription() != n.LongDescription || created.GetKind() != n.Kind {
+		t.Errorf("CreateNote: got %v, want the fields of %v", created, n)
+	}
+	_, err = s.CreateNote(ctx, "p1", "n1", "u1", n)
+	wantCode(t, "CreateNote of an existing note", err, codes.AlreadyExists)
+	createProject(t, s, "p2")
+	_, err = s.CreateNote(ctx, "p2", "n1", "u1", n)
+	mustSucceed(t, "CreateNote with the same ID in another project", err)
+
+	got, err := s.GetNote(ctx, "p1", "n1")
+	mustSucceed(t, "GetNote", err)
+	if !proto.Equal(got, created) {
+		t.Errorf("GetNote: got %v, want %v", got, created)
+	}
+	_, err = s.GetNote(ctx, "p1", "missing")
+	wantCode(t, "GetNote of a missing note", err, codes.NotFound)
+
+	update := &gpb.Note{ShortDescription: "updated", LongDescription: "ignored"}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"short_description"}}
+	updated, err := s.UpdateNote(ctx, "p1", "n1", update, mask)
+	mustSucceed(t, "UpdateNote", err)
+	if updated.GetName() != created.GetName() || updated.GetShortDescription() != "updated" || updated.GetLongDescription() != "long" {
+		t.Errorf("UpdateNote: got %v, want only the short description of %v to be updated", updated, created)
+	}
+	got, err = s.GetNote(ctx, "p1", "n1")
+	mustSucceed(t, "GetNote after UpdateNote", err)
+	if !proto.Equal(got, updated) {
+		t.Errorf("GetNote after UpdateNote: got %v, want %v", got, updated)
+	}
+	_, err = s.UpdateNote(ctx, "p1", "missing", update, mask)
+	wantCode(t, "UpdateNote of a missing note", err, codes.NotFound)
+
+	mustSucceed(t, "DeleteNote", s.DeleteNote(ctx, "p1", "n1"))
+	_, err = s.GetNote(ctx, "p1", "n1")
+	wantCode(t, "GetNote of a deleted note", err, codes.NotFound)
+	wantCode(t, "DeleteNote of a deleted note", s.DeleteNote(ctx, "p1", "n1"), codes.NotFound)
+}
+
+func testOccurrences(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	createProject(t, s, "p1")
+	note := createNote(t, s, "p1", "n1")
+
+	o := &gpb.Occurrence{
+		Resource:    &gpb.Resource{Uri: "https://example.com/image@sha256:0"},
+		NoteName:    note.GetName(),
+		Kind:        cpb.NoteKind_VULNERABILITY,
+		Remediation: "upgrade",
+	}
+	created, err := s.CreateOccurrence(ctx, "p1", "u1", o)
+	mustSucceed(t, "CreateOccurrence", err)
+	pID, oID, err := name.ParseOccurrence(created.GetName())
+	if err != nil || pID != "p1" || oID == "" {
+		t.Fatalf("CreateOccurrence: got name %q, want an occurrence of p1", created.GetName())
+	}
+	if created.GetNoteName() != o.NoteName || created.GetResource().GetUri() != o.Resource.Uri || created.GetRemediation() != o.Remediation {
+		t.Errorf("CreateOccurrence: got %v, want the fields of %v", created, o)
+	}
+	_, err = s.CreateOccurrence(ctx, "p1", "u1", &gpb.Occurrence{NoteName: name.FormatNote("p1", "missing")})
+	wantCode(t, "CreateOccurrence of a missing note", err, codes.NotFound)
+
+	got, err := s.GetOccurrence(ctx, "p1", oID)
+	mustSucceed(t, "GetOccurrence", err)
+	if !proto.Equal(got, created) {
+		t.Errorf("GetOccurrence: got %v, want %v", got, created)
+	}
+	_, err = s.GetOccurrence(ctx, "p1", "missing")
+	wantCode(t, "GetOccurrence of a missing occurrence", err, codes.NotFound)
+
+	gotNote, err := s.GetOccurrenceNote(ctx, "p1", oID)
+	mustSucceed(t, "GetOccurrenceNote", err)
+	if !proto.Equal(gotNote, note) {
+		t.Errorf("GetOccurrenceNote: got %v, want %v", gotNote, note)
+	}
+	_, err = s.GetOccurrenceNote(ctx, "p1", "missing")
+	wantCode(t, "GetOccurrenceNote of a missing occurrence", err, codes.NotFound)
+
+	update := &gpb.Occurrence{Remediation: "rebuild", Resource: &gpb.Resource{Uri: "ignored"}}
+	mask := &fieldmaskpb.FieldMask{Paths: []string{"remediation"}}
+	updated, err := s.UpdateOccurrence(ctx, "p1", oID, update, mask)
+	mustSucceed(t, "UpdateOccurrence", err)
+	if updated.GetName() != created.GetName() || updated.GetRemediation() != "rebuild" || updated.GetResource().GetUri() != o.Resource.Uri {
+		t.Errorf("UpdateOccurrence: got %v, want only the remediation of %v to be updated", updated, created)
+	}
+	got, err = s.GetOccurrence(ctx, "p1", oID)
+	mustSucceed(t, "GetOccurrence after UpdateOccurrence", err)
+	if !proto.Equal(got, updated) {
+		t.Errorf("GetOccurrence after UpdateOccurrence: got %v, want %v", got, updated)
+	}
+	_, err = s.UpdateOccurrence(ctx, "p1", "missing", update, mask)
+	wantCode(t, "UpdateOccurrence of a missing occurrence", err, codes.NotFound)
+
+	wantCode(t, "DeleteNote with an occurrence", s.DeleteNote(ctx, "p1", "n1"), codes.FailedPrecondition)
+
+	mustSucceed(t, "DeleteOccurrence", s.DeleteOccurrence(ctx, "p1", oID))
+	_, err = s.GetOccurrence(ctx, "p1", oID)
+	wantCode(t, "GetOccurrence of a deleted occurrence", err, codes.NotFound)
+	wantCode(t, "DeleteOccurrence of a deleted occurrence", s.DeleteOccurrence(ctx, "p1", oID), codes.NotFound)
+	mustSucceed(t, "DeleteNote without occurrences", s.DeleteNote(ctx, "p1", "n1"))
+}
+
+func testPagination(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	const count = 5
+	var projects, notes, occurrences []string
+	for i := 0; i < count; i++ {
+		projects = append(projects, createProject(t, s, fmt.Sprintf("p%d", i)).GetName())
+		notes = append(notes, createNote(t, s, "p0", fmt.Sprintf("n%d", i)).GetName())
+	}
+	for i := 0; i < count; i++ {
+		occurrences = append(occurrences, createOccurrence(t, s, "p0", notes[0]).GetName())
+	}
+	// Another project's resources must not be listed.
+	createOccurrence(t, s, "p1", createNote(t, s, "p1", "n0").GetName())
+
+	tests := []struct {
+		name string
+		want []string
+		list func(pageToken string, pageSize int32) ([]string, string, error)
+	}{
+		{
+			name: "ListProjects",
+			want: projects,
+			list: func(pageToken string, pageSize int32) ([]string, string, error) {
+				ps, next, err := s.ListProjects(ctx, "", int(pageSize), pageToken)
+				names := make([]string, 0, len(ps))
+				for _, p := range ps {
+					names = append(names, p.GetName())
+				}
+				return names, next, err
+			},
+		},
+		{
+			name: "ListNotes",
+			want: notes,
+			list: func(pageToken string, pageSize int32) ([]string, string, error) {
+				ns, next, err := s.ListNotes(ctx, "p0", "", pageToken, pageSize)
+				return noteNames(ns), next, err
+			},
+		},
+		{
+			name: "ListOccurrences",
+			want: occurrences,
+			list: func(pageToken string, pageSize int32) ([]string, string, error) {
+				occs, next, err := s.ListOccurrences(ctx, "p0", "", pageToken, pageSize)
+				return occurrenceNames(occs), next, err
+			},
+		},
+		{
+			name: "ListNoteOccurrences",
+			want: occurrences,
+			list: func(pageToken string, pageSize int32) ([]string, string, error) {
+				occs, next, err := s.ListNoteOccurrences(ctx, "p0", "n0", "", pageToken, pageSize)
+				return occurrenceNames(occs), next, err
+			},
+		},
+	}
+	for _, tt := range tests {
+		// The page size of 0 falls back to a default one, which is large enough for all the resources.
+		got, next, err := tt.list("", 0)
+		mustSucceed(t, tt.name+" with the default page size", err)
+		if next != "" || !equalSets(got, tt.want) {
+			t.Errorf("%s with the default page size: got %q and the next page token %q, want %q without a next page", tt.name, got, next, tt.want)
+		}
+
+		got = nil
+		var pageSizes []int
+		pageToken := ""
+		for i := 0; i < count; i++ {
+			names, next, err := tt.list(pageToken, 2)
+			mustSucceed(t, tt.name, err)
+			got = append(got, names...)
+			pageSizes = append(pageSizes, len(names))
+			if pageToken = next; pageToken == "" {
+				break
+			}
+		}
+		if !equalSets(got, tt.want) {
+			t.Errorf("%s: got %q in the pages, want %q", tt.name, got, tt.want)
+		}
+		if want := []int{2, 2, 1}; fmt.Sprint(pageSizes) != fmt.Sprint(want) {
+			t.Errorf("%s: got pages of %v resources, want %v", tt.name, pageSizes, want)
+		}
+
+		_, _, err = tt.list("invalid-page-token", 2)
+		wantCode(t, tt.name+" with an invalid page token", err, codes.InvalidArgument)
+	}
+}
+
+func testBatchCreateNotes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	createProject(t, s, "p1")
+	createNote(t, s, "p1", "existing")
+
+	notes := map[string]*gpb.Note{
+		"n1":       {ShortDescription: "n1"},
+		"n2":       {ShortDescription: "n2"},
+		"existing": {ShortDescription: "overwritten"},
+	}
+	created, errs := s.BatchCreateNotes(ctx, "p1", "u1", notes)
+	if got, want := noteNames(created), []string{name.FormatNote("p1", "n1"), name.FormatNote("p1", "n2")}; !equalSets(got, want) {
+		t.Errorf("BatchCreateNotes: got %q created, want %q", got, want)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("BatchCreateNotes: got errs %v, want 1 error", errs)
+	}
+	wantCode(t, "BatchCreateNotes of an existing note", errs[0], codes.AlreadyExists)
+
+	for _, nID := range []string{"n1", "n2"} {
+		n, err := s.GetNote(ctx, "p1", nID)
+		mustSucceed(t, "GetNote of a note created in a batch", err)
+		if n.GetShortDescription() != nID {
+			t.Errorf("GetNote of a note created in a batch: got %v, want the fields of %v", n, notes[nID])
+		}
+	}
+	n, err := s.GetNote(ctx, "p1", "existing")
+	mustSucceed(t, "GetNote of the existing note", err)
+	if n.GetShortDescription() == "overwritten" {
+		t.Errorf("BatchCreateNotes overwrote the existing note: %v", n)
+	}
+}
+
+func testBatchCreateOccurrences(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	createProject(t, s, "p1")
+	note := createNote(t, s, "p1", "n1")
+
+	occs := []*gpb.Occurrence{
+		{NoteName: note.GetName(), Remediation: "first"},
+		{NoteName: name.FormatNote("p1", "missing"), Remediation: "missing note"},
+		{NoteName: note.GetName(), Remediation: "second"},
+	}
+	created, errs := s.BatchCreateOccurrences(ctx, "p1", "u1", occs)
+	if len(created) != 2 {
+		t.Fatalf("BatchCreateOccurrences: got %v created, want 2 occurrences", created)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("BatchCreateOccurrences: got errs %v, want 1 error", errs)
+	}
+	wantCode(t, "BatchCreateOccurrences of a missing note", errs[0], codes.NotFound)
+
+	listed, _, err := s.ListOccurrences(ctx, "p1", "", "", 0)
+	mustSucceed(t, "ListOccurrences", err)
+	if got, want := occurrenceNames(listed), occurrenceNames(created); !equalSets(got, want) {
+		t.Errorf("ListOccurrences after BatchCreateOccurrences: got %q, want %q", got, want)
+	}
+	var remediations []string
+	for _, o := range listed {
+		remediations = append(remediations, o.GetRemediation())
+	}
+	if want := []string{"first", "second"}; !equalSets(remediations, want) {
+		t.Errorf("ListOccurrences after BatchCreateOccurrences: got remediations %q, want %q", remediations, want)
+	}
+}
+
+func testListNoteOccurrences(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	createProject(t, s, "p1")
+	createProject(t, s, "p2")
+	n1 := createNote(t, s, "p1", "n1")
+	n2 := createNote(t, s, "p1", "n2")
+
+	// The occurrences of a note may belong to other projects.
+	want := []string{
+		createOccurrence(t, s, "p1", n1.GetName()).GetName(),
+		createOccurrence(t, s, "p2", n1.GetName()).GetName(),
+	}
+	createOccurrence(t, s, "p1", n2.GetName())
+
+	occs, next, err := s.ListNoteOccurrences(ctx, "p1", "n1", "", "", 0)
+	mustSucceed(t, "ListNoteOccurrences", err)
+	if got := occurrenceNames(occs); next != "" || !equalSets(got, want) {
+		t.Errorf("ListNoteOccurrences: got %q and the next page token %q, want %q without a next page", got, next, want)
+	}
+
+	createNote(t, s, "p1", "empty")
+	occs, _, err = s.ListNoteOccurrences(ctx, "p1", "empty", "", "", 0)
+	mustSucceed(t, "ListNoteOccurrences of a note without occurrences", err)
+	if len(occs) != 0 {
+		t.Errorf("ListNoteOccurrences of a note without occurrences: got %v, want none", occs)
+	}
+	_, _, err = s.ListNoteOccurrences(ctx, "p1", "missing", "", "", 0)
+	wantCode(t, "ListNoteOccurrences of a missing note", err, codes.NotFound)
+}
+
+func testGetVulnerabilityOccurrencesSummary(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	createProject(t, s, "p1")
+	createProject(t, s, "p2")
+	note := createNote(t, s, "p1", "n1")
+
+	const imageA, imageB = "https://example.com/a@sha256:0", "https://example.com/b@sha256:0"
+	occs := []*gpb.Occurrence{
+		vulnerabilityOccurrence(imageA, vpb.Severity_HIGH, pkgpb.Version_NORMAL),
+		vulnerabilityOccurrence(imageA, vpb.Severity_HIGH, pkgpb.Version_MAXIMUM),
+		vulnerabilityOccurrence(imageA, vpb.Severity_LOW),
+		vulnerabilityOccurrence(imageB, vpb.Severity_HIGH, pkgpb.Version_MAXIMUM, pkgpb.Version_NORMAL),
+		// The other kinds of occurrences are not counted.
+		{Resource: &gpb.Resource{Uri: imageB}, Kind: cpb.NoteKind_BUILD},
+	}
+	for _, o := range occs {
+		o.NoteName = note.GetName()
+		_, err := s.CreateOccurrence(ctx, "p1", "u1", o)
+		mustSucceed(t, "CreateOccurrence", err)
+	}
+	// The occurrences of the other projects are not counted.
+	o := vulnerabilityOccurrence(imageA, vpb.Severity_HIGH, pkgpb.Version_NORMAL)
+	o.NoteName = note.GetName()
+	_, err := s.CreateOccurrence(ctx, "p2", "u1", o)
+	mustSucceed(t, "CreateOccurrence", err)
+
+	summary, err := s.GetVulnerabilityOccurrencesSummary(ctx, "p1", "")
+	mustSucceed(t, "GetVulnerabilityOccurrencesSummary", err)
+	want := []string{
+		summaryCount(imageA, vpb.Severity_HIGH, 1, 2),
+		summaryCount(imageA, vpb.Severity_LOW, 0, 1),
+		summaryCount(imageB, vpb.Severity_HIGH, 1, 1),
+	}
+	var got []string
+	for _, c := range summary.GetCounts() {
+		got = append(got, summaryCount(c.GetResource().GetUri(), c.GetSeverity(), c.GetFixableCount(), c.GetTotalCount()))
+	}
+	if !equalSets(got, want) {
+		t.Errorf("GetVulnerabilityOccurrencesSummary: got %q, want %q", got, want)
+	}
+
+	createProject(t, s, "empty")
+	summary, err = s.GetVulnerabilityOccurrencesSummary(ctx, "empty", "")
+	mustSucceed(t, "GetVulnerabilityOccurrencesSummary of a project without occurrences", err)
+	if len(summary.GetCounts()) != 0 {
+		t.Errorf("GetVulnerabilityOccurrencesSummary of a project without occurrences: got %v, want no counts", summary)
+	}
+}
+
+// vulnerabilityOccurrence returns a vulnerability occurrence of the resource with a package issue for each kind of the fixed version.
+func vulnerabilityOccurrence(uri string, severity vpb.Severity, fixedKinds ...pkgpb.Version_VersionKind) *gpb.Occurrence {
+	details := &vpb.Details{Severity: severity}
+	for _, kind := range fixedKinds {
+		details.PackageIssue = append(details.PackageIssue, &vpb.PackageIssue{
+			AffectedLocation: &vpb.VulnerabilityLocation{CpeUri: "cpe:/o:debian:debian_linux:10", Package: "openssl"},
+			FixedLocation: &vpb.VulnerabilityLocation{
+				CpeUri:  "cpe:/o:debian:debian_linux:10",
+				Package: "openssl",
+				Version: &pkgpb.Version{Name: "1.1.1", Kind: kind},
+			},
+		})
+	}
+	return &gpb.Occurrence{
+		Resource: &gpb.Resource{Uri: uri},
+		Kind:     cpb.NoteKind_VULNERABILITY,
+		Details:  &gpb.Occurrence_Vulnerability{Vulnerability: details},
+	}
+}
+
+func summaryCount(uri string, severity vpb.Severity, fixable, total int64) string {
+	return fmt.Sprintf("%s %v: %d fixable of %d", uri, severity, fixable, total)
+}
+
+func createProject(t *testing.T, s storage.Storage, pID string) *prpb.Project {
+	t.Helper()
+	p, err := s.CreateProject(context.Background(), pID, nil)
+	mustSucceed(t, "CreateProject", err)
+	return p
+}
+
+func createNote(t *testing.T, s storage.Storage, pID, nID string) *gpb.Note {
+	t.Helper()
+	n, err := s.CreateNote(context.Background(), pID, nID, "u1", &gpb.Note{ShortDescription: nID, Kind: cpb.NoteKind_VULNERABILITY})
+	mustSucceed(t, "CreateNote", err)
+	return n
+}
+
+func createOccurrence(t *testing.T, s storage.Storage, pID, noteName string) *gpb.Occurrence {
+	t.Helper()
+	o, err := s.CreateOccurrence(context.Background(), pID, "u1", &gpb.Occurrence{
+		Resource: &gpb.Resource{Uri: "https://example.com/image@sha256:0"},
+		NoteName: noteName,
+		Kind:     cpb.NoteKind_VULNERABILITY,
+	})
+	mustSucceed(t, "CreateOccurrence", err)
+	return o
+}
+
+func noteNames(notes []*gpb.Note) []string {
+	names := make([]string, 0, len(notes))
+	for _, n := range notes {
+		names = append(names, n.GetName())
+	}
+	return names
+}
+
+func occurrenceNames(occs []*gpb.Occurrence) []string {
+	names := make([]string, 0, len(occs))
+	for _, o := range occs {
+		names = append(names, o.GetName())
+	}
+	return names
+}
+
+// equalSets reports whether got and want contain the same strings, regardless of the order.
+func equalSets(got, want []string) bool {
+	got = append([]string(nil), got...)
+	want = append([]string(nil), want...)
+	sort.Strings(got)
+	sort.Strings(want)
+	return strings.Join(got, "\n") == strings.Join(want, "\n")
+}